@@ -8,15 +8,16 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/coocood/freecache"
 	// "github.com/go-redis/redis/v8"
-	"github.com/redis/go-redis/v9"
 	"github.com/klauspost/compress/s2"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 	uuid "github.com/satori/go.uuid"
-	"github.com/vmihailenco/msgpack/v5"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -27,11 +28,18 @@ const (
 	// Duration to sleep before try to get another distributed lock for single flight.
 	lockSleep = 50 * time.Millisecond
 
+	defaultReadInterval = time.Second
+
 	// invalidate can support up to ~ (100 * 100 ops / second)
 	// without blocking.
 	redisCacheInvalidateTopic = "CacheInvalidatePubSub"
 	maxInvalidate             = 100
 	invalidateChSize          = 100
+	// the maximum size of invalidation messages, see WithMaxInvalidatePayload.
+	defaultMaxInvalidatePayload = 32 << 10
+
+	// number of locks striped by key for memory cache updates, and of stripes of localVersions.
+	memLockStripes = 64
 
 	// the maximum read interval to warn about inappropriately large value.
 	maxReadInterval = 3 * time.Second
@@ -57,10 +65,24 @@ var (
 	ErrTimeout = errors.New("timeout")
 	// ErrInternal should never happen
 	ErrInternal = errors.New("internal")
-	// ErrNotPointer value passed to get functions is not a pointer.
+	// ErrNotPointer value passed to get functions is neither nil nor a non-nil pointer.
 	ErrNotPointer = errors.New("value is not a pointer")
 	// ErrTypeMismatch value passed to get functions is not a pointer.
 	ErrTypeMismatch = errors.New("value type mismatches cached type")
+	// ErrLockWaitExceeded waited too long for another caller to populate the key.
+	ErrLockWaitExceeded = errors.New("lock wait exceeded")
+	// ErrNotFound key is not cached.
+	ErrNotFound = errors.New("not found")
+	// ErrWriteQueueFull the write is dropped because the write queue is full.
+	ErrWriteQueueFull = errors.New("write queue full")
+	// ErrTargetsMismatch the number of targets does not match the number of keys.
+	ErrTargetsMismatch = errors.New("number of targets does not match keys")
+	// ErrInvalidKeyPrefix the key prefix would be mistaken in invalidation messages.
+	ErrInvalidKeyPrefix = errors.New("dcache: invalid key prefix")
+	// ErrNilClient the Redis client is nil, see NewMemoryCache for caches without Redis.
+	ErrNilClient = errors.New("dcache: Redis client is nil")
+	// ErrEntryTooLarge the entry is larger than memory cache accepts, see LocalCache.
+	ErrEntryTooLarge = errors.New("dcache: entry too large for memory cache")
 )
 
 var (
@@ -81,22 +103,100 @@ type ReadWithTtlFunc = func() (any, time.Duration, error)
 type ValueBytesExpiredAt struct {
 	ValueBytes []byte `msgpack:"v,omitempty"`
 	ExpiredAt  int64  `msgpack:"e,omitempty"` // UNIX timestamp in Milliseconds.
+	// SoftExpiredAt is the UNIX timestamp in Milliseconds after which the value is stale,
+	// 0 if never, see SoftTTL. It is not carried by EnvelopeFlat.
+	SoftExpiredAt int64 `msgpack:"se,omitempty"`
+	// ComputeTime is the time in Milliseconds taken to read the value from the data source,
+	// 0 if unknown, see WithXFetch. It is not carried by EnvelopeFlat.
+	ComputeTime int64 `msgpack:"ct,omitempty"`
+	// CreatedAt is the UNIX timestamp in Milliseconds when the value was written, 0 if
+	// unknown, see WithMaxStaleness. It also stamps invalidations of the value, see
+	// entryStamps. It is not carried by EnvelopeFlat.
+	CreatedAt int64 `msgpack:"c,omitempty"`
+	// Seq tells apart values written by the same writer in the same millisecond of
+	// CreatedAt, increasing with writes, see entryStamps. It is not carried by EnvelopeFlat.
+	Seq uint32 `msgpack:"sq,omitempty"`
+	// Writer identifies the client that wrote the value, 0 if unknown, so that values written
+	// by different clients in the same millisecond are told apart, see writerOf. It is not
+	// carried by EnvelopeFlat.
+	Writer uint32 `msgpack:"w,omitempty"`
+}
+
+// Cache is the interface of the two-tier cache, implemented by DCache.
+type Cache interface {
+	Get(ctx context.Context, key string, target any, expire time.Duration, read ReadFunc,
+		noCache bool, noStore bool, opts ...CallOption) error
+	GetWithTtl(ctx context.Context, key string, target any, read ReadWithTtlFunc,
+		noCache bool, noStore bool, opts ...CallOption) error
+	GetMulti(ctx context.Context, keys []string, targets []any, ttl time.Duration,
+		readMulti ReadMultiFunc, opts ...CallOption) []error
+	Peek(ctx context.Context, key string, target any) error
+	Set(ctx context.Context, key string, val any, ttl time.Duration) error
+	SetMulti(ctx context.Context, values map[string]any, ttl time.Duration) error
+	Invalidate(ctx context.Context, key string) error
+	InvalidateMulti(ctx context.Context, keys ...string) error
+	Close()
 }
 
-// DCache implements cache.
+var _ Cache = (*DCache)(nil)
+
+// DCache implements Cache.
 type DCache struct {
-	conn         redis.UniversalClient
-	readInterval time.Duration
-	group        singleflight.Group
-	stats        *metricSet
-	tracer       *tracer
+	appName       string
+	conn          redis.UniversalClient
+	lockConn      redis.UniversalClient // locks and pub/sub, see WithLockClient.
+	readInterval  time.Duration
+	group         singleflight.Group
+	stats         *metricSet
+	tracer        *tracer
+	opts          *options
+	quarantine    *quarantine
+	writeCh       chan *writeTask
+	leader        *leaderElection
+	signals       *signalCounters
+	counters      statCounters
+	degradation   *degradationDetector
+	versions      *localVersions
+	stamps        *entryStamps
+	digests       *valueDigests
+	coalescer     setCoalescer
+	loaderDigests *loaderDigests
+	recorder      *recorder
+	repairer      *readRepairer
+	dryRun        *dryRun
+	canary        *codecCanary
+	codecs        sync.Map // codecs of values by name, see Policy.Codec.
+	quotas        []*quotaState
+	encryptor     *encryptor
+	writes        *writeTracker
+	writeReport   *writeReport
+	namespaces    *namespaceEpochs
+	prefetcher    *prefetcher
+	advisor       *capacityAdvisor
+	revalidator   *revalidator
+	entryStats    *entryStats
+	memPressure   memPressure
+	pins          pins
+	ephemeral     ephemeralKeys
+	resync        resyncer
+	memLocks      [memLockStripes]sync.Mutex
+	hooks         []*redisHook // detached on Close, see WithRedisHook.
+
+	// lockWaits are the channels to interrupt lock-wait loops, by key.
+	lockWaits   map[string]chan struct{}
+	lockWaitsMu sync.Mutex
 
 	// In memory cache related
-	inMemCache            *freecache.Cache
-	memCacheMaxTTLSeconds int64
+	inMemCache            atomic.Pointer[LocalCache]
+	memCacheMaxTTLSeconds atomic.Int64
 	pubsub                *redis.PubSub
+	stream                *invalidateStream
+	tracking              *redis.Client
+	attachMu              sync.Mutex
 	id                    string
-	invalidateKeys        map[string]struct{}
+	invalidateKeys        map[string]valueStamp // stamps of pending keys, see broadcastKeyInvalidate.
+	invalidateSpare       map[string]valueStamp
+	invalidateOverflow    atomic.Bool // see WithInvalidateBacklog.
 	invalidateMu          *sync.Mutex
 	invalidateCh          chan struct{}
 	ctx                   context.Context
@@ -108,6 +208,9 @@ type DCache struct {
 // Cache MUST be explicitly closed by calling Close().
 // It will also register several Prometheus metrics to the default register.
 // @p readInterval specify the duration between each read per key.
+// @p opts are optional configurations, see Option.
+// Prefer NewCache, positional arguments are the same as WithInMemCache, WithReadInterval,
+// WithStats and WithTracer, which are overridden by @p opts.
 func NewDCache(
 	appName string,
 	primaryClient redis.UniversalClient,
@@ -115,15 +218,84 @@ func NewDCache(
 	readInterval time.Duration,
 	enableStats bool,
 	enableTracer bool,
+	opts ...Option,
 ) (*DCache, error) {
+	return NewCache(appName, primaryClient, append([]Option{
+		WithInMemCache(inMemCache),
+		WithReadInterval(readInterval),
+		WithStats(enableStats),
+		WithTracer(enableTracer),
+	}, opts...)...)
+}
+
+// isNilClient returns true if @p client is nil, including nil pointers of go-redis clients,
+// e.g., a nil *redis.Client, which are not nil as interfaces.
+func isNilClient(client redis.UniversalClient) bool {
+	switch c := client.(type) {
+	case nil:
+		return true
+	case *redis.Client:
+		return c == nil
+	case *redis.ClusterClient:
+		return c == nil
+	case *redis.Ring:
+		return c == nil
+	}
+	return false
+}
+
+// NewCache creates a new cache client of @p appName on @p primaryClient, configured by
+// @p opts, see Option. Memory cache is enabled by WithInMemCache.
+// ErrNilClient is returned if @p primaryClient is nil, see NewMemoryCache instead.
+// Cache MUST be explicitly closed by calling Close().
+func NewCache(appName string, primaryClient redis.UniversalClient, opts ...Option) (*DCache, error) {
+	if isNilClient(primaryClient) {
+		return nil, ErrNilClient
+	}
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.lockSleep <= 0 {
+		o.lockSleep = lockSleep
+	}
+	if o.invalidateTopic == "" {
+		o.invalidateTopic = redisCacheInvalidateTopic + ":" + appName
+	}
+	if o.invalidateBatch <= 0 {
+		o.invalidateBatch = maxInvalidate
+	}
+	if o.codec == nil {
+		o.codec = MsgpackCodec{}
+	}
+	if o.envelopeVersion < EnvelopeCodec || o.envelopeVersion > latestEnvelopeVersion {
+		o.envelopeVersion = EnvelopeCodec
+	}
+	if strings.HasPrefix(o.keyPrefix, metaPrefix) || strings.Contains(o.keyPrefix, delimiter) {
+		return nil, ErrInvalidKeyPrefix
+	}
+	if o.serverTracking {
+		if _, ok := primaryClient.(*redis.Client); !ok {
+			return nil, ErrClusterUnsupported
+		}
+	}
+	var enc *encryptor
+	if len(o.encryptionKeys) > 0 {
+		var err error
+		if enc, err = newEncryptor(o.encryptionKeys); err != nil {
+			return nil, err
+		}
+	}
+	inMemCache, readInterval := o.localCache, o.readInterval
+
 	var stats *metricSet = nil
-	if enableStats {
-		stats = newMetricSet(appName)
+	if o.enableStats {
+		stats = newMetricSet(appName, o)
 		stats.Register()
 	}
 
 	var tracer *tracer = nil
-	if enableTracer {
+	if o.enableTracer {
 		tracer = newTracer()
 	}
 
@@ -134,56 +306,206 @@ func NewDCache(
 
 	ctx, cancel := context.WithCancel(context.Background())
 	c := &DCache{
-		conn:                  primaryClient,
-		stats:                 stats,
-		tracer:                tracer,
-		id:                    uuid.NewV4().String(),
-		invalidateKeys:        make(map[string]struct{}),
-		invalidateMu:          &sync.Mutex{},
-		invalidateCh:          make(chan struct{}, invalidateChSize),
-		inMemCache:            inMemCache,
-		memCacheMaxTTLSeconds: defaultMemCacheMaxTTLSeconds,
-		readInterval:          readInterval,
-		ctx:                   ctx,
-		cancel:                cancel,
+		appName:         appName,
+		conn:            primaryClient,
+		lockConn:        primaryClient,
+		stats:           stats,
+		tracer:          tracer,
+		opts:            o,
+		encryptor:       enc,
+		signals:         &signalCounters{},
+		lockWaits:       make(map[string]chan struct{}),
+		versions:        newLocalVersions(),
+		stamps:          newEntryStamps(),
+		revalidator:     newRevalidator(o.backgroundRefresh),
+		pins:            pins{entries: make(map[string]*pinnedEntry), reload: make(chan struct{}, 1)},
+		coalescer:       setCoalescer{pending: make(map[string]*pendingSet), flushing: make(map[*pendingSet]string)},
+		id:              instanceID(o.instanceID),
+		invalidateKeys:  make(map[string]valueStamp),
+		invalidateSpare: make(map[string]valueStamp),
+		invalidateMu:    &sync.Mutex{},
+		invalidateCh:    make(chan struct{}, invalidateChSize),
+		readInterval:    readInterval,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+	c.memCacheMaxTTLSeconds.Store(defaultMemCacheMaxTTLSeconds)
+	if o.lockClient != nil {
+		c.lockConn = o.lockClient
+	}
+	if o.redisHook {
+		c.ctx = c.tagContext(c.ctx, "background")
+		c.hooks = append(c.hooks, newRedisHook(c))
+		c.conn.AddHook(c.hooks[0])
+		if c.lockConn != c.conn {
+			c.hooks = append(c.hooks, newRedisHook(c))
+			c.lockConn.AddHook(c.hooks[1])
+		}
+	}
+	if stats != nil {
+		stats.AddConnPool("", c.conn.PoolStats)
+		if c.lockConn != c.conn {
+			stats.AddConnPool("lock_", c.lockConn.PoolStats)
+		}
+	}
+	if o.quarantineThreshold > 0 {
+		c.quarantine = newQuarantine(o.quarantineThreshold, o.quarantineCooldown)
+	}
+	if len(o.loaderDigestPrefixes) > 0 {
+		c.loaderDigests = newLoaderDigests(o.loaderDigestPrefixes)
+	}
+	if o.skipNoopSets {
+		c.digests = newValueDigests()
+	}
+	if o.recordTo != nil {
+		c.recorder = newRecorder(o.recordTo)
+	}
+	if o.readRepairInterval > 0 {
+		c.repairer = newReadRepairer(o.readRepairInterval)
+	}
+	if o.dryRun {
+		c.dryRun = newDryRun(o.keyPrefix)
+	}
+	c.registerCodecs(o)
+	if o.canaryCodec != nil && o.canaryFraction > 0 {
+		c.canary = &codecCanary{codec: o.canaryCodec, fraction: o.canaryFraction}
 	}
 	if inMemCache != nil {
-		c.pubsub = c.conn.Subscribe(ctx, redisCacheInvalidateTopic)
-		c.wg.Add(2)
-		go c.aggregateSend()
-		go c.listenKeyInvalidate()
+		if o.remoteOnly {
+			cancel()
+			return nil, ErrRemoteOnly
+		}
+		c.startLocalStore(inMemCache)
+	} else if !o.remoteOnly {
+		log.Warn().Msgf("Memory cache is not given, consider WithRemoteOnly() to be explicit")
+	}
+	if stats != nil {
+		stats.UpdateMode(c.memCache() == nil)
+	}
+	if o.writeWorkers > 0 {
+		c.startWriteWorkers(o.writeWorkers, o.writeQueueSize)
 	}
-	if enableStats {
+	if o.leaderTTL > 0 {
+		c.leader = &leaderElection{key: leaderKeyPrefix + appName, ttl: o.leaderTTL}
+		c.RunAsLeader(c.runScheduledInvalidations)
+		c.wg.Add(1)
+		go c.campaign()
+	}
+	if o.degradation != nil {
+		c.degradation = o.degradation
+		c.wg.Add(1)
+		go c.detectDegradation()
+	}
+	if o.peerHeartbeat > 0 {
+		c.wg.Add(1)
+		go c.heartbeat()
+	}
+	if o.expiryEvents {
+		c.startExpiryEvents()
+	}
+	if o.keyspaceEviction && c.memCache() != nil {
+		c.startKeyspaceEviction()
+	}
+	if o.capacityTarget > 0 {
+		c.advisor = newCapacityAdvisor(o.capacityTarget, o.capacitySampleRate)
+		c.wg.Add(1)
+		go c.logCapacityAdvice()
+	}
+	if o.prefetchRelated != nil {
+		c.prefetcher = newPrefetcher(o.prefetchRelated, o.prefetchConcurrency)
+	}
+	if len(o.namespaces) > 0 {
+		c.namespaces = newNamespaceEpochs(o.namespaces)
+	}
+	if len(o.writeReportPrefixes) > 0 {
+		c.writeReport = newWriteReport(o.writeReportPrefixes)
+		c.wg.Add(1)
+		go c.runWriteReport()
+	}
+	if o.entryStats {
+		c.entryStats = newEntryStats()
+		if o.entryStatsAggregate {
+			c.wg.Add(1)
+			go c.runEntryStats()
+		}
+	}
+	if len(o.warmLoaders) > 0 {
+		c.wg.Add(1)
+		go c.consumeWarmQueue()
+	}
+	if len(o.quotas) > 0 {
+		c.quotas = newQuotaStates(appName, o.quotas)
+		c.wg.Add(1)
+		go c.runQuotas()
+	}
+	if o.enableStats {
 		c.wg.Add(1)
 		go c.updateMetrics()
 	}
+	if o.startupValidation > 0 {
+		if err := c.validateOnStart(o.startupValidation); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
+// instanceID returns the id given by @p provider, or a random UUID if not provided.
+func instanceID(provider func() string) string {
+	if provider != nil {
+		if id := provider(); id != "" {
+			return id
+		}
+	}
+	return uuid.NewV4().String()
+}
+
+// ID returns the instance ID of the cache client, which identifies the origin
+// of invalidation messages.
+func (c *DCache) ID() string {
+	return c.id
+}
+
 // Ping checks if the underlying redis connection is alive
 func (c *DCache) Ping(ctx context.Context) error {
 	return c.conn.Ping(ctx).Err()
 }
 
-// Close terminates redis pubsub gracefully
+// Close terminates redis pubsub gracefully. Keys marked ephemeral are invalidated, see
+// MarkEphemeral, and pending invalidations are published before it returns.
 func (c *DCache) Close() {
+	c.flushPendingSets()
+	c.invalidateEphemeral()
 	if c.pubsub != nil {
 		err := c.pubsub.Unsubscribe(c.ctx)
 		if err != nil {
-			log.Err(err).Msgf("failed to pubsub.Unsubscribe()")
+			c.logger(c.ctx).Err(err).Msgf("failed to pubsub.Unsubscribe()")
 		}
 		err = c.pubsub.Close()
 		if err != nil {
-			log.Err(err).Msgf("failed to close pubsub")
+			c.logger(c.ctx).Err(err).Msgf("failed to close pubsub")
 		}
 	}
 	c.cancel()  // should be no-op because pubsub has been closed.
 	c.wg.Wait() // wait aggregateSend, listenKeyValidate and updateMetrics close.
+	c.flushInvalidateKeys()
+	if c.tracking != nil {
+		if err := c.tracking.Close(); err != nil {
+			c.logger(c.ctx).Err(err).Msgf("failed to close client tracking")
+		}
+	}
+	if c.recorder != nil {
+		c.recorder.flush()
+	}
 
 	// unregister after all	go routines are closed.
 	if c.stats != nil {
 		c.stats.Unregister()
 	}
+	for _, h := range c.hooks {
+		h.cache.Store(nil)
+	}
 }
 
 func (c *DCache) SetMemCacheMaxTTLSeconds(ttl int64) error {
@@ -191,21 +513,113 @@ func (c *DCache) SetMemCacheMaxTTLSeconds(ttl int64) error {
 		return fmt.Errorf(
 			"invalid ttl: %d, should be in range (0, %d]", ttl, memCacheMaxTTLHardCapSeconds)
 	}
-	c.memCacheMaxTTLSeconds = ttl
+	c.memCacheMaxTTLSeconds.Store(ttl)
 	return nil
 }
 
 func (c *DCache) makeHitRecorder(label metricHitLabel, startedAt time.Time) func() {
 	if c.stats != nil {
-		return c.stats.MakeHitObserver(label, startedAt)
+		observe := c.stats.MakeHitObserver(label, startedAt)
+		return func() {
+			c.signals.observeHit(label)
+			observe()
+		}
 	}
-	return func() {}
+	return func() { c.signals.observeHit(label) }
 }
 
-func (c *DCache) recordError(label metricErrLabel) {
+// recordError records an error that is handled internally, i.e., not returned to caller,
+// to metrics and the OnError callback if configured.
+func (c *DCache) recordError(label metricErrLabel, key string, err error) {
+	c.signals.errors.Add(1)
 	if c.stats != nil {
 		c.stats.ObserveError(label)
 	}
+	if c.opts.onError != nil {
+		c.opts.onError(string(label), key, err)
+	}
+}
+
+// reportDecodeFailure reports that bytes stored for @p key failed to unmarshal.
+// Returns true if the key is quarantined, in which case the cached entry is deleted.
+func (c *DCache) reportDecodeFailure(ctx context.Context, key string) bool {
+	if c.quarantine == nil || !c.quarantine.ReportFailure(key) {
+		return false
+	}
+	c.logger(ctx).Warn().Msgf("Quarantine key %s for %s after repeated unmarshal failures",
+		key, c.quarantine.cooldown)
+	if c.stats != nil {
+		c.stats.ObserveQuarantine()
+	}
+	if err := c.deleteKey(ctx, key); err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to delete quarantined key %s", key)
+	}
+	return true
+}
+
+// noLockFor returns true if the distributed lock is disabled for @p key.
+func (c *DCache) noLockFor(key string) bool {
+	for _, prefix := range c.opts.noLockPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockScope returns the scope of locks for reading @p key in the call of @p co.
+func (c *DCache) lockScope(key string, co *callOptions) LockScope {
+	if co.lockScope != nil {
+		return *co.lockScope
+	}
+	if c.noLockFor(key) {
+		return LockScopeLocal
+	}
+	return c.opts.lockScope
+}
+
+// lockWaitInterrupt returns the channel that is closed when the lock-wait of @p key
+// is interrupted, and a function to release it when the wait is over.
+func (c *DCache) lockWaitInterrupt(key string) (<-chan struct{}, func()) {
+	c.lockWaitsMu.Lock()
+	defer c.lockWaitsMu.Unlock()
+	ch, ok := c.lockWaits[key]
+	if !ok {
+		ch = make(chan struct{})
+		c.lockWaits[key] = ch
+	}
+	return ch, func() {
+		c.lockWaitsMu.Lock()
+		defer c.lockWaitsMu.Unlock()
+		if c.lockWaits[key] == ch {
+			delete(c.lockWaits, key)
+		}
+	}
+}
+
+// forgetInFlight makes later reads of @p key start new flights instead of joining the
+// in-flight ones, and interrupts the lock-wait of @p key, if any, so that value computed
+// from the state before the invalidation will not be served.
+func (c *DCache) forgetInFlight(key string) {
+	c.group.Forget(key)
+	c.group.Forget(c.lockKey(key))
+	c.lockWaitsMu.Lock()
+	defer c.lockWaitsMu.Unlock()
+	if ch, ok := c.lockWaits[key]; ok {
+		close(ch)
+		delete(c.lockWaits, key)
+	}
+}
+
+// lockWaitExceeded returns true if the lock-wait loop has reached the configured caps.
+func (c *DCache) lockWaitExceeded(attempts int, waitStartedAt time.Time) bool {
+	if c.opts.maxLockWaitAttempts > 0 && attempts >= c.opts.maxLockWaitAttempts {
+		return true
+	}
+	if c.opts.maxLockWait > 0 && getNow().Sub(waitStartedAt) >= c.opts.maxLockWait {
+		return true
+	}
+	return false
 }
 
 func (c *DCache) traceHit(ctx context.Context, hit hitFrom) {
@@ -214,197 +628,335 @@ func (c *DCache) traceHit(ctx context.Context, hit hitFrom) {
 	}
 }
 
+// flightResult is the result shared by all calls grouped into one flight.
+type flightResult struct {
+	valueBytes []byte
+	from       hitFrom
+	// storeErr is the error of caching the value read from the data source.
+	storeErr error
+	// stale is true if the value is past its soft expiration, see SoftTTL.
+	stale bool
+}
+
 // readValue read through using f and cache to @p key if no error and not @p noStore.
-// return the marshaled bytes if no error.
+// return the marshaled bytes if no error. Failing to cache the value is not an error,
+// but it is reported in the storeErr of the result.
+// @p seq is the local version of key when the read started, see updateMemoryCache.
 func (c *DCache) readValue(
-	ctx context.Context, key string, f ReadWithTtlFunc, noStore bool) ([]byte, error) {
+	ctx context.Context, key string, f ReadWithTtlFunc, noStore bool, seq uint64) (*flightResult, error) {
 	c.traceHit(ctx, hitDB)
 	// valueTtl is an internal helper struct that bundles value and ttl.
 	type valueTtl struct {
-		Val any
-		Ttl time.Duration
+		Val         any
+		Ttl         time.Duration
+		ComputeTime time.Duration
 	}
 	// per-pod single flight for calling @p f.
 	// NOTE: This is mostly useful when user call cache layer with noCache flag, because
 	// when cache is used, call to this function is protected by a distributed lock.
 	rv, err, _ := c.group.Do(key, func() (any, error) {
-		defer c.makeHitRecorder(hitLabelDB, getNow())()
+		readStartedAt := getNow()
+		defer c.makeHitRecorder(hitLabelDB, readStartedAt)()
 		dbres, ttl, err := f()
+		if err == nil {
+			c.observeRefresh(key)
+		}
+		computeTime := getNow().Sub(readStartedAt)
+		if c.loaderDigests != nil {
+			c.loaderDigests.observe(key, computeTime)
+		}
 		return &valueTtl{
-			Val: dbres,
-			Ttl: ttl,
+			Val:         dbres,
+			Ttl:         ttl,
+			ComputeTime: computeTime,
 		}, err
 	})
 	if err != nil {
 		return nil, err
 	}
 	valTtl := rv.(*valueTtl)
-	valueBytes, err := marshal(valTtl.Val)
+	val := valTtl.Val
+	if u, ok := val.(unstoredValue); ok {
+		val, noStore = u.value, true
+	}
+	valueBytes, err := c.marshal(ctx, key, val)
 	if err != nil {
 		return nil, err
 	}
-	if !noStore {
+	ttl := c.policyTTL(key, valTtl.Ttl)
+	rst := &flightResult{valueBytes: valueBytes, from: hitDB}
+	if c.opts.xfetchBeta > 0 {
+		// stored along with the value, including async writes.
+		ctx = context.WithValue(ctx, computeTimeCtxKey{}, valTtl.ComputeTime)
+	}
+	if !noStore && c.writeCh != nil {
+		// offload the write, dropping it if the queue is full.
+		err := c.enqueueWrite(ctx, key, valueBytes, ttl, seq)
+		if err != nil {
+			c.logger(ctx).Warn().Msgf("Dropped write of %s: %s", key, err)
+			c.recordError(errLabelWriteDropped, key, err)
+			rst.storeErr = err
+		}
+	} else if !noStore {
 		// If failed to set cache, we do not return error because value has been
 		// successfully retrieved.
-		err := c.setKey(ctx, key, valueBytes, valTtl.Ttl, false)
+		err := c.setKey(ctx, key, valueBytes, ttl, false, seq)
 		if err != nil {
-			log.Ctx(ctx).Err(err).Msgf("Failed to set Redis cache for %s", key)
-			c.recordError(errLabelSetRedis)
+			c.logger(ctx).Err(err).Msgf("Failed to set Redis cache for %s", key)
+			c.recordError(errLabelSetRedis, key, err)
+			rst.storeErr = err
+		}
+	}
+	return rst, nil
+}
+
+// readLocal reads @p key by @p f like readValue, but caches the value in memory cache only,
+// unless @p noStore, see Policy.SkipRemote.
+func (c *DCache) readLocal(
+	ctx context.Context, key string, f ReadWithTtlFunc, noStore bool, seq uint64) (*flightResult, error) {
+	c.traceHit(ctx, hitDB)
+	type valueTtl struct {
+		Val any
+		Ttl time.Duration
+	}
+	// per-pod single flight for calling @p f.
+	rv, err, _ := c.group.Do(key, func() (any, error) {
+		readStartedAt := getNow()
+		defer c.makeHitRecorder(hitLabelDB, readStartedAt)()
+		val, ttl, err := f()
+		if err == nil {
+			c.observeRefresh(key)
+		}
+		return &valueTtl{Val: val, Ttl: ttl}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	valTtl := rv.(*valueTtl)
+	val := valTtl.Val
+	if u, ok := val.(unstoredValue); ok {
+		val, noStore = u.value, true
+	}
+	valueBytes, err := c.marshal(ctx, key, val)
+	if err != nil {
+		return nil, err
+	}
+	if !noStore {
+		ve := &ValueBytesExpiredAt{
+			ValueBytes: valueBytes,
+			ExpiredAt:  getNow().Add(c.policyTTL(key, valTtl.Ttl)).UnixMilli(),
 		}
+		c.updateMemoryCache(ctx, key, ve, false, seq)
 	}
-	return valueBytes, nil
+	return &flightResult{valueBytes: valueBytes, from: hitDB}, nil
 }
 
-// setKey set key in redis and inMemCache
-func (c *DCache) setKey(ctx context.Context, key string, valueBytes []byte, ttl time.Duration, isExplicitSet bool) error {
+// setKey set key in redis and inMemCache, see updateMemoryCache for @p isExplicitSet and @p seq.
+func (c *DCache) setKey(
+	ctx context.Context, key string, valueBytes []byte, ttl time.Duration, isExplicitSet bool, seq uint64) error {
+	if !isExplicitSet && c.versions.changed(c.storeKey(key), seq) {
+		// value read before the local write must not overwrite it.
+		c.logger(ctx).Debug().Msgf("Discarded stale write of %s", key)
+		return nil
+	}
+	if !isExplicitSet && c.digests != nil {
+		c.digests.forget(c.storeKey(key))
+	}
+	if isExplicitSet {
+		// memory cache is updated only if key is not invalidated during the Redis write.
+		seq = c.versions.current(c.storeKey(key))
+	}
+	now := getNow()
+	stamp := c.stamps.next(now)
 	ve := &ValueBytesExpiredAt{
-		ValueBytes: valueBytes,
-		ExpiredAt:  getNow().Add(ttl).UnixMilli(),
+		ValueBytes:    valueBytes,
+		ExpiredAt:     now.Add(ttl).UnixMilli(),
+		SoftExpiredAt: softExpiredAt(ctx, now, ttl),
+		ComputeTime:   computeTimeOf(ctx),
+		CreatedAt:     stamp.at,
+		Seq:           stamp.seq,
+		Writer:        writerOf(c.id),
 	}
-	veBytes, err := msgpack.Marshal(ve)
+	veBytes, err := c.encodeEnvelope(ve)
 	if err != nil {
 		return err
 	}
-	err = c.conn.Set(ctx, storeKey(key), veBytes, ttl).Err()
+	if !c.admitWrite(key, len(veBytes)) {
+		if !isExplicitSet {
+			c.logger(ctx).Debug().Msgf("Discarded write of %s over quota", key)
+			return nil
+		}
+		// the previous value must not be left.
+		if err := c.deleteKey(ctx, key); err != nil {
+			return err
+		}
+		return ErrQuotaExceeded
+	}
+	wctx, cancel := c.writeContext(ctx)
+	defer cancel()
+	if tags := tagsOf(ctx); len(tags) > 0 {
+		// indexed before written, so that InvalidateTag during the write invalidates it.
+		if err := c.addTags(wctx, key, tags, ttl); err != nil {
+			return err
+		}
+	}
+	if isExplicitSet {
+		err = c.conn.Set(wctx, c.storeKey(key), veBytes, ttl).Err()
+	} else {
+		var written bool
+		written, err = c.fillKey(wctx, key, veBytes, ttl)
+		if err == nil && !written {
+			c.logger(ctx).Debug().Msgf("Discarded write of tombstoned %s", key)
+			return nil
+		}
+	}
 	if err != nil {
 		return err
 	}
-	c.updateMemoryCache(ctx, key, ve, isExplicitSet)
+	if rst := setResultOf(ctx); rst != nil {
+		rst.Redis = true
+	}
+	c.observeWrite(key, ttl)
+	if c.opts.setKeyHook != nil {
+		c.opts.setKeyHook(key)
+	}
+	// the same ExpiredAt as Redis.
+	c.updateMemoryCache(ctx, key, ve, isExplicitSet, seq)
 	return nil
 }
 
 // tryReadFromRedis try to read value from Redis.
 func (c *DCache) tryReadFromRedis(ctx context.Context, key string) (*ValueBytesExpiredAt, error) {
-	veBytes, err := c.conn.Get(ctx, storeKey(key)).Bytes()
+	if c.opts.serverTimeExpiry {
+		return c.readRedisRebased(ctx, key)
+	}
+	veBytes, err := c.getRedis(ctx, key)
 	if err != nil {
 		return nil, err
 	}
-	ve := &ValueBytesExpiredAt{}
-	err = msgpack.Unmarshal(veBytes, ve)
-	return ve, err
+	if isTombstone(veBytes) {
+		return nil, redis.Nil
+	}
+	return c.decodeEnvelope(veBytes)
 }
 
-// isExplicitSet = true, calling from Set. Otherwise, value is backfilled from Redis.
+// isExplicitSet = true, calling from Set. Otherwise, value is backfilled from Redis or
+// data source. The update is discarded if key has been changed locally, i.e., written or
+// invalidated, since its local version was @p seq, when the read or write started.
+// Updates are serialized with invalidations from peers of the same key, so that a value
+// older than a concurrent invalidation is never left in memory cache.
 func (c *DCache) updateMemoryCache(
-	ctx context.Context, key string, ve *ValueBytesExpiredAt, isExplicitSet bool) {
+	ctx context.Context, key string, ve *ValueBytesExpiredAt, isExplicitSet bool, seq uint64) {
+	if c.memCache() != nil {
+		lock := c.memLock(c.storeKey(key))
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	if c.versions.changed(c.storeKey(key), seq) {
+		c.logger(ctx).Debug().Msgf("Discarded stale update of memory cache for %s", key)
+		if isExplicitSet && c.memCache() != nil {
+			// peers may still hold values older than this Set.
+			c.broadcastKeyInvalidate(key, stampOf(ve))
+			if rst := setResultOf(ctx); rst != nil {
+				rst.Broadcast = true
+			}
+		}
+		return
+	}
 	// update memory cache.
 	// sub-second TTL will be ignored for memory cache.
-	ttl := time.UnixMilli(ve.ExpiredAt).Unix() - getNow().Unix()
-	if ttl > c.memCacheMaxTTLSeconds {
-		ttl = c.memCacheMaxTTLSeconds
+	expiredAt := ve.ExpiredAt
+	if ve.SoftExpiredAt > 0 && ve.SoftExpiredAt < expiredAt {
+		// stale values are served from Redis only, so that refreshes are seen.
+		expiredAt = ve.SoftExpiredAt
+	}
+	ttl := time.UnixMilli(expiredAt).Unix() - getNow().Unix()
+	if max := c.memCacheMaxTTLSeconds.Load(); ttl > max {
+		ttl = max
+	}
+	if c.advisor != nil {
+		c.advisor.written(key, getNow().Add(time.Duration(ttl)*time.Second))
 	}
-	if c.inMemCache != nil && ttl > 0 {
-		memValue, err := c.inMemCache.Get([]byte(storeKey(key)))
+	if c.memCacheFor(key) && ttl > 0 {
+		memValue, err := c.getMemoryCache(key)
+		c.updatePinned(key, ve)
 		// Broadcast invalidation request only when value is explicitly set to new one,
 		// by Set(), instead of backfilled from Redis, and if
 		// (1) The value does not exist before
 		//     so that we do not know if the new value will make any difference, or
 		// (2) we have value cached before and they are different from new value.
 		if isExplicitSet {
-			if err == freecache.ErrNotFound ||
+			if err == ErrNotFound ||
 				(err == nil && !bytes.Equal(ve.ValueBytes, memValue)) {
-				c.broadcastKeyInvalidate(storeKey(key))
+				c.broadcastKeyInvalidate(key, stampOf(ve))
+				if rst := setResultOf(ctx); rst != nil {
+					rst.Broadcast = true
+				}
 			}
 		}
+		if !c.admit(ctx, key) {
+			// must not leave the previous value.
+			c.memCache().Del([]byte(c.storeKey(key)))
+			c.logger(ctx).Debug().Msgf("Memory cache is under pressure, skipped admission of %s", key)
+			return
+		}
 		// ignore in memory cache error
-		err = c.inMemCache.Set([]byte(storeKey(key)), ve.ValueBytes, int(ttl))
+		err = c.memCache().Set([]byte(c.storeKey(key)), ve.ValueBytes, int(ttl))
 		if err != nil {
-			log.Ctx(ctx).Err(err).Msgf("Failed to set memory cache for key %s", storeKey(key))
-			c.recordError(errLabelSetMemCache)
+			c.logger(ctx).Err(err).Msgf("Failed to set memory cache for key %s", c.storeKey(key))
+			c.recordError(errLabelSetMemCache, key, err)
+			return
+		}
+		c.stamps.record(c.storeKey(key), stampOf(ve), ve.Writer)
+		if rst := setResultOf(ctx); rst != nil {
+			rst.Memory = true
 		}
 	}
 }
 
-// deleteKey delete key in redis and inMemCache
-func (c *DCache) deleteKey(ctx context.Context, key string) error {
-	n, err := c.conn.Del(ctx, storeKey(key)).Result()
-	if err != nil {
-		return err
-	}
-	if n > 0 {
-		if c.inMemCache != nil {
-			c.inMemCache.Del([]byte(storeKey(key)))
-			c.broadcastKeyInvalidate(key)
-		}
-	}
-	return nil
+// memLock returns the lock that serializes memory cache updates of @p skey, a store key.
+func (c *DCache) memLock(skey string) *sync.Mutex {
+	return &c.memLocks[xxhash.Sum64String(skey)%memLockStripes]
 }
 
-// broadcastKeyInvalidate pushes key into a list and wait for broadcast
-func (c *DCache) broadcastKeyInvalidate(key string) {
-	c.invalidateMu.Lock()
-	c.invalidateKeys[storeKey(key)] = struct{}{}
-	l := len(c.invalidateKeys)
-	c.invalidateMu.Unlock()
-	if l == maxInvalidate {
-		c.invalidateCh <- struct{}{}
+// getMemoryCache returns the value of @p key in memory cache, including pinned keys.
+func (c *DCache) getMemoryCache(key string) ([]byte, error) {
+	if valueBytes, ok := c.getPinned(key); ok {
+		return valueBytes, nil
 	}
+	return c.memCache().Get([]byte(c.storeKey(key)))
 }
 
-// aggregateSend waits for 1 seconds or list accumulating more than maxInvalidate
-// to send to redis pubsub
-func (c *DCache) aggregateSend() {
-	defer c.wg.Done()
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-		case <-c.invalidateCh:
-		case <-c.ctx.Done():
-			return
-		}
-		c.wg.Add(1)
-		go func() {
-			defer c.wg.Done()
-			c.invalidateMu.Lock()
-			if len(c.invalidateKeys) == 0 {
-				c.invalidateMu.Unlock()
-				return
-			}
-			toSend := c.invalidateKeys
-			c.invalidateKeys = make(map[string]struct{})
-			c.invalidateMu.Unlock()
-			keys := make([]string, 0)
-			for key := range toSend {
-				keys = append(keys, key)
-			}
-			msg := c.id + delimiter + strings.Join(keys, delimiter)
-			c.conn.Publish(c.ctx, redisCacheInvalidateTopic, msg)
-		}()
-	}
+// deleteMemoryCache deletes @p key from memory cache, including pinned keys.
+func (c *DCache) deleteMemoryCache(key string) {
+	// ordered with memory cache updates of the key, see updateMemoryCache.
+	lock := c.memLock(c.storeKey(key))
+	lock.Lock()
+	defer lock.Unlock()
+	c.clearPinned(c.storeKey(key))
+	c.memCache().Del([]byte(c.storeKey(key)))
 }
 
-// listenKeyInvalidate subscribe to invalidate key requests and invalidates memory cache.
-func (c *DCache) listenKeyInvalidate() {
-	defer c.wg.Done()
-	ch := c.pubsub.Channel()
-	for {
-		msg, ok := <-ch
-		if !ok {
-			return
+// deleteKey delete key in redis and inMemCache
+func (c *DCache) deleteKey(ctx context.Context, key string) error {
+	if c.digests != nil {
+		c.digests.forget(c.storeKey(key))
+	}
+	c.observeDelete(key)
+	// pending coalesced Sets are dropped, whose values are in memory cache only.
+	pending := c.cancelPendingSet(key)
+	existed, err := c.deleteCmd(ctx, c.conn, key)()
+	if err != nil {
+		return err
+	}
+	// keys skipping Redis may be cached by peers regardless.
+	if existed || pending || c.skipRemoteFor(key) {
+		if c.memCache() != nil {
+			c.deleteMemoryCache(key)
+			c.broadcastKeyInvalidate(key, valueStamp{})
 		}
-		payload := msg.Payload
-		c.wg.Add(1)
-		go func(payload string) {
-			defer c.wg.Done()
-			l := strings.Split(payload, delimiter)
-			if len(l) < 2 {
-				// Invalid payload
-				log.Error().Msgf("Received invalidate payload %s", payload)
-				c.recordError(errLabelInvalidate)
-				return
-			}
-			if l[0] == c.id {
-				// Receive message from self
-				return
-			}
-			// Invalidate key
-			for _, key := range l[1:] {
-				c.inMemCache.Del([]byte(key))
-			}
-		}(payload)
 	}
+	return nil
 }
 
 func (c *DCache) updateMetrics() {
@@ -420,17 +972,43 @@ func (c *DCache) updateMetrics() {
 		case <-c.ctx.Done():
 			return
 		}
-		stats := c.conn.PoolStats()
-		c.stats.UpdateConnPoolStatus(stats.TotalConns, stats.IdleConns)
+		c.stats.UpdateConnPoolStatus("", c.conn.PoolStats())
+		if c.lockConn != c.conn {
+			c.stats.UpdateConnPoolStatus("lock_", c.lockConn.PoolStats())
+		}
+		if c.writeCh != nil {
+			c.stats.UpdateWriteQueueDepth(len(c.writeCh))
+		}
+		c.stats.UpdateRefreshQueueDepth(len(c.revalidator.tasks))
+		c.stats.UpdateInvalidateBacklog(c.invalidateBacklog())
+		if c.dryRun != nil {
+			c.stats.UpdateDryRunSize(c.dryRun.size())
+		}
 	}
 }
 
-func storeKey(key string) string {
-	return fmt.Sprintf(":{%s}", key)
+// storeKeyOf returns the key @p key is stored by in Redis and memory cache, of clients of
+// key prefix @p prefix. The hash tag keeps keys and their lock keys in one slot of clusters.
+func storeKeyOf(prefix string, key string) string {
+	return prefix + ":{" + key + "}"
 }
 
-func lockKey(key string) string {
-	return fmt.Sprintf(":%s%s", storeKey(key), lockSuffix)
+// storeKey returns the key @p key is stored by, see WithKeyPrefix.
+func (c *DCache) storeKey(key string) string {
+	return storeKeyOf(c.opts.keyPrefix, key)
+}
+
+// keyOf returns the key stored by @p storedKey, false if it is not a store key of the client.
+func (c *DCache) keyOf(storedKey string) (string, bool) {
+	head := c.opts.keyPrefix + ":{"
+	if !strings.HasPrefix(storedKey, head) || !strings.HasSuffix(storedKey, "}") {
+		return "", false
+	}
+	return storedKey[len(head) : len(storedKey)-1], true
+}
+
+func (c *DCache) lockKey(key string) string {
+	return ":" + c.storeKey(key) + lockSuffix
 }
 
 // Get will read the value from cache if exists or call read() to retrieve the value and
@@ -445,17 +1023,15 @@ func lockKey(key string) string {
 //
 // @p ttl:     Expiration of cache key
 // @p read:    Actual call that hits underlying data source.
-// @p noCache: The response value will be fetched through @p read(). The new value will be
-//
-//	cached, unless @p noStore is specified.
-//
-// @p noStore: The response value will not be saved into the cache.
-func (c *DCache) Get(ctx context.Context, key string, target any, expire time.Duration, read ReadFunc, noCache bool, noStore bool) error {
+// @p noCache: Deprecated, pass false and use NoCache() instead.
+// @p noStore: Deprecated, pass false and use NoStore() instead.
+// @p opts:    Per-call options, see CallOption.
+func (c *DCache) Get(ctx context.Context, key string, target any, expire time.Duration, read ReadFunc, noCache bool, noStore bool, opts ...CallOption) error {
 	readWithTtl := func() (any, time.Duration, error) {
 		res, err := read()
 		return res, expire, err
 	}
-	return c.GetWithTtl(ctx, key, target, readWithTtl, noCache, noStore)
+	return c.GetWithTtl(ctx, key, target, readWithTtl, noCache, noStore, opts...)
 }
 
 // GetWithTtl will read the value from cache if exists or call @p read to retrieve the value and
@@ -467,15 +1043,41 @@ func (c *DCache) Get(ctx context.Context, key string, target any, expire time.Du
 //	For example, if we are caching string, then target must be of type *string.
 //	if we caching a null-able string, using *string to represent it, then the
 //	target must be of type **string, i.e., pointer to the pointer of string.
+//	A nil target only warms the cache, or checks existence along with MemoryOnly,
+//	the value is not decoded. Otherwise ErrNotPointer is returned for targets
+//	that are not non-nil pointers, before reading anything.
 //
 // @p read:    Actual call that hits underlying data source that also returns a ttl for cache.
-// @p noCache: The response value will be fetched through @p read(). The new value will be
-//
-//	cached, unless @p noStore is specified.
-//
-// @p noStore: The response value will not be saved into the cache.
-func (c *DCache) GetWithTtl(ctx context.Context, key string, target any, read ReadWithTtlFunc, noCache bool, noStore bool) (err error) {
+// @p noCache: Deprecated, pass false and use NoCache() instead.
+// @p noStore: Deprecated, pass false and use NoStore() instead.
+// @p opts:    Per-call options, see CallOption.
+func (c *DCache) GetWithTtl(ctx context.Context, key string, target any, read ReadWithTtlFunc, noCache bool, noStore bool, opts ...CallOption) (err error) {
 	startedAt := getNow()
+	co := newCallOptions(opts)
+	noCache, noStore = noCache || co.noCache, noStore || co.noStore
+	if err = checkTarget(target); err != nil {
+		return
+	}
+	// keys related to the key of the caller are prefetched, see WithPrefetch.
+	callerKey := key
+	if key, err = c.namespaced(ctx, key); err != nil {
+		return
+	}
+	ctx = c.tagContext(ctx, "GetWithTtl")
+	if co.priority != nil {
+		// carried to the admission of memory cache, including async writes.
+		ctx = context.WithValue(ctx, priorityCtxKey{}, *co.priority)
+	}
+	if co.softTTL > 0 {
+		// carried to writes of values read from the data source, including async writes.
+		ctx = context.WithValue(ctx, softTTLCtxKey{}, co.softTTL)
+	}
+	if len(co.tags) > 0 {
+		ctx = context.WithValue(ctx, tagsCtxKey{}, co.tags)
+	}
+	if co.codec != nil {
+		ctx = context.WithValue(ctx, codecCtxKey{}, co.codec)
+	}
 	if c.tracer != nil {
 		ctx = c.tracer.TraceStart(ctx,
 			"GetWithTtl",
@@ -486,69 +1088,188 @@ func (c *DCache) GetWithTtl(ctx context.Context, key string, target any, read Re
 			})
 		defer c.tracer.TraceEnd(ctx, err)
 	}
+	if c.quarantine != nil && c.quarantine.IsQuarantined(key) {
+		noCache, noStore = true, true
+	}
+	if co.maxTTL > 0 {
+		read = c.capTTL(key, read, co.maxTTL)
+	}
+	if co.shouldStore != nil {
+		read = checkShouldStore(read, co.shouldStore)
+	}
+	if c.recorder != nil {
+		defer func() {
+			if err == nil && co.rst != nil {
+				c.recorder.record(RecordGet, key, len(co.rst.valueBytes), co.rst.from)
+			}
+		}()
+	}
+	if c.advisor != nil {
+		defer func() {
+			if err == nil && co.rst != nil {
+				c.advisor.observe(key, len(co.rst.valueBytes)+len(c.storeKey(key)))
+			}
+		}()
+	}
+	if c.dryRun != nil {
+		err = c.dryRunGet(ctx, key, target, read, noCache, noStore, co)
+		return
+	}
+	// local version of key before reading, backfills are discarded if it changes.
+	seq := c.versions.current(c.storeKey(key))
 
 	if noCache {
-		var targetBytes []byte
-		targetBytes, err = c.readValue(ctx, key, read, noStore)
+		var rst *flightResult
+		if c.skipRemoteFor(key) {
+			rst, err = c.readLocal(ctx, key, read, noStore, seq)
+		} else {
+			rst, err = c.readValue(ctx, key, read, noStore, seq)
+		}
 		if err != nil {
 			return
 		}
-		err = unmarshal(targetBytes, target)
+		co.setResult(rst)
+		err = c.unmarshal(key, rst.valueBytes, target)
 		return
 	}
 	// lookup in memory cache, return only when unmarshal succeeded.
-	if c.inMemCache != nil {
+	// ages of values in memory cache are unknown, see WithMaxStaleness.
+	if c.memCacheFor(key) && co.maxStaleness <= 0 {
 		var targetBytes []byte
-		targetBytes, err = c.inMemCache.Get([]byte(storeKey(key)))
+		targetBytes, err = c.getMemoryCache(key)
 		if err == nil {
-			err = unmarshal(targetBytes, target)
+			err = c.unmarshal(key, targetBytes, target)
 			if err == nil {
 				c.makeHitRecorder(hitLabelMemory, startedAt)()
 				c.traceHit(ctx, hitMem)
+				c.readRepair(ctx, key, targetBytes)
+				c.observeRead(key)
+				c.prefetchRelated(callerKey)
+				co.setResult(&flightResult{valueBytes: targetBytes, from: hitMem})
 				return
 			} else {
-				log.Ctx(ctx).Err(err).Msgf("Failed to unmarshal from memory cache for %s", key)
-				c.recordError(errLabelMemoryUnmarshalFailed)
+				c.logger(ctx).Err(err).Msgf("Failed to unmarshal from memory cache for %s", key)
+				c.recordError(errLabelMemoryUnmarshalFailed, key, err)
+				if c.reportDecodeFailure(ctx, key) {
+					noStore = true
+				}
+				switch c.opts.decodeFailurePolicy {
+				case DecodeFailureError:
+					return
+				case DecodeFailureReload:
+					c.deleteMemoryCache(key)
+				}
 			}
 		}
 	}
+	if co.memoryOnly {
+		err = ErrNotFound
+		return
+	}
+	if c.skipRemoteFor(key) {
+		var rst *flightResult
+		rst, err = c.readLocal(ctx, key, read, noStore, seq)
+		if err != nil {
+			return
+		}
+		co.setResult(rst)
+		err = c.unmarshal(key, rst.valueBytes, target)
+		return
+	}
 
-	var anyTypedBytes any
+	var anyTypedRst any
 	var targetHasUnmarshalled bool
-	anyTypedBytes, err, _ = c.group.Do(lockKey(key), func() (any, error) {
+	scope := c.lockScope(key, co)
+	flight := func() (any, error) {
 		// distributed single flight to query db for value.
-		for {
+		waitStartedAt := getNow()
+		attempts := 1
+		interrupted, release := c.lockWaitInterrupt(key)
+		defer release()
+		defer func() {
+			if attempts > 1 {
+				waited := getNow().Sub(waitStartedAt)
+				c.signals.observeLockWait(waited)
+				c.counters.observeLockWait(waited)
+			}
+		}()
+		for ; ; attempts++ {
 			ve, e := c.tryReadFromRedis(ctx, key)
+			if e == nil && tooStale(ve, co.maxStaleness) {
+				// treated as a miss, refreshed under the lock.
+				e = redis.Nil
+			}
+			if e == nil && !noStore && c.expireEarly(ve) {
+				// recomputed by this reader alone, others keep reading the value.
+				c.counters.earlyExpiries.Add(1)
+				rst, err := c.readValue(ctx, key, read, noStore, seq)
+				if err == nil {
+					return rst, nil
+				}
+				// the value read is not expired yet, and served instead.
+				c.logger(ctx).Err(err).Msgf("Failed to recompute %s early, serving the cached value", key)
+			}
 			if e == nil {
 				// NOTE: must check if bytes stored in Redis can be correctly
 				// unmarshalled into target, because it may not when data structure changes.
 				// When that happens, we will still fetch from DB.
-				e = unmarshal(ve.ValueBytes, target)
+				e = c.unmarshal(key, ve.ValueBytes, target)
 				if e == nil {
 					targetHasUnmarshalled = true
 					// Value was retrieved from Redis, backfill memory cache and return.
 					defer c.makeHitRecorder(hitLabelRedis, startedAt)()
 					c.traceHit(ctx, hitRedis)
+					c.observeRead(key)
+					c.prefetchRelated(callerKey)
 					if !noStore {
-						c.updateMemoryCache(ctx, key, ve, false)
+						c.updateMemoryCache(ctx, key, ve, false, seq)
+					}
+					stale := isStale(ve)
+					if stale {
+						c.counters.staleHits.Add(1)
+						if !noStore {
+							c.revalidate(ctx, key, read)
+						}
 					}
-					return ve.ValueBytes, nil
+					return &flightResult{valueBytes: ve.ValueBytes, from: hitRedis, stale: stale}, nil
 				} else {
-					log.Ctx(ctx).Err(err).Msgf("Failed to unmarshal from Redis for %s", key)
-					c.recordError(errLabelRedisUnmarshalFailed)
+					c.logger(ctx).Err(e).Msgf("Failed to unmarshal from Redis for %s", key)
+					c.recordError(errLabelRedisUnmarshalFailed, key, e)
+					if c.reportDecodeFailure(ctx, key) {
+						noStore = true
+					}
+					switch c.opts.decodeFailurePolicy {
+					case DecodeFailureError:
+						return nil, e
+					case DecodeFailureReload:
+						if err := c.deleteKey(ctx, key); err != nil {
+							c.logger(ctx).Err(err).Msgf("Failed to delete undecodable key %s", key)
+						}
+					}
 				}
 			}
+			if scope == LockScopeLocal {
+				// loader is cheaper than the round trips of the distributed lock.
+				return c.readValue(ctx, key, read, noStore, seq)
+			}
 			// If failed to retrieve value from Redis, try to get a lock and query DB.
 			// To avoid spamming Redis with SetNX requests, only one request should try to get
 			// the lock per-pod.
 			// If timeout or not cache-able error, another thread will obtain lock after sleep.
-			updated, err := c.conn.SetNX(ctx, lockKey(key), "", c.readInterval).Result()
+			updated, err := c.lockConn.SetNX(ctx, c.lockKey(key), "", c.readInterval).Result()
 			if err != nil {
-				log.Ctx(ctx).Err(err).Msgf("Failed to get lock by SetNX for %s", key)
-				c.recordError(errLabelSetRedis)
+				c.logger(ctx).Err(err).Msgf("Failed to get lock by SetNX for %s", key)
+				c.recordError(errLabelSetRedis, key, err)
 			}
 			if updated {
-				return c.readValue(ctx, key, read, noStore)
+				return c.readValue(ctx, key, read, noStore, seq)
+			}
+			if c.lockWaitExceeded(attempts, waitStartedAt) {
+				if c.opts.lockWaitFallback {
+					c.logger(ctx).Warn().Msgf("Lock wait exceeded for %s, reading directly", key)
+					return c.readValue(ctx, key, read, noStore, seq)
+				}
+				return nil, ErrLockWaitExceeded
 			}
 			// Did not obtain lock, sleep and retry to wait for update
 			select {
@@ -556,31 +1277,167 @@ func (c *DCache) GetWithTtl(ctx context.Context, key string, target any, read Re
 				// NOTE: for requests grouped into one flight, if the earliest request
 				// timeout, all of them will timeout.
 				return nil, ErrTimeout
-			case <-time.After(lockSleep):
+			case <-interrupted:
+				// key was invalidated while waiting, the value being loaded by the lock
+				// holder may be computed from the state before that.
+				c.logger(ctx).Debug().Msgf("Lock wait interrupted for %s, reading directly", key)
+				return c.readValue(ctx, key, read, noStore, seq)
+			case <-time.After(c.opts.lockSleep):
 				// TODO(yumin): we can further optimize this part by
-				// check TTL of lockKey(key), and sleep wisely.
+				// check TTL of c.lockKey(key), and sleep wisely.
 				continue
 			}
 		}
-	})
+	}
+	if scope == LockScopeDistributed {
+		anyTypedRst, err = flight()
+	} else {
+		flightKey := c.lockKey(key)
+		if co.maxStaleness > 0 {
+			// must not share values of callers with laxer freshness needs.
+			flightKey += "@" + co.maxStaleness.String()
+		}
+		anyTypedRst, err, _ = c.group.Do(flightKey, flight)
+	}
 	if err != nil {
 		return
 	}
+	rst := anyTypedRst.(*flightResult)
 	if !targetHasUnmarshalled {
-		err = unmarshal(anyTypedBytes.([]byte), target)
+		err = c.unmarshal(key, rst.valueBytes, target)
+		if err != nil && c.opts.decodeFailurePolicy == DecodeFailureReload {
+			// value shared from another flight is not decodable into target,
+			// e.g., callers of different versions. Read it by ourselves.
+			c.logger(ctx).Err(err).Msgf("Failed to unmarshal shared value for %s, reloading", key)
+			rst, err = c.readValue(ctx, key, read, noStore, seq)
+			if err != nil {
+				return
+			}
+			err = c.unmarshal(key, rst.valueBytes, target)
+		}
+	}
+	if err == nil {
+		co.setResult(rst)
+	}
+	return
+}
+
+// Peek reads the value of @p key from cache into @p target, without reading the
+// underlying data source. ErrNotFound is returned if the key is not cached.
+func (c *DCache) Peek(ctx context.Context, key string, target any) (err error) {
+	ctx = c.tagContext(ctx, "Peek")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "Peek", []string{fmt.Sprintf("key=%s", key)})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if key, err = c.namespaced(ctx, key); err != nil {
+		return
+	}
+	found, err := c.lookup(ctx, key, target, getNow())
+	if err == nil && !found {
+		err = ErrNotFound
 	}
 	return
 }
 
-// Invalidate explicitly invalidates a cache key
+// WaitForValue waits until the value of @p key is available in cache, populated by
+// another caller, and unmarshals it into @p target. It never reads the underlying data source.
+// Inputs:
+// @p key:     Key used in cache
+// @p target:  A pointer to the memory piece of the type of the value, see Get.
+// @p maxWait: Maximum duration to wait, ErrTimeout is returned if the value is still not
+//
+//	available by then, or when @p ctx is done.
+func (c *DCache) WaitForValue(ctx context.Context, key string, target any, maxWait time.Duration) (err error) {
+	startedAt := getNow()
+	ctx = c.tagContext(ctx, "WaitForValue")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "WaitForValue",
+			[]string{
+				fmt.Sprintf("key=%s", key),
+				fmt.Sprintf("maxWait=%s", maxWait),
+			})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if key, err = c.namespaced(ctx, key); err != nil {
+		return
+	}
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		var found bool
+		found, err = c.lookup(ctx, key, target, startedAt)
+		if found || err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return ErrTimeout
+		case <-timer.C:
+			return ErrTimeout
+		case <-time.After(c.opts.lockSleep):
+		}
+	}
+}
+
+// lookup reads @p key from memory cache, then Redis, into @p target.
+// Value found in Redis is backfilled into memory cache.
+// Errors of reading Redis are logged and treated as not found.
+func (c *DCache) lookup(ctx context.Context, key string, target any, startedAt time.Time) (bool, error) {
+	if c.memCacheFor(key) {
+		if targetBytes, e := c.getMemoryCache(key); e == nil {
+			if e = c.unmarshal(key, targetBytes, target); e == nil {
+				c.makeHitRecorder(hitLabelMemory, startedAt)()
+				c.traceHit(ctx, hitMem)
+				c.readRepair(ctx, key, targetBytes)
+				return true, nil
+			}
+		}
+	}
+	seq := c.versions.current(c.storeKey(key))
+	ve, err := c.tryReadFromRedis(ctx, key)
+	if err != nil {
+		if err != redis.Nil {
+			c.logger(ctx).Err(err).Msgf("Failed to read Redis for %s", key)
+		}
+		return false, nil
+	}
+	if err = c.unmarshal(key, ve.ValueBytes, target); err != nil {
+		return false, err
+	}
+	c.makeHitRecorder(hitLabelRedis, startedAt)()
+	c.traceHit(ctx, hitRedis)
+	c.updateMemoryCache(ctx, key, ve, false, seq)
+	return true, nil
+}
+
+// Invalidate explicitly invalidates a cache key.
+// In-flight reads of the key are forgotten, so that reads after Invalidate will not
+// be served with values loaded before it.
 // Inputs:
 // key    - key to invalidate
 func (c *DCache) Invalidate(ctx context.Context, key string) (err error) {
+	ctx = c.tagContext(ctx, "Invalidate")
 	if c.tracer != nil {
 		ctx = c.tracer.TraceStart(ctx, "Invalidate", []string{fmt.Sprintf("key=%s", key)})
 		defer c.tracer.TraceEnd(ctx, nil)
 	}
+	if key, err = c.namespaced(ctx, key); err != nil {
+		return
+	}
+	// bump local version before and after the write, so that backfills of reads
+	// started before the write completes are discarded.
+	c.versions.bump(c.storeKey(key))
+	defer c.versions.bump(c.storeKey(key))
+	if c.recorder != nil {
+		c.recorder.record(RecordInvalidate, key, 0, "")
+	}
+	if c.dryRun != nil {
+		c.dryRun.remove(key)
+		return
+	}
 	err = c.deleteKey(ctx, key)
+	c.forgetInFlight(key)
 	return
 }
 
@@ -590,6 +1447,7 @@ func (c *DCache) Invalidate(ctx context.Context, key string) (err error) {
 // val	  - val to set
 // ttl    - ttl of key
 func (c *DCache) Set(ctx context.Context, key string, val any, ttl time.Duration) (err error) {
+	ctx = c.tagContext(ctx, "Set")
 	if c.tracer != nil {
 		ctx = c.tracer.TraceStart(ctx, "Set",
 			[]string{
@@ -598,14 +1456,85 @@ func (c *DCache) Set(ctx context.Context, key string, val any, ttl time.Duration
 			})
 		defer c.tracer.TraceEnd(ctx, err)
 	}
-	bs, err := marshal(val)
+	if key, err = c.namespaced(ctx, key); err != nil {
+		return
+	}
+	bs, err := c.marshal(ctx, key, val)
 	if err != nil {
 		return
 	}
-	err = c.setKey(ctx, key, bs, ttl, true)
+	rst := setResultOf(ctx)
+	if rst != nil {
+		rst.Size = len(bs)
+	}
+	ttl = c.policyTTL(key, ttl)
+	if c.recorder != nil {
+		c.recorder.record(RecordSet, key, len(bs), "")
+	}
+	if c.dryRun != nil {
+		c.dryRun.store(key, len(bs), ttl)
+		return
+	}
+	if c.digests != nil && c.memCache() != nil && len(tagsOf(ctx)) == 0 &&
+		c.digests.unchanged(c.storeKey(key), bs, ttl) {
+		// same value was Set by this pod and not changed since.
+		if rst != nil {
+			rst.Skipped = true
+		}
+		return
+	}
+	if window := c.coalesceWindow(key); window > 0 {
+		c.coalesceSet(ctx, key, bs, ttl, window)
+		return
+	}
+	err = c.writeSet(ctx, key, bs, ttl)
 	return
 }
 
+// SetResult is the outcome of a Set, see SetDetailed.
+type SetResult struct {
+	// Size is the number of bytes of the encoded value, before the envelope.
+	Size int
+	// Redis and Memory are true if the value is written to Redis and memory cache.
+	Redis  bool
+	Memory bool
+	// Broadcast is true if an invalidation of the key is queued to be broadcast to peers.
+	Broadcast bool
+	// Skipped is true if the value is not written as unchanged, see WithNoopSetSkip.
+	Skipped bool
+	// Deferred is true if the value is written to Redis later, see WithSetCoalescing.
+	Deferred bool
+}
+
+// setResultCtxKey is the context key of the SetResult filled in by writes, see SetDetailed.
+type setResultCtxKey struct{}
+
+// setResultOf returns the SetResult to fill in by writes with @p ctx, nil if none.
+func setResultOf(ctx context.Context) *SetResult {
+	r, _ := ctx.Value(setResultCtxKey{}).(*SetResult)
+	return r
+}
+
+// SetDetailed is Set that also reports which tiers are updated, e.g., for debugging write
+// paths, or for tests asserting side effects of writes. The result is filled in even if an
+// error is returned, for the steps done before the error.
+func (c *DCache) SetDetailed(ctx context.Context, key string, val any, ttl time.Duration) (SetResult, error) {
+	var rst SetResult
+	err := c.Set(context.WithValue(ctx, setResultCtxKey{}, &rst), key, val, ttl)
+	return rst, err
+}
+
+// writeSet writes @p valueBytes explicitly Set to @p key.
+func (c *DCache) writeSet(ctx context.Context, key string, valueBytes []byte, ttl time.Duration) error {
+	c.versions.bump(c.storeKey(key))
+	defer c.versions.bump(c.storeKey(key))
+	err := c.setKey(ctx, key, valueBytes, ttl, true, 0)
+	if err == nil && c.digests != nil {
+		c.digests.record(c.storeKey(key), valueBytes, ttl)
+	}
+	return err
+}
+
 // compress data with s2. Add 1 suffix byte to indicate if it is cached.
 func compress(data []byte) []byte {
 	if len(data) < compressionThreshold {
@@ -623,9 +1552,14 @@ func compress(data []byte) []byte {
 	return b
 }
 
-// marshal @p value into returned bytes, with compression.
+// marshal @p value into returned bytes by MsgpackCodec, with compression.
 // copy from https://github.com/go-redis/cache/blob/v8/cache.go
 func marshal(value interface{}) ([]byte, error) {
+	return encode(MsgpackCodec{}, value, true)
+}
+
+// encode @p value into returned bytes by @p codec, compressed if @p compression.
+func encode(codec Codec, value interface{}, compression bool) ([]byte, error) {
 	switch value := value.(type) {
 	case nil:
 		return nil, nil
@@ -635,19 +1569,41 @@ func marshal(value interface{}) ([]byte, error) {
 		return []byte(value), nil
 	}
 
-	b, err := msgpack.Marshal(value)
+	b, err := codec.Marshal(value)
 	if err != nil {
 		return nil, err
 	}
+	if !compression {
+		return append(b, noCompression), nil
+	}
 	return compress(b), nil
 }
 
-// unmarshal @p b into @p value.
+// unmarshal @p b into @p value by MsgpackCodec.
 // copy from https://github.com/go-redis/cache/blob/v8/cache.go
 func unmarshal(b []byte, value interface{}) error {
-	if reflect.ValueOf(value).Kind() != reflect.Ptr {
+	return decode(MsgpackCodec{}, b, value)
+}
+
+// checkTarget returns ErrNotPointer if @p target is neither nil nor a non-nil pointer.
+func checkTarget(target any) error {
+	if target == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(target); v.Kind() != reflect.Ptr || v.IsNil() {
 		return ErrNotPointer
 	}
+	return nil
+}
+
+// decode @p b into @p value by @p codec, see encode. Nothing is decoded if @p value is nil.
+func decode(codec Codec, b []byte, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if err := checkTarget(value); err != nil {
+		return err
+	}
 	if len(b) == 0 {
 		// if we cache nil or any zero value, must set *value to
 		// the same zero value.
@@ -660,8 +1616,6 @@ func unmarshal(b []byte, value interface{}) error {
 		return nil
 	}
 	switch value := value.(type) {
-	case nil:
-		return nil
 	case *[]byte:
 		clone := make([]byte, len(b))
 		copy(clone, b)
@@ -687,5 +1641,5 @@ func unmarshal(b []byte, value interface{}) error {
 		return fmt.Errorf("unknown compression method: %x", c)
 	}
 
-	return msgpack.Unmarshal(b, value)
+	return codec.Unmarshal(b, value)
 }
@@ -1,20 +1,33 @@
 package dcache
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/coocood/freecache"
 	//"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/redis/go-redis/v9"
-	// "github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var (
@@ -167,6 +180,16 @@ func (suite *testSuite) encodeByte(value interface{}) []byte {
 	return b
 }
 
+// storeKey returns the store key of @p key of clients without key prefix.
+func storeKey(key string) string {
+	return storeKeyOf("", key)
+}
+
+// lockKey returns the lock key of @p key of clients without key prefix.
+func lockKey(key string) string {
+	return ":" + storeKey(key) + lockSuffix
+}
+
 func (suite *testSuite) TestCloseCache() {
 	cache1, e := NewDCache("test", suite.redisConn, nil, time.Second, false, false)
 	suite.Require().Nil(e)
@@ -790,3 +813,3924 @@ func (suite *testSuite) TestSetMemCacheMaxTTlSeconds() {
 	suite.Require().Error(suite.cacheRepo.SetMemCacheMaxTTLSeconds(0))
 	suite.Require().Error(suite.cacheRepo.SetMemCacheMaxTTLSeconds(1000000))
 }
+
+func (suite *testSuite) TestLatencyBucketsOption() {
+	o := defaultOptions()
+	WithLatencyBuckets([]float64{0.1, 0.5, 1})(o)
+	WithNativeHistogram(1.1)(o)
+	m := newMetricSet("test_buckets", o)
+	startedAt := getNow().Add(-200 * time.Microsecond)
+	m.MakeHitObserver(hitLabelRedis, startedAt)()
+
+	metric := &dto.Metric{}
+	h := m.Latency.WithLabelValues("test_buckets", string(hitLabelRedis)).(prometheus.Histogram)
+	suite.Require().NoError(h.Write(metric))
+	buckets := metric.GetHistogram().GetBucket()
+	suite.Require().Len(buckets, 3)
+	// 0.2ms must not land in the first bucket.
+	suite.EqualValues(0, buckets[0].GetCumulativeCount())
+	suite.EqualValues(1, buckets[1].GetCumulativeCount())
+	suite.EqualValues(1.1, o.nativeHistogramBucketFactor)
+	suite.NotNil(metric.GetHistogram().Schema)
+}
+
+func (suite *testSuite) TestLatencyUnitOption() {
+	o := defaultOptions()
+	WithLatencyUnit(LatencySeconds)(o)
+	m := newMetricSet("test_unit", o)
+	m.MakeHitObserver(hitLabelDB, getNow().Add(-1500*time.Millisecond))()
+
+	metric := &dto.Metric{}
+	h := m.Latency.WithLabelValues("test_unit", string(hitLabelDB)).(prometheus.Histogram)
+	suite.Require().NoError(h.Write(metric))
+	suite.InDelta(1.5, metric.GetHistogram().GetSampleSum(), 0.1)
+	buckets := metric.GetHistogram().GetBucket()
+	suite.Require().Len(buckets, len(defaultLatencyBuckets))
+	suite.InDelta(0.001, buckets[0].GetUpperBound(), 1e-9)
+
+	desc := make(chan *prometheus.Desc, 1)
+	m.Latency.Describe(desc)
+	suite.Contains((<-desc).String(), "dcache_latency_seconds")
+}
+
+func (suite *testSuite) TestOnErrorCallback() {
+	ctx := context.Background()
+	queryKey := "test"
+	var mu sync.Mutex
+	ops := make(map[string]string)
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithOnError(func(op string, key string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ops[op] = key
+		}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	// value with an unknown compression method cannot be unmarshalled.
+	veBytes, err := msgpack.Marshal(&ValueBytesExpiredAt{
+		ValueBytes: []byte{0x1, 0x2, 0x7},
+		ExpiredAt:  getNow().Add(time.Minute).UnixMilli(),
+	})
+	suite.Require().NoError(err)
+	suite.Require().NoError(suite.redisConn.Set(ctx, storeKey(queryKey), veBytes, time.Minute).Err())
+
+	v := &Dummy{A: 1}
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	var vget Dummy
+	err = cache.Get(ctx, queryKey, &vget, Normal.ToDuration(), func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}, false, false)
+	suite.NoError(err)
+	suite.Equal(*v, vget)
+
+	mu.Lock()
+	defer mu.Unlock()
+	suite.Equal(queryKey, ops[ErrorOpRedisUnmarshal])
+}
+
+func (suite *testSuite) TestGetResult() {
+	ctx := context.Background()
+	queryKey := "test"
+	v := "testvalue"
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	read := func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}
+	var vget string
+	var rst GetResult
+	suite.NoError(suite.cacheRepo.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal(GetResult{Source: "db"}, rst)
+
+	suite.NoError(suite.cacheRepo.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal(GetResult{Source: "mem"}, rst)
+
+	suite.NoError(suite.cacheRepo2.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal(GetResult{Source: "redis"}, rst)
+	suite.Equal(v, vget)
+}
+
+func (suite *testSuite) TestGetResultStoreErr() {
+	// nothing is listening on this port, so storing the value always fails.
+	brokenConn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer brokenConn.Close()
+	cache, err := NewDCache("test", brokenConn, nil, time.Second, false, false)
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	v := "testvalue"
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	var vget string
+	var rst GetResult
+	err = cache.Get(context.Background(), "test", &vget, Normal.ToDuration(), func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}, true, false, WithResult(&rst))
+	suite.NoError(err)
+	suite.Equal(v, vget)
+	suite.Equal("db", rst.Source)
+	suite.Error(rst.StoreErr)
+}
+
+func (suite *testSuite) TestQuarantinePoisonKey() {
+	ctx := context.Background()
+	queryKey := "test"
+	cache, err := NewDCache("test", suite.redisConn, nil, 100*time.Millisecond, false, false,
+		WithQuarantine(2, time.Minute))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	corrupt := func() {
+		veBytes, err := msgpack.Marshal(&ValueBytesExpiredAt{
+			ValueBytes: []byte{0x1, 0x2, 0x7},
+			ExpiredAt:  getNow().Add(time.Minute).UnixMilli(),
+		})
+		suite.Require().NoError(err)
+		suite.Require().NoError(
+			suite.redisConn.Set(ctx, storeKey(queryKey), veBytes, time.Minute).Err())
+	}
+	v := &Dummy{A: 1}
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Times(3)
+	get := func() {
+		var vget Dummy
+		err := cache.Get(ctx, queryKey, &vget, Normal.ToDuration(), func() (interface{}, error) {
+			return suite.mockRepo.ReadThrough()
+		}, false, false)
+		suite.NoError(err)
+		suite.Equal(*v, vget)
+	}
+
+	// first failure, value is reloaded and cached.
+	corrupt()
+	get()
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey(queryKey)).Val())
+
+	// second failure, key is quarantined and deleted.
+	corrupt()
+	get()
+	suite.True(cache.quarantine.IsQuarantined(queryKey))
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(queryKey)).Val())
+
+	// caching is bypassed during cooldown.
+	get()
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(queryKey)).Val())
+}
+
+func (suite *testSuite) TestDecodeFailurePolicy() {
+	ctx := context.Background()
+	queryKey := "test"
+	corruptBytes := []byte{0x1, 0x2, 0x7}
+	veBytes, err := msgpack.Marshal(&ValueBytesExpiredAt{
+		ValueBytes: corruptBytes,
+		ExpiredAt:  getNow().Add(time.Minute).UnixMilli(),
+	})
+	suite.Require().NoError(err)
+	v := &Dummy{A: 1}
+	read := func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}
+
+	// DecodeFailureError returns the decode error.
+	errCache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithDecodeFailurePolicy(DecodeFailureError))
+	suite.Require().NoError(err)
+	defer errCache.Close()
+	suite.Require().NoError(suite.redisConn.Set(ctx, storeKey(queryKey), veBytes, time.Minute).Err())
+	var vget Dummy
+	suite.Error(errCache.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false))
+
+	// DecodeFailureReload deletes the entries and reloads.
+	memCache := freecache.NewCache(1024 * 1024)
+	reloadCache, err := NewDCache("test", suite.redisConn, memCache, time.Second, false, false,
+		WithDecodeFailurePolicy(DecodeFailureReload))
+	suite.Require().NoError(err)
+	defer reloadCache.Close()
+	suite.Require().NoError(memCache.Set([]byte(storeKey(queryKey)), corruptBytes, 60))
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	suite.NoError(reloadCache.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false))
+	suite.Equal(*v, vget)
+
+	vinmem, err := memCache.Get([]byte(storeKey(queryKey)))
+	suite.Require().NoError(err)
+	suite.NotEqual(corruptBytes, vinmem)
+	redisBytes, err := suite.redisConn.Get(ctx, storeKey(queryKey)).Bytes()
+	suite.Require().NoError(err)
+	suite.NotEqual(veBytes, redisBytes)
+}
+
+func (suite *testSuite) TestMaxLockWait() {
+	ctx := context.Background()
+	queryKey := "test"
+	// lock held by some other pod that never populates the key.
+	suite.Require().NoError(suite.redisConn.Set(ctx, lockKey(queryKey), "", time.Minute).Err())
+	read := func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}
+
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithMaxLockWait(3, 0, false))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	var vget string
+	suite.Equal(ErrLockWaitExceeded, cache.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false))
+
+	fallbackCache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithMaxLockWait(0, lockSleep, true))
+	suite.Require().NoError(err)
+	defer fallbackCache.Close()
+	v := "testvalue"
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	suite.NoError(fallbackCache.Get(ctx, queryKey, &vget, Normal.ToDuration(), read, false, false))
+	suite.Equal(v, vget)
+}
+
+func (suite *testSuite) TestWaitForValue() {
+	ctx := context.Background()
+	queryKey := "test"
+	var vget string
+	suite.Equal(ErrTimeout, suite.cacheRepo.WaitForValue(ctx, queryKey, &vget, 2*lockSleep))
+
+	v := "testvalue"
+	go func() {
+		time.Sleep(2 * lockSleep)
+		suite.NoError(suite.cacheRepo2.Set(ctx, queryKey, v, Normal.ToDuration()))
+	}()
+	suite.NoError(suite.cacheRepo.WaitForValue(ctx, queryKey, &vget, time.Second))
+	suite.Equal(v, vget)
+
+	// backfilled into memory cache.
+	vinmem, err := suite.inMemCache.Get([]byte(storeKey(queryKey)))
+	suite.NoError(err)
+	suite.Equal(suite.encodeByte(v), vinmem)
+}
+
+func (suite *testSuite) TestRedisHook() {
+	ctx := context.Background()
+	conn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer conn.Close()
+	cache, err := NewDCache("hookapp", conn, nil, time.Second, true, false, WithRedisHook(time.Second))
+	suite.Require().NoError(err)
+
+	count := func(cmd string) uint64 {
+		metric := &dto.Metric{}
+		h := cache.stats.RedisCmd.WithLabelValues("hookapp", cmd).(prometheus.Histogram)
+		suite.Require().NoError(h.Write(metric))
+		return metric.GetHistogram().GetSampleCount()
+	}
+	suite.NoError(cache.Set(ctx, "test", "testvalue", Normal.ToDuration()))
+	suite.EqualValues(1, count("set"))
+
+	// commands not issued by dcache are not observed.
+	suite.NoError(conn.Get(ctx, storeKey("test")).Err())
+	suite.EqualValues(0, count("get"))
+	var vget string
+	suite.NoError(cache.Get(ctx, "test", &vget, Normal.ToDuration(), func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}, false, false))
+	suite.EqualValues(1, count("get"))
+
+	// hooks are left on the client, detached from closed caches.
+	cache.Close()
+	suite.Nil(cache.hooks[0].cache.Load())
+	suite.NoError(conn.Get(ctx, storeKey("test")).Err())
+}
+
+func (suite *testSuite) TestPeek() {
+	ctx := context.Background()
+	queryKey := "test"
+	var vget string
+	suite.Equal(ErrNotFound, suite.cacheRepo.Peek(ctx, queryKey, &vget))
+
+	v := "testvalue"
+	suite.NoError(suite.cacheRepo2.Set(ctx, queryKey, v, Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo.Peek(ctx, queryKey, &vget))
+	suite.Equal(v, vget)
+}
+
+func (suite *testSuite) TestDetachedWrites() {
+	queryKey := "test"
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithDetachedWrites(time.Second))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	v := "testvalue"
+	ctx, cancel := context.WithCancel(context.Background())
+	var vget string
+	err = cache.Get(ctx, queryKey, &vget, Normal.ToDuration(), func() (interface{}, error) {
+		// caller gives up right after the data source returns.
+		cancel()
+		return v, nil
+	}, true, false)
+	suite.NoError(err)
+	suite.Equal(v, vget)
+	suite.EqualValues(1, suite.redisConn.Exists(context.Background(), storeKey(queryKey)).Val())
+}
+
+func (suite *testSuite) TestAsyncWrites() {
+	ctx := context.Background()
+	queryKey := "test"
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithAsyncWrites(1, 10))
+	suite.Require().NoError(err)
+
+	v := "testvalue"
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	var vget string
+	var rst GetResult
+	err = cache.Get(ctx, queryKey, &vget, Normal.ToDuration(), func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}, false, false, WithResult(&rst))
+	suite.NoError(err)
+	suite.Equal(v, vget)
+	suite.NoError(rst.StoreErr)
+
+	// pending writes are flushed on close.
+	cache.Close()
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey(queryKey)).Val())
+
+	// writes are dropped when queue is full.
+	full := &DCache{writeCh: make(chan *writeTask, 1)}
+	suite.NoError(full.enqueueWrite(ctx, queryKey, nil, time.Second, 0))
+	suite.Equal(ErrWriteQueueFull, full.enqueueWrite(ctx, queryKey, nil, time.Second, 0))
+}
+
+func (suite *testSuite) TestSetInvalidateKeyAcrossPods() {
+	ctx := context.Background()
+	queryKey := "test"
+	v := "testvalueold"
+	suite.NoError(suite.cacheRepo.Set(ctx, queryKey, v, Normal.ToDuration()))
+	var vget2 string
+	suite.NoError(suite.cacheRepo2.Peek(ctx, queryKey, &vget2))
+	suite.Equal(v, vget2)
+
+	newv := "testvaluenew"
+	suite.NoError(suite.cacheRepo.Set(ctx, queryKey, newv, Normal.ToDuration()))
+	// Wait for key to be broadcasted
+	time.Sleep(time.Second + waitTime)
+	_, e := suite.inMemCache2.Get([]byte(storeKey(queryKey)))
+	suite.Equal(freecache.ErrNotFound, e)
+	suite.NoError(suite.cacheRepo2.Peek(ctx, queryKey, &vget2))
+	suite.Equal(newv, vget2)
+}
+
+func (suite *testSuite) TestInvalidateBatched() {
+	ctx := context.Background()
+	publisher, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)),
+		WithInvalidateBatch(3))
+	suite.Require().NoError(err)
+	defer publisher.Close()
+	pubsub := suite.redisConn.Subscribe(ctx, publisher.opts.invalidateTopic)
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	suite.Require().NoError(err)
+
+	keys := []string{"batched:0", "batched:1", "batched:2"}
+	for _, key := range keys {
+		suite.NoError(suite.cacheRepo2.Set(ctx, key, "old", Normal.ToDuration()))
+		_, err := suite.inMemCache2.Get([]byte(storeKey(key)))
+		suite.Require().NoError(err)
+	}
+	for _, key := range keys {
+		suite.NoError(publisher.Set(ctx, key, "new", Normal.ToDuration()))
+	}
+	// keys of writes are published in one message, sent once the batch is full.
+	rctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var msg *invalidateMessage
+	for msg == nil || msg.Origin != publisher.id {
+		m, err := pubsub.ReceiveMessage(rctx)
+		suite.Require().NoError(err)
+		msg, err = parseInvalidateMessage(m.Payload)
+		suite.Require().NoError(err)
+	}
+	suite.ElementsMatch([]string{storeKey(keys[0]), storeKey(keys[1]), storeKey(keys[2])}, msg.Keys)
+
+	// and evicted by peers.
+	suite.Eventually(func() bool {
+		for _, key := range keys {
+			if _, err := suite.inMemCache2.Get([]byte(storeKey(key))); err != freecache.ErrNotFound {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 10*time.Millisecond)
+	var v string
+	suite.NoError(suite.cacheRepo2.Peek(ctx, keys[2], &v))
+	suite.Equal("new", v)
+}
+
+func (suite *testSuite) TestPublishPipelined() {
+	ctx := context.Background()
+	pubsub := suite.redisConn.Subscribe(ctx, "topicA", "topicB")
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	suite.Require().NoError(err)
+	_, err = pubsub.Receive(ctx)
+	suite.Require().NoError(err)
+
+	suite.cacheRepo.publish(ctx, []pubMsg{
+		{topic: "topicA", payload: []byte("a")},
+		{topic: "topicB", payload: []byte("b")},
+	})
+	received := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		msg := <-pubsub.Channel()
+		received[msg.Channel] = msg.Payload
+	}
+	suite.Equal(map[string]string{"topicA": "a", "topicB": "b"}, received)
+}
+
+func (suite *testSuite) TestInstanceID() {
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithInstanceID(func() string { return "pod-1" }))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.Equal("pod-1", cache.ID())
+
+	cache2, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithInstanceID(func() string { return "" }))
+	suite.Require().NoError(err)
+	defer cache2.Close()
+	suite.NotEmpty(cache2.ID())
+	suite.NotEqual(suite.cacheRepo.ID(), cache2.ID())
+}
+
+func (suite *testSuite) TestParseInvalidateMessage() {
+	msg, err := parseInvalidateMessage("pod-1~|~@t=1700000000000~|~@unknown=x~|~:{a}~|~:{b}")
+	suite.Require().NoError(err)
+	suite.Equal("pod-1", msg.Origin)
+	suite.Equal(time.UnixMilli(1700000000000), msg.SentAt)
+	suite.Equal([]string{":{a}", ":{b}"}, msg.Keys)
+
+	// messages from older versions do not have metadata.
+	msg, err = parseInvalidateMessage("pod-1~|~:{a}")
+	suite.Require().NoError(err)
+	suite.True(msg.SentAt.IsZero())
+	suite.Equal([]string{":{a}"}, msg.Keys)
+
+	_, err = parseInvalidateMessage("pod-1")
+	suite.Error(err)
+
+	msg, err = parseInvalidateMessage("pod-1~|~@t=1700000000000~|~@v=5,~|~:{a}~|~:{b}")
+	suite.Require().NoError(err)
+	suite.Equal([]valueStamp{{at: 1699999999995}, {}}, msg.Stamps)
+	msg, err = parseInvalidateMessage("pod-1~|~@t=1700000000000~|~@v=5.2,0~|~:{a}~|~:{b}")
+	suite.Require().NoError(err)
+	suite.Equal([]valueStamp{{at: 1699999999995, seq: 2}, {at: 1700000000000}}, msg.Stamps)
+	suite.Equal("5.2,0,", formatStamps(1700000000000, []pendingKey{
+		{stamp: valueStamp{at: 1699999999995, seq: 2}}, {stamp: valueStamp{at: 1700000000000}}, {}}))
+
+	// stamps not aligned with keys are dropped.
+	msg, err = parseInvalidateMessage("pod-1~|~@t=1700000000000~|~@v=5~|~:{a}~|~:{b}")
+	suite.Require().NoError(err)
+	suite.Nil(msg.Stamps)
+}
+
+func (suite *testSuite) TestInvalidateReceivedMetrics() {
+	ctx := context.Background()
+	queryKey := "test"
+	suite.NoError(suite.cacheRepo2.Set(ctx, queryKey, "testvalue", Normal.ToDuration()))
+	// Wait for key to be broadcasted
+	time.Sleep(time.Second + waitTime)
+
+	metric := &dto.Metric{}
+	counter := suite.cacheRepo.stats.Invalidated.WithLabelValues("test", peerOrigin)
+	suite.Require().NoError(counter.Write(metric))
+	suite.GreaterOrEqual(metric.GetCounter().GetValue(), 1.0)
+}
+
+func (suite *testSuite) TestPeers() {
+	ctx := context.Background()
+	newPeer := func(id string) *DCache {
+		cache, err := NewDCache("peers", suite.redisConn, nil, time.Second, false, false,
+			WithInstanceID(func() string { return id }),
+			WithPeerRegistry(100*time.Millisecond))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1 := newPeer("pod-1")
+	defer cache1.Close()
+	cache2 := newPeer("pod-2")
+	time.Sleep(waitTime)
+
+	peers, err := cache1.Peers(ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(peers, 2)
+	suite.Equal("pod-1", peers[0].ID)
+	suite.Equal("pod-2", peers[1].ID)
+	suite.False(peers[0].StartedAt.IsZero())
+
+	cache2.Close()
+	peers, err = cache1.Peers(ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(peers, 1)
+	suite.Equal("pod-1", peers[0].ID)
+
+	// clients without heartbeats do not prune the registry.
+	observer, err := NewDCache("peers", suite.redisConn, nil, time.Second, false, false)
+	suite.Require().NoError(err)
+	defer observer.Close()
+	_, err = observer.Peers(ctx)
+	suite.Equal(ErrNoPeerRegistry, err)
+	suite.Len(suite.redisConn.HGetAll(ctx, cache1.peersKey()).Val(), 1)
+}
+
+func (suite *testSuite) TestLeaderElection() {
+	newCandidate := func(id string) *DCache {
+		cache, err := NewDCache("leader", suite.redisConn, nil, time.Second, false, false,
+			WithInstanceID(func() string { return id }),
+			WithLeaderElection(300*time.Millisecond))
+		suite.Require().NoError(err)
+		return cache
+	}
+	var mu sync.Mutex
+	running := make(map[string]bool)
+	task := func(id string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			mu.Lock()
+			running[id] = true
+			mu.Unlock()
+			<-ctx.Done()
+			mu.Lock()
+			running[id] = false
+			mu.Unlock()
+		}
+	}
+	cache1 := newCandidate("pod-1")
+	cache1.RunAsLeader(task("pod-1"))
+	time.Sleep(waitTime)
+	cache2 := newCandidate("pod-2")
+	defer cache2.Close()
+	cache2.RunAsLeader(task("pod-2"))
+	time.Sleep(waitTime)
+
+	suite.True(cache1.IsLeader())
+	suite.False(cache2.IsLeader())
+	mu.Lock()
+	suite.Equal(map[string]bool{"pod-1": true}, running)
+	mu.Unlock()
+
+	// fail over after the leader is closed.
+	cache1.Close()
+	time.Sleep(300 * time.Millisecond)
+	suite.True(cache2.IsLeader())
+	mu.Lock()
+	suite.Equal(map[string]bool{"pod-1": false, "pod-2": true}, running)
+	mu.Unlock()
+
+	// leadership expires if renewals fail for the ttl.
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer down.Close()
+	c := &DCache{conn: down, ctx: context.Background(), id: "pod-3", opts: defaultOptions(),
+		leader: &leaderElection{key: "leader-down", ttl: 300 * time.Millisecond}}
+	c.leader.isLeader.Store(true)
+	c.leader.renewedAt = getNow()
+	c.tryLead()
+	suite.True(c.IsLeader())
+	c.leader.renewedAt = getNow().Add(-300 * time.Millisecond)
+	c.tryLead()
+	suite.False(c.IsLeader())
+}
+
+func (suite *testSuite) TestEvaluateSignals() {
+	s := &signalCounters{}
+	s.lastPubSubAt.Store(getNow().Add(-time.Minute).UnixNano())
+	s.observeHit(hitLabelMemory)
+	s.observeHit(hitLabelDB)
+	s.observeHit(hitLabelDB)
+	s.observeHit(hitLabelDB)
+	s.errors.Add(5)
+	s.observeLockWait(time.Second)
+	s.observeLockWait(3 * time.Second)
+	th := &DegradationThresholds{
+		MinHitRatio:  0.5,
+		MinRequests:  4,
+		MaxErrors:    4,
+		MaxPubSubGap: 10 * time.Second,
+		MaxLockWait:  time.Second,
+	}
+	status := evaluateSignals(s, th, true)
+	suite.True(status.Degraded)
+	suite.Len(status.Reasons, 4)
+	suite.EqualValues(4, status.Requests)
+	suite.Equal(0.25, status.HitRatio)
+	suite.Equal(2*time.Second, status.AvgLockWait)
+
+	// counters are reset, pubsub gap is not evaluated without pubsub.
+	status = evaluateSignals(s, th, false)
+	suite.False(status.Degraded)
+}
+
+func (suite *testSuite) TestDegradationDetector() {
+	changed := make(chan DegradationStatus, 10)
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithDegradationDetector(100*time.Millisecond, DegradationThresholds{
+			MinHitRatio: 0.5,
+			MinRequests: 1,
+		}, func(status DegradationStatus) {
+			changed <- status
+		}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var vget string
+	suite.NoError(cache.Get(context.Background(), "test", &vget, Normal.ToDuration(), func() (interface{}, error) {
+		return "testvalue", nil
+	}, false, false))
+	status := <-changed
+	suite.True(status.Degraded)
+	suite.True(cache.Degraded())
+	// no requests, recovered.
+	status = <-changed
+	suite.False(status.Degraded)
+}
+
+func (suite *testSuite) TestGetBytes() {
+	ctx := context.Background()
+	queryKey := "test"
+	v := []byte(`{"a":1}`)
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	read := func() ([]byte, error) {
+		rv, err := suite.mockRepo.ReadThrough()
+		return rv.([]byte), err
+	}
+	b, err := suite.cacheRepo.GetBytes(ctx, queryKey, Normal.ToDuration(), read)
+	suite.NoError(err)
+	suite.Equal(v, b)
+
+	// stored as-is, and served from cache.
+	vinmem, err := suite.inMemCache.Get([]byte(storeKey(queryKey)))
+	suite.NoError(err)
+	suite.Equal(v, vinmem)
+	b, err = suite.cacheRepo2.GetBytes(ctx, queryKey, Normal.ToDuration(), read)
+	suite.NoError(err)
+	suite.Equal(v, b)
+
+	newv := []byte(`{"a":2}`)
+	suite.NoError(suite.cacheRepo.SetBytes(ctx, queryKey, newv, Normal.ToDuration()))
+	b, err = suite.cacheRepo.GetBytes(ctx, queryKey, Normal.ToDuration(), read)
+	suite.NoError(err)
+	suite.Equal(newv, b)
+}
+
+func (suite *testSuite) TestNoLock() {
+	ctx := context.Background()
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithNoLockPrefixes("cheap:"))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	v := "testvalue"
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Twice()
+	read := func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}
+	var vget string
+	suite.NoError(cache.Get(ctx, "cheap:1", &vget, Normal.ToDuration(), read, false, false))
+	suite.Equal(v, vget)
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, lockKey("cheap:1")).Val())
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey("cheap:1")).Val())
+
+	suite.NoError(cache.Get(ctx, "other", &vget, Normal.ToDuration(), read, false, false, NoLock()))
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, lockKey("other")).Val())
+}
+
+func (suite *testSuite) TestInvalidateInterruptsLockWait() {
+	ctx := context.Background()
+	key := "interrupted"
+	// lock held by a reader of another pod.
+	suite.Require().NoError(suite.redisConn.SetNX(ctx, lockKey(key), "", time.Minute).Err())
+
+	v := "new"
+	suite.mockRepo.On("ReadThrough").Return(v, nil).Once()
+	read := func() (interface{}, error) {
+		return suite.mockRepo.ReadThrough()
+	}
+	done := make(chan error)
+	var vget string
+	go func() {
+		done <- suite.cacheRepo.Get(ctx, key, &vget, Normal.ToDuration(), read, false, false)
+	}()
+	time.Sleep(3 * lockSleep)
+	suite.NoError(suite.cacheRepo.Invalidate(ctx, key))
+	select {
+	case err := <-done:
+		suite.NoError(err)
+		suite.Equal(v, vget)
+	case <-time.After(time.Second):
+		suite.Fail("lock wait is not interrupted")
+	}
+}
+
+func (suite *testSuite) TestReadYourWrites() {
+	ctx := context.Background()
+	key := "ryw"
+	loading := make(chan struct{})
+	written := make(chan struct{})
+	read := func() (interface{}, error) {
+		close(loading)
+		<-written
+		return "old", nil
+	}
+	done := make(chan error)
+	var vget string
+	go func() {
+		done <- suite.cacheRepo.Get(ctx, key, &vget, Normal.ToDuration(), read, false, false)
+	}()
+	<-loading
+	suite.NoError(suite.cacheRepo.Set(ctx, key, "new", Normal.ToDuration()))
+	close(written)
+	suite.NoError(<-done)
+	suite.Equal("old", vget)
+
+	// value loaded before Set is not cached.
+	suite.NoError(suite.cacheRepo.Peek(ctx, key, &vget))
+	suite.Equal("new", vget)
+	vget = ""
+	suite.NoError(suite.cacheRepo2.Peek(ctx, key, &vget))
+	suite.Equal("new", vget)
+
+	// invalidation sent before the local write is ignored.
+	suite.cacheRepo.versions.bump(storeKey(key))
+	suite.True(suite.cacheRepo.versions.writtenAfter(storeKey(key), getNow().Add(-time.Minute)))
+	suite.False(suite.cacheRepo.versions.writtenAfter(storeKey(key), getNow()))
+}
+
+func (suite *testSuite) TestLocalVersions() {
+	v := newLocalVersions()
+	suite.Equal(uint64(0), v.current("a"))
+	v.bump("a")
+	seqA, seqB := v.current("a"), v.current("b")
+	suite.NotZero(seqA)
+	suite.Zero(seqB)
+
+	// other keys are not changed, all keys are changed by flushes.
+	v.invalidated("b")
+	suite.False(v.changed("a", seqA))
+	suite.True(v.changed("b", seqB))
+	seqB = v.current("b")
+	v.flushed()
+	suite.True(v.changed("a", seqA))
+	suite.True(v.changed("b", seqB))
+	suite.Greater(v.current("c"), seqB)
+
+	// versions only grow under concurrent changes and flushes.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key:%d", j)
+				seq := v.current(key)
+				if i%2 == 0 {
+					v.bump(key)
+				} else {
+					v.flushed()
+				}
+				suite.Greater(v.current(key), seq)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (suite *testSuite) TestNoopSetSkip() {
+	ctx := context.Background()
+	cache, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+		WithNoopSetSkip())
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	key := "noop"
+	suite.NoError(cache.Set(ctx, key, "v1", Normal.ToDuration()))
+	// remove it behind the cache to observe whether Redis is written.
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	suite.NoError(cache.Set(ctx, key, "v1", Normal.ToDuration()))
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+
+	// a different value is written.
+	suite.NoError(cache.Set(ctx, key, "v2", Normal.ToDuration()))
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+
+	// same value is written again after Invalidate.
+	suite.NoError(cache.Invalidate(ctx, key))
+	suite.NoError(cache.Set(ctx, key, "v2", Normal.ToDuration()))
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+
+	// TTL is extended when less than half remains.
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	suite.NoError(cache.Set(ctx, key, "v2", 2*Normal.ToDuration()+time.Second))
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+}
+
+func (suite *testSuite) TestSetCoalescing() {
+	ctx := context.Background()
+	cache, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+		WithSetCoalescing("counter:", 200*time.Millisecond))
+	suite.Require().NoError(err)
+
+	key := "counter:1"
+	for i := 1; i <= 3; i++ {
+		suite.NoError(cache.Set(ctx, key, i, Normal.ToDuration()))
+	}
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+	var v int
+	suite.NoError(cache.Peek(ctx, key, &v))
+	suite.Equal(3, v)
+
+	time.Sleep(400 * time.Millisecond)
+	v = 0
+	suite.NoError(suite.cacheRepo.Peek(ctx, key, &v))
+	suite.Equal(3, v)
+
+	// pending values are dropped by invalidations.
+	suite.NoError(cache.Set(ctx, key, 5, Normal.ToDuration()))
+	suite.NoError(cache.Invalidate(ctx, key))
+	suite.Equal(ErrNotFound, cache.Peek(ctx, key, &v))
+	suite.NoError(cache.Set(ctx, key, 6, Normal.ToDuration()))
+	suite.NoError(cache.InvalidateMulti(ctx, key))
+	time.Sleep(400 * time.Millisecond)
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+
+	// pending value is written on Close.
+	suite.NoError(cache.Set(ctx, key, 4, Normal.ToDuration()))
+	cache.Close()
+	ve, err := suite.cacheRepo.tryReadFromRedis(ctx, key)
+	suite.Require().NoError(err)
+	suite.NoError(unmarshal(ve.ValueBytes, &v))
+	suite.Equal(4, v)
+
+	// other keys are not coalesced.
+	suite.NoError(suite.cacheRepo.Set(ctx, "other", 1, Normal.ToDuration()))
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey("other")).Val())
+}
+
+func (suite *testSuite) TestSnapshot() {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		suite.NoError(suite.cacheRepo.Set(ctx, fmt.Sprintf("snapshot:%d", i), i, Normal.ToDuration()))
+	}
+	snapshot := suite.cacheRepo.Snapshot()
+	var v int
+	suite.NoError(snapshot.Get("snapshot:1", &v))
+	suite.Equal(1, v)
+	suite.Equal(ErrNotFound, snapshot.Get("snapshot:missing", &v))
+
+	values := make(map[string]int)
+	snapshot.Range(func(entry SnapshotEntry) bool {
+		var v int
+		suite.NoError(entry.Decode(&v))
+		values[entry.Key] = v
+		return true
+	})
+	suite.Equal(map[string]int{"snapshot:0": 0, "snapshot:1": 1, "snapshot:2": 2}, values)
+
+	n := 0
+	snapshot.Range(func(SnapshotEntry) bool {
+		n++
+		return false
+	})
+	suite.Equal(1, n)
+}
+
+func (suite *testSuite) TestPolicies() {
+	ctx := context.Background()
+	memCache := freecache.NewCache(1024 * 1024)
+	cache, err := NewDCache("test", suite.redisConn, memCache, time.Second, false, false,
+		WithPolicies(
+			Policy{Prefix: "p:", TTL: time.Minute, Jitter: time.Second},
+			Policy{Prefix: "p:raw:", TTL: 2 * time.Minute, NoMemCache: true, NoCompression: true},
+		))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	// default TTL with jitter.
+	suite.NoError(cache.Set(ctx, "p:1", "v", 0))
+	ttl := suite.redisConn.PTTL(ctx, storeKey("p:1")).Val()
+	suite.True(ttl > 59*time.Second && ttl <= 61*time.Second, ttl)
+	_, err = memCache.Get([]byte(storeKey("p:1")))
+	suite.NoError(err)
+
+	// longest prefix applies, TTL returned by read is kept.
+	value := strings.Repeat("a", 2*compressionThreshold)
+	var vget []string
+	suite.NoError(cache.GetWithTtl(ctx, "p:raw:1", &vget, func() (any, time.Duration, error) {
+		return []string{value}, 0, nil
+	}, false, false))
+	suite.Equal([]string{value}, vget)
+	ttl = suite.redisConn.PTTL(ctx, storeKey("p:raw:1")).Val()
+	suite.True(ttl > 119*time.Second && ttl <= 120*time.Second, ttl)
+	_, err = memCache.Get([]byte(storeKey("p:raw:1")))
+	suite.Equal(freecache.ErrNotFound, err)
+	ve, err := cache.tryReadFromRedis(ctx, "p:raw:1")
+	suite.Require().NoError(err)
+	suite.EqualValues(noCompression, ve.ValueBytes[len(ve.ValueBytes)-1])
+
+	suite.NoError(cache.Set(ctx, "other", "v", time.Second))
+	suite.True(suite.redisConn.PTTL(ctx, storeKey("other")).Val() <= time.Second)
+}
+
+func (suite *testSuite) TestTDigest() {
+	t := newTDigest(defaultDigestCompression)
+	suite.True(math.IsNaN(t.Quantile(0.5)))
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(100000) {
+		t.Add(float64(i + 1))
+	}
+	suite.EqualValues(100000, t.Count())
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		suite.InDelta(q*100000, t.Quantile(q), 0.01*100000, "q=%v", q)
+	}
+	suite.Equal(1.0, t.Quantile(0))
+	suite.Equal(100000.0, t.Quantile(1))
+	suite.LessOrEqual(len(t.centroids), defaultDigestCompression)
+}
+
+func (suite *testSuite) TestStats() {
+	ctx := context.Background()
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false,
+		WithLoaderLatencyDigests("slow:", "fast:"))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		var v int
+		suite.NoError(cache.Get(ctx, fmt.Sprintf("slow:%d", i), &v, Normal.ToDuration(), func() (any, error) {
+			time.Sleep(10 * time.Millisecond)
+			return i, nil
+		}, false, false))
+	}
+	stats := cache.Stats()
+	suite.Len(stats.LoaderLatency, 2)
+	slow := stats.LoaderLatency["slow:"]
+	suite.EqualValues(10, slow.Count)
+	suite.GreaterOrEqual(slow.P50, 10*time.Millisecond)
+	suite.GreaterOrEqual(slow.Max, slow.P99)
+	suite.EqualValues(0, stats.LoaderLatency["fast:"].Count)
+}
+
+func (suite *testSuite) TestPriority() {
+	ctx := context.Background()
+	memCache := freecache.NewCache(512 * 1024)
+	cache, err := NewDCache("test", suite.redisConn, memCache, time.Second, false, false,
+		WithPolicies(Policy{Prefix: "auth:", Priority: PriorityHigh}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	// pressure is detected by evictions.
+	suite.Equal(memPressureNone, cache.memPressure.get(FreecacheLocal(memCache)))
+	value := make([]byte, 256)
+	for i := 0; i < 4096; i++ {
+		suite.NoError(memCache.Set([]byte(fmt.Sprintf("filler:%d", i)), value, 0))
+	}
+	cache.memPressure.checkedAt = cache.memPressure.checkedAt.Add(-memPressureInterval)
+	suite.Equal(memPressureSevere, cache.memPressure.get(FreecacheLocal(memCache)))
+	memCache.Clear()
+
+	cache.memPressure.level.Store(memPressureHigh)
+	read := func() (any, error) { return "v", nil }
+	var v string
+	suite.NoError(cache.Get(ctx, "low", &v, Normal.ToDuration(), read, false, false, WithPriority(PriorityLow)))
+	suite.NoError(cache.Get(ctx, "normal", &v, Normal.ToDuration(), read, false, false))
+	_, err = memCache.Get([]byte(storeKey("low")))
+	suite.Equal(freecache.ErrNotFound, err)
+	_, err = memCache.Get([]byte(storeKey("normal")))
+	suite.NoError(err)
+
+	cache.memPressure.level.Store(memPressureSevere)
+	suite.NoError(cache.Set(ctx, "normal", "v2", Normal.ToDuration()))
+	_, err = memCache.Get([]byte(storeKey("normal")))
+	suite.Equal(freecache.ErrNotFound, err)
+	suite.NoError(cache.Set(ctx, "auth:1", "v", Normal.ToDuration()))
+	_, err = memCache.Get([]byte(storeKey("auth:1")))
+	suite.NoError(err)
+}
+
+func (suite *testSuite) TestPin() {
+	ctx := context.Background()
+	key := "pinned"
+	suite.NoError(suite.cacheRepo2.Set(ctx, key, "v1", Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo.Pin(ctx, key))
+
+	// resident regardless of evictions.
+	suite.inMemCache.Clear()
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	var v string
+	suite.NoError(suite.cacheRepo.Peek(ctx, key, &v))
+	suite.Equal("v1", v)
+
+	// reloaded after invalidation.
+	suite.NoError(suite.cacheRepo2.Set(ctx, key, "v2", Normal.ToDuration()))
+	suite.Eventually(func() bool {
+		_ = suite.cacheRepo.Peek(ctx, key, &v)
+		return v == "v2"
+	}, 3*time.Second, 100*time.Millisecond)
+
+	suite.cacheRepo.Unpin(key)
+	suite.inMemCache.Clear()
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	suite.Equal(ErrNotFound, suite.cacheRepo.Peek(ctx, key, &v))
+
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, false, false)
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.Equal(ErrNoMemCache, cache.Pin(ctx, key))
+}
+
+// readHook calls f after Redis reads of key.
+type readHook struct {
+	key string
+	f   func()
+}
+
+func (h *readHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *readHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if args := cmd.Args(); cmd.Name() == "get" && len(args) > 1 && fmt.Sprint(args[1]) == h.key {
+			h.f()
+		}
+		return err
+	}
+}
+
+func (h *readHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (suite *testSuite) TestPinRefreshOrdering() {
+	ctx := context.Background()
+	key := "pinned:ordering"
+	writer, err := NewCache("test", suite.redisConn, WithRemoteOnly())
+	suite.Require().NoError(err)
+	defer writer.Close()
+	suite.NoError(writer.Set(ctx, key, "v1", Normal.ToDuration()))
+
+	conn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer conn.Close()
+	var cache *DCache
+	var armed, blocking atomic.Bool
+	release := make(chan struct{})
+	// key is written and invalidated between the Redis read and the update of a refresh.
+	conn.AddHook(&readHook{key: storeKey(key), f: func() {
+		if blocking.Load() {
+			<-release
+		}
+		if armed.CompareAndSwap(true, false) {
+			suite.NoError(writer.Set(ctx, key, "v2", Normal.ToDuration()))
+			cache.applyInvalidation(storeKey(key), time.Time{}, valueStamp{}, "")
+		}
+	}})
+	cache, err = NewDCache("test", conn, freecache.NewCache(1024*1024), time.Second, true, true)
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.NoError(cache.Pin(ctx, key))
+
+	armed.Store(true)
+	suite.NoError(cache.refreshPin(ctx, key))
+	suite.False(armed.Load())
+	// the older value read is discarded, the newer one is reloaded in background.
+	var v string
+	if b, ok := cache.getPinned(key); ok {
+		suite.NoError(cache.unmarshal(storeKey(key), b, &v))
+		suite.Equal("v2", v)
+	}
+	suite.Eventually(func() bool {
+		b, ok := cache.getPinned(key)
+		return ok && cache.unmarshal(storeKey(key), b, &v) == nil && v == "v2"
+	}, time.Second, 10*time.Millisecond)
+
+	// invalidations never wait for Redis reads, pins are reloaded in background.
+	blocking.Store(true)
+	suite.NoError(writer.Set(ctx, key, "v3", Normal.ToDuration()))
+	done := make(chan struct{})
+	go func() {
+		cache.applyInvalidation(storeKey(key), time.Time{}, valueStamp{}, "")
+		close(done)
+	}()
+	suite.Eventually(func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	blocking.Store(false)
+	close(release)
+	suite.Eventually(func() bool {
+		b, ok := cache.getPinned(key)
+		return ok && cache.unmarshal(storeKey(key), b, &v) == nil && v == "v3"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestGetMultiPartialResults() {
+	ctx := context.Background()
+	suite.NoError(suite.cacheRepo.Set(ctx, "multi:a", "a", Normal.ToDuration()))
+	// undecodable into string slice.
+	suite.NoError(suite.cacheRepo.Set(ctx, "multi:b", 1, Normal.ToDuration()))
+
+	keys := []string{"multi:a", "multi:b", "multi:c", "multi:d"}
+	var va string
+	var vb, vc, vd []string
+	targets := []any{&va, &vb, &vc, &vd}
+	var read []string
+	errs := suite.cacheRepo.GetMulti(ctx, keys, targets, Normal.ToDuration(), func(keys []string) (map[string]any, error) {
+		read = keys
+		return map[string]any{"multi:b": []string{"b"}, "multi:c": []string{"c"}}, nil
+	})
+	suite.Equal([]string{"multi:b", "multi:c", "multi:d"}, read)
+	suite.Equal([]error{nil, nil, nil, ErrNotFound}, errs)
+	suite.Equal("a", va)
+	suite.Equal([]string{"b"}, vb)
+	suite.Equal([]string{"c"}, vc)
+
+	// loaded values are cached.
+	vc = nil
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "multi:c", &vc))
+	suite.Equal([]string{"c"}, vc)
+
+	loadErr := errors.New("load failed")
+	readFail := func(keys []string) (map[string]any, error) {
+		return nil, loadErr
+	}
+	errs = suite.cacheRepo.GetMulti(ctx, keys, targets, Normal.ToDuration(), readFail)
+	suite.Equal([]error{nil, nil, nil, loadErr}, errs)
+	errs = suite.cacheRepo.GetMulti(ctx, keys, targets, Normal.ToDuration(), readFail, TolerateLoadErrors())
+	suite.Equal([]error{nil, nil, nil, ErrNotFound}, errs)
+
+	suite.Nil(suite.cacheRepo.GetMulti(ctx, keys[:3], targets[:3], Normal.ToDuration(), readFail))
+	suite.Equal([]error{ErrTargetsMismatch}, suite.cacheRepo.GetMulti(ctx, keys[:1], nil, Normal.ToDuration(), readFail))
+}
+
+func (suite *testSuite) TestSetKeyOrdering() {
+	ctx := context.Background()
+	key := "ordering"
+	// a peer writes and invalidates the key between the Redis write and the memory update.
+	var cache *DCache
+	var armed atomic.Bool
+	armed.Store(true)
+	cache, err := NewDCache("test", suite.redisConn, suite.inMemCache, time.Second, true, true,
+		withSetKeyHook(func(k string) {
+			if k == key && armed.Load() {
+				cache.applyInvalidation(storeKey(k), time.Time{}, valueStamp{}, "")
+			}
+		}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.NoError(cache.Set(ctx, key, "v", Normal.ToDuration()))
+	_, err = suite.inMemCache.Get([]byte(storeKey(key)))
+	suite.Equal(freecache.ErrNotFound, err)
+
+	// memory cache is updated with the same ExpiredAt as Redis otherwise.
+	armed.Store(false)
+	suite.NoError(cache.Set(ctx, key, "v", 3*time.Second))
+	ve, err := cache.tryReadFromRedis(ctx, key)
+	suite.Require().NoError(err)
+	_, expireAt, err := suite.inMemCache.GetWithExpiration([]byte(storeKey(key)))
+	suite.NoError(err)
+	suite.InDelta(time.UnixMilli(ve.ExpiredAt).Unix(), expireAt, 1)
+}
+
+func (suite *testSuite) TestRemoteOnly() {
+	ctx := context.Background()
+	_, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+		WithRemoteOnly())
+	suite.Equal(ErrRemoteOnly, err)
+
+	cache, err := NewDCache("test", suite.redisConn, nil, time.Second, true, false, WithRemoteOnly())
+	suite.Require().NoError(err)
+	defer cache.Close()
+	mode := func(label string) float64 {
+		m := &dto.Metric{}
+		suite.NoError(cache.stats.Mode.WithLabelValues("test", label).Write(m))
+		return m.GetGauge().GetValue()
+	}
+	suite.True(cache.RemoteOnly())
+	suite.Equal(1.0, mode(modeLabelRemoteOnly))
+	suite.Equal(0.0, mode(modeLabelTwoTier))
+
+	key := "attached"
+	suite.NoError(cache.Set(ctx, key, "v1", Normal.ToDuration()))
+	memCache := freecache.NewCache(1024 * 1024)
+	suite.NoError(cache.AttachLocalStore(memCache))
+	suite.Equal(ErrLocalStoreAttached, cache.AttachLocalStore(memCache))
+	suite.False(cache.RemoteOnly())
+	suite.Equal(0.0, mode(modeLabelRemoteOnly))
+	suite.Equal(1.0, mode(modeLabelTwoTier))
+
+	var v string
+	suite.NoError(cache.Peek(ctx, key, &v))
+	suite.Equal("v1", v)
+	_, err = memCache.Get([]byte(storeKey(key)))
+	suite.NoError(err)
+
+	// invalidations of peers are received.
+	suite.NoError(suite.cacheRepo2.Set(ctx, key, "v2", Normal.ToDuration()))
+	suite.Eventually(func() bool {
+		_, err := memCache.Get([]byte(storeKey(key)))
+		return err == freecache.ErrNotFound
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func (suite *testSuite) TestWithMaxTTL() {
+	ctx := context.Background()
+	read := func() (any, time.Duration, error) {
+		return "v", time.Hour, nil
+	}
+	var v string
+	suite.NoError(suite.cacheRepo.GetWithTtl(ctx, "maxttl", &v, read, false, false, WithMaxTTL(time.Minute)))
+	suite.Equal("v", v)
+	ttl := suite.redisConn.PTTL(ctx, storeKey("maxttl")).Val()
+	suite.True(ttl > 59*time.Second && ttl <= time.Minute, ttl)
+
+	suite.NoError(suite.cacheRepo.GetWithTtl(ctx, "maxttl:uncapped", &v, read, false, false, WithMaxTTL(2*time.Hour)))
+	ttl = suite.redisConn.PTTL(ctx, storeKey("maxttl:uncapped")).Val()
+	suite.True(ttl > 59*time.Minute && ttl <= time.Hour, ttl)
+}
+
+func (suite *testSuite) TestWithShouldStore() {
+	ctx := context.Background()
+	shouldStore := WithShouldStore(func(value any) bool {
+		return len(value.([]string)) > 1
+	})
+	var v []string
+	suite.NoError(suite.cacheRepo.Get(ctx, "partial", &v, Normal.ToDuration(), func() (any, error) {
+		return []string{"warming"}, nil
+	}, false, false, shouldStore))
+	suite.Equal([]string{"warming"}, v)
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey("partial")).Val())
+
+	suite.NoError(suite.cacheRepo.Get(ctx, "partial", &v, Normal.ToDuration(), func() (any, error) {
+		return []string{"a", "b"}, nil
+	}, false, false, shouldStore))
+	suite.Equal([]string{"a", "b"}, v)
+	suite.EqualValues(1, suite.redisConn.Exists(ctx, storeKey("partial")).Val())
+}
+
+func (suite *testSuite) TestRecorder() {
+	ctx := context.Background()
+	var recording bytes.Buffer
+	cache, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+		WithRecorder(&recording))
+	suite.Require().NoError(err)
+	read := func() (any, error) { return "value", nil }
+	var v string
+	suite.NoError(cache.Get(ctx, "recorded", &v, Normal.ToDuration(), read, false, false))
+	suite.NoError(cache.Get(ctx, "recorded", &v, Normal.ToDuration(), read, false, false))
+	suite.NoError(cache.Set(ctx, "recorded", "value2", Normal.ToDuration()))
+	suite.NoError(cache.Invalidate(ctx, "recorded"))
+	cache.Close()
+
+	rr := NewRecordReader(&recording)
+	var events []RecordEvent
+	for {
+		e, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		suite.Require().NoError(err)
+		suite.False(e.At.Before(time.Time{}))
+		e.At = time.Time{}
+		events = append(events, e)
+	}
+	suite.Equal([]RecordEvent{
+		{Op: RecordGet, Key: "recorded", Size: len("value"), Tier: "db"},
+		{Op: RecordGet, Key: "recorded", Size: len("value"), Tier: "mem"},
+		{Op: RecordSet, Key: "recorded", Size: len("value2")},
+		{Op: RecordInvalidate, Key: "recorded"},
+	}, events)
+
+	_, err = NewRecordReader(bytes.NewReader([]byte("garbage"))).Next()
+	suite.Equal(ErrBadRecording, err)
+	// sizes beyond maxRecordValueSize are corrupted.
+	event := append([]byte(recordMagic), byte(RecordSet), 0, 0, 1, 'k')
+	_, err = NewRecordReader(bytes.NewReader(binary.AppendUvarint(event, maxRecordValueSize))).Next()
+	suite.NoError(err)
+	_, err = NewRecordReader(bytes.NewReader(binary.AppendUvarint(event, maxRecordValueSize+1))).Next()
+	suite.Equal(ErrBadRecording, err)
+}
+
+// commandCounter counts Redis commands by name.
+type commandCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (h *commandCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *commandCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.observe(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *commandCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			h.observe(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// observe counts @p cmd by name, and by name and key, e.g., "set key".
+func (h *commandCounter) observe(cmd redis.Cmder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[cmd.Name()]++
+	if args := cmd.Args(); len(args) > 1 {
+		h.counts[fmt.Sprintf("%s %v", cmd.Name(), args[1])]++
+	}
+}
+
+func (h *commandCounter) count(name string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[name]
+}
+
+func (suite *testSuite) TestGetMultiMGet() {
+	ctx := context.Background()
+	conn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer conn.Close()
+	counter := &commandCounter{counts: make(map[string]int)}
+	conn.AddHook(counter)
+	cache, err := NewDCache("test", conn, freecache.NewCache(1024*1024), time.Second, false, false)
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var keys []string
+	for i := 0; i < 60; i++ {
+		keys = append(keys, fmt.Sprintf("mget:%d", i))
+	}
+	// a third in memory cache, a third in Redis only, and a third in neither.
+	for _, key := range keys[:20] {
+		suite.NoError(cache.Set(ctx, key, key, Normal.ToDuration()))
+	}
+	for _, key := range keys[20:40] {
+		suite.NoError(suite.cacheRepo.Set(ctx, key, key, Normal.ToDuration()))
+	}
+	values := make([]string, len(keys))
+	targets := make([]any, len(keys))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	var read []string
+	counter.counts = make(map[string]int)
+	errs := cache.GetMulti(ctx, keys, targets, Normal.ToDuration(), func(keys []string) (map[string]any, error) {
+		read = keys
+		rv := make(map[string]any)
+		for _, key := range keys {
+			rv[key] = key
+		}
+		return rv, nil
+	})
+	suite.Nil(errs)
+	suite.Equal(keys, values)
+	suite.Equal(keys[40:], read)
+	suite.Equal(1, counter.count("mget"))
+	suite.Zero(counter.count("get"))
+}
+
+func (suite *testSuite) TestReadRepair() {
+	ctx := context.Background()
+	cache, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+		WithReadRepair(time.Minute))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	read := func() (any, error) {
+		suite.Fail("loader must not be called")
+		return nil, nil
+	}
+
+	// Redis loses the key while memory cache still holds it.
+	key := "repaired"
+	suite.NoError(cache.Set(ctx, key, "v", Normal.ToDuration()))
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	var v string
+	suite.NoError(cache.Get(ctx, key, &v, Normal.ToDuration(), read, false, false))
+	suite.Equal("v", v)
+	suite.Eventually(func() bool {
+		return suite.redisConn.Exists(ctx, storeKey(key)).Val() == 1
+	}, time.Second, 10*time.Millisecond)
+	v = ""
+	suite.NoError(suite.cacheRepo2.Peek(ctx, key, &v))
+	suite.Equal("v", v)
+	suite.EqualValues(1, cache.Stats().ReadRepairs)
+
+	// checked at most once per interval.
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	suite.NoError(cache.Get(ctx, key, &v, Normal.ToDuration(), read, false, false))
+	time.Sleep(50 * time.Millisecond)
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+
+	// repairs are undone if the key is invalidated right after.
+	key = "repair-undone"
+	suite.NoError(cache.Set(ctx, key, "v", Normal.ToDuration()))
+	suite.NoError(suite.redisConn.Del(ctx, storeKey(key)).Err())
+	suite.NoError(cache.Get(ctx, key, &v, Normal.ToDuration(), read, false, false))
+	suite.Eventually(func() bool {
+		return cache.Stats().ReadRepairs == 2
+	}, time.Second, 10*time.Millisecond)
+	cache.versions.invalidated(storeKey(key))
+	suite.Eventually(func() bool {
+		return suite.redisConn.Exists(ctx, storeKey(key)).Val() == 0
+	}, 2*readRepairGrace, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestSetMulti() {
+	ctx := context.Background()
+	conn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer conn.Close()
+	counter := &commandCounter{counts: make(map[string]int)}
+	conn.AddHook(counter)
+	cache, err := NewDCache("test", conn, freecache.NewCache(1024*1024), time.Second, false, false)
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	// peers hold old values.
+	values := map[string]any{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("setmulti:%d", i)
+		suite.NoError(suite.cacheRepo.Set(ctx, key, "old", Normal.ToDuration()))
+		values[key] = fmt.Sprintf("new%d", i)
+	}
+	// invalidations of old values are received before new values are set.
+	time.Sleep(time.Second + waitTime)
+	counter.counts = make(map[string]int)
+	suite.NoError(cache.SetMulti(ctx, values, Normal.ToDuration()))
+	suite.Equal(10, counter.count("set"))
+	for key, value := range values {
+		var v string
+		suite.NoError(cache.Snapshot().Get(key, &v))
+		suite.Equal(value, v)
+		suite.Eventually(func() bool {
+			_, err := suite.inMemCache.Get([]byte(storeKey(key)))
+			return err == freecache.ErrNotFound
+		}, 2*time.Second, 10*time.Millisecond)
+		suite.NoError(suite.cacheRepo.Peek(ctx, key, &v))
+		suite.Equal(value, v)
+	}
+
+	// nothing is written if any value fails to marshal.
+	suite.Error(cache.SetMulti(ctx, map[string]any{"setmulti:0": "v", "setmulti:bad": make(chan int)}, Normal.ToDuration()))
+	var v string
+	suite.NoError(cache.Peek(ctx, "setmulti:0", &v))
+	suite.Equal("new0", v)
+	suite.NoError(cache.SetMulti(ctx, nil, Normal.ToDuration()))
+}
+
+func (suite *testSuite) TestInvalidateAt() {
+	ctx := context.Background()
+	suite.Equal(ErrNoLeaderElection, suite.cacheRepo.InvalidateAt(ctx, "scheduled", getNow().Add(time.Second)))
+
+	cache, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+		WithLeaderElection(300*time.Millisecond))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.Eventually(cache.IsLeader, time.Second, 10*time.Millisecond)
+
+	key := "scheduled"
+	suite.NoError(suite.cacheRepo.Set(ctx, key, "v", Normal.ToDuration()))
+	suite.NoError(cache.InvalidateAt(ctx, key, getNow().Add(time.Hour)))
+	// replaced by a later schedule.
+	at := getNow().Add(300 * time.Millisecond)
+	suite.NoError(cache.InvalidateAt(ctx, key, at))
+	var v string
+	suite.NoError(suite.cacheRepo.Peek(ctx, key, &v))
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache.Get([]byte(storeKey(key)))
+		return err == freecache.ErrNotFound && suite.redisConn.Exists(ctx, storeKey(key)).Val() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	suite.False(getNow().Before(at))
+	suite.EqualValues(0, suite.redisConn.ZCard(ctx, cache.scheduledKey()).Val())
+
+	// not in the future.
+	suite.NoError(suite.cacheRepo.Set(ctx, key, "v", Normal.ToDuration()))
+	suite.NoError(cache.InvalidateAt(ctx, key, getNow()))
+	suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+}
+
+func (suite *testSuite) TestInvalidateMulti() {
+	ctx := context.Background()
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("invalidatemulti:%d", i)
+		keys = append(keys, key)
+		suite.NoError(suite.cacheRepo.Set(ctx, key, "v", Normal.ToDuration()))
+		var v string
+		suite.NoError(suite.cacheRepo2.Peek(ctx, key, &v))
+	}
+	suite.NoError(suite.cacheRepo.InvalidateMulti(ctx, append(keys, "invalidatemulti:absent")...))
+	for _, key := range keys {
+		suite.EqualValues(0, suite.redisConn.Exists(ctx, storeKey(key)).Val())
+		_, err := suite.inMemCache.Get([]byte(storeKey(key)))
+		suite.Equal(freecache.ErrNotFound, err)
+	}
+	suite.Eventually(func() bool {
+		for _, key := range keys {
+			if _, err := suite.inMemCache2.Get([]byte(storeKey(key))); err != freecache.ErrNotFound {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+	suite.NoError(suite.cacheRepo.InvalidateMulti(ctx))
+}
+
+func (suite *testSuite) TestTombstones() {
+	ctx := context.Background()
+	newCache := func() *DCache {
+		cache, err := NewDCache("test", suite.redisConn, freecache.NewCache(1024*1024), time.Second, false, false,
+			WithTombstones(500*time.Millisecond))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1, cache2 := newCache(), newCache()
+	defer cache1.Close()
+	defer cache2.Close()
+
+	// a read started before the invalidation fills after it.
+	key := "tombstoned"
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var v string
+		suite.NoError(cache2.Get(ctx, key, &v, Normal.ToDuration(), func() (any, error) {
+			<-release
+			return "stale", nil
+		}, false, false))
+		suite.Equal("stale", v)
+	}()
+	time.Sleep(waitTime)
+	suite.NoError(cache1.Invalidate(ctx, key))
+	close(release)
+	<-done
+	var v string
+	suite.Equal(ErrNotFound, cache1.Peek(ctx, key, &v))
+	suite.Equal(ErrNotFound, cache2.Peek(ctx, key, &v))
+	vals := suite.redisConn.MGet(ctx, storeKey(key)).Val()
+	suite.Equal([]any{tombstone}, vals)
+	errs := cache1.GetMulti(ctx, []string{key}, []any{&v}, Normal.ToDuration(), func(keys []string) (map[string]any, error) {
+		return map[string]any{key: "fresh"}, nil
+	})
+	suite.Nil(errs)
+	suite.Equal("fresh", v)
+	suite.Equal(ErrNotFound, cache2.Peek(ctx, key, &v))
+
+	// cached again after the tombstone expires.
+	time.Sleep(500 * time.Millisecond)
+	suite.NoError(cache1.Get(ctx, key, &v, Normal.ToDuration(), func() (any, error) {
+		return "fresh", nil
+	}, false, false))
+	v = ""
+	suite.NoError(cache2.Peek(ctx, key, &v))
+	suite.Equal("fresh", v)
+
+	// explicit Sets overwrite tombstones.
+	suite.NoError(cache1.Invalidate(ctx, key))
+	suite.NoError(cache1.Set(ctx, key, "set", Normal.ToDuration()))
+	ve, err := cache2.tryReadFromRedis(ctx, key)
+	suite.Require().NoError(err)
+	suite.Equal([]byte("set"), ve.ValueBytes)
+
+	// fills without TTLs never expire, sub-millisecond TTLs are rounded up.
+	written, err := cache1.fillKey(ctx, "fill:forever", []byte("v"), 0)
+	suite.NoError(err)
+	suite.True(written)
+	suite.Equal(time.Duration(-1), suite.redisConn.PTTL(ctx, storeKey("fill:forever")).Val())
+	written, err = cache1.fillKey(ctx, "fill:short", []byte("v"), time.Microsecond)
+	suite.NoError(err)
+	suite.True(written)
+}
+
+func (suite *testSuite) TestNewCache() {
+	ctx := context.Background()
+	newCache := func(mem *freecache.Cache) *DCache {
+		cache, err := NewCache("test", suite.redisConn,
+			WithInMemCache(mem),
+			WithReadInterval(100*time.Millisecond),
+			WithLockSleep(10*time.Millisecond),
+			WithInvalidateTopic("CustomInvalidatePubSub"),
+			WithInvalidateBatch(2))
+		suite.Require().NoError(err)
+		return cache
+	}
+	mem1, mem2 := freecache.NewCache(1024*1024), freecache.NewCache(1024*1024)
+	cache1, cache2 := newCache(mem1), newCache(mem2)
+	defer cache1.Close()
+	defer cache2.Close()
+	suite.Equal(100*time.Millisecond, cache1.readInterval)
+	suite.False(cache1.RemoteOnly())
+
+	keys := []string{"custom:1", "custom:2"}
+	for _, key := range keys {
+		suite.NoError(cache2.Set(ctx, key, "old", Normal.ToDuration()))
+		suite.NoError(suite.cacheRepo.Set(ctx, key, "old", Normal.ToDuration()))
+	}
+	time.Sleep(time.Second + waitTime)
+	for _, key := range keys {
+		var v string
+		suite.NoError(cache2.Peek(ctx, key, &v))
+		suite.NoError(suite.cacheRepo.Peek(ctx, key, &v))
+	}
+	// a full batch is published without waiting, only to clients of the same topic.
+	for _, key := range keys {
+		suite.NoError(cache1.Set(ctx, key, "new", Normal.ToDuration()))
+	}
+	suite.Eventually(func() bool {
+		for _, key := range keys {
+			if _, err := mem2.Get([]byte(storeKey(key))); err != freecache.ErrNotFound {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 10*time.Millisecond)
+	time.Sleep(time.Second + waitTime)
+	for _, key := range keys {
+		v, err := suite.inMemCache.Get([]byte(storeKey(key)))
+		suite.NoError(err)
+		suite.Equal("old", string(v))
+	}
+}
+
+func (suite *testSuite) TestLockScope() {
+	ctx := context.Background()
+	conn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer conn.Close()
+	counter := &commandCounter{counts: make(map[string]int)}
+	conn.AddHook(counter)
+	cache, err := NewCache("test", conn, WithRemoteOnly(), WithDefaultLockScope(LockScopeLocal))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var loads atomic.Int32
+	read := func() (any, error) {
+		loads.Add(1)
+		time.Sleep(dbResponseTime)
+		return "v", nil
+	}
+	getConcurrently := func(key string, opts ...CallOption) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var v string
+				suite.NoError(cache.Get(ctx, key, &v, Normal.ToDuration(), read, false, false, opts...))
+				suite.Equal("v", v)
+			}()
+		}
+		wg.Wait()
+	}
+
+	// in-process single flight only.
+	getConcurrently("scope:local")
+	suite.EqualValues(1, loads.Load())
+	suite.Zero(counter.count("set " + lockKey("scope:local")))
+
+	// distributed lock only, each caller tries the lock, at least once.
+	loads.Store(0)
+	getConcurrently("scope:distributed", WithLockScope(LockScopeDistributed))
+	suite.EqualValues(1, loads.Load())
+	suite.GreaterOrEqual(counter.count("set "+lockKey("scope:distributed")), 5)
+
+	// both, only one caller per process tries the lock.
+	loads.Store(0)
+	getConcurrently("scope:all", WithLockScope(LockScopeAll))
+	suite.EqualValues(1, loads.Load())
+	suite.Equal(1, counter.count("set "+lockKey("scope:all")))
+}
+
+func (suite *testSuite) TestDryRun() {
+	ctx := context.Background()
+	mem := freecache.NewCache(1024 * 1024)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithDryRun())
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var loads int
+	read := func() (any, error) {
+		loads++
+		return "value", nil
+	}
+	for i := 0; i < 3; i++ {
+		var v string
+		suite.NoError(cache.Get(ctx, "dry", &v, Normal.ToDuration(), read, false, false))
+		suite.Equal("value", v)
+	}
+	// loaders are always called, and nothing is written.
+	suite.Equal(3, loads)
+	suite.Equal(int64(0), mem.EntryCount())
+	var v string
+	suite.ErrorIs(cache.Peek(ctx, "dry", &v), ErrNotFound)
+
+	s := cache.Stats()
+	suite.Equal(int64(2), s.DryRunHits)
+	suite.Equal(int64(1), s.DryRunMisses)
+	suite.Equal(int64(1), s.DryRunKeys)
+	suite.Equal(int64(len("value")+len(storeKey("dry"))), s.DryRunBytes)
+
+	// invalidations and sets change what would be hit.
+	suite.NoError(cache.Invalidate(ctx, "dry"))
+	suite.NoError(cache.Get(ctx, "dry", &v, Normal.ToDuration(), read, false, false))
+	suite.NoError(cache.Set(ctx, "dry:set", "value", Normal.ToDuration()))
+	suite.NoError(cache.Get(ctx, "dry:set", &v, Normal.ToDuration(), read, false, false))
+	// noStore values are not counted as cached.
+	suite.NoError(cache.Get(ctx, "dry:nostore", &v, Normal.ToDuration(), read, false, true))
+	suite.NoError(cache.Get(ctx, "dry:nostore", &v, Normal.ToDuration(), read, false, true))
+	suite.ErrorIs(cache.Peek(ctx, "dry:set", &v), ErrNotFound)
+
+	s = cache.Stats()
+	suite.Equal(int64(3), s.DryRunHits)
+	suite.Equal(int64(4), s.DryRunMisses)
+	suite.Equal(int64(2), s.DryRunKeys)
+}
+
+func (suite *testSuite) TestCallOptionFlags() {
+	ctx := context.Background()
+	var loads int
+	read := func() (any, error) {
+		loads++
+		return fmt.Sprintf("v%d", loads), nil
+	}
+	var v string
+	suite.ErrorIs(suite.cacheRepo.Get(ctx, "flags", &v, Normal.ToDuration(), read, false, false, MemoryOnly()),
+		ErrNotFound)
+	suite.Equal(0, loads)
+
+	suite.NoError(suite.cacheRepo.Get(ctx, "flags", &v, Normal.ToDuration(), read, false, false, NoStore()))
+	suite.Equal("v1", v)
+	suite.ErrorIs(suite.cacheRepo.Peek(ctx, "flags", &v), ErrNotFound)
+
+	suite.NoError(suite.cacheRepo.Get(ctx, "flags", &v, Normal.ToDuration(), read, false, false))
+	suite.Equal("v2", v)
+	suite.NoError(suite.cacheRepo.Get(ctx, "flags", &v, Normal.ToDuration(), read, false, false, NoCache()))
+	suite.Equal("v3", v)
+	suite.NoError(suite.cacheRepo.Get(ctx, "flags", &v, Normal.ToDuration(), read, false, false, MemoryOnly()))
+	suite.Equal("v3", v)
+	suite.Equal(3, loads)
+
+	// per-call options also apply to GetMulti.
+	keys := []string{"flags", "flags:missing"}
+	targets := []any{new(string), new(string)}
+	errs := suite.cacheRepo.GetMulti(ctx, keys, targets, Normal.ToDuration(),
+		func(keys []string) (map[string]any, error) {
+			suite.Fail("must not read the data source")
+			return nil, nil
+		}, MemoryOnly())
+	suite.Require().Len(errs, 2)
+	suite.NoError(errs[0])
+	suite.ErrorIs(errs[1], ErrNotFound)
+	suite.Equal("v3", *targets[0].(*string))
+
+	errs = suite.cacheRepo.GetMulti(ctx, keys, targets, Normal.ToDuration(),
+		func(keys []string) (map[string]any, error) {
+			suite.Equal([]string{"flags", "flags:missing"}, keys)
+			return map[string]any{"flags": "v4", "flags:missing": "v4"}, nil
+		}, NoCache(), NoStore())
+	suite.Nil(errs)
+	suite.Equal("v4", *targets[0].(*string))
+	suite.NoError(suite.cacheRepo.Peek(ctx, "flags", &v))
+	suite.Equal("v3", v)
+	suite.ErrorIs(suite.cacheRepo.Peek(ctx, "flags:missing", &v), ErrNotFound)
+}
+
+func (suite *testSuite) TestGenericGet() {
+	ctx := context.Background()
+	var loads int
+	read := func() (data, error) {
+		loads++
+		return data{S: "s", I: loads}, nil
+	}
+	for i := 0; i < 2; i++ {
+		v, err := Get(ctx, suite.cacheRepo, "generic", Normal.ToDuration(), read)
+		suite.NoError(err)
+		suite.Equal(data{S: "s", I: 1}, v)
+	}
+	suite.Equal(1, loads)
+
+	// nil pointers are cached as nil.
+	p, err := Get(ctx, suite.cacheRepo, "generic:nil", Normal.ToDuration(), func() (*data, error) {
+		return nil, nil
+	})
+	suite.NoError(err)
+	suite.Nil(p)
+
+	loadErr := errors.New("load failed")
+	_, err = Get(ctx, suite.cacheRepo, "generic:err", Normal.ToDuration(), func() (int, error) {
+		return 1, loadErr
+	})
+	suite.ErrorIs(err, loadErr)
+	_, err = Get(ctx, suite.cacheRepo, "generic:err", Normal.ToDuration(), func() (int, error) {
+		return 0, nil
+	}, MemoryOnly())
+	suite.ErrorIs(err, ErrNotFound)
+}
+
+// slowHook delays Redis commands of keys in delays.
+type slowHook struct {
+	delays map[string]time.Duration
+}
+
+func (h *slowHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *slowHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if args := cmd.Args(); len(args) > 1 {
+			if d, ok := h.delays[fmt.Sprint(args[1])]; ok {
+				time.Sleep(d)
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *slowHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (suite *testSuite) TestHedgedReads() {
+	ctx := context.Background()
+	conn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer conn.Close()
+	conn.AddHook(&slowHook{delays: map[string]time.Duration{storeKey("hedge:slow"): 500 * time.Millisecond}})
+	replica := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 10})
+	defer replica.Close()
+	cache, err := NewCache("test", conn, WithRemoteOnly(), WithHedgedReads(replica, 20*time.Millisecond))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	for _, key := range []string{"hedge:fast", "hedge:slow"} {
+		suite.NoError(suite.cacheRepo.Set(ctx, key, "v", Normal.ToDuration()))
+	}
+	var v string
+	suite.NoError(cache.Peek(ctx, "hedge:fast", &v))
+	suite.Equal(int64(0), cache.Stats().HedgedReads)
+
+	startedAt := time.Now()
+	suite.NoError(cache.Peek(ctx, "hedge:slow", &v))
+	suite.Equal("v", v)
+	suite.Less(time.Since(startedAt), 400*time.Millisecond)
+	s := cache.Stats()
+	suite.Equal(int64(1), s.HedgedReads)
+	suite.Equal(int64(1), s.HedgeWins)
+
+	// keys missing on the replica are waited for on the primary.
+	startedAt = time.Now()
+	suite.ErrorIs(cache.Peek(ctx, "hedge:slow:missing", &v), ErrNotFound)
+	suite.NoError(suite.cacheRepo.Invalidate(ctx, "hedge:slow"))
+	suite.ErrorIs(cache.Peek(ctx, "hedge:slow", &v), ErrNotFound)
+	suite.GreaterOrEqual(time.Since(startedAt), 500*time.Millisecond)
+	suite.Equal(int64(2), cache.Stats().HedgedReads)
+}
+
+func (suite *testSuite) TestKeySlot() {
+	// values of CLUSTER KEYSLOT.
+	suite.Equal(12182, keySlot("foo"))
+	suite.Equal(5061, keySlot("bar"))
+	suite.Equal(keySlot("user1000"), keySlot("{user1000}.following"))
+	suite.Equal(keySlot("bar"), keySlot("foo{bar}{zap}"))
+	suite.Equal(crc16("foo{}{bar}")%clusterSlots, uint16(keySlot("foo{}{bar}")))
+	suite.Equal(keySlot("foo"), keySlot(storeKey("foo")))
+
+	keys := []string{storeKey("foo"), storeKey("bar"), "{foo}:other", "{bar}:other"}
+	suite.Equal([][]int{{0, 2}, {1, 3}}, groupBySlot(keys))
+}
+
+func (suite *testSuite) TestTypedCache() {
+	ctx := context.Background()
+	loads := make(map[string]int)
+	users := NewTypedCache(suite.cacheRepo, "typed:user:", Normal.ToDuration(),
+		func(ctx context.Context, id string) (data, error) {
+			loads[id]++
+			return data{S: id, I: loads[id]}, nil
+		})
+	suite.Equal("typed:user:1", users.Key("1"))
+
+	for i := 0; i < 2; i++ {
+		v, err := users.Get(ctx, "1")
+		suite.NoError(err)
+		suite.Equal(data{S: "1", I: 1}, v)
+	}
+	var raw data
+	suite.NoError(suite.cacheRepo.Peek(ctx, "typed:user:1", &raw))
+	suite.Equal(data{S: "1", I: 1}, raw)
+
+	suite.NoError(users.Set(ctx, "2", data{S: "set"}))
+	v, err := users.Get(ctx, "2")
+	suite.NoError(err)
+	suite.Equal(data{S: "set"}, v)
+	suite.Equal(0, loads["2"])
+
+	suite.NoError(users.Invalidate(ctx, "1"))
+	v, err = users.Get(ctx, "1")
+	suite.NoError(err)
+	suite.Equal(data{S: "1", I: 2}, v)
+}
+
+func (suite *testSuite) TestMaintain() {
+	ctx := context.Background()
+	type big struct {
+		S string
+	}
+	value := big{S: strings.Repeat("a", 1024)}
+	for i := 0; i < 6; i++ {
+		suite.NoError(suite.cacheRepo.Set(ctx, fmt.Sprintf("maintain:%d", i), value, time.Minute))
+	}
+	suite.NoError(suite.cacheRepo.Set(ctx, "maintain*other", value, time.Minute))
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithPolicies(
+		Policy{Prefix: "maintain:", NoCompression: true, Jitter: time.Hour}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	// interrupted by the rate limit, then resumed.
+	spec := MaintenanceSpec{
+		Prefix:   "maintain:",
+		Batch:    2,
+		Rate:     10,
+		Rejitter: true,
+		Reencode: func(key string) any { return &big{} },
+	}
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	rst, err := cache.Maintain(tctx, spec)
+	suite.ErrorIs(err, context.DeadlineExceeded)
+	suite.NotZero(rst.Cursor)
+	suite.Less(rst.Updated, int64(6))
+	updated := rst.Updated
+	spec.Cursor, spec.Rate = rst.Cursor, 0
+	rst, err = cache.Maintain(ctx, spec)
+	suite.NoError(err)
+	suite.Zero(rst.Cursor)
+	suite.Equal(int64(6), updated+rst.Updated)
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("maintain:%d", i)
+		ve, err := cache.tryReadFromRedis(ctx, key)
+		suite.Require().NoError(err)
+		suite.Equal(byte(noCompression), ve.ValueBytes[len(ve.ValueBytes)-1])
+		var v big
+		suite.NoError(suite.cacheRepo.Peek(ctx, key, &v))
+		suite.Equal(value, v)
+		ttl, err := suite.redisConn.PTTL(ctx, storeKey(key)).Result()
+		suite.NoError(err)
+		suite.Greater(ttl, time.Minute)
+	}
+	// prefixes are matched literally.
+	ve, err := cache.tryReadFromRedis(ctx, "maintain*other")
+	suite.Require().NoError(err)
+	suite.Equal(byte(s2Compression), ve.ValueBytes[len(ve.ValueBytes)-1])
+}
+
+// jsonCodec is a Codec of encoding/json for tests.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func (suite *testSuite) TestCodec() {
+	ctx := context.Background()
+	mem := freecache.NewCache(1024 * 1024)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithCodec(jsonCodec{}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	expected := data{S: "codec", I: 1}
+	var v data
+	suite.NoError(cache.Get(ctx, "codec", &v, Normal.ToDuration(), func() (any, error) {
+		return expected, nil
+	}, false, false))
+	suite.Equal(expected, v)
+
+	// both the envelope and the value are serialized by the codec.
+	raw, err := suite.redisConn.Get(ctx, storeKey("codec")).Bytes()
+	suite.Require().NoError(err)
+	ve := &ValueBytesExpiredAt{}
+	suite.Require().NoError(json.Unmarshal(raw, ve))
+	suite.Equal(byte(noCompression), ve.ValueBytes[len(ve.ValueBytes)-1])
+	var decoded data
+	suite.NoError(json.Unmarshal(ve.ValueBytes[:len(ve.ValueBytes)-1], &decoded))
+	suite.Equal(expected, decoded)
+
+	// read from Redis and memory by the codec.
+	mem.Clear()
+	for i := 0; i < 2; i++ {
+		v = data{}
+		suite.NoError(cache.Get(ctx, "codec", &v, Normal.ToDuration(), func() (any, error) {
+			suite.Fail("must not read the data source")
+			return nil, nil
+		}, false, false))
+		suite.Equal(expected, v)
+	}
+	v = data{}
+	suite.NoError(cache.Snapshot().Get("codec", &v))
+	suite.Equal(expected, v)
+}
+
+func (suite *testSuite) TestJSONCodec() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithJSONCodec())
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	large := data{S: strings.Repeat("a", 128), I: 1}
+	values := map[string]any{
+		"json:struct": large,
+		"json:string": "text",
+		"json:bytes":  []byte{0xff, 0x00},
+		"json:nil":    nil,
+	}
+	for key, v := range values {
+		suite.NoError(cache.Set(ctx, key, v, Normal.ToDuration()))
+	}
+	// values are readable JSON in Redis, even if large.
+	raw, err := suite.redisConn.Get(ctx, storeKey("json:struct")).Result()
+	suite.Require().NoError(err)
+	suite.Regexp(`^\{"v":\{"S":"a+","I":1\},"e":\d+,"c":\d+(,"sq":\d+)?,"w":\d+\}$`, raw)
+	raw, err = suite.redisConn.Get(ctx, storeKey("json:string")).Result()
+	suite.Require().NoError(err)
+	suite.Regexp(`^\{"s":"text","e":\d+,"c":\d+(,"sq":\d+)?,"w":\d+\}$`, raw)
+	raw, err = suite.redisConn.Get(ctx, storeKey("json:bytes")).Result()
+	suite.Require().NoError(err)
+	suite.Regexp(`^\{"b":"/wA=","e":\d+,"c":\d+(,"sq":\d+)?,"w":\d+\}$`, raw)
+
+	var d data
+	suite.NoError(cache.Peek(ctx, "json:struct", &d))
+	suite.Equal(large, d)
+	var s string
+	suite.NoError(cache.Peek(ctx, "json:string", &s))
+	suite.Equal("text", s)
+	var b []byte
+	suite.NoError(cache.Peek(ctx, "json:bytes", &b))
+	suite.Equal([]byte{0xff, 0x00}, b)
+	p := &data{}
+	suite.NoError(cache.Peek(ctx, "json:nil", &p))
+	suite.Nil(p)
+}
+
+func (suite *testSuite) TestEnvelopeVersion() {
+	ctx := context.Background()
+	flat, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithEnvelopeVersion(EnvelopeFlat))
+	suite.Require().NoError(err)
+	defer flat.Close()
+
+	tagged, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithEnvelopeVersion(EnvelopeTagged))
+	suite.Require().NoError(err)
+	defer tagged.Close()
+
+	expected := data{S: "flat", I: 1}
+	suite.NoError(flat.Set(ctx, "envelope:flat", expected, Normal.ToDuration()))
+	suite.NoError(tagged.Set(ctx, "envelope:tagged", expected, Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo.Set(ctx, "envelope:codec", expected, Normal.ToDuration()))
+	raw, err := suite.redisConn.Get(ctx, storeKey("envelope:flat")).Bytes()
+	suite.Require().NoError(err)
+	suite.Equal([]byte{envelopeMagic, byte(EnvelopeFlat)}, raw[:2])
+	suite.Equal(EnvelopeFlat, envelopeVersionOf(raw))
+	raw, err = suite.redisConn.Get(ctx, storeKey("envelope:tagged")).Bytes()
+	suite.Require().NoError(err)
+	suite.Equal([]byte{envelopeMagic, byte(EnvelopeTagged)}, raw[:2])
+
+	// all versions are read by clients of any version.
+	for _, c := range []*DCache{flat, tagged, suite.cacheRepo} {
+		for _, key := range []string{"envelope:flat", "envelope:tagged", "envelope:codec"} {
+			var v data
+			suite.NoError(c.Peek(ctx, key, &v))
+			suite.Equal(expected, v)
+		}
+	}
+	_, err = flat.decodeEnvelope([]byte{envelopeMagic, 9})
+	suite.ErrorIs(err, ErrBadEnvelope)
+
+	// existing envelopes are migrated by Maintain.
+	rst, err := flat.Maintain(ctx, MaintenanceSpec{Prefix: "envelope:", Reenvelope: true})
+	suite.NoError(err)
+	suite.Equal(int64(2), rst.Updated)
+	raw, err = suite.redisConn.Get(ctx, storeKey("envelope:codec")).Bytes()
+	suite.Require().NoError(err)
+	suite.Equal(EnvelopeFlat, envelopeVersionOf(raw))
+	var v data
+	suite.NoError(suite.cacheRepo.Peek(ctx, "envelope:codec", &v))
+	suite.Equal(expected, v)
+}
+
+func (suite *testSuite) TestCodecCanary() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithCodecCanary(jsonCodec{}, 1))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	suite.NoError(cache.Set(ctx, "canary:struct", data{S: "s", I: 1}, Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "canary:string", "not compared", Normal.ToDuration()))
+	// numbers in maps are decoded as float64 by JSON.
+	suite.NoError(cache.Set(ctx, "canary:map", map[string]any{"n": 1}, Normal.ToDuration()))
+	// infinity is not supported by JSON.
+	type float struct {
+		F float64
+	}
+	suite.NoError(cache.Set(ctx, "canary:inf", float{F: math.Inf(1)}, Normal.ToDuration()))
+
+	s := cache.Stats()
+	suite.Equal(int64(1), s.CodecCanaryMatches)
+	suite.Equal(int64(1), s.CodecCanaryMismatches)
+	suite.Equal(int64(1), s.CodecCanaryErrors)
+	// values are still written by the codec of the client.
+	var v float
+	suite.NoError(suite.cacheRepo.Peek(ctx, "canary:inf", &v))
+	suite.True(math.IsInf(v.F, 1))
+}
+
+func (suite *testSuite) TestProtoCodec() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithCodec(ProtoCodec{}),
+		WithPolicies(Policy{Prefix: "proto:", NoCompression: true}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	msg := wrapperspb.String("proto")
+	suite.NoError(cache.Set(ctx, "proto:msg", msg, Normal.ToDuration()))
+	// values of messages are in their wire format.
+	ve, err := cache.tryReadFromRedis(ctx, "proto:msg")
+	suite.Require().NoError(err)
+	wire, err := proto.Marshal(msg)
+	suite.Require().NoError(err)
+	suite.Equal(append(wire, noCompression), ve.ValueBytes)
+
+	v := &wrapperspb.StringValue{}
+	suite.NoError(cache.Peek(ctx, "proto:msg", v))
+	suite.True(proto.Equal(msg, v))
+	var p *wrapperspb.StringValue
+	suite.NoError(cache.Peek(ctx, "proto:msg", &p))
+	suite.True(proto.Equal(msg, p))
+
+	// nil messages are read as nil.
+	suite.NoError(cache.Set(ctx, "proto:nil", (*wrapperspb.StringValue)(nil), Normal.ToDuration()))
+	suite.NoError(cache.Peek(ctx, "proto:nil", &p))
+	suite.Nil(p)
+
+	// other values fall back to msgpack.
+	suite.NoError(cache.Set(ctx, "proto:struct", data{S: "s"}, Normal.ToDuration()))
+	var d data
+	suite.NoError(suite.cacheRepo.Peek(ctx, "proto:struct", &d))
+	suite.Equal(data{S: "s"}, d)
+}
+
+func (suite *testSuite) TestQuotas() {
+	ctx := context.Background()
+	newCache := func() *DCache {
+		cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithQuotas(
+			Quota{Prefix: "quota:", Budget: 300, Window: time.Minute, Enforce: true},
+			Quota{Prefix: "quota:counted:", Budget: 1},
+		))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1, cache2 := newCache(), newCache()
+	defer cache1.Close()
+	defer cache2.Close()
+
+	value := strings.Repeat("a", 200)
+	suite.NoError(cache1.Set(ctx, "quota:1", value, Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo.Set(ctx, "quota:2", "old", Normal.ToDuration()))
+	suite.ErrorIs(cache1.Set(ctx, "quota:2", value, Normal.ToDuration()), ErrQuotaExceeded)
+	// the previous value is invalidated.
+	var v string
+	suite.ErrorIs(cache1.Peek(ctx, "quota:2", &v), ErrNotFound)
+	// values read from the data source are returned, but not cached.
+	suite.NoError(cache1.Get(ctx, "quota:3", &v, Normal.ToDuration(), func() (any, error) {
+		return value, nil
+	}, false, false))
+	suite.Equal(value, v)
+	suite.ErrorIs(cache1.Peek(ctx, "quota:3", &v), ErrNotFound)
+	// not enforced quotas only count.
+	suite.NoError(cache1.Set(ctx, "quota:counted:1", value, Normal.ToDuration()))
+	suite.NoError(cache1.Set(ctx, "quota:counted:2", value, Normal.ToDuration()))
+	suite.Equal(int64(2), cache1.Stats().QuotaRefused)
+
+	// usage is shared by clients through Redis.
+	suite.NoError(cache2.Set(ctx, "quota:4", "small", Normal.ToDuration()))
+	// both have flushed at least once after the other.
+	time.Sleep(2*quotaFlushInterval + waitTime)
+	suite.ErrorIs(cache2.SetMulti(ctx, map[string]any{"quota:4": value}, Normal.ToDuration()), ErrQuotaExceeded)
+	suite.ErrorIs(cache2.Peek(ctx, "quota:4", &v), ErrNotFound)
+	total, err := suite.redisConn.Get(ctx, quotaKeyPrefix+"test:quota:").Int64()
+	suite.NoError(err)
+	suite.Greater(total, int64(200))
+	ttl, err := suite.redisConn.PTTL(ctx, quotaKeyPrefix+"test:quota:").Result()
+	suite.NoError(err)
+	suite.Greater(ttl, 50*time.Second)
+}
+
+func (suite *testSuite) TestEncryption() {
+	ctx := context.Background()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	_, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithEncryption([]byte("short")))
+	suite.Error(err)
+
+	mem := freecache.NewCache(1024 * 1024)
+	old, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithEncryption(oldKey))
+	suite.Require().NoError(err)
+	defer old.Close()
+	expected := data{S: "secret", I: 1}
+	var v data
+	suite.NoError(old.Get(ctx, "encrypted", &v, Normal.ToDuration(), func() (any, error) {
+		return expected, nil
+	}, false, false))
+	suite.Equal(expected, v)
+
+	// plaintext is neither in Redis nor in memory cache.
+	raw, err := suite.redisConn.Get(ctx, storeKey("encrypted")).Bytes()
+	suite.Require().NoError(err)
+	suite.NotContains(string(raw), "secret")
+	memValue, err := mem.Get([]byte(storeKey("encrypted")))
+	suite.Require().NoError(err)
+	suite.NotContains(string(memValue), "secret")
+	v = data{}
+	suite.NoError(old.Snapshot().Get("encrypted", &v))
+	suite.Equal(expected, v)
+
+	// rotated rings read values of old keys, and write by the new key.
+	rotated, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithEncryption(newKey, oldKey))
+	suite.Require().NoError(err)
+	defer rotated.Close()
+	v = data{}
+	suite.NoError(rotated.Peek(ctx, "encrypted", &v))
+	suite.Equal(expected, v)
+	suite.NoError(rotated.Set(ctx, "encrypted:new", expected, Normal.ToDuration()))
+	suite.ErrorIs(old.Peek(ctx, "encrypted:new", &v), ErrDecrypt)
+	suite.Error(suite.cacheRepo.Peek(ctx, "encrypted", &v))
+
+	// values copied to other keys are not decrypted.
+	suite.NoError(suite.redisConn.Set(ctx, storeKey("encrypted:copied"), raw, Normal.ToDuration()).Err())
+	suite.ErrorIs(rotated.Peek(ctx, "encrypted:copied", &v), ErrDecrypt)
+}
+
+func (suite *testSuite) TestExpiryEvents() {
+	ctx := context.Background()
+	events := make(chan ExpiryEvent, 10)
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithExpiryEvents(func(e ExpiryEvent) {
+		events <- e
+	}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	// wait for the subscription.
+	time.Sleep(waitTime)
+
+	ttl := 200 * time.Millisecond
+	suite.NoError(cache.Set(ctx, "expiry:unread", "v", ttl))
+	suite.NoError(cache.Set(ctx, "expiry:read", "v", ttl))
+	suite.NoError(suite.cacheRepo.Set(ctx, "expiry:other", "v", ttl))
+	var v string
+	suite.NoError(cache.Peek(ctx, "expiry:read", &v))
+	suite.NoError(cache.Get(ctx, "expiry:read", &v, ttl, func() (any, error) {
+		return "fresh", nil
+	}, false, false))
+	suite.Equal("v", v)
+
+	got := make(map[string]ExpiryEvent)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got[e.Key] = e
+		case <-timeout:
+			suite.FailNow("missing expiry events", "%v", got)
+		}
+	}
+	suite.Equal(ExpiryEvent{Key: "expiry:unread", Tracked: true, Unread: true}, got["expiry:unread"])
+	suite.Equal(ExpiryEvent{Key: "expiry:read", Tracked: true}, got["expiry:read"])
+	suite.Equal(ExpiryEvent{Key: "expiry:other"}, got["expiry:other"])
+	stats := cache.Stats()
+	suite.Equal(int64(3), stats.Expired)
+	suite.Equal(int64(1), stats.ExpiredUnread)
+}
+
+func (suite *testSuite) TestNilTarget() {
+	ctx := context.Background()
+	calls := 0
+	read := func() (any, error) {
+		calls++
+		return "v", nil
+	}
+	// nil targets only warm the cache.
+	suite.NoError(suite.cacheRepo.Get(ctx, "nil-target", nil, Normal.ToDuration(), read, false, false))
+	suite.Equal(1, calls)
+	var v string
+	suite.NoError(suite.cacheRepo.Peek(ctx, "nil-target", &v))
+	suite.Equal("v", v)
+	suite.NoError(suite.cacheRepo.Get(ctx, "nil-target", nil, Normal.ToDuration(), read, false, false))
+	suite.Equal(1, calls)
+	suite.NoError(suite.cacheRepo.Peek(ctx, "nil-target", nil))
+	// or check existence.
+	suite.ErrorIs(suite.cacheRepo.Get(ctx, "nil-target-missing", nil, Normal.ToDuration(), read, false, false,
+		MemoryOnly()), ErrNotFound)
+	suite.Equal(1, calls)
+
+	suite.ErrorIs(suite.cacheRepo.Get(ctx, "nil-target", v, Normal.ToDuration(), read, false, false), ErrNotPointer)
+	suite.ErrorIs(suite.cacheRepo.Get(ctx, "nil-target-2", (*string)(nil), Normal.ToDuration(), read, false, false),
+		ErrNotPointer)
+	suite.Equal(1, calls)
+}
+
+type traceIDCtxKey struct{}
+
+func (suite *testSuite) TestLogFields() {
+	var calls atomic.Int32
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithLogFields(
+		func(ctx context.Context) map[string]any {
+			calls.Add(1)
+			return map[string]any{"trace_id": ctx.Value(traceIDCtxKey{})}
+		}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	ctx := context.WithValue(logger.WithContext(context.Background()), traceIDCtxKey{}, "trace-1")
+	var v string
+	errs := cache.GetMulti(ctx, []string{"log-fields"}, []any{&v}, Normal.ToDuration(),
+		func(keys []string) (map[string]any, error) {
+			return nil, errors.New("db down")
+		})
+	suite.Len(errs, 1)
+	suite.Contains(buf.String(), `"trace_id":"trace-1"`)
+	suite.Contains(buf.String(), "Failed to read 1 keys")
+
+	// fields are not extracted for events of disabled levels.
+	calls.Store(0)
+	buf.Reset()
+	ctx = logger.Level(zerolog.InfoLevel).WithContext(ctx)
+	cache.logger(ctx).Debug().Msg("filtered")
+	suite.Zero(calls.Load())
+	suite.Empty(buf.String())
+	cache.logger(ctx).Info().Msg("logged")
+	suite.Equal(int32(1), calls.Load())
+	suite.Contains(buf.String(), `"trace_id":"trace-1"`)
+}
+
+func (suite *testSuite) TestSoftTTL() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithReadInterval(100*time.Millisecond))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	var calls atomic.Int32
+	read := func() (any, error) {
+		n := calls.Add(1)
+		return fmt.Sprintf("v%d", n), nil
+	}
+	var v string
+	suite.NoError(cache.Get(ctx, "swr", &v, Normal.ToDuration(), read, false, false,
+		SoftTTL(200*time.Millisecond)))
+	suite.Equal("v1", v)
+	raw, err := suite.redisConn.Get(ctx, storeKey("swr")).Bytes()
+	suite.Require().NoError(err)
+	ve, err := cache.decodeEnvelope(raw)
+	suite.Require().NoError(err)
+	suite.Greater(ve.SoftExpiredAt, int64(0))
+	suite.Less(ve.SoftExpiredAt, ve.ExpiredAt)
+
+	// fresh values are returned.
+	suite.NoError(cache.Get(ctx, "swr", &v, Normal.ToDuration(), read, false, false,
+		SoftTTL(200*time.Millisecond)))
+	suite.Equal("v1", v)
+	suite.Equal(int32(1), calls.Load())
+
+	// stale values are returned immediately, and refreshed in the background.
+	time.Sleep(300 * time.Millisecond)
+	var rst GetResult
+	suite.NoError(cache.Get(ctx, "swr", &v, Normal.ToDuration(), read, false, false,
+		SoftTTL(200*time.Millisecond), WithResult(&rst)))
+	suite.Equal("v1", v)
+	suite.True(rst.Stale)
+	suite.Eventually(func() bool {
+		return cache.Peek(ctx, "swr", &v) == nil && v == "v2"
+	}, time.Second, 10*time.Millisecond)
+	suite.Equal(int32(2), calls.Load())
+	stats := cache.Stats()
+	suite.Equal(int64(1), stats.StaleHits)
+	suite.Equal(int64(1), stats.Revalidations)
+}
+
+func (suite *testSuite) TestWarmQueue() {
+	ctx := context.Background()
+	var loaded atomic.Int32
+	var badFailed atomic.Bool
+	consumer, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)),
+		WithWarmQueue(100, WarmLoader{
+			Prefix: "warm:",
+			Load: func(ctx context.Context, key string) (any, time.Duration, error) {
+				loaded.Add(1)
+				// warm:bad fails once, then is retried.
+				if key == "warm:bad" && badFailed.CompareAndSwap(false, true) {
+					return nil, 0, errors.New("db down")
+				}
+				return "warmed " + key, Normal.ToDuration(), nil
+			},
+		}))
+	suite.Require().NoError(err)
+	defer consumer.Close()
+
+	// peers drop copies of warmed keys.
+	suite.NoError(suite.cacheRepo.Set(ctx, "warm:1", "old", Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo.RequestWarm(ctx, "warm:1", "warm:bad", "unknown:1"))
+	suite.NoError(suite.redisConn.RPush(ctx, WarmQueueKey("test"), "warm:2").Err())
+	suite.Eventually(func() bool {
+		stats := consumer.Stats()
+		return stats.Warmed == 3 && stats.WarmFailed == 2
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.Equal(int32(4), loaded.Load())
+	suite.Zero(suite.redisConn.LLen(ctx, WarmQueueKey("test")).Val())
+	for _, key := range []string{"warm:1", "warm:2", "warm:bad"} {
+		suite.Eventually(func() bool {
+			var v string
+			return suite.cacheRepo.Peek(ctx, key, &v) == nil && v == "warmed "+key
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+}
+
+func (suite *testSuite) TestXFetch() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithXFetch(10))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	r := 1.0
+	defer func(f func() float64) { xfetchRand = f }(xfetchRand)
+	xfetchRand = func() float64 { return r }
+
+	calls := 0
+	read := func() (any, error) {
+		calls++
+		time.Sleep(20 * time.Millisecond)
+		return fmt.Sprintf("v%d", calls), nil
+	}
+	var v string
+	suite.NoError(cache.Get(ctx, "xfetch", &v, time.Minute, read, false, false))
+	ve, err := cache.tryReadFromRedis(ctx, "xfetch")
+	suite.Require().NoError(err)
+	suite.GreaterOrEqual(ve.ComputeTime, int64(20))
+
+	// far from expiration.
+	suite.NoError(cache.Get(ctx, "xfetch", &v, time.Minute, read, false, false))
+	suite.Equal("v1", v)
+	// 20ms * 10 * -ln(1e-300) is longer than the remaining TTL.
+	r = 1e-300
+	suite.NoError(cache.Get(ctx, "xfetch", &v, time.Minute, read, false, false))
+	suite.Equal("v2", v)
+	suite.Equal(int64(1), cache.Stats().EarlyExpiries)
+	r = 1
+	suite.NoError(cache.Get(ctx, "xfetch", &v, time.Minute, read, false, false))
+	suite.Equal("v2", v)
+	suite.Equal(2, calls)
+
+	// errors of recomputing early serve the value read.
+	r = 1e-300
+	suite.NoError(cache.Get(ctx, "xfetch", &v, time.Minute, func() (any, error) {
+		return nil, errors.New("db down")
+	}, false, false))
+	suite.Equal("v2", v)
+	suite.Equal(int64(2), cache.Stats().EarlyExpiries)
+}
+
+func (suite *testSuite) TestCompute() {
+	ctx := context.Background()
+	calls := 0
+	render := func(ctx context.Context) (string, error) {
+		calls++
+		return fmt.Sprintf("rendered %d", calls), nil
+	}
+	newCache := func(mem *freecache.Cache) *DCache {
+		cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem),
+			WithPolicies(Policy{Prefix: "compute:local:", SkipRemote: true}))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1, cache2 := newCache(suite.inMemCache), newCache(suite.inMemCache2)
+	defer cache1.Close()
+	defer cache2.Close()
+	v, err := Compute(ctx, cache1, "compute:local:1", time.Minute, render)
+	suite.NoError(err)
+	suite.Equal("rendered 1", v)
+	v, err = Compute(ctx, cache1, "compute:local:1", time.Minute, render)
+	suite.NoError(err)
+	suite.Equal("rendered 1", v)
+	suite.Equal(1, calls)
+	// never written to Redis.
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, storeKey("compute:local:1")).Val())
+
+	// invalidated on all clients.
+	v, err = Compute(ctx, cache2, "compute:local:1", time.Minute, render)
+	suite.NoError(err)
+	suite.Equal("rendered 2", v)
+	suite.NoError(cache1.Invalidate(ctx, "compute:local:1"))
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("compute:local:1")))
+		return err == freecache.ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+	v, err = Compute(ctx, cache2, "compute:local:1", time.Minute, render)
+	suite.NoError(err)
+	suite.Equal("rendered 3", v)
+
+	// nor read from or written to Redis by GetMulti, and invalidated by InvalidateMulti.
+	suite.NoError(suite.cacheRepo.Set(ctx, "compute:local:2", "remote", Normal.ToDuration()))
+	readMulti := func(keys []string) (map[string]any, error) {
+		values := make(map[string]any, len(keys))
+		for _, key := range keys {
+			values[key] = "loaded " + key
+		}
+		return values, nil
+	}
+	var s1, s3 string
+	suite.Nil(cache2.GetMulti(ctx, []string{"compute:local:2", "compute:local:3"}, []any{&s1, &s3},
+		time.Minute, readMulti))
+	suite.Equal("loaded compute:local:2", s1)
+	suite.Equal("loaded compute:local:3", s3)
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, storeKey("compute:local:3")).Val())
+	_, err = suite.inMemCache2.Get([]byte(storeKey("compute:local:3")))
+	suite.Require().NoError(err)
+	suite.NoError(cache1.InvalidateMulti(ctx, "compute:local:3"))
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("compute:local:3")))
+		return err == freecache.ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// shared through Redis by default.
+	v, err = Compute(ctx, cache1, "compute:shared", time.Minute, render)
+	suite.NoError(err)
+	suite.Equal("rendered 4", v)
+	v, err = Compute(ctx, cache2, "compute:shared", time.Minute, render)
+	suite.NoError(err)
+	suite.Equal("rendered 4", v)
+}
+
+func (suite *testSuite) TestEntryStats() {
+	ctx := context.Background()
+	_, err := suite.cacheRepo.EntryStats(ctx, "entry")
+	suite.ErrorIs(err, ErrNoEntryStats)
+
+	newCache := func(aggregate bool) *DCache {
+		cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithEntryStats(aggregate))
+		suite.Require().NoError(err)
+		return cache
+	}
+	local, cache1, cache2 := newCache(false), newCache(true), newCache(true)
+	defer local.Close()
+	defer cache1.Close()
+	defer cache2.Close()
+	read := func() (any, error) { return "v", nil }
+	startedAt := getNow()
+	var v string
+	for _, c := range []*DCache{local, cache1, cache2} {
+		suite.NoError(c.Get(ctx, "entry", &v, Normal.ToDuration(), read, false, false))
+		suite.NoError(c.Get(ctx, "entry", &v, Normal.ToDuration(), read, false, false))
+	}
+	stats, err := local.EntryStats(ctx, "entry")
+	suite.NoError(err)
+	// the value was read from the data source by the first client.
+	suite.Equal(int64(1), stats.Refreshes)
+	suite.Equal(int64(1), stats.Hits)
+	suite.False(stats.LastAccess.Before(startedAt))
+
+	// aggregated across clients in Redis, including the part not yet flushed.
+	stats, err = cache1.EntryStats(ctx, "entry")
+	suite.NoError(err)
+	suite.Equal(int64(2), stats.Hits)
+	time.Sleep(entryStatsFlushInterval + waitTime)
+	stats, err = cache1.EntryStats(ctx, "entry")
+	suite.NoError(err)
+	suite.Equal(int64(4), stats.Hits)
+	suite.Equal(int64(0), stats.Refreshes)
+	suite.False(stats.LastAccess.Before(startedAt.Truncate(time.Millisecond)))
+
+	stats, err = cache1.EntryStats(ctx, "unread")
+	suite.NoError(err)
+	suite.Equal(EntryStats{}, stats)
+
+	// beyond maxEntryStatsKeys, the least recently accessed key is evicted once idle.
+	s := newEntryStats()
+	for i := 0; i < maxEntryStatsKeys; i++ {
+		s.observe(fmt.Sprint(i), false)
+	}
+	s.takePending()
+	s.observe("new", false)
+	_, found := s.entries["new"]
+	suite.False(found)
+	s.entries["0"].Value.(*entryCounter).LastAccess = getNow().Add(-entryStatsIdle - time.Second)
+	s.observe("new", false)
+	_, found = s.entries["new"]
+	suite.True(found)
+	_, found = s.entries["0"]
+	suite.False(found)
+	suite.Equal(maxEntryStatsKeys, s.lru.Len())
+}
+
+func (suite *testSuite) TestMaxStaleness() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(suite.inMemCache),
+		WithReadInterval(50*time.Millisecond))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	calls := 0
+	read := func() (any, error) {
+		calls++
+		return fmt.Sprintf("v%d", calls), nil
+	}
+	var v string
+	suite.NoError(cache.Get(ctx, "staleness", &v, time.Minute, read, false, false))
+	suite.Equal("v1", v)
+	suite.NoError(cache.Get(ctx, "staleness", &v, time.Minute, read, false, false, WithMaxStaleness(time.Minute)))
+	suite.Equal("v1", v)
+
+	time.Sleep(150 * time.Millisecond)
+	suite.NoError(cache.Get(ctx, "staleness", &v, time.Minute, read, false, false,
+		WithMaxStaleness(100*time.Millisecond)))
+	suite.Equal("v2", v)
+	// refreshed for all callers.
+	suite.NoError(cache.Get(ctx, "staleness", &v, time.Minute, read, false, false))
+	suite.Equal("v2", v)
+	suite.Equal(2, calls)
+}
+
+func (suite *testSuite) TestLockClient() {
+	ctx := context.Background()
+	lockConn := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 13})
+	defer lockConn.Close()
+	suite.Require().NoError(lockConn.FlushDB(ctx).Err())
+	newCache := func(mem *freecache.Cache) *DCache {
+		cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithLockClient(lockConn),
+			WithInvalidateTopic("lock-client"), WithStats(true))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1, cache2 := newCache(suite.inMemCache), newCache(suite.inMemCache2)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	var v string
+	suite.NoError(cache1.Get(ctx, "locked", &v, Normal.ToDuration(), func() (any, error) {
+		return "v", nil
+	}, false, false))
+	suite.Equal(int64(1), lockConn.Exists(ctx, lockKey("locked")).Val())
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, lockKey("locked")).Val())
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("locked")).Val())
+
+	// invalidations go through the lock client.
+	suite.NoError(cache2.Peek(ctx, "locked", &v))
+	suite.NoError(cache1.Set(ctx, "locked", "new", Normal.ToDuration()))
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("locked")))
+		return err == freecache.ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+
+	stats := cache1.Stats()
+	suite.Require().NotNil(stats.RedisPool)
+	suite.Require().NotNil(stats.LockPool)
+	suite.Greater(stats.LockPool.TotalConns, uint32(0))
+	suite.Nil(suite.cacheRepo.Stats().LockPool)
+
+	// gets of conns are exported as counters of both pools.
+	suite.Require().NotNil(cache1.stats)
+	ch := make(chan prometheus.Metric, 16)
+	cache1.stats.RedisPoolGet.Collect(ch)
+	close(ch)
+	gets := make(map[string]*dto.Metric)
+	for metric := range ch {
+		m := &dto.Metric{}
+		suite.NoError(metric.Write(m))
+		gets[m.GetLabel()[1].GetValue()] = m
+	}
+	suite.Len(gets, 6)
+	suite.Require().Contains(gets, "lock_hits")
+	suite.Require().NotNil(gets["lock_hits"].GetCounter())
+	suite.Greater(gets["hits"].GetCounter().GetValue()+gets["misses"].GetCounter().GetValue(), 0.0)
+}
+
+func (suite *testSuite) TestInvalidateTag() {
+	ctx := context.Background()
+	var v string
+	suite.NoError(suite.cacheRepo.Get(ctx, "tag:a", &v, Normal.ToDuration(), func() (any, error) {
+		return "a", nil
+	}, false, false, WithTags("user:1", "org:9")))
+	suite.NoError(suite.cacheRepo.SetWithTags(ctx, "tag:b", "b", Normal.ToDuration(), "org:9"))
+	suite.NoError(suite.cacheRepo.Set(ctx, "tag:c", "c", Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "tag:b", &v))
+	suite.ElementsMatch([]string{"tag:a", "tag:b"}, suite.redisConn.SMembers(ctx, suite.cacheRepo.tagKey("org:9")).Val())
+	suite.Greater(suite.redisConn.PTTL(ctx, suite.cacheRepo.tagKey("org:9")).Val(), time.Duration(0))
+
+	suite.NoError(suite.cacheRepo.InvalidateTag(ctx, "org:9"))
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, storeKey("tag:a"), storeKey("tag:b"), suite.cacheRepo.tagKey("org:9")).Val())
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("tag:c")).Val())
+	_, err := suite.inMemCache.Get([]byte(storeKey("tag:a")))
+	suite.Equal(freecache.ErrNotFound, err)
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("tag:b")))
+		return err == freecache.ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+	// members of other tags are left.
+	suite.Equal([]string{"tag:a"}, suite.redisConn.SMembers(ctx, suite.cacheRepo.tagKey("user:1")).Val())
+	suite.NoError(suite.cacheRepo.InvalidateTag(ctx, "none"))
+
+	// tags of SetMulti.
+	suite.NoError(suite.cacheRepo.SetMultiWithTags(ctx, map[string]any{"tag:d": "d", "tag:e": "e"},
+		Normal.ToDuration(), "team:2"))
+	suite.ElementsMatch([]string{"tag:d", "tag:e"}, suite.redisConn.SMembers(ctx, suite.cacheRepo.tagKey("team:2")).Val())
+	suite.NoError(suite.cacheRepo.InvalidateTag(ctx, "team:2"))
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, storeKey("tag:d"), storeKey("tag:e")).Val())
+}
+
+func (suite *testSuite) TestInvalidateByPrefix() {
+	ctx := context.Background()
+	var v int
+	for i := 0; i < 250; i++ {
+		suite.NoError(suite.cacheRepo.Set(ctx, fmt.Sprintf("import:%d", i), i, Normal.ToDuration()))
+	}
+	suite.NoError(suite.cacheRepo.Set(ctx, "import*other", 0, Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "import:7", &v))
+
+	suite.NoError(suite.cacheRepo.InvalidateByPrefix(ctx, "import:"))
+	suite.Empty(suite.redisConn.Keys(ctx, storeKey("import:*")).Val())
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("import*other")).Val())
+	_, err := suite.inMemCache.Get([]byte(storeKey("import:0")))
+	suite.Equal(freecache.ErrNotFound, err)
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("import:7")))
+		return err == freecache.ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestWriteReport() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(suite.inMemCache), WithWriteReport("wr:", "wr:x:"))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var v string
+	suite.NoError(cache.Set(ctx, "wr:read", "v", Normal.ToDuration()))
+	suite.NoError(cache.Get(ctx, "wr:read", &v, Normal.ToDuration(), func() (any, error) {
+		return "", errors.New("must not be called")
+	}, false, false))
+	suite.NoError(cache.Get(ctx, "wr:read", &v, Normal.ToDuration(), func() (any, error) {
+		return "", errors.New("must not be called")
+	}, false, false))
+	// overwritten and invalidated unread.
+	suite.NoError(cache.Set(ctx, "wr:x:overwritten", "a", Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "wr:x:overwritten", "b", Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "wr:invalidated", "v", Normal.ToDuration()))
+	suite.NoError(cache.Invalidate(ctx, "wr:invalidated"))
+	suite.NoError(cache.Set(ctx, "other", "v", Normal.ToDuration()))
+
+	stats := cache.Stats().Writes
+	suite.Equal(map[string]WriteStats{
+		"wr:":   {Written: 2, Read: 1, Unread: 1},
+		"wr:x:": {Written: 2, Unread: 1},
+	}, stats)
+	suite.Equal(0.5, stats["wr:"].UnreadRatio())
+
+	// expired unread.
+	suite.NoError(cache.Set(ctx, "wr:expired", "v", time.Second))
+	suite.Eventually(func() bool {
+		return cache.Stats().Writes["wr:"].Unread == 2
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestNamespaces() {
+	ctx := context.Background()
+	newCache := func(mem *freecache.Cache) *DCache {
+		cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithNamespaces("user"),
+			WithInvalidateTopic("namespaces"))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1, cache2 := newCache(suite.inMemCache), newCache(suite.inMemCache2)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	var v string
+	suite.NoError(cache1.Set(ctx, "user:1", "a", Normal.ToDuration()))
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("user:0:1")).Val())
+	suite.NoError(cache2.Peek(ctx, "user:1", &v))
+	suite.Equal("a", v)
+	var loaded []string
+	errs := cache2.GetMulti(ctx, []string{"user:1", "user:2", "other"}, []any{new(string), new(string), new(string)},
+		Normal.ToDuration(), func(keys []string) (map[string]any, error) {
+			loaded = keys
+			return map[string]any{"user:2": "b", "other": "c"}, nil
+		})
+	suite.Nil(errs)
+	suite.Equal([]string{"user:2", "other"}, loaded)
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("user:0:2")).Val())
+
+	suite.NoError(cache1.BumpNamespace(ctx, "user"))
+	suite.Equal("1", suite.redisConn.Get(ctx, cache1.namespaceKey("user")).Val())
+	suite.ErrorIs(cache1.Peek(ctx, "user:1", &v), ErrNotFound)
+	suite.Eventually(func() bool {
+		return cache2.Peek(ctx, "user:2", &v) == ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+	// keys of older epochs are left to expire, and keys of other namespaces are kept.
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("user:0:1")).Val())
+	suite.NoError(cache2.Peek(ctx, "other", &v))
+
+	suite.NoError(cache2.Get(ctx, "user:1", &v, Normal.ToDuration(), func() (any, error) {
+		return "new", nil
+	}, false, false))
+	suite.Equal("new", v)
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("user:1:1")).Val())
+	suite.NoError(cache1.Invalidate(ctx, "user:1"))
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, storeKey("user:1:1")).Val())
+}
+
+func (suite *testSuite) TestSetDetailed() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(suite.inMemCache), WithNoopSetSkip(),
+		WithSetCoalescing("coalesced:", 50*time.Millisecond))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	rst, err := cache.SetDetailed(ctx, "detailed", "v", Normal.ToDuration())
+	suite.NoError(err)
+	suite.Greater(rst.Size, 0)
+	suite.Equal(SetResult{Size: rst.Size, Redis: true, Memory: true, Broadcast: true}, rst)
+	rst, err = cache.SetDetailed(ctx, "detailed", "v", Normal.ToDuration())
+	suite.NoError(err)
+	suite.Equal(SetResult{Size: rst.Size, Skipped: true}, rst)
+	rst, err = cache.SetDetailed(ctx, "coalesced:1", "v", Normal.ToDuration())
+	suite.NoError(err)
+	suite.Equal(SetResult{Size: rst.Size, Memory: true, Deferred: true}, rst)
+
+	remote, err := NewCache("test", suite.redisConn, WithRemoteOnly())
+	suite.Require().NoError(err)
+	defer remote.Close()
+	rst, err = remote.SetDetailed(ctx, "detailed", "w", Normal.ToDuration())
+	suite.NoError(err)
+	suite.Equal(SetResult{Size: rst.Size, Redis: true}, rst)
+}
+
+func (suite *testSuite) TestPrefetch() {
+	ctx := context.Background()
+	var warmed atomic.Int32
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(suite.inMemCache),
+		WithPrefetch(func(key string) []string {
+			if strings.HasPrefix(key, "profile:") {
+				id := strings.TrimPrefix(key, "profile:")
+				return []string{"settings:" + id, "friends:" + id}
+			}
+			return nil
+		}, 2),
+		WithWarmQueue(0, WarmLoader{Prefix: "friends:", Load: func(ctx context.Context, key string) (any, time.Duration, error) {
+			warmed.Add(1)
+			return "friends", Normal.ToDuration(), nil
+		}}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	suite.NoError(suite.cacheRepo2.Set(ctx, "settings:1", "settings", Normal.ToDuration()))
+	var v string
+	suite.NoError(cache.Get(ctx, "profile:1", &v, Normal.ToDuration(), func() (any, error) {
+		return "profile", nil
+	}, false, false))
+	// a miss does not prefetch.
+	suite.Zero(cache.Stats().Prefetches)
+	suite.NoError(cache.Get(ctx, "profile:1", &v, Normal.ToDuration(), func() (any, error) {
+		return "", errors.New("must not be called")
+	}, false, false))
+	suite.Eventually(func() bool {
+		return cache.Stats().Prefetches == 2
+	}, time.Second, 10*time.Millisecond)
+	valueBytes, err := suite.inMemCache.Get([]byte(storeKey("settings:1")))
+	suite.Require().NoError(err)
+	suite.NoError(cache.unmarshal("settings:1", valueBytes, &v))
+	suite.Equal("settings", v)
+	suite.Equal(int32(1), warmed.Load())
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("friends:1")).Val())
+
+	// related keys are keys of callers, namespaced once when prefetched or warmed.
+	var loaded []string
+	var mu sync.Mutex
+	nsCache, err := NewCache("test", suite.redisConn, WithInMemCache(suite.inMemCache2),
+		WithNamespaces("user"),
+		WithPrefetch(func(key string) []string {
+			if key == "user:profile" {
+				return []string{"user:settings", "user:friends"}
+			}
+			return nil
+		}, 2),
+		WithWarmQueue(0, WarmLoader{Prefix: "user:friends", Load: func(ctx context.Context, key string) (any, time.Duration, error) {
+			mu.Lock()
+			loaded = append(loaded, key)
+			mu.Unlock()
+			return "friends", Normal.ToDuration(), nil
+		}}))
+	suite.Require().NoError(err)
+	defer nsCache.Close()
+	suite.NoError(nsCache.Set(ctx, "user:settings", "settings", Normal.ToDuration()))
+	suite.NoError(nsCache.Set(ctx, "user:profile", "profile", Normal.ToDuration()))
+	suite.True(suite.inMemCache2.Del([]byte(storeKey("user:0:settings"))))
+	suite.NoError(nsCache.Get(ctx, "user:profile", &v, Normal.ToDuration(), func() (any, error) {
+		return "", errors.New("must not be called")
+	}, false, false))
+	suite.Eventually(func() bool {
+		return suite.redisConn.Exists(ctx, storeKey("user:0:friends")).Val() == 1
+	}, time.Second, 10*time.Millisecond)
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("user:0:settings")))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	suite.Equal([]string{"user:friends"}, loaded)
+	mu.Unlock()
+}
+
+func (suite *testSuite) TestFlush() {
+	ctx := context.Background()
+	var v string
+	for i := 0; i < 150; i++ {
+		suite.NoError(suite.cacheRepo.Set(ctx, fmt.Sprintf("flush:%d", i), "v", Normal.ToDuration()))
+	}
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "flush:1", &v))
+	suite.NoError(suite.redisConn.Set(ctx, "unowned", "v", 0).Err())
+
+	suite.NoError(suite.cacheRepo.Flush(ctx))
+	suite.Empty(suite.redisConn.Keys(ctx, storeKey("*")).Val())
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, "unowned").Val())
+	suite.Zero(suite.inMemCache.EntryCount())
+	suite.Eventually(func() bool {
+		return suite.inMemCache2.EntryCount() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.ErrorIs(suite.cacheRepo2.Peek(ctx, "flush:1", &v), ErrNotFound)
+}
+
+func (suite *testSuite) TestCapacityAdvisor() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(suite.inMemCache), WithCapacityAdvisor(0.5, 0))
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	value := strings.Repeat("a", 1000)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			var v string
+			suite.NoError(cache.Get(ctx, fmt.Sprintf("advised:%d", i), &v, Normal.ToDuration(), func() (any, error) {
+				return value, nil
+			}, false, false))
+		}
+	}
+	// 10 values of about 1KB read in cycles hit in caches of 16KB, but first reads.
+	suite.Equal(&CapacityAdvice{TargetHitRatio: 0.5, Bytes: 16 << 10, MaxHitRatio: 0.8, Samples: 50},
+		cache.Stats().CapacityAdvice)
+	suite.Nil(suite.cacheRepo.Stats().CapacityAdvice)
+
+	// distances are kept across renumbering of access times.
+	a := newCapacityAdvisor(0.5, 1)
+	for n := 0; n < 2*maxCapacityClock; n++ {
+		a.observe(fmt.Sprintf("advised:%d", n%10), 1000)
+	}
+	advice := a.advice()
+	suite.Equal(int64(16<<10), advice.Bytes)
+	suite.Equal(int64(2*maxCapacityClock-10), a.hits[bits.Len64((10*(1000+freecacheEntryOverhead))>>minCapacityShift)])
+}
+
+func (suite *testSuite) TestKeyPrefix() {
+	ctx := context.Background()
+	_, err := NewCache("test", suite.redisConn, WithKeyPrefix("@app"))
+	suite.ErrorIs(err, ErrInvalidKeyPrefix)
+
+	newCache := func(prefix string, mem *freecache.Cache) *DCache {
+		cache, err := NewCache(prefix, suite.redisConn, WithInMemCache(mem), WithKeyPrefix(prefix))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cacheA, cacheB := newCache("a", suite.inMemCache), newCache("b", suite.inMemCache2)
+	defer cacheA.Close()
+	defer cacheB.Close()
+
+	var v string
+	suite.NoError(cacheA.Get(ctx, "shared", &v, Normal.ToDuration(), func() (any, error) {
+		return "a", nil
+	}, false, false))
+	suite.NoError(cacheB.Get(ctx, "shared", &v, Normal.ToDuration(), func() (any, error) {
+		return "b", nil
+	}, false, false))
+	suite.Equal("b", v)
+	suite.ElementsMatch([]string{"a:{shared}", ":a:{shared}_LOCK", "b:{shared}", ":b:{shared}_LOCK"},
+		suite.redisConn.Keys(ctx, "*").Val())
+	suite.Equal(int64(1), cacheA.Snapshot().Len())
+
+	// invalidations of one prefix do not touch keys of the other.
+	suite.NoError(cacheA.Invalidate(ctx, "shared"))
+	suite.NoError(cacheA.Set(ctx, "shared", "a2", Normal.ToDuration()))
+	time.Sleep(1500 * time.Millisecond)
+	suite.NoError(cacheB.Peek(ctx, "shared", &v))
+	suite.Equal("b", v)
+	_, err = suite.inMemCache2.Get([]byte("b:{shared}"))
+	suite.NoError(err)
+}
+
+func (suite *testSuite) TestInvalidateTopicPerApp() {
+	ctx := context.Background()
+	suite.Equal("CacheInvalidatePubSub:test", suite.cacheRepo.opts.invalidateTopic)
+	mem := freecache.NewCache(1024 * 1024)
+	other, err := NewCache("other", suite.redisConn, WithInMemCache(mem))
+	suite.Require().NoError(err)
+	defer other.Close()
+
+	var v string
+	suite.NoError(suite.cacheRepo.Set(ctx, "shared", "v", Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "shared", &v))
+	suite.NoError(other.Peek(ctx, "shared", &v))
+	suite.NoError(suite.cacheRepo.Invalidate(ctx, "shared"))
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("shared")))
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	// invalidations of app "test" are not broadcast to app "other".
+	_, err = mem.Get([]byte(storeKey("shared")))
+	suite.NoError(err)
+}
+
+func (suite *testSuite) TestValidate() {
+	ctx := context.Background()
+	levels := func(findings []Finding) map[string]FindingLevel {
+		rv := make(map[string]FindingLevel)
+		for _, f := range findings {
+			rv[f.Check] = f.Level
+		}
+		return rv
+	}
+	findings, err := suite.cacheRepo.Validate(ctx)
+	suite.NoError(err)
+	suite.Equal(map[string]FindingLevel{
+		CheckRedis:     FindingOK,
+		CheckPubSub:    FindingOK,
+		CheckClockSkew: FindingOK,
+		CheckMemCache:  FindingOK,
+	}, levels(findings))
+
+	// values of 4KB do not fit in memory cache of 1MB.
+	findings, err = suite.cacheRepo2.Validate(ctx)
+	suite.NoError(err)
+	suite.Equal(FindingWarning, levels(findings)[CheckMemCache])
+	suite.Equal(ErrEntryTooLarge, FreecacheLocal(suite.inMemCache2).Set([]byte("large"), make([]byte, 4<<10), 1))
+
+	unreachable := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer unreachable.Close()
+	_, err = NewCache("test", unreachable, WithRemoteOnly(), WithStartupValidation(time.Second))
+	suite.ErrorIs(err, ErrValidationFailed)
+}
+
+func (suite *testSuite) TestServerTimeExpiry() {
+	ctx := context.Background()
+	// written by a writer of a clock a minute ahead, with 10 seconds left in Redis.
+	valueBytes, err := suite.cacheRepo.marshal(context.Background(), "skewed", "v")
+	suite.Require().NoError(err)
+	veBytes, err := suite.cacheRepo.encodeEnvelope(&ValueBytesExpiredAt{
+		ValueBytes: valueBytes,
+		ExpiredAt:  time.Now().Add(-time.Minute).UnixMilli(),
+	})
+	suite.Require().NoError(err)
+	suite.NoError(suite.redisConn.Set(ctx, storeKey("skewed"), veBytes, 10*time.Second).Err())
+	suite.NoError(suite.redisConn.Set(ctx, storeKey("skewed:multi"), veBytes, 10*time.Second).Err())
+
+	var v string
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "skewed", &v))
+	_, err = suite.inMemCache2.Get([]byte(storeKey("skewed")))
+	suite.ErrorIs(err, freecache.ErrNotFound)
+
+	mem := freecache.NewCache(1024 * 1024)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithServerTimeExpiry())
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.NoError(cache.Peek(ctx, "skewed", &v))
+	suite.Equal("v", v)
+	ttl, err := mem.TTL([]byte(storeKey("skewed")))
+	suite.NoError(err)
+	suite.Equal(uint32(defaultMemCacheMaxTTLSeconds), ttl)
+
+	ves := cache.readMultiFromRedis(ctx, []string{"skewed:multi", "absent"})
+	suite.Nil(ves[1])
+	suite.InDelta(time.Now().Add(10*time.Second).UnixMilli(), ves[0].ExpiredAt, 1000)
+}
+
+func (suite *testSuite) TestStreamInvalidation() {
+	ctx := context.Background()
+	newCache := func(mem *freecache.Cache) *DCache {
+		cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem),
+			WithStreamInvalidation(StreamRetention{MaxLen: 3}))
+		suite.Require().NoError(err)
+		return cache
+	}
+	memA, memB := freecache.NewCache(1024*1024), freecache.NewCache(1024*1024)
+	cacheA, cacheB := newCache(memA), newCache(memB)
+	defer cacheA.Close()
+	cached := func(mem *freecache.Cache, key string) bool {
+		_, err := mem.Get([]byte(storeKey(key)))
+		return err == nil
+	}
+
+	var v string
+	suite.NoError(cacheA.Set(ctx, "streamed", "v", Normal.ToDuration()))
+	suite.NoError(cacheB.Peek(ctx, "streamed", &v))
+	suite.True(cached(memB, "streamed"))
+	suite.NoError(cacheA.Invalidate(ctx, "streamed"))
+	suite.Eventually(func() bool {
+		return !cached(memB, "streamed")
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.Positive(cacheB.Stats().StreamLag)
+
+	// groups that missed messages trimmed are removed, and their clients clear memory cache.
+	suite.NoError(cacheA.Set(ctx, "streamed", "v", Normal.ToDuration()))
+	suite.NoError(cacheB.Peek(ctx, "streamed", &v))
+	key := cacheA.streamKey()
+	suite.NoError(suite.redisConn.XGroupCreate(ctx, key, "gone", "0-0").Err())
+	for i := 0; i < 5; i++ {
+		cacheA.publish(ctx, []pubMsg{{payload: []byte(cacheA.ID() + delimiter + storeKey("other"))}})
+	}
+	suite.NoError(suite.redisConn.XGroupDestroy(ctx, key, cacheB.ID()).Err())
+	suite.NoError(cacheA.trimStream(ctx))
+	groups, err := suite.redisConn.XInfoGroups(ctx, key).Result()
+	suite.NoError(err)
+	for _, g := range groups {
+		suite.NotEqual("gone", g.Name)
+	}
+	suite.Eventually(func() bool {
+		return !cached(memB, "streamed") && cacheB.Stats().StreamGaps == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cacheB.Close()
+	groups, err = suite.redisConn.XInfoGroups(ctx, key).Result()
+	suite.NoError(err)
+	suite.Len(groups, 1)
+	suite.Equal(cacheA.ID(), groups[0].Name)
+}
+
+func (suite *testSuite) TestServerTracking() {
+	ctx := context.Background()
+	mem := freecache.NewCache(1024 * 1024)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithServerTracking())
+	suite.Require().NoError(err)
+	defer cache.Close()
+
+	var v string
+	suite.NoError(suite.cacheRepo.Set(ctx, "tracked", "v", Normal.ToDuration()))
+	suite.NoError(cache.Peek(ctx, "tracked", &v))
+	_, err = mem.Get([]byte(storeKey("tracked")))
+	suite.NoError(err)
+	// changed by a tool not using dcache.
+	suite.NoError(suite.redisConn.Del(ctx, storeKey("tracked")).Err())
+	suite.Eventually(func() bool {
+		_, err := mem.Get([]byte(storeKey("tracked")))
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	_, err = NewCache("test", redis.NewClusterClient(&redis.ClusterOptions{}), WithServerTracking())
+	suite.ErrorIs(err, ErrClusterUnsupported)
+
+	// tracking is enabled on the server of values, by RESP2 pubsub.
+	lockClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer lockClient.Close()
+	cache2, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)),
+		WithServerTracking(), WithLockClient(lockClient))
+	suite.Require().NoError(err)
+	defer cache2.Close()
+	suite.Equal(suite.redisConn.(*redis.Client).Options().Addr, cache2.tracking.Options().Addr)
+	suite.Equal(2, cache2.tracking.Options().Protocol)
+}
+
+func (suite *testSuite) TestValueCodec() {
+	ctx := context.Background()
+	readRaw := func(key string) []byte {
+		b, err := suite.redisConn.Get(ctx, storeKey(key)).Bytes()
+		suite.Require().NoError(err)
+		ve, err := suite.cacheRepo.decodeEnvelope(b)
+		suite.Require().NoError(err)
+		return ve.ValueBytes
+	}
+	want := &data{S: "s", I: 1}
+
+	// per call, read by peers of the default codec.
+	var v *data
+	suite.NoError(suite.cacheRepo.Get(ctx, "codec:call", &v, Normal.ToDuration(), func() (any, error) {
+		return want, nil
+	}, false, false, WithValueCodec(JSONCodec{})))
+	suite.Equal(want, v)
+	suite.Contains(string(readRaw("codec:call")), `{"S":"s","I":1}`)
+	v = nil
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "codec:call", &v))
+	suite.Equal(want, v)
+	// memory cache.
+	v = nil
+	suite.NoError(suite.cacheRepo.Peek(ctx, "codec:call", &v))
+	suite.Equal(want, v)
+
+	// by prefix.
+	mem := freecache.NewCache(1024 * 1024)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem),
+		WithPolicies(Policy{Prefix: "ext:", Codec: JSONCodec{}}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.NoError(cache.Set(ctx, "ext:1", want, Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "int:1", want, Normal.ToDuration()))
+	suite.Contains(string(readRaw("ext:1")), `{"S":"s","I":1}`)
+	suite.NotContains(string(readRaw("int:1")), `{"S":"s","I":1}`)
+	v = nil
+	suite.NoError(suite.cacheRepo.Peek(ctx, "ext:1", &v))
+	suite.Equal(want, v)
+
+	// codecs not known.
+	suite.NoError(suite.cacheRepo.SetWithCodec(ctx, "codec:custom", want, Normal.ToDuration(), jsonCodec{}))
+	suite.ErrorIs(cache.Peek(ctx, "codec:custom", &v), ErrUnknownCodec)
+	known, err := NewCache("test", suite.redisConn, WithKnownCodecs(jsonCodec{}))
+	suite.Require().NoError(err)
+	defer known.Close()
+	v = nil
+	suite.NoError(known.Peek(ctx, "codec:custom", &v))
+	suite.Equal(want, v)
+}
+
+func (suite *testSuite) TestBackgroundRefresh() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithRemoteOnly(), WithReadInterval(100*time.Millisecond),
+		WithBackgroundRefresh(BackgroundRefresh{Timeout: 100 * time.Millisecond, Concurrency: 1, QueueSize: 1}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	soft := SoftTTL(100 * time.Millisecond)
+	var v string
+	for _, key := range []string{"bg:a", "bg:b", "bg:c"} {
+		suite.NoError(cache.Get(ctx, key, &v, Normal.ToDuration(), func() (any, error) {
+			return "v1", nil
+		}, false, false, soft))
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	release := make(chan struct{})
+	slow := func() (any, error) {
+		<-release
+		return "v2", nil
+	}
+	fast := func() (any, error) {
+		return "v2", nil
+	}
+	// a runs and blocks the only worker, b is queued, and c is dropped.
+	suite.NoError(cache.Get(ctx, "bg:a", &v, Normal.ToDuration(), slow, false, false, soft))
+	suite.Eventually(func() bool {
+		return cache.Stats().Revalidations == 1
+	}, time.Second, 10*time.Millisecond)
+	suite.NoError(cache.Get(ctx, "bg:b", &v, Normal.ToDuration(), fast, false, false, soft))
+	suite.NoError(cache.Get(ctx, "bg:c", &v, Normal.ToDuration(), fast, false, false, soft))
+	suite.Equal("v1", v)
+	stats := cache.Stats()
+	suite.Equal(1, stats.RevalidationQueue)
+	suite.Equal(int64(1), stats.RevalidationsDropped)
+
+	// the value of a read past the deadline is not written.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	suite.Eventually(func() bool {
+		return cache.Peek(ctx, "bg:b", &v) == nil && v == "v2"
+	}, time.Second, 10*time.Millisecond)
+	suite.NoError(cache.Peek(ctx, "bg:a", &v))
+	suite.Equal("v1", v)
+	suite.NoError(cache.Peek(ctx, "bg:c", &v))
+	suite.Equal("v1", v)
+	stats = cache.Stats()
+	suite.Equal(int64(1), stats.RevalidationsFailed)
+	suite.Equal(0, stats.RevalidationQueue)
+}
+
+func (suite *testSuite) TestKeyspaceEviction() {
+	ctx := context.Background()
+	mem := freecache.NewCache(1024 * 1024)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(mem), WithKeyspaceEviction())
+	suite.Require().NoError(err)
+	defer cache.Close()
+	// wait for the subscription.
+	time.Sleep(waitTime)
+
+	suite.NoError(cache.Set(ctx, "ks:del", "v", Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "ks:expired", "v", Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "ks:kept", "v", Normal.ToDuration()))
+	var v string
+	for _, key := range []string{"ks:del", "ks:expired", "ks:kept"} {
+		suite.Require().NoError(cache.Peek(ctx, key, &v))
+		_, err := mem.Get([]byte(storeKey(key)))
+		suite.Require().NoError(err)
+	}
+	// deleted or expired by other tools.
+	suite.NoError(suite.redisConn.Del(ctx, storeKey("ks:del")).Err())
+	suite.NoError(suite.redisConn.PExpire(ctx, storeKey("ks:expired"), 100*time.Millisecond).Err())
+	suite.Eventually(func() bool {
+		_, err := mem.Get([]byte(storeKey("ks:del")))
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.Eventually(func() bool {
+		_, err := mem.Get([]byte(storeKey("ks:expired")))
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = mem.Get([]byte(storeKey("ks:kept")))
+	suite.NoError(err)
+}
+
+func (suite *testSuite) TestCloseFlushesInvalidations() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)))
+	suite.Require().NoError(err)
+	var v string
+	suite.NoError(suite.cacheRepo.Set(ctx, "close:flush", "v", Normal.ToDuration()))
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "close:flush", &v))
+	_, err = suite.inMemCache2.Get([]byte(storeKey("close:flush")))
+	suite.Require().NoError(err)
+
+	// batched, and sent by Close before the next tick.
+	suite.NoError(cache.Invalidate(ctx, "close:flush"))
+	cache.Close()
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("close:flush")))
+		return err != nil
+	}, 500*time.Millisecond, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestEphemeralKeys() {
+	ctx := context.Background()
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)))
+	suite.Require().NoError(err)
+	suite.NoError(cache.SetEphemeral(ctx, "ephemeral:presence", "up", Normal.ToDuration()))
+	suite.NoError(cache.Set(ctx, "ephemeral:released", "v", Normal.ToDuration()))
+	cache.MarkEphemeral("ephemeral:released")
+	cache.UnmarkEphemeral("ephemeral:released")
+	var v string
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "ephemeral:presence", &v))
+	suite.Equal("up", v)
+
+	cache.Close()
+	suite.Equal(int64(0), suite.redisConn.Exists(ctx, storeKey("ephemeral:presence")).Val())
+	suite.Equal(int64(1), suite.redisConn.Exists(ctx, storeKey("ephemeral:released")).Val())
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("ephemeral:presence")))
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestInvalidateBacklog() {
+	ctx := context.Background()
+	inMem := func(key string) bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey(key)))
+		return err == nil
+	}
+	keys := []string{"backlog:1", "backlog:2", "backlog:3", "backlog:4"}
+	var v string
+	load := func() {
+		for _, key := range append(keys, "backlog:other") {
+			suite.NoError(suite.cacheRepo.Set(ctx, key, "v", Normal.ToDuration()))
+			suite.NoError(suite.cacheRepo2.Peek(ctx, key, &v))
+			suite.Require().True(inMem(key))
+		}
+	}
+
+	// published once overflowed.
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)),
+		WithInvalidateBacklog(3, OverflowFlush))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	load()
+	suite.NoError(cache.InvalidateMulti(ctx, keys[:3]...))
+	suite.Equal(3, cache.Stats().InvalidateBacklog)
+	suite.NoError(cache.Invalidate(ctx, keys[3]))
+	suite.Eventually(func() bool {
+		stats := cache.Stats()
+		return stats.InvalidateBacklog == 0 && stats.InvalidateOverflows == 1
+	}, time.Second, 10*time.Millisecond)
+	suite.Eventually(func() bool {
+		return !inMem(keys[0]) && !inMem(keys[3])
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.True(inMem("backlog:other"))
+
+	// memory caches of peers are flushed instead.
+	flushAll, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)),
+		WithInvalidateBacklog(3, OverflowFlushAll))
+	suite.Require().NoError(err)
+	defer flushAll.Close()
+	load()
+	suite.NoError(flushAll.InvalidateMulti(ctx, keys...))
+	suite.Eventually(func() bool {
+		return flushAll.Stats().InvalidateOverflows == 1
+	}, time.Second, 10*time.Millisecond)
+	suite.Eventually(func() bool {
+		return !inMem("backlog:other")
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestFlushOrdering() {
+	ctx := context.Background()
+	key := "flush:ordering"
+	// memory cache is flushed between the Redis write and the memory update of a read.
+	var cache *DCache
+	var armed atomic.Bool
+	armed.Store(true)
+	cache, err := NewDCache("test", suite.redisConn, suite.inMemCache, time.Second, true, true,
+		withSetKeyHook(func(k string) {
+			if k == key && armed.Load() {
+				cache.flushLocal()
+			}
+		}))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	var v string
+	suite.NoError(cache.Get(ctx, key, &v, Normal.ToDuration(), func() (any, error) {
+		return "v", nil
+	}, false, false))
+	_, err = suite.inMemCache.Get([]byte(storeKey(key)))
+	suite.Equal(freecache.ErrNotFound, err)
+
+	// reads started after the flush are cached.
+	armed.Store(false)
+	suite.NoError(cache.Peek(ctx, key, &v))
+	_, err = suite.inMemCache.Get([]byte(storeKey(key)))
+	suite.NoError(err)
+}
+
+// TestInvalidationOrderingStress races writes, reads and invalidations of a few keys on two
+// clients, then checks that no memory cache is left with a value other than the one in Redis.
+// Run with -race to check the locking, e.g., go test -race -run 'Test.*/TestInvalidationOrderingStress'.
+func (suite *testSuite) TestInvalidationOrderingStress() {
+	if testing.Short() {
+		suite.T().Skip("stress test")
+	}
+	ctx := context.Background()
+	keys := []string{"stress:0", "stress:1", "stress:2", "stress:3"}
+	clients := []*DCache{suite.cacheRepo, suite.cacheRepo2}
+	var wg sync.WaitGroup
+	var n atomic.Int64
+	deadline := time.Now().Add(time.Second)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for time.Now().Before(deadline) {
+				c := clients[r.Intn(len(clients))]
+				key := keys[r.Intn(len(keys))]
+				var v int64
+				switch op := r.Intn(10); {
+				case op < 4:
+					suite.NoError(c.Set(ctx, key, n.Add(1), Normal.ToDuration()))
+				case op < 5:
+					suite.NoError(c.Invalidate(ctx, key))
+				case op < 6:
+					c.flushLocal()
+				default:
+					suite.NoError(c.Get(ctx, key, &v, Normal.ToDuration(), func() (any, error) {
+						return n.Add(1), nil
+					}, false, false))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// once invalidations are delivered, memory caches hold either nothing or values in Redis.
+	mems := []*freecache.Cache{suite.inMemCache, suite.inMemCache2}
+	suite.Eventually(func() bool {
+		for _, key := range keys {
+			var redisValue []byte
+			if ve, err := suite.cacheRepo.tryReadFromRedis(ctx, key); err == nil {
+				redisValue = ve.ValueBytes
+			}
+			for _, mem := range mems {
+				if b, err := mem.Get([]byte(storeKey(key))); err == nil && !bytes.Equal(b, redisValue) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func (suite *testSuite) TestMaxInvalidatePayload() {
+	ctx := context.Background()
+	pubsub := suite.redisConn.Subscribe(ctx, suite.cacheRepo.opts.invalidateTopic)
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	suite.Require().NoError(err)
+	cache, err := NewCache("test", suite.redisConn, WithInMemCache(freecache.NewCache(1024*1024)),
+		WithMaxInvalidatePayload(200))
+	suite.Require().NoError(err)
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("payload:%s:%d", strings.Repeat("k", 40), i)
+		keys = append(keys, key)
+		suite.NoError(cache.Set(ctx, key, "v", Normal.ToDuration()))
+	}
+	long := "payload:" + strings.Repeat("l", 300)
+	suite.NoError(cache.Set(ctx, long, "v", Normal.ToDuration()))
+	// pending invalidations are sent by Close.
+	cache.Close()
+
+	received := make(map[string]bool)
+	for len(received) < len(keys)+1 {
+		msg, err := pubsub.ReceiveTimeout(ctx, 3*time.Second)
+		suite.Require().NoError(err)
+		m, err := parseInvalidateMessage(msg.(*redis.Message).Payload)
+		suite.Require().NoError(err)
+		suite.Equal(cache.id, m.Origin)
+		if len(m.Keys) > 1 {
+			suite.LessOrEqual(len(msg.(*redis.Message).Payload), 200)
+		}
+		for _, key := range m.Keys {
+			received[key] = true
+		}
+	}
+	for _, key := range append(keys, long) {
+		suite.True(received[storeKey(key)], key)
+	}
+}
+
+// noRangeLocal is a LocalCache not implementing LocalCacheRanger.
+type noRangeLocal struct {
+	LocalCache
+}
+
+func (suite *testSuite) TestPubSubResync() {
+	ctx := context.Background()
+	memA, memB, memC := freecache.NewCache(1024*1024), freecache.NewCache(1024*1024), freecache.NewCache(1024*1024)
+	flushed, err := NewCache("test", suite.redisConn, WithInMemCache(memA))
+	suite.Require().NoError(err)
+	defer flushed.Close()
+	reconciled, err := NewCache("test", suite.redisConn, WithInMemCache(memB), WithPubSubResync(ResyncReconcile))
+	suite.Require().NoError(err)
+	defer reconciled.Close()
+	// memory caches not iterating entries are cleared instead.
+	unranged, err := NewCache("test", suite.redisConn, WithLocalCache(noRangeLocal{FreecacheLocal(memC)}),
+		WithPubSubResync(ResyncReconcile))
+	suite.Require().NoError(err)
+	defer unranged.Close()
+	// wait for the subscriptions.
+	time.Sleep(waitTime)
+
+	var v string
+	for _, key := range []string{"resync:changed", "resync:kept"} {
+		suite.NoError(suite.cacheRepo.Set(ctx, key, "v1", Normal.ToDuration()))
+		suite.NoError(flushed.Peek(ctx, key, &v))
+		suite.NoError(reconciled.Peek(ctx, key, &v))
+		suite.NoError(unranged.Peek(ctx, key, &v))
+	}
+	// changed while invalidations are lost.
+	veBytes, err := suite.cacheRepo.encodeEnvelope(&ValueBytesExpiredAt{
+		ValueBytes: []byte("v2"),
+		ExpiredAt:  getNow().Add(Normal.ToDuration()).UnixMilli(),
+	})
+	suite.Require().NoError(err)
+	suite.NoError(suite.redisConn.Set(ctx, storeKey("resync:changed"), veBytes, Normal.ToDuration()).Err())
+	suite.NoError(suite.redisConn.Do(ctx, "client", "kill", "type", "pubsub").Err())
+
+	inMem := func(mem *freecache.Cache, key string) bool {
+		_, err := mem.Get([]byte(storeKey(key)))
+		return err == nil
+	}
+	suite.Eventually(func() bool {
+		return flushed.Stats().PubSubReconnects > 0 && reconciled.Stats().PubSubReconnects > 0 &&
+			unranged.Stats().PubSubReconnects > 0
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.Eventually(func() bool {
+		return !inMem(memA, "resync:changed") && !inMem(memA, "resync:kept") && !inMem(memB, "resync:changed") &&
+			!inMem(memC, "resync:changed") && !inMem(memC, "resync:kept")
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.True(inMem(memB, "resync:kept"))
+	suite.NoError(reconciled.Peek(ctx, "resync:changed", &v))
+	suite.Equal("v2", v)
+}
+
+func (suite *testSuite) TestInvalidationStamps() {
+	ctx := context.Background()
+	pubsub := suite.redisConn.Subscribe(ctx, suite.cacheRepo.opts.invalidateTopic)
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	suite.Require().NoError(err)
+	waitInvalidation := func(key string) {
+		for {
+			msg, err := pubsub.ReceiveTimeout(ctx, 3*time.Second)
+			suite.Require().NoError(err)
+			m, err := parseInvalidateMessage(msg.(*redis.Message).Payload)
+			suite.Require().NoError(err)
+			for i, k := range m.Keys {
+				if k == storeKey(key) {
+					suite.Require().NotNil(m.Stamps)
+					suite.Positive(m.Stamps[i].at)
+					return
+				}
+			}
+		}
+	}
+
+	var v string
+	suite.NoError(suite.cacheRepo.Set(ctx, "stamp:key", "v1", Normal.ToDuration()))
+	// read by the peer before the invalidation of the write arrives.
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "stamp:key", &v))
+	suite.Equal("v1", v)
+	waitInvalidation("stamp:key")
+	time.Sleep(100 * time.Millisecond)
+	_, err = suite.inMemCache2.Get([]byte(storeKey("stamp:key")))
+	suite.NoError(err, "value as new as the invalidation must be kept")
+
+	suite.NoError(suite.cacheRepo.Set(ctx, "stamp:key", "v2", Normal.ToDuration()))
+	waitInvalidation("stamp:key")
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("stamp:key")))
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	suite.NoError(suite.cacheRepo2.Peek(ctx, "stamp:key", &v))
+	suite.Equal("v2", v)
+
+	// deletes are not stamped, and always evict.
+	suite.NoError(suite.cacheRepo.Invalidate(ctx, "stamp:key"))
+	suite.Eventually(func() bool {
+		_, err := suite.inMemCache2.Get([]byte(storeKey("stamp:key")))
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// stamps of the same millisecond of other writers are not the same write.
+	stamps := newEntryStamps()
+	stamps.record("k", valueStamp{at: 100, seq: 1}, writerOf("pod-1"))
+	suite.True(stamps.covers("k", valueStamp{at: 100, seq: 1}, writerOf("pod-1")))
+	suite.False(stamps.covers("k", valueStamp{at: 100, seq: 1}, writerOf("pod-2")))
+	suite.False(stamps.covers("k", valueStamp{at: 100, seq: 1}, 0))
+	// nor are later writes of the same writer in the same millisecond.
+	suite.True(stamps.covers("k", valueStamp{at: 100}, writerOf("pod-1")))
+	suite.False(stamps.covers("k", valueStamp{at: 100, seq: 2}, writerOf("pod-1")))
+	stamps.record("k", valueStamp{at: 100}, 0)
+	suite.False(stamps.covers("k", valueStamp{at: 100}, 0))
+}
+
+func (suite *testSuite) TestStampsFollowClock() {
+	// writes beyond 1000 per millisecond are told apart by Seq, not by running ahead of
+	// the clock.
+	stamps := newEntryStamps()
+	now := getNow()
+	var last valueStamp
+	for i := 0; i < 5000; i++ {
+		stamp := stamps.next(now)
+		suite.Equal(now.UnixMilli(), stamp.at)
+		if i > 0 {
+			suite.Greater(stamp.seq, last.seq)
+		}
+		last = stamp
+	}
+	suite.Equal(valueStamp{at: now.UnixMilli() + 1}, stamps.next(now.Add(time.Millisecond)))
+
+	ctx := context.Background()
+	for i := 0; i < 2000; i++ {
+		suite.NoError(suite.cacheRepo.Set(ctx, "stamp:clock", i, Normal.ToDuration()))
+	}
+	ve, err := suite.cacheRepo.tryReadFromRedis(ctx, "stamp:clock")
+	suite.Require().NoError(err)
+	suite.LessOrEqual(ve.CreatedAt, getNow().UnixMilli())
+	suite.InDelta(getNow().UnixMilli(), ve.CreatedAt, float64(time.Second.Milliseconds()))
+}
+
+// mapLocal is a LocalCache of a map, without expirations.
+type mapLocal struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (m *mapLocal) Get(key []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.entries[string(key)]; ok {
+		return v, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *mapLocal) Set(key, value []byte, expireSeconds int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[string(key)] = value
+	return nil
+}
+
+func (m *mapLocal) Del(key []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[string(key)]
+	delete(m.entries, string(key))
+	return ok
+}
+
+func (m *mapLocal) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = make(map[string][]byte)
+}
+
+func (m *mapLocal) Stats() LocalCacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return LocalCacheStats{Entries: int64(len(m.entries))}
+}
+
+func (suite *testSuite) TestLocalCache() {
+	ctx := context.Background()
+	local := &mapLocal{entries: make(map[string][]byte)}
+	cache, err := NewCache("test", suite.redisConn, WithLocalCache(local))
+	suite.Require().NoError(err)
+	defer cache.Close()
+	suite.False(cache.RemoteOnly())
+	// wait for the subscription.
+	time.Sleep(waitTime)
+
+	var v string
+	suite.NoError(suite.cacheRepo.Set(ctx, "local:key", "v1", Normal.ToDuration()))
+	suite.NoError(cache.Peek(ctx, "local:key", &v))
+	suite.Equal("v1", v)
+	_, err = local.Get([]byte(storeKey("local:key")))
+	suite.Require().NoError(err)
+	suite.EqualValues(1, cache.Snapshot().Len())
+	// not iterated without LocalCacheRanger.
+	cache.Snapshot().Range(func(SnapshotEntry) bool {
+		suite.Fail("unexpected entry")
+		return true
+	})
+
+	suite.NoError(suite.cacheRepo.Set(ctx, "local:key", "v2", Normal.ToDuration()))
+	suite.Eventually(func() bool {
+		_, err := local.Get([]byte(storeKey("local:key")))
+		return err == ErrNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+	suite.NoError(cache.Get(ctx, "local:key", &v, Normal.ToDuration(), nil, false, false))
+	suite.Equal("v2", v)
+}
+
+func (suite *testSuite) TestMemoryCache() {
+	ctx := context.Background()
+	_, err := NewCache("test", nil)
+	suite.Equal(ErrNilClient, err)
+	var client *redis.Client
+	_, err = NewCache("test", client)
+	suite.Equal(ErrNilClient, err)
+	var cluster *redis.ClusterClient
+	_, err = NewCache("test", cluster)
+	suite.Equal(ErrNilClient, err)
+
+	cache := NewMemoryCache()
+	defer cache.Close()
+	reads := 0
+	read := func() (any, error) {
+		reads++
+		return "v1", nil
+	}
+	var v string
+	var rst GetResult
+	suite.NoError(cache.Get(ctx, "mem:key", &v, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal("v1", v)
+	suite.Equal(string(hitDB), rst.Source)
+	suite.NoError(cache.Get(ctx, "mem:key", &v, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal(string(hitMem), rst.Source)
+	suite.Equal(1, reads)
+
+	suite.NoError(cache.Set(ctx, "mem:key", "v2", Normal.ToDuration()))
+	suite.NoError(cache.Peek(ctx, "mem:key", &v))
+	suite.Equal("v2", v)
+	suite.NoError(cache.Invalidate(ctx, "mem:key"))
+	suite.Equal(ErrNotFound, cache.Peek(ctx, "mem:key", &v))
+	suite.Equal(ErrNotFound, cache.Get(ctx, "mem:key", &v, Normal.ToDuration(), read, false, false, MemoryOnly()))
+
+	// reads in flight are not cached once invalidated.
+	suite.NoError(cache.Get(ctx, "mem:flight", &v, Normal.ToDuration(), func() (any, error) {
+		suite.NoError(cache.Invalidate(ctx, "mem:flight"))
+		return "old", nil
+	}, false, false))
+	suite.Equal("old", v)
+	suite.Equal(ErrNotFound, cache.Peek(ctx, "mem:flight", &v))
+
+	suite.NoError(cache.SetMulti(ctx, map[string]any{"mem:a": "a"}, Normal.ToDuration()))
+	var a, b, c string
+	errs := cache.GetMulti(ctx, []string{"mem:a", "mem:b", "mem:c"}, []any{&a, &b, &c}, Normal.ToDuration(),
+		func(keys []string) (map[string]any, error) {
+			suite.Equal([]string{"mem:b", "mem:c"}, keys)
+			return map[string]any{"mem:b": "b"}, nil
+		})
+	suite.Equal([]error{nil, nil, ErrNotFound}, errs)
+	suite.Equal("a", a)
+	suite.Equal("b", b)
+	suite.NoError(cache.Peek(ctx, "mem:b", &b))
+
+	// memory is the only tier, values of TTL 0 never expire, nor are sub-second TTLs dropped.
+	suite.NoError(cache.Set(ctx, "mem:forever", "v", 0))
+	suite.NoError(cache.Peek(ctx, "mem:forever", &v))
+	suite.Equal("v", v)
+	suite.NoError(cache.Set(ctx, "mem:brief", "v", 100*time.Millisecond))
+	suite.NoError(cache.Peek(ctx, "mem:brief", &v))
+}
+
+func (suite *testSuite) TestTieredCache() {
+	ctx := context.Background()
+	newTiered := func() *TieredCache {
+		cache, err := NewTieredCache(RedisRemote(suite.redisConn),
+			RedisInvalidationBus(suite.redisConn, "tiered-invalidate"), WithKeyPrefix("tiered"))
+		suite.Require().NoError(err)
+		return cache
+	}
+	cache1, cache2 := newTiered(), newTiered()
+	defer cache1.Close()
+	defer cache2.Close()
+	suite.Error(cache1.SetMemCacheMaxTTLSeconds(0))
+
+	reads := 0
+	read := func() (any, error) {
+		reads++
+		return "v1", nil
+	}
+	var v string
+	var rst GetResult
+	suite.NoError(cache1.Get(ctx, "key", &v, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal("v1", v)
+	suite.Equal(string(hitDB), rst.Source)
+	raw, err := suite.redisConn.Get(ctx, "tiered:{key}").Bytes()
+	suite.NoError(err)
+	ve, err := decodeFlatEnvelope(raw)
+	suite.NoError(err)
+	suite.Greater(ve.ExpiredAt, getNow().UnixMilli())
+
+	// peers read the remote tier, then memory cache.
+	suite.NoError(cache2.Get(ctx, "key", &v, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal("v1", v)
+	suite.Equal(string(hitRemote), rst.Source)
+	suite.NoError(cache2.Get(ctx, "key", &v, Normal.ToDuration(), read, false, false, WithResult(&rst)))
+	suite.Equal(string(hitMem), rst.Source)
+	suite.Equal(1, reads)
+
+	// writes evict memory caches of peers.
+	suite.NoError(cache1.Set(ctx, "key", "v2", Normal.ToDuration()))
+	suite.Eventually(func() bool {
+		return cache2.Peek(ctx, "key", &v) == nil && v == "v2"
+	}, time.Second, 10*time.Millisecond)
+	suite.NoError(cache1.Invalidate(ctx, "key"))
+	suite.Eventually(func() bool {
+		return cache2.Peek(ctx, "key", &v) == ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	// values of peers written meanwhile are not overwritten by reads.
+	suite.NoError(cache1.Get(ctx, "race", &v, Normal.ToDuration(), func() (any, error) {
+		suite.NoError(cache2.Set(ctx, "race", "new", Normal.ToDuration()))
+		return "old", nil
+	}, false, false))
+	suite.Equal("old", v)
+	suite.NoError(cache1.Peek(ctx, "race", &v))
+	suite.Equal("new", v)
+
+	suite.NoError(cache1.SetMulti(ctx, map[string]any{"a": "a"}, Normal.ToDuration()))
+	var a, b, c string
+	errs := cache2.GetMulti(ctx, []string{"a", "b", "c"}, []any{&a, &b, &c}, Normal.ToDuration(),
+		func(keys []string) (map[string]any, error) {
+			suite.Equal([]string{"b", "c"}, keys)
+			return map[string]any{"b": "b"}, nil
+		})
+	suite.Equal([]error{nil, nil, ErrNotFound}, errs)
+	suite.Equal("a", a)
+	suite.Equal("b", b)
+	suite.NoError(cache1.Peek(ctx, "b", &b))
+
+	// reads of the data source before invalidations are not cached, even without buses.
+	cache3, err := NewTieredCache(RedisRemote(suite.redisConn), nil, WithKeyPrefix("tiered"))
+	suite.Require().NoError(err)
+	defer cache3.Close()
+	suite.NoError(cache3.Get(ctx, "slow", &v, Normal.ToDuration(), func() (any, error) {
+		suite.NoError(cache1.Invalidate(ctx, "slow"))
+		return "old", nil
+	}, false, false))
+	suite.Equal("old", v)
+	raw, err = suite.redisConn.Get(ctx, "tiered:{slow}").Bytes()
+	suite.NoError(err)
+	suite.True(isTombstone(raw))
+	suite.Equal(ErrNotFound, cache3.Peek(ctx, "slow", &v))
+	suite.Equal(ErrNotFound, cache2.Peek(ctx, "slow", &v))
+
+	// keys are invalidated even if others fail.
+	failing, err := NewTieredCache(failingRemote{RedisRemote(suite.redisConn), "tiered:{fail}"}, nil,
+		WithKeyPrefix("tiered"))
+	suite.Require().NoError(err)
+	defer failing.Close()
+	suite.NoError(cache1.SetMulti(ctx, map[string]any{"x": "x", "y": "y"}, Normal.ToDuration()))
+	err = failing.InvalidateMulti(ctx, "x", "fail", "y")
+	suite.ErrorIs(err, errRemoteDown)
+	suite.Equal(ErrNotFound, failing.Peek(ctx, "x", &v))
+	suite.Equal(ErrNotFound, failing.Peek(ctx, "y", &v))
+}
+
+var errRemoteDown = errors.New("remote down")
+
+// failingRemote is a RemoteCache failing writes of key.
+type failingRemote struct {
+	RemoteCache
+	key string
+}
+
+func (f failingRemote) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if key == f.key {
+		return errRemoteDown
+	}
+	return f.RemoteCache.Set(ctx, key, value, ttl)
+}
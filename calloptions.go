@@ -0,0 +1,215 @@
+package dcache
+
+import "time"
+
+// CallOption configures a single Get/GetWithTtl/GetMulti call.
+type CallOption func(*callOptions)
+
+// callOptions holds all per-call configurations.
+type callOptions struct {
+	result    *GetResult
+	lockScope *LockScope
+	priority  *Priority
+
+	noCache    bool
+	noStore    bool
+	memoryOnly bool
+
+	tolerateLoadErrors bool
+
+	maxTTL       time.Duration
+	softTTL      time.Duration
+	maxStaleness time.Duration
+
+	shouldStore func(value any) bool
+
+	tags []string
+
+	codec Codec
+
+	// rst is the result of the call, kept for the recorder.
+	rst *flightResult
+}
+
+func newCallOptions(opts []CallOption) *callOptions {
+	co := &callOptions{}
+	for _, opt := range opts {
+		opt(co)
+	}
+	return co
+}
+
+// GetResult is the metadata of a Get call, filled in when the call returns
+// without error, see WithResult.
+type GetResult struct {
+	// Source is where the value was found: "mem", "redis" or "db", or "remote" for the remote
+	// tier of TieredCache.
+	Source string
+	// StoreErr is the error of storing the value read from the data source into the
+	// cache. The value is still returned successfully, but a non-nil StoreErr means the
+	// cache is working but not caching.
+	StoreErr error
+	// Stale is true if the value is past its soft expiration, and being refreshed, see SoftTTL.
+	Stale bool
+}
+
+// WithResult asks the call to fill @p r with the metadata of the call.
+func WithResult(r *GetResult) CallOption {
+	return func(co *callOptions) {
+		co.result = r
+	}
+}
+
+// NoCache skips looking up the cache for this call, the value is read from the data source
+// and cached, unless NoStore is also given.
+func NoCache() CallOption {
+	return func(co *callOptions) {
+		co.noCache = true
+	}
+}
+
+// NoStore skips caching the value read from the data source in this call.
+func NoStore() CallOption {
+	return func(co *callOptions) {
+		co.noStore = true
+	}
+}
+
+// MemoryOnly makes this call only look up the memory cache, ErrNotFound is returned on misses
+// without reading Redis or the data source, e.g., for latency critical paths that can degrade.
+// It is ignored with NoCache.
+func MemoryOnly() CallOption {
+	return func(co *callOptions) {
+		co.memoryOnly = true
+	}
+}
+
+// NoLock skips the distributed lock for this call, see WithNoLockPrefixes.
+// It is the same as WithLockScope(LockScopeLocal).
+func NoLock() CallOption {
+	return WithLockScope(LockScopeLocal)
+}
+
+// WithLockScope sets the scope of locks for reading the data source in this call,
+// overriding WithDefaultLockScope and WithNoLockPrefixes.
+func WithLockScope(scope LockScope) CallOption {
+	return func(co *callOptions) {
+		co.lockScope = &scope
+	}
+}
+
+// WithPriority attaches the eviction priority hint @p p to the entry cached by this call,
+// overriding the one of policies.
+func WithPriority(p Priority) CallOption {
+	return func(co *callOptions) {
+		co.priority = &p
+	}
+}
+
+// TolerateLoadErrors makes GetMulti omit keys that failed to be read from the data source,
+// reported as ErrNotFound like keys not found, instead of the error of reading.
+func TolerateLoadErrors() CallOption {
+	return func(co *callOptions) {
+		co.tolerateLoadErrors = true
+	}
+}
+
+// WithMaxTTL caps the TTL returned by ReadWithTtlFunc at @p ttl, for loaders shared across
+// callers with different freshness requirements. Jitter of policies is still added.
+// NOTE: callers grouped into one flight share the TTL of the caller who reads the data source.
+func WithMaxTTL(ttl time.Duration) CallOption {
+	return func(co *callOptions) {
+		co.maxTTL = ttl
+	}
+}
+
+// SoftTTL makes values read from the data source by this call fresh for @p ttl only, shorter
+// than their TTL. Stale values, past @p ttl but not expired, are still returned immediately
+// by Get/GetWithTtl, while one client refreshes them in the background under the distributed
+// lock, so that hot keys do not wait for the data source when they expire.
+// Stale values are not kept in memory cache, and are returned as-is by Peek and GetMulti.
+// @p ttl should be longer than the read interval, the minimum interval of refreshes.
+// NOTE: the read function must not depend on the cancellation of the ctx of the call.
+// NOTE: soft TTLs are not carried by EnvelopeFlat.
+func SoftTTL(ttl time.Duration) CallOption {
+	return func(co *callOptions) {
+		co.softTTL = ttl
+	}
+}
+
+// WithMaxStaleness treats values older than @p d since written as misses in Get/GetWithTtl,
+// even if they are not expired, e.g., written with a long TTL by callers with laxer freshness
+// needs sharing the key. Such values are read from the data source again under the lock, so
+// @p d should be longer than the read interval. Memory cache is skipped by this call, since
+// ages of values in it are unknown, while values of unknown ages in Redis, e.g., written by
+// older clients or in EnvelopeFlat, are taken.
+func WithMaxStaleness(d time.Duration) CallOption {
+	return func(co *callOptions) {
+		co.maxStaleness = d
+	}
+}
+
+// tooStale returns true if @p ve is older than @p maxStaleness, see WithMaxStaleness.
+func tooStale(ve *ValueBytesExpiredAt, maxStaleness time.Duration) bool {
+	return maxStaleness > 0 && ve.CreatedAt > 0 && getNow().UnixMilli()-ve.CreatedAt > maxStaleness.Milliseconds()
+}
+
+// WithShouldStore caches the value read from the data source only if @p shouldStore returns
+// true for it, so that loaders can return transient or partial results, e.g., during warmup
+// of the data source, without returning errors.
+// NOTE: callers grouped into one flight share the decision of the caller who reads the data source.
+func WithShouldStore(shouldStore func(value any) bool) CallOption {
+	return func(co *callOptions) {
+		co.shouldStore = shouldStore
+	}
+}
+
+// WithTags attaches @p tags to keys whose values are read from the data source and cached by
+// this call, so that they can be invalidated together by InvalidateTag.
+// NOTE: callers grouped into one flight share the tags of the caller who reads the data source.
+func WithTags(tags ...string) CallOption {
+	return func(co *callOptions) {
+		co.tags = tags
+	}
+}
+
+// WithValueCodec serializes values read from the data source and cached by this call by
+// @p codec instead of the codec of the policy of the key or of the client, e.g., for values
+// whose types are serialized only by some codecs. The codec is recorded along with values, so
+// that they are read by it regardless of codecs of readers, as long as it is known to them,
+// see WithKnownCodecs. Values cached by other codecs are still read.
+// NOTE: only values are serialized by @p codec, envelopes of values in Redis are still
+// serialized by the codec of the client, see WithCodec, so that any client decodes them, i.e.,
+// values are readable by other services only if all clients of the keys use WithJSONCodec.
+// NOTE: callers grouped into one flight share the codec of the caller who reads the data source.
+func WithValueCodec(codec Codec) CallOption {
+	return func(co *callOptions) {
+		co.codec = codec
+	}
+}
+
+// unstoredValue is a value read from the data source that must not be cached.
+type unstoredValue struct {
+	value any
+}
+
+// checkShouldStore returns @p read with values rejected by @p shouldStore marked unstored.
+func checkShouldStore(read ReadWithTtlFunc, shouldStore func(value any) bool) ReadWithTtlFunc {
+	return func() (any, time.Duration, error) {
+		v, ttl, err := read()
+		if err == nil && !shouldStore(v) {
+			return unstoredValue{value: v}, ttl, nil
+		}
+		return v, ttl, err
+	}
+}
+
+func (co *callOptions) setResult(rst *flightResult) {
+	co.rst = rst
+	if co.result == nil {
+		return
+	}
+	co.result.Source = string(rst.from)
+	co.result.StoreErr = rst.storeErr
+	co.result.Stale = rst.stale
+}
@@ -0,0 +1,73 @@
+package dcache
+
+import (
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+)
+
+// canary results, as metric labels.
+const (
+	canaryMatch    = "match"
+	canaryMismatch = "mismatch"
+	canaryError    = "error"
+)
+
+// codecCanary compares a candidate codec with the codec of the client, see WithCodecCanary.
+type codecCanary struct {
+	codec    Codec
+	fraction float64
+
+	matches    atomic.Int64
+	mismatches atomic.Int64
+	errors     atomic.Int64
+}
+
+// checkCodec compares, for a sampled fraction of writes, decoding @p value of @p key from
+// @p valueBytes encoded by the codec of the client with decoding it encoded by the candidate.
+func (c *DCache) checkCodec(key string, value any, valueBytes []byte) {
+	cc := c.canary
+	if cc == nil || rand.Float64() >= cc.fraction {
+		return
+	}
+	switch value.(type) {
+	case nil, []byte, string:
+		// stored as-is by both.
+		return
+	}
+	result := canaryMatch
+	defer func() {
+		switch result {
+		case canaryMatch:
+			cc.matches.Add(1)
+		case canaryMismatch:
+			cc.mismatches.Add(1)
+		default:
+			cc.errors.Add(1)
+		}
+		if c.stats != nil {
+			c.stats.ObserveCodecCanary(result)
+		}
+	}()
+	typ := reflect.TypeOf(value)
+	current, candidate := reflect.New(typ), reflect.New(typ)
+	if err := decode(c.opts.codec, valueBytes, current.Interface()); err != nil {
+		c.logger(c.ctx).Warn().Err(err).Msgf("Codec canary failed to decode %s by the current codec", key)
+		result = canaryError
+		return
+	}
+	b, err := encode(cc.codec, value, false)
+	if err == nil {
+		err = decode(cc.codec, b, candidate.Interface())
+	}
+	if err != nil {
+		c.logger(c.ctx).Warn().Err(err).Msgf(
+			"Codec canary failed to encode or decode %s by the candidate codec", key)
+		result = canaryError
+		return
+	}
+	if !reflect.DeepEqual(current.Elem().Interface(), candidate.Elem().Interface()) {
+		c.logger(c.ctx).Warn().Msgf("Codec canary found %s decoded differently by the candidate codec", key)
+		result = canaryMismatch
+	}
+}
@@ -0,0 +1,227 @@
+package dcache
+
+import (
+	"container/list"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// maxSampledKeys bounds keys tracked by the capacity advisor, so that sizes beyond about
+	// maxSampledKeys/rate keys are not advised.
+	maxSampledKeys = 1 << 14
+	// maxCapacityClock bounds access times of sampled keys, which are renumbered beyond.
+	maxCapacityClock = 4 * maxSampledKeys
+	// capacityBuckets are buckets of reuse distances, bucket i counts distances of up to
+	// 2^(i+minCapacityShift) bytes.
+	capacityBuckets  = 32
+	minCapacityShift = 10
+	// freecacheEntryOverhead is the size of the header of entries of freecache.
+	freecacheEntryOverhead = 24
+	// capacityAdviceLogInterval is the interval of logging capacity advice.
+	capacityAdviceLogInterval = 10 * time.Minute
+)
+
+// CapacityAdvice is the estimated size of memory cache needed for a target hit ratio, see
+// WithCapacityAdvisor.
+type CapacityAdvice struct {
+	// TargetHitRatio is the hit ratio advised for.
+	TargetHitRatio float64
+	// Bytes is the size of memory cache estimated to reach TargetHitRatio, rounded up to a
+	// power of 2, 0 if TargetHitRatio is not reachable, or not known yet.
+	Bytes int64
+	// MaxHitRatio is the hit ratio of an unbounded memory cache, bounded by first reads and
+	// reads of expired values.
+	MaxHitRatio float64
+	// Samples is the number of reads sampled.
+	Samples int64
+}
+
+// sampledKey is a key sampled by the capacity advisor.
+type sampledKey struct {
+	key       string
+	size      int64
+	expiredAt time.Time
+	// read is false if the key is written but not read yet, with size 0.
+	read bool
+	// at is the access time of the key, see capacityAdvisor.sizes.
+	at int
+}
+
+// capacityAdvisor simulates an LRU memory cache of every size at once over sampled keys, by
+// reuse distances in bytes of reads, i.e., the size of values of distinct keys read since the
+// last read of the same key, which is a hit in caches larger than it.
+type capacityAdvisor struct {
+	target    float64
+	rate      float64
+	threshold uint64
+
+	mu    sync.Mutex
+	lru   *list.List
+	index map[string]*list.Element
+	// sizes is the Fenwick tree of sizes of sampled keys by their access times, so that reuse
+	// distances are summed in O(log n), the last access time being clock.
+	sizes   []int64
+	clock   int
+	hits    [capacityBuckets]int64
+	samples int64
+}
+
+func newCapacityAdvisor(target float64, rate float64) *capacityAdvisor {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	threshold := uint64(math.MaxUint64)
+	if rate < 1 {
+		threshold = uint64(rate * math.MaxUint64)
+	}
+	return &capacityAdvisor{
+		target:    target,
+		rate:      rate,
+		threshold: threshold,
+		lru:       list.New(),
+		index:     make(map[string]*list.Element),
+		sizes:     make([]int64, maxCapacityClock+1),
+	}
+}
+
+// addSize adds @p size to the size at access time @p at.
+func (a *capacityAdvisor) addSize(at int, size int64) {
+	for ; at < len(a.sizes); at += at & -at {
+		a.sizes[at] += size
+	}
+}
+
+// sumSizes returns the sum of sizes at access times up to @p at.
+func (a *capacityAdvisor) sumSizes(at int) int64 {
+	var sum int64
+	for ; at > 0; at -= at & -at {
+		sum += a.sizes[at]
+	}
+	return sum
+}
+
+// touch makes @p s, at the front of the LRU, accessed last, with @p size.
+func (a *capacityAdvisor) touch(s *sampledKey, size int64) {
+	if s.at > 0 {
+		a.addSize(s.at, -s.size)
+	}
+	s.size = size
+	if a.clock < maxCapacityClock {
+		a.clock++
+		s.at = a.clock
+		a.addSize(s.at, s.size)
+		return
+	}
+	// renumbered in the order of the LRU, amortized over maxCapacityClock-maxSampledKeys
+	// accesses.
+	for i := range a.sizes {
+		a.sizes[i] = 0
+	}
+	a.clock = 0
+	for cur := a.lru.Back(); cur != nil; cur = cur.Prev() {
+		k := cur.Value.(*sampledKey)
+		a.clock++
+		k.at = a.clock
+		a.addSize(k.at, k.size)
+	}
+}
+
+// sampled returns true if @p key is sampled.
+func (a *capacityAdvisor) sampled(key string) bool {
+	return xxhash.Sum64String(key) <= a.threshold
+}
+
+// observe a read of @p key of @p size bytes of value and key.
+func (a *capacityAdvisor) observe(key string, size int) {
+	if !a.sampled(key) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.samples++
+	e := a.entry(key)
+	if s := e.Value.(*sampledKey); s.read && (s.expiredAt.IsZero() || getNow().Before(s.expiredAt)) {
+		// sizes of keys accessed since, and of the key.
+		distance := a.sumSizes(a.clock) - a.sumSizes(s.at) + s.size
+		// distances among sampled keys are scaled to all keys.
+		scaled := uint64(float64(distance) / a.rate)
+		i := bits.Len64(scaled >> minCapacityShift)
+		if i >= capacityBuckets {
+			i = capacityBuckets - 1
+		}
+		a.hits[i]++
+	}
+	a.lru.MoveToFront(e)
+	s := e.Value.(*sampledKey)
+	a.touch(s, int64(size+freecacheEntryOverhead))
+	s.read = true
+}
+
+// entry returns the entry of @p key, added if absent.
+func (a *capacityAdvisor) entry(key string) *list.Element {
+	if e, ok := a.index[key]; ok {
+		return e
+	}
+	e := a.lru.PushFront(&sampledKey{key: key})
+	a.index[key] = e
+	if a.lru.Len() > maxSampledKeys {
+		last := a.lru.Back()
+		a.lru.Remove(last)
+		k := last.Value.(*sampledKey)
+		a.addSize(k.at, -k.size)
+		delete(a.index, k.key)
+	}
+	a.touch(e.Value.(*sampledKey), 0)
+	return e
+}
+
+// written records that the value of @p key cached in memory expires at @p expiredAt, reads
+// after it are misses of caches of any size.
+func (a *capacityAdvisor) written(key string, expiredAt time.Time) {
+	if !a.sampled(key) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entry(key).Value.(*sampledKey).expiredAt = expiredAt
+}
+
+func (a *capacityAdvisor) advice() CapacityAdvice {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rv := CapacityAdvice{TargetHitRatio: a.target, Samples: a.samples}
+	if a.samples == 0 {
+		return rv
+	}
+	var hits int64
+	for i, n := range a.hits {
+		hits += n
+		if rv.Bytes == 0 && float64(hits)/float64(a.samples) >= a.target {
+			rv.Bytes = 1 << (i + minCapacityShift)
+		}
+	}
+	rv.MaxHitRatio = float64(hits) / float64(a.samples)
+	return rv
+}
+
+// logCapacityAdvice logs capacity advice periodically until the cache is closed.
+func (c *DCache) logCapacityAdvice() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(capacityAdviceLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		a := c.advisor.advice()
+		c.logger(c.ctx).Info().Msgf("Capacity advice of %s: %d bytes of memory cache for hit ratio %.2f, "+
+			"max hit ratio %.2f, of %d sampled reads", c.appName, a.Bytes, a.TargetHitRatio, a.MaxHitRatio, a.Samples)
+	}
+}
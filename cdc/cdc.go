@@ -0,0 +1,187 @@
+// Package cdc invalidates dcache keys by change events of databases, e.g., Debezium events
+// consumed from Kafka, so that writes by other services invalidate caches automatically.
+// It is transport agnostic: Kafka clients are adapted to Consumer.
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/stumble/dcache"
+)
+
+// ErrBadEvent is the error of undecodable change events, see ParseEvent.
+var ErrBadEvent = errors.New("cdc: bad event")
+
+// Op is the operation of a change event, as Debezium "op".
+type Op string
+
+const (
+	OpCreate Op = "c"
+	OpUpdate Op = "u"
+	OpDelete Op = "d"
+	// OpRead is a row read by snapshots.
+	OpRead Op = "r"
+)
+
+// Event is a change event of a row.
+type Event struct {
+	Op Op
+	// DB, Schema and Table are the source of the event. Schema is empty for MySQL.
+	DB     string
+	Schema string
+	Table  string
+	// Before and After are the row before and after the change, nil for creates and deletes
+	// respectively. Numbers are json.Number, so that IDs are formatted exactly.
+	Before map[string]any
+	After  map[string]any
+}
+
+// Row returns the row after the change, or before it if deleted.
+func (e *Event) Row() map[string]any {
+	if e.After != nil {
+		return e.After
+	}
+	return e.Before
+}
+
+// TableName returns the name of the table of the event qualified by its schema, e.g.,
+// "public.users", or by its database if it has no schema, e.g., "app.users" of MySQL.
+func (e *Event) TableName() string {
+	if e.Schema != "" {
+		return e.Schema + "." + e.Table
+	}
+	if e.DB != "" {
+		return e.DB + "." + e.Table
+	}
+	return e.Table
+}
+
+// KeyMapper returns keys of the cache to invalidate by @p e, e.g., keys of both rows before
+// and after updates if keys depend on changed columns.
+type KeyMapper func(e *Event) []string
+
+// Message is a message of change events, e.g., a Kafka message.
+type Message struct {
+	Key   []byte
+	Value []byte
+	// Raw is the message of the client, e.g., kafka.Message, for committing.
+	Raw any
+}
+
+// Consumer reads messages of change events, e.g., a Kafka reader of a consumer group.
+type Consumer interface {
+	// FetchMessage returns the next message, blocks until available or @p ctx is done.
+	FetchMessage(ctx context.Context) (Message, error)
+	// CommitMessages marks @p msgs consumed.
+	CommitMessages(ctx context.Context, msgs ...Message) error
+}
+
+// Invalidator invalidates keys, implemented by *dcache.DCache.
+type Invalidator interface {
+	InvalidateMulti(ctx context.Context, keys ...string) error
+}
+
+var _ Invalidator = (*dcache.DCache)(nil)
+
+// Adapter invalidates keys mapped from change events consumed from Consumer.
+type Adapter struct {
+	Cache    Invalidator
+	Consumer Consumer
+	// Mappers are key mappers by qualified table names, see Event.TableName. Events of other
+	// tables are ignored.
+	Mappers map[string]KeyMapper
+	// OnBadEvent is called with undecodable messages, which are skipped, optional.
+	OnBadEvent func(msg Message, err error)
+}
+
+// Run consumes messages until @p ctx is done or an error occurs, which is returned.
+// Messages are committed after their keys are invalidated, so that events are handled at
+// least once across restarts. Undecodable messages are reported to OnBadEvent and committed,
+// so that they do not stop consuming.
+func (a *Adapter) Run(ctx context.Context) error {
+	for {
+		msg, err := a.Consumer.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if err := a.Handle(ctx, msg.Value); err != nil {
+			if !errors.Is(err, ErrBadEvent) {
+				return err
+			}
+			if a.OnBadEvent != nil {
+				a.OnBadEvent(msg, err)
+			}
+		}
+		if err := a.Consumer.CommitMessages(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Handle invalidates keys mapped from the change event in @p value. Tombstones, i.e., empty
+// values, and events of tables without mappers are ignored.
+func (a *Adapter) Handle(ctx context.Context, value []byte) error {
+	if len(value) == 0 {
+		return nil
+	}
+	e, err := ParseEvent(value)
+	if err != nil {
+		return err
+	}
+	mapper, ok := a.Mappers[e.TableName()]
+	if !ok {
+		return nil
+	}
+	keys := mapper(e)
+	if len(keys) == 0 {
+		return nil
+	}
+	return a.Cache.InvalidateMulti(ctx, keys...)
+}
+
+// debeziumEvent is the payload of Debezium change events.
+type debeziumEvent struct {
+	Op     Op             `json:"op"`
+	Before map[string]any `json:"before"`
+	After  map[string]any `json:"after"`
+	Source struct {
+		DB     string `json:"db"`
+		Schema string `json:"schema"`
+		Table  string `json:"table"`
+	} `json:"source"`
+}
+
+// ParseEvent parses a Debezium change event in JSON, with or without the schema envelope.
+// Errors are ErrBadEvent.
+func ParseEvent(value []byte) (*Event, error) {
+	var envelope struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEvent, err)
+	}
+	if len(envelope.Payload) > 0 && !bytes.Equal(envelope.Payload, []byte("null")) {
+		value = envelope.Payload
+	}
+	var raw debeziumEvent
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEvent, err)
+	}
+	if raw.Op == "" {
+		return nil, fmt.Errorf("%w: missing op", ErrBadEvent)
+	}
+	return &Event{
+		Op:     raw.Op,
+		DB:     raw.Source.DB,
+		Schema: raw.Source.Schema,
+		Table:  raw.Source.Table,
+		Before: raw.Before,
+		After:  raw.After,
+	}, nil
+}
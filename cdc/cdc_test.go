@@ -0,0 +1,169 @@
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/stumble/dcache"
+)
+
+// fakeConsumer serves messages in order, then blocks until ctx is done.
+type fakeConsumer struct {
+	msgs      []Message
+	committed []Message
+}
+
+func (f *fakeConsumer) FetchMessage(ctx context.Context) (Message, error) {
+	if len(f.msgs) == 0 {
+		<-ctx.Done()
+		return Message{}, ctx.Err()
+	}
+	msg := f.msgs[0]
+	f.msgs = f.msgs[1:]
+	return msg, nil
+}
+
+func (f *fakeConsumer) CommitMessages(_ context.Context, msgs ...Message) error {
+	f.committed = append(f.committed, msgs...)
+	return nil
+}
+
+// failingInvalidator fails to invalidate.
+type failingInvalidator struct{}
+
+func (failingInvalidator) InvalidateMulti(context.Context, ...string) error {
+	return errors.New("down")
+}
+
+type cdcTestSuite struct {
+	suite.Suite
+	redisConn  redis.UniversalClient
+	inMemCache *freecache.Cache
+	dc         *dcache.DCache
+}
+
+func TestCDCTestSuite(t *testing.T) {
+	suite.Run(t, &cdcTestSuite{})
+}
+
+func (suite *cdcTestSuite) SetupSuite() {
+	suite.redisConn = redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+		DB:   12,
+	})
+	suite.inMemCache = freecache.NewCache(1024 * 1024)
+	dc, err := dcache.NewDCache(
+		"cdc", suite.redisConn, suite.inMemCache, time.Second, false, false)
+	suite.Require().NoError(err)
+	suite.dc = dc
+}
+
+func (suite *cdcTestSuite) TearDownSuite() {
+	suite.dc.Close()
+}
+
+func (suite *cdcTestSuite) BeforeTest(_, _ string) {
+	suite.inMemCache.Clear()
+	suite.Require().NoError(suite.redisConn.FlushDB(context.Background()).Err())
+}
+
+func (suite *cdcTestSuite) TestParseEvent() {
+	e, err := ParseEvent([]byte(`{"schema":{},"payload":{"op":"u","before":{"id":12345678901,"email":"a@x"},` +
+		`"after":{"id":12345678901,"email":"b@x"},"source":{"db":"app","schema":"public","table":"users"}}}`))
+	suite.Require().NoError(err)
+	suite.Equal(OpUpdate, e.Op)
+	suite.Equal("app", e.DB)
+	suite.Equal("public", e.Schema)
+	suite.Equal("users", e.Table)
+	suite.Equal("12345678901", fmt.Sprint(e.Row()["id"]))
+	suite.Equal("a@x", e.Before["email"])
+	suite.Equal("public.users", e.TableName())
+
+	// without the schema envelope.
+	e, err = ParseEvent([]byte(`{"op":"d","before":{"id":1},"after":null,"source":{"table":"users"}}`))
+	suite.Require().NoError(err)
+	suite.Equal(OpDelete, e.Op)
+	suite.Equal("1", fmt.Sprint(e.Row()["id"]))
+	suite.Equal("users", e.TableName())
+	e, err = ParseEvent([]byte(`{"op":"c","after":{"id":1},"source":{"db":"app","table":"users"}}`))
+	suite.Require().NoError(err)
+	suite.Equal("app.users", e.TableName())
+
+	_, err = ParseEvent([]byte(`{"payload":{}}`))
+	suite.ErrorIs(err, ErrBadEvent)
+	_, err = ParseEvent([]byte(`not json`))
+	suite.ErrorIs(err, ErrBadEvent)
+}
+
+func (suite *cdcTestSuite) TestRun() {
+	ctx := context.Background()
+	for _, key := range []string{"user:1", "user:email:a@x", "user:email:b@x", "order:1"} {
+		suite.Require().NoError(suite.dc.Set(ctx, key, "cached", time.Minute))
+	}
+	consumer := &fakeConsumer{msgs: []Message{
+		{Value: []byte(`{"op":"u","before":{"id":1,"email":"a@x"},"after":{"id":1,"email":"b@x"},` +
+			`"source":{"schema":"public","table":"users"}}`)},
+		// tombstone following deletes.
+		{Value: nil},
+		{Value: []byte(`{"op":"d","before":{"id":1},"source":{"schema":"public","table":"orders_archive"}}`)},
+		// same table of another schema.
+		{Value: []byte(`{"op":"d","before":{"id":2},"source":{"schema":"audit","table":"users"}}`)},
+	}}
+	var bad []Message
+	a := &Adapter{
+		Cache:    suite.dc,
+		Consumer: consumer,
+		OnBadEvent: func(msg Message, err error) {
+			suite.ErrorIs(err, ErrBadEvent)
+			bad = append(bad, msg)
+		},
+		Mappers: map[string]KeyMapper{
+			"public.users": func(e *Event) []string {
+				keys := []string{fmt.Sprintf("user:%s", e.Row()["id"])}
+				for _, row := range []map[string]any{e.Before, e.After} {
+					if row != nil {
+						keys = append(keys, fmt.Sprintf("user:email:%s", row["email"]))
+					}
+				}
+				return keys
+			},
+		},
+	}
+	runCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	suite.True(errors.Is(a.Run(runCtx), context.DeadlineExceeded))
+	suite.Len(consumer.committed, 4)
+	suite.Empty(bad)
+
+	for _, key := range []string{"user:1", "user:email:a@x", "user:email:b@x"} {
+		var v string
+		suite.ErrorIs(suite.dc.Peek(ctx, key, &v), dcache.ErrNotFound, key)
+	}
+	var v string
+	suite.NoError(suite.dc.Peek(ctx, "order:1", &v))
+
+	// bad events are reported and committed, without stopping the adapter.
+	consumer.msgs = []Message{{Value: []byte(`{}`)}, {Value: []byte(`{"op":"d","before":{"id":1},` +
+		`"source":{"schema":"public","table":"users"}}`)}}
+	consumer.committed = nil
+	runCtx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	suite.True(errors.Is(a.Run(runCtx), context.DeadlineExceeded))
+	suite.Len(consumer.committed, 2)
+	suite.Equal([]Message{{Value: []byte(`{}`)}}, bad)
+
+	// errors of invalidating stop the adapter without committing.
+	a.Cache = failingInvalidator{}
+	consumer.msgs = []Message{{Value: []byte(`{"op":"d","before":{"id":1},` +
+		`"source":{"schema":"public","table":"users"}}`)}}
+	consumer.committed = nil
+	suite.Error(a.Run(ctx))
+	suite.Empty(consumer.committed)
+}
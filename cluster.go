@@ -0,0 +1,86 @@
+package dcache
+
+import (
+	"context"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// clusterSlots is the number of hash slots of Redis Cluster.
+const clusterSlots = 16384
+
+// keySlot returns the hash slot of @p key in Redis Cluster, hashing only its hash tag if any.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XModem) used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// groupBySlot groups indexes of @p keys by their hash slots, in the order of first appearance.
+func groupBySlot(keys []string) [][]int {
+	var groups [][]int
+	bySlot := make(map[int]int)
+	for i, key := range keys {
+		slot := keySlot(key)
+		g, ok := bySlot[slot]
+		if !ok {
+			g = len(groups)
+			bySlot[slot] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// mget reads @p storeKeys like MGET. On Redis Cluster, where MGET across slots fails, keys are
+// grouped by slot into one MGET per slot, sent in one pipeline that the client splits into
+// per-node pipelines executed in parallel. Values of slots failed to be read are nil.
+func (c *DCache) mget(ctx context.Context, storeKeys []string) ([]any, error) {
+	if _, ok := c.conn.(*redis.ClusterClient); !ok {
+		return c.conn.MGet(ctx, storeKeys...).Result()
+	}
+	groups := groupBySlot(storeKeys)
+	pipe := c.conn.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(groups))
+	for g, indexes := range groups {
+		keys := make([]string, len(indexes))
+		for j, i := range indexes {
+			keys[j] = storeKeys[i]
+		}
+		cmds[g] = pipe.MGet(ctx, keys...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to read Redis for some of %d keys", len(storeKeys))
+	}
+	values := make([]any, len(storeKeys))
+	for g, indexes := range groups {
+		if cmds[g].Err() != nil {
+			continue
+		}
+		for j, v := range cmds[g].Val() {
+			values[indexes[j]] = v
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,175 @@
+package dcache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescePolicy coalesces Sets of keys of prefix within window.
+type coalescePolicy struct {
+	prefix string
+	window time.Duration
+}
+
+// pendingSet is the last value Set to a key, waiting to be written.
+type pendingSet struct {
+	ctx        context.Context
+	valueBytes []byte
+	ttl        time.Duration
+	timer      *time.Timer
+	// canceled is set if the key is invalidated while the value is being written.
+	canceled bool
+}
+
+// setCoalescer holds pending Sets by key.
+type setCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]*pendingSet
+	// flushing are keys of pending Sets being written.
+	flushing map[*pendingSet]string
+}
+
+// coalesceWindow returns the window to coalesce Sets of @p key, 0 if not coalesced.
+func (c *DCache) coalesceWindow(key string) time.Duration {
+	for _, p := range c.opts.coalescePolicies {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.window
+		}
+	}
+	return 0
+}
+
+// coalesceSet holds @p valueBytes of @p key for @p window, replacing the pending value
+// if any, and writes the last value when the window ends.
+// Memory cache is updated immediately, so that reads on this pod reflect the Set.
+func (c *DCache) coalesceSet(
+	ctx context.Context, key string, valueBytes []byte, ttl time.Duration, window time.Duration) {
+	skey := c.storeKey(key)
+	if c.memCache() != nil {
+		// ordered with reads in flight and invalidations of the key, see updateMemoryCache.
+		lock := c.memLock(skey)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	c.versions.bump(skey)
+	c.updatePinned(key, &ValueBytesExpiredAt{ValueBytes: valueBytes, ExpiredAt: getNow().Add(ttl).UnixMilli()})
+	if c.memCacheFor(key) {
+		memTTL := ttl
+		if max := time.Duration(c.memCacheMaxTTLSeconds.Load()) * time.Second; memTTL > max {
+			memTTL = max
+		}
+		if memTTL >= time.Second {
+			// not written yet, evicted by any invalidation.
+			c.stamps.forget(skey)
+			if err := c.memCache().Set([]byte(skey), valueBytes, int(memTTL.Seconds())); err != nil {
+				c.logger(ctx).Err(err).Msgf("Failed to set memory cache for key %s", skey)
+				c.recordError(errLabelSetMemCache, key, err)
+			} else if rst := setResultOf(ctx); rst != nil {
+				rst.Memory = true
+			}
+		}
+	}
+	if rst := setResultOf(ctx); rst != nil {
+		rst.Deferred = true
+		// the write is done after SetDetailed returns.
+		ctx = context.WithValue(ctx, setResultCtxKey{}, (*SetResult)(nil))
+	}
+	c.coalescer.mu.Lock()
+	defer c.coalescer.mu.Unlock()
+	if p, ok := c.coalescer.pending[key]; ok {
+		p.ctx, p.valueBytes, p.ttl = detachedContext{parent: ctx}, valueBytes, ttl
+		return
+	}
+	p := &pendingSet{ctx: detachedContext{parent: ctx}, valueBytes: valueBytes, ttl: ttl}
+	c.wg.Add(1)
+	p.timer = time.AfterFunc(window, func() {
+		defer c.wg.Done()
+		c.flushSet(key)
+	})
+	c.coalescer.pending[key] = p
+}
+
+// flushSet writes the pending value of @p key, if any.
+func (c *DCache) flushSet(key string) {
+	c.coalescer.mu.Lock()
+	p, ok := c.coalescer.pending[key]
+	if ok {
+		delete(c.coalescer.pending, key)
+		c.coalescer.flushing[p] = key
+	}
+	c.coalescer.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer func() {
+		c.coalescer.mu.Lock()
+		delete(c.coalescer.flushing, p)
+		c.coalescer.mu.Unlock()
+	}()
+	timeout := c.opts.detachedWriteTimeout
+	if timeout <= 0 {
+		timeout = defaultDetachedWriteTimeout
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+	if err := c.writeSet(ctx, key, p.valueBytes, p.ttl); err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to set coalesced value of %s", key)
+		c.recordError(errLabelSetRedis, key, err)
+		return
+	}
+	c.coalescer.mu.Lock()
+	canceled := p.canceled
+	c.coalescer.mu.Unlock()
+	if canceled {
+		// the delete of the invalidation may have been applied before the write.
+		if _, err := c.deleteCmd(ctx, c.conn, key)(); err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to delete coalesced value of invalidated %s", key)
+			c.recordError(errLabelSetRedis, key, err)
+		}
+		return
+	}
+	if c.memCache() != nil {
+		// memory cache was updated by Set, which suppresses the broadcast of setKey.
+		c.broadcastKeyInvalidate(key, valueStamp{})
+	}
+}
+
+// cancelPendingSet drops the pending value of @p key, if any, so that it is not written after
+// the key is invalidated. It returns true if a value was pending or being written.
+func (c *DCache) cancelPendingSet(key string) bool {
+	c.coalescer.mu.Lock()
+	defer c.coalescer.mu.Unlock()
+	canceled := false
+	if p, ok := c.coalescer.pending[key]; ok {
+		if p.timer.Stop() {
+			c.wg.Done()
+		}
+		delete(c.coalescer.pending, key)
+		canceled = true
+	}
+	for p, k := range c.coalescer.flushing {
+		if k == key {
+			p.canceled = true
+			canceled = true
+		}
+	}
+	return canceled
+}
+
+// flushPendingSets writes all pending values without waiting for their windows.
+func (c *DCache) flushPendingSets() {
+	c.coalescer.mu.Lock()
+	keys := make([]string, 0, len(c.coalescer.pending))
+	for key, p := range c.coalescer.pending {
+		if p.timer.Stop() {
+			c.wg.Done()
+			keys = append(keys, key)
+		}
+	}
+	c.coalescer.mu.Unlock()
+	for _, key := range keys {
+		c.flushSet(key)
+	}
+}
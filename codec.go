@@ -0,0 +1,282 @@
+package dcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec serializes values and envelopes of values, see WithCodec. Strings and []byte are
+// stored as-is without the codec. Envelopes are *ValueBytesExpiredAt.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// codecTagged is the suffix byte of values encoded by codecs other than the codec of the
+// client, following the name of the codec and its length in one byte, which follow the value
+// encoded by the codec with its compression byte, so that the codec is recorded along with
+// the value in its envelope, and in memory cache. Older clients fail to decode such values.
+const codecTagged = 0x2
+
+// ErrUnknownCodec is returned reading values encoded by codecs not known to this client, see
+// WithKnownCodecs.
+var ErrUnknownCodec = errors.New("dcache: unknown codec")
+
+// codecCtxKey is the context key of the codec given by WithValueCodec or SetWithCodec,
+// carried to writes of values, including async writes.
+type codecCtxKey struct{}
+
+// MsgpackCodec is the default Codec, serializing by MessagePack.
+type MsgpackCodec struct{}
+
+// Name is the name of the codec recorded with values, see Policy.Codec. Codecs without
+// Name methods are named by their types.
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// JSONCodec is a Codec serializing by encoding/json, so that values in Redis are readable by
+// redis-cli and by consumers in other languages, see WithJSONCodec. Envelopes are JSON objects
+// of "e", the expiration in UNIX milliseconds, "se", the soft expiration, "ct", the compute
+// time in milliseconds, "c", the creation in UNIX milliseconds, and "w", the writer, if any, and one of
+// "v", the value in JSON, "s", the value stored as a string, or "b", the value in base64 if it
+// is neither JSON nor UTF-8.
+type JSONCodec struct{}
+
+// jsonEnvelope is the JSON form of ValueBytesExpiredAt.
+type jsonEnvelope struct {
+	Value         json.RawMessage `json:"v,omitempty"`
+	String        *string         `json:"s,omitempty"`
+	Bytes         []byte          `json:"b,omitempty"`
+	ExpiredAt     int64           `json:"e,omitempty"`
+	SoftExpiredAt int64           `json:"se,omitempty"`
+	ComputeTime   int64           `json:"ct,omitempty"`
+	CreatedAt     int64           `json:"c,omitempty"`
+	Seq           uint32          `json:"sq,omitempty"`
+	Writer        uint32          `json:"w,omitempty"`
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	ve, ok := v.(*ValueBytesExpiredAt)
+	if !ok {
+		return json.Marshal(v)
+	}
+	env := jsonEnvelope{
+		ExpiredAt:     ve.ExpiredAt,
+		SoftExpiredAt: ve.SoftExpiredAt,
+		ComputeTime:   ve.ComputeTime,
+		CreatedAt:     ve.CreatedAt,
+		Seq:           ve.Seq,
+		Writer:        ve.Writer,
+	}
+	b := ve.ValueBytes
+	switch {
+	case len(b) == 0:
+	case b[len(b)-1] == noCompression && json.Valid(b[:len(b)-1]):
+		env.Value = b[:len(b)-1]
+	case utf8.Valid(b):
+		s := string(b)
+		env.String = &s
+	default:
+		env.Bytes = b
+	}
+	return json.Marshal(env)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	ve, ok := v.(*ValueBytesExpiredAt)
+	if !ok {
+		return json.Unmarshal(data, v)
+	}
+	var env jsonEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	ve.ExpiredAt, ve.SoftExpiredAt = env.ExpiredAt, env.SoftExpiredAt
+	ve.ComputeTime, ve.CreatedAt, ve.Seq, ve.Writer = env.ComputeTime, env.CreatedAt, env.Seq, env.Writer
+	switch {
+	case env.Value != nil:
+		ve.ValueBytes = append(env.Value, noCompression)
+	case env.String != nil:
+		ve.ValueBytes = []byte(*env.String)
+	default:
+		ve.ValueBytes = env.Bytes
+	}
+	return nil
+}
+
+// unmarshal @p b of @p key into @p value by the codec of the client, see unmarshal. @p b is
+// decrypted first if encryption is enabled.
+func (c *DCache) unmarshal(key string, b []byte, value any) error {
+	if value == nil {
+		return nil
+	}
+	if c.encryptor != nil {
+		plain, err := c.encryptor.open(b, []byte(c.storeKey(key)))
+		if err != nil {
+			return err
+		}
+		b = plain
+	}
+	codec := c.opts.codec
+	if name, inner, ok := splitCodec(b, value); ok {
+		v, found := c.codecs.Load(name)
+		if !found {
+			return fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+		}
+		codec, b = v.(Codec), inner
+	}
+	return decode(codec, b, value)
+}
+
+// codecName returns the name of @p codec, by its Name method if any, or by its type.
+func codecName(codec Codec) string {
+	if n, ok := codec.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return reflect.TypeOf(codec).String()
+}
+
+// registerCodecs makes values encoded by the builtin codecs, the codec of the client, codecs
+// of policies and known codecs of @p o readable, the latter overriding the builtins of the
+// same names, e.g., ProtoCodec of other fallbacks.
+func (c *DCache) registerCodecs(o *options) {
+	codecs := []Codec{MsgpackCodec{}, JSONCodec{}, ProtoCodec{}, o.codec}
+	for _, p := range o.policies {
+		if p.Codec != nil {
+			codecs = append(codecs, p.Codec)
+		}
+	}
+	for _, codec := range append(codecs, o.knownCodecs...) {
+		c.codecs.Store(codecName(codec), codec)
+	}
+}
+
+// codecFor returns the codec of values of @p key written with @p ctx: the codec given to the
+// call, the codec of the policy of the key, or the codec of the client.
+func (c *DCache) codecFor(ctx context.Context, key string) Codec {
+	if codec, ok := ctx.Value(codecCtxKey{}).(Codec); ok {
+		return codec
+	}
+	if p := c.policy(key); p != nil && p.Codec != nil {
+		return p.Codec
+	}
+	return c.opts.codec
+}
+
+// SetWithCodec is Set that serializes @p val by @p codec, see WithValueCodec.
+func (c *DCache) SetWithCodec(ctx context.Context, key string, val any, ttl time.Duration, codec Codec) error {
+	return c.Set(context.WithValue(ctx, codecCtxKey{}, codec), key, val, ttl)
+}
+
+// tagCodec appends the name of @p codec, @p name, to @p b, @p value encoded by it, see
+// codecTagged. Values stored as-is are returned unchanged. Codecs used to write are known
+// to read values of this client.
+func (c *DCache) tagCodec(b []byte, value any, codec Codec, name string) []byte {
+	switch value.(type) {
+	case nil, []byte, string:
+		return b
+	}
+	if len(name) > 0xff {
+		name = name[:0xff]
+	}
+	c.codecs.LoadOrStore(name, codec)
+	b = append(b, name...)
+	return append(b, byte(len(name)), codecTagged)
+}
+
+// splitCodec returns the name of the codec of @p b and the value encoded by it, if @p b is
+// tagged by tagCodec. Values stored as-is, read into *[]byte and *string, are never tagged.
+func splitCodec(b []byte, value any) (string, []byte, bool) {
+	switch value.(type) {
+	case *[]byte, *string:
+		return "", nil, false
+	}
+	if len(b) < 2 || b[len(b)-1] != codecTagged {
+		return "", nil, false
+	}
+	n := int(b[len(b)-2])
+	if len(b) < n+2 {
+		return "", nil, false
+	}
+	end := len(b) - 2 - n
+	return string(b[end : len(b)-2]), b[:end], true
+}
+
+// ProtoCodec is a Codec serializing proto.Message values to their wire format, so that they
+// are not encoded twice and are readable in other languages, see WithCodec. Targets of
+// messages are either messages, e.g., &pb.User{}, or pointers to them, e.g., new(*pb.User).
+// Other values, including envelopes, are serialized by Fallback, MsgpackCodec if nil.
+// NOTE: values of messages are followed by the compression byte, see Policy.NoCompression.
+type ProtoCodec struct {
+	Fallback Codec
+}
+
+func (ProtoCodec) Name() string {
+	return "proto"
+}
+
+func (p ProtoCodec) fallback() Codec {
+	if p.Fallback == nil {
+		return MsgpackCodec{}
+	}
+	return p.Fallback
+}
+
+// protoNil is the value of nil messages, the nil of msgpack, never valid wire format alone.
+const protoNil = 0xc0
+
+func (p ProtoCodec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		if !m.ProtoReflect().IsValid() {
+			return []byte{protoNil}, nil
+		}
+		return proto.Marshal(m)
+	}
+	return p.fallback().Marshal(v)
+}
+
+func (p ProtoCodec) Unmarshal(data []byte, v any) error {
+	isNil := len(data) == 1 && data[0] == protoNil
+	if m, ok := v.(proto.Message); ok {
+		if isNil {
+			proto.Reset(m)
+			return nil
+		}
+		return proto.Unmarshal(data, m)
+	}
+	// pointers to pointers of messages, allocated as needed.
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		if _, ok := reflect.Zero(rv.Elem().Type()).Interface().(proto.Message); ok {
+			if isNil {
+				rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+				return nil
+			}
+			if rv.Elem().IsNil() {
+				rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+			}
+			return proto.Unmarshal(data, rv.Elem().Interface().(proto.Message))
+		}
+	}
+	return p.fallback().Unmarshal(data, v)
+}
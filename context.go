@@ -0,0 +1,52 @@
+package dcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultDetachedWriteTimeout is the timeout of detached writes if not specified.
+const defaultDetachedWriteTimeout = time.Second
+
+// detachedContext carries values of its parent but is never cancelled with it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (d detachedContext) Value(key any) any         { return d.parent.Value(key) }
+
+// writeContext returns the context for writing values to Redis. When detached writes
+// are enabled, it is detached from @p ctx with its own timeout, so that a caller
+// cancelled right after reading the data source still gets the value cached.
+func (c *DCache) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if !c.opts.detachedWrites {
+		return ctx, func() {}
+	}
+	timeout := c.opts.detachedWriteTimeout
+	if timeout <= 0 {
+		timeout = defaultDetachedWriteTimeout
+	}
+	return context.WithTimeout(detachedContext{parent: ctx}, timeout)
+}
+
+// logger returns the logger of @p ctx, with fields of the request extracted from @p ctx by
+// WithLogFields, if given, so that logs can be correlated with requests. Fields are extracted
+// by a hook, run only for events of enabled levels.
+func (c *DCache) logger(ctx context.Context) *zerolog.Logger {
+	l := log.Ctx(ctx)
+	if c.opts.logFields == nil || l.GetLevel() == zerolog.Disabled {
+		return l
+	}
+	hooked := l.Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, message string) {
+		if fields := c.opts.logFields(ctx); len(fields) > 0 {
+			e.Fields(fields)
+		}
+	}))
+	return &hooked
+}
@@ -0,0 +1,322 @@
+// Package dcachebench drives simulated traffic against dcache, to validate tuning changes,
+// e.g., TTLs, memory sizes and options, before production. Pods are simulated by
+// independent caches sharing one Redis, which can be a real or mini Redis.
+package dcachebench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/stumble/dcache"
+)
+
+// lag measurement polls peers at this interval, and gives up after maxLag.
+const (
+	lagPollInterval = 5 * time.Millisecond
+	maxLag          = 5 * time.Second
+)
+
+// Config configures a simulation.
+type Config struct {
+	// Redis shared by all pods. Keys of the simulation are prefixed by AppName.
+	Redis   redis.UniversalClient
+	AppName string
+	// Pods is the number of simulated pods, each with its own memory cache of MemCacheSize bytes.
+	// Memory cache is not used if MemCacheSize is 0.
+	Pods         int
+	MemCacheSize int
+	// Workers is the number of concurrent callers per pod.
+	Workers int
+	// Keys is the size of the key space, accessed by a Zipf distribution of ZipfS (> 1) and ZipfV (>= 1).
+	Keys  uint64
+	ZipfS float64
+	ZipfV float64
+	// TTL of values read from the simulated data source, which takes LoadLatency per read.
+	TTL          time.Duration
+	LoadLatency  time.Duration
+	ReadInterval time.Duration
+	// WriteRatio is the fraction of operations that are Sets, in [0, 1].
+	WriteRatio float64
+	// LagSampleRatio is the fraction of Sets whose invalidation lag is measured, in [0, 1].
+	LagSampleRatio float64
+	// Duration of the simulation.
+	Duration time.Duration
+	Seed     int64
+	// Options are given to the cache of every pod.
+	Options []dcache.Option
+}
+
+// LagStats summarizes the invalidation lag, from a Set on one pod until no other pod holds
+// the previous value in memory cache.
+type LagStats struct {
+	Samples int
+	P50     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+// Report is the result of a simulation.
+type Report struct {
+	Duration time.Duration
+	// Reads is the number of successful reads.
+	Reads  int64
+	Writes int64
+	Errors int64
+	// MemHits, RedisHits and DBHits are reads by the source of values.
+	MemHits   int64
+	RedisHits int64
+	DBHits    int64
+	// HitRatio is the fraction of reads served by memory cache or Redis.
+	HitRatio float64
+	// SourceReads is the number of reads of the simulated data source.
+	SourceReads int64
+	// LockWaits and AvgLockWait measure contention of the distributed lock.
+	LockWaits       int64
+	AvgLockWait     time.Duration
+	InvalidationLag LagStats
+}
+
+// String formats the report for humans.
+func (r *Report) String() string {
+	return fmt.Sprintf(
+		"duration=%s reads=%d writes=%d errors=%d hit_ratio=%.4f mem=%d redis=%d db=%d "+
+			"source_reads=%d lock_waits=%d avg_lock_wait=%s "+
+			"invalidation_lag(samples=%d p50=%s p99=%s max=%s)",
+		r.Duration, r.Reads, r.Writes, r.Errors, r.HitRatio, r.MemHits, r.RedisHits, r.DBHits,
+		r.SourceReads, r.LockWaits, r.AvgLockWait,
+		r.InvalidationLag.Samples, r.InvalidationLag.P50, r.InvalidationLag.P99, r.InvalidationLag.Max)
+}
+
+// pod is a simulated pod.
+type pod struct {
+	cache *dcache.DCache
+	mem   *freecache.Cache
+}
+
+// simulation holds states shared by workers.
+type simulation struct {
+	cfg  Config
+	pods []*pod
+
+	// versions of keys in the simulated data source.
+	mu       sync.Mutex
+	versions map[string]int64
+
+	reads, writes, errors      atomic.Int64
+	memHits, redisHits, dbHits atomic.Int64
+	sourceReads                atomic.Int64
+	lagMu                      sync.Mutex
+	lags                       []time.Duration
+	lagWg                      sync.WaitGroup
+}
+
+// Run runs a simulation of @p cfg until its Duration elapses or @p ctx is done.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Redis == nil || cfg.Pods <= 0 || cfg.Workers <= 0 || cfg.Keys == 0 {
+		return nil, errors.New("dcachebench: Redis, Pods, Workers and Keys are required")
+	}
+	if cfg.ZipfS <= 1 {
+		cfg.ZipfS = 1.1
+	}
+	if cfg.ZipfV < 1 {
+		cfg.ZipfV = 1
+	}
+	if cfg.ReadInterval <= 0 {
+		cfg.ReadInterval = time.Second
+	}
+	s := &simulation{cfg: cfg, versions: make(map[string]int64)}
+	for i := 0; i < cfg.Pods; i++ {
+		p, err := newPod(cfg)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.pods = append(s.pods, p)
+	}
+	defer s.close()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	startedAt := time.Now()
+	var wg sync.WaitGroup
+	for i, p := range s.pods {
+		for j := 0; j < cfg.Workers; j++ {
+			wg.Add(1)
+			go func(p *pod, seed int64) {
+				defer wg.Done()
+				s.work(ctx, p, seed)
+			}(p, cfg.Seed+int64(i*cfg.Workers+j))
+		}
+	}
+	wg.Wait()
+	duration := time.Since(startedAt)
+	s.lagWg.Wait()
+	return s.report(duration), nil
+}
+
+// newPod creates a pod of @p cfg.
+func newPod(cfg Config) (*pod, error) {
+	p := &pod{}
+	opts := cfg.Options
+	if cfg.MemCacheSize > 0 {
+		p.mem = freecache.NewCache(cfg.MemCacheSize)
+	} else {
+		opts = append(opts[:len(opts):len(opts)], dcache.WithRemoteOnly())
+	}
+	c, err := dcache.NewDCache(cfg.AppName, cfg.Redis, p.mem, cfg.ReadInterval, false, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.cache = c
+	return p, nil
+}
+
+func (s *simulation) close() {
+	for _, p := range s.pods {
+		p.cache.Close()
+	}
+}
+
+// key returns the i-th key of the key space.
+func (s *simulation) key(i uint64) string {
+	return s.cfg.AppName + ":" + strconv.FormatUint(i, 10)
+}
+
+// load reads the current version of @p key from the simulated data source.
+func (s *simulation) load(key string) int64 {
+	s.sourceReads.Add(1)
+	if s.cfg.LoadLatency > 0 {
+		time.Sleep(s.cfg.LoadLatency)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versions[key]
+}
+
+// write increments the version of @p key in the simulated data source.
+func (s *simulation) write(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[key]++
+	return s.versions[key]
+}
+
+func (s *simulation) work(ctx context.Context, p *pod, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(r, s.cfg.ZipfS, s.cfg.ZipfV, s.cfg.Keys-1)
+	for ctx.Err() == nil {
+		key := s.key(zipf.Uint64())
+		if r.Float64() < s.cfg.WriteRatio {
+			s.writes.Add(1)
+			version := s.write(key)
+			if err := p.cache.Set(ctx, key, version, s.cfg.TTL); err != nil {
+				s.errors.Add(1)
+				continue
+			}
+			if r.Float64() < s.cfg.LagSampleRatio {
+				s.measureLag(p, key, version)
+			}
+			continue
+		}
+		var version int64
+		var result dcache.GetResult
+		err := p.cache.Get(ctx, key, &version, s.cfg.TTL, func() (any, error) {
+			return s.load(key), nil
+		}, false, false, dcache.WithResult(&result))
+		if err != nil {
+			if ctx.Err() == nil {
+				s.errors.Add(1)
+			}
+			continue
+		}
+		s.reads.Add(1)
+		s.countHit(result.Source)
+	}
+}
+
+// countHit counts a read served from @p source, see dcache.GetResult.
+func (s *simulation) countHit(source string) {
+	switch source {
+	case "mem":
+		s.memHits.Add(1)
+	case "redis":
+		s.redisHits.Add(1)
+	default:
+		s.dbHits.Add(1)
+	}
+}
+
+// measureLag measures the time until no pod other than @p from holds a version of @p key
+// older than @p version in memory cache.
+func (s *simulation) measureLag(from *pod, key string, version int64) {
+	setAt := time.Now()
+	s.lagWg.Add(1)
+	go func() {
+		defer s.lagWg.Done()
+		for time.Since(setAt) < maxLag {
+			stale := false
+			for _, p := range s.pods {
+				if p == from {
+					continue
+				}
+				var v int64
+				if err := p.cache.Snapshot().Get(key, &v); err == nil && v < version {
+					stale = true
+					break
+				}
+			}
+			if !stale {
+				s.lagMu.Lock()
+				s.lags = append(s.lags, time.Since(setAt))
+				s.lagMu.Unlock()
+				return
+			}
+			time.Sleep(lagPollInterval)
+		}
+	}()
+}
+
+func (s *simulation) report(duration time.Duration) *Report {
+	r := &Report{
+		Duration:    duration,
+		Reads:       s.reads.Load(),
+		Writes:      s.writes.Load(),
+		Errors:      s.errors.Load(),
+		MemHits:     s.memHits.Load(),
+		RedisHits:   s.redisHits.Load(),
+		DBHits:      s.dbHits.Load(),
+		SourceReads: s.sourceReads.Load(),
+	}
+	if served := r.MemHits + r.RedisHits + r.DBHits; served > 0 {
+		r.HitRatio = float64(r.MemHits+r.RedisHits) / float64(served)
+	}
+	var lockWaitTime time.Duration
+	for _, p := range s.pods {
+		stats := p.cache.Stats()
+		r.LockWaits += stats.LockWaits
+		lockWaitTime += stats.LockWaitTime
+	}
+	if r.LockWaits > 0 {
+		r.AvgLockWait = lockWaitTime / time.Duration(r.LockWaits)
+	}
+	sort.Slice(s.lags, func(i, j int) bool { return s.lags[i] < s.lags[j] })
+	if n := len(s.lags); n > 0 {
+		r.InvalidationLag = LagStats{
+			Samples: n,
+			P50:     s.lags[n/2],
+			P99:     s.lags[n*99/100],
+			Max:     s.lags[n-1],
+		}
+	}
+	return r
+}
@@ -0,0 +1,115 @@
+package dcachebench
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/stumble/dcache"
+)
+
+type benchTestSuite struct {
+	suite.Suite
+	redisConn redis.UniversalClient
+}
+
+func TestBenchTestSuite(t *testing.T) {
+	suite.Run(t, &benchTestSuite{})
+}
+
+func (suite *benchTestSuite) SetupSuite() {
+	suite.redisConn = redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+		DB:   12,
+	})
+}
+
+func (suite *benchTestSuite) BeforeTest(_, _ string) {
+	suite.Require().NoError(suite.redisConn.FlushDB(context.Background()).Err())
+}
+
+func (suite *benchTestSuite) TestRun() {
+	report, err := Run(context.Background(), Config{
+		Redis:          suite.redisConn,
+		AppName:        "bench",
+		Pods:           2,
+		MemCacheSize:   1024 * 1024,
+		Workers:        4,
+		Keys:           100,
+		ZipfS:          1.2,
+		TTL:            time.Minute,
+		LoadLatency:    time.Millisecond,
+		WriteRatio:     0.05,
+		LagSampleRatio: 1,
+		Duration:       500 * time.Millisecond,
+		Seed:           1,
+	})
+	suite.Require().NoError(err)
+	suite.Zero(report.Errors)
+	suite.Positive(report.Reads)
+	suite.Positive(report.Writes)
+	suite.Equal(report.Reads, report.MemHits+report.RedisHits+report.DBHits)
+	suite.Greater(report.HitRatio, 0.5)
+	suite.Positive(report.SourceReads)
+	suite.Positive(report.InvalidationLag.Samples)
+	suite.NotEmpty(report.String())
+}
+
+func (suite *benchTestSuite) TestInvalidConfig() {
+	_, err := Run(context.Background(), Config{})
+	suite.Error(err)
+}
+
+func (suite *benchTestSuite) TestReplay() {
+	ctx := context.Background()
+	var recording bytes.Buffer
+	c, err := dcache.NewDCache("recorded", suite.redisConn, freecache.NewCache(1024*1024),
+		10*time.Millisecond, false, false, dcache.WithRecorder(&recording))
+	suite.Require().NoError(err)
+	// working set of about 900KB.
+	value := make([]byte, 400)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 6000; i++ {
+		key := strconv.Itoa(r.Intn(2000))
+		var v []byte
+		suite.Require().NoError(c.Get(ctx, key, &v, time.Minute, func() (any, error) {
+			return value, nil
+		}, false, false))
+		if i%100 == 0 {
+			suite.Require().NoError(c.Invalidate(ctx, key))
+		}
+	}
+	c.Close()
+
+	replay := func(memCacheSize int) *Report {
+		suite.Require().NoError(suite.redisConn.FlushDB(ctx).Err())
+		report, err := Replay(ctx, Config{
+			Redis:        suite.redisConn,
+			AppName:      "replay",
+			MemCacheSize: memCacheSize,
+			TTL:          time.Minute,
+			ReadInterval: 10 * time.Millisecond,
+		}, bytes.NewReader(recording.Bytes()))
+		suite.Require().NoError(err)
+		suite.Zero(report.Errors)
+		suite.EqualValues(6000, report.Reads)
+		suite.EqualValues(60, report.Writes)
+		// timings are not deterministic.
+		report.Duration, report.LockWaits, report.AvgLockWait = 0, 0, 0
+		return report
+	}
+	small, large := replay(512*1024), replay(4*1024*1024)
+	suite.Less(small.MemHits, large.MemHits)
+	suite.Equal(small.SourceReads, large.SourceReads)
+	suite.Equal(large, replay(4*1024*1024))
+
+	_, err = Replay(ctx, Config{Redis: suite.redisConn}, bytes.NewReader([]byte("garbage")))
+	suite.Equal(dcache.ErrBadRecording, err)
+}
@@ -0,0 +1,80 @@
+package dcachebench
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/stumble/dcache"
+)
+
+// Replay re-drives the traffic recorded by dcache.WithRecorder in @p r against a pod of
+// @p cfg, e.g., to evaluate the hit ratio with twice the memory offline. Only Redis, AppName,
+// MemCacheSize, TTL, ReadInterval and Options of @p cfg are used; keys are prefixed by AppName.
+//
+// Events are replayed sequentially as fast as possible, so results are deterministic for the
+// same recording and configuration, given a fresh Redis. Gets read values of recorded sizes
+// from the simulated data source on misses, Sets write values of recorded sizes, and both Sets
+// and Invalidates are counted as writes.
+func Replay(ctx context.Context, cfg Config, r io.Reader) (*Report, error) {
+	if cfg.Redis == nil {
+		return nil, errors.New("dcachebench: Redis is required")
+	}
+	if cfg.ReadInterval <= 0 {
+		cfg.ReadInterval = time.Second
+	}
+	p, err := newPod(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &simulation{cfg: cfg, pods: []*pod{p}}
+	defer s.close()
+
+	rr := dcache.NewRecordReader(r)
+	startedAt := time.Now()
+	for ctx.Err() == nil {
+		e, err := rr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.replay(ctx, p, e)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.report(time.Since(startedAt)), nil
+}
+
+// replay re-drives event @p e on pod @p p.
+func (s *simulation) replay(ctx context.Context, p *pod, e dcache.RecordEvent) {
+	key := s.cfg.AppName + ":" + e.Key
+	switch e.Op {
+	case dcache.RecordGet:
+		var value []byte
+		var result dcache.GetResult
+		err := p.cache.Get(ctx, key, &value, s.cfg.TTL, func() (any, error) {
+			s.sourceReads.Add(1)
+			return make([]byte, e.Size), nil
+		}, false, false, dcache.WithResult(&result))
+		if err != nil {
+			s.errors.Add(1)
+			return
+		}
+		s.reads.Add(1)
+		s.countHit(result.Source)
+	case dcache.RecordSet:
+		s.writes.Add(1)
+		if err := p.cache.Set(ctx, key, make([]byte, e.Size), s.cfg.TTL); err != nil {
+			s.errors.Add(1)
+		}
+	case dcache.RecordInvalidate:
+		s.writes.Add(1)
+		if err := p.cache.Invalidate(ctx, key); err != nil {
+			s.errors.Add(1)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dcache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DegradationThresholds are thresholds of internal signals, beyond which the cache is
+// considered degraded. Zero value of a threshold disables the corresponding check.
+type DegradationThresholds struct {
+	// MinHitRatio is the minimum ratio of requests served by memory or Redis.
+	MinHitRatio float64
+	// MinRequests is the minimum number of requests in an interval to evaluate MinHitRatio.
+	MinRequests int64
+	// MaxErrors is the maximum number of internal errors in an interval.
+	MaxErrors int64
+	// MaxPubSubGap is the maximum duration without receiving any invalidation message.
+	// When set, clients publish keepalive messages so that gaps are detectable in quiet times.
+	MaxPubSubGap time.Duration
+	// MaxLockWait is the maximum average duration spent waiting for distributed locks
+	// held by others, among requests that waited.
+	MaxLockWait time.Duration
+}
+
+// DegradationStatus is the result of evaluating internal signals in the last interval.
+type DegradationStatus struct {
+	Degraded    bool
+	Reasons     []string
+	EvaluatedAt time.Time
+
+	Requests    int64
+	HitRatio    float64
+	Errors      int64
+	PubSubGap   time.Duration
+	AvgLockWait time.Duration
+}
+
+// signalCounters are internal signals accumulated for the degradation detector.
+type signalCounters struct {
+	hits          atomic.Int64 // served by memory or Redis.
+	misses        atomic.Int64 // served by data source.
+	errors        atomic.Int64
+	lockWaits     atomic.Int64
+	lockWaitNanos atomic.Int64
+	lastPubSubAt  atomic.Int64 // UNIX nanoseconds.
+}
+
+func (s *signalCounters) observeHit(label metricHitLabel) {
+	if label == hitLabelDB {
+		s.misses.Add(1)
+	} else {
+		s.hits.Add(1)
+	}
+}
+
+func (s *signalCounters) observeLockWait(d time.Duration) {
+	s.lockWaits.Add(1)
+	s.lockWaitNanos.Add(int64(d))
+}
+
+// degradationDetector evaluates signals every interval.
+type degradationDetector struct {
+	interval   time.Duration
+	thresholds DegradationThresholds
+	onChange   func(DegradationStatus)
+
+	mu     sync.Mutex
+	status DegradationStatus
+}
+
+// Degraded returns true if the cache was evaluated as degraded in the last interval.
+// Always false if not enabled by WithDegradationDetector.
+func (c *DCache) Degraded() bool {
+	return c.DegradationStatus().Degraded
+}
+
+// DegradationStatus returns the status evaluated in the last interval.
+func (c *DCache) DegradationStatus() DegradationStatus {
+	if c.degradation == nil {
+		return DegradationStatus{}
+	}
+	c.degradation.mu.Lock()
+	defer c.degradation.mu.Unlock()
+	return c.degradation.status
+}
+
+// detectDegradation evaluates signals periodically until closed.
+func (c *DCache) detectDegradation() {
+	defer c.wg.Done()
+	d := c.degradation
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	c.signals.lastPubSubAt.Store(getNow().UnixNano())
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		status := evaluateSignals(c.signals, &d.thresholds, (c.pubsub != nil && c.tracking == nil) || c.stream != nil)
+		d.mu.Lock()
+		changed := status.Degraded != d.status.Degraded
+		d.status = status
+		d.mu.Unlock()
+		if c.stats != nil {
+			c.stats.UpdateDegraded(status.Degraded)
+		}
+		if changed {
+			c.logger(c.ctx).Warn().Msgf("Cache degraded: %v, reasons: %v", status.Degraded, status.Reasons)
+			if d.onChange != nil {
+				d.onChange(status)
+			}
+		}
+	}
+}
+
+// evaluateSignals evaluates and resets interval counters of @p s.
+func evaluateSignals(s *signalCounters, th *DegradationThresholds, hasPubSub bool) DegradationStatus {
+	now := getNow()
+	hits, misses := s.hits.Swap(0), s.misses.Swap(0)
+	lockWaits, lockWaitNanos := s.lockWaits.Swap(0), s.lockWaitNanos.Swap(0)
+	status := DegradationStatus{
+		EvaluatedAt: now,
+		Requests:    hits + misses,
+		Errors:      s.errors.Swap(0),
+		PubSubGap:   now.Sub(time.Unix(0, s.lastPubSubAt.Load())),
+	}
+	if status.Requests > 0 {
+		status.HitRatio = float64(hits) / float64(status.Requests)
+	}
+	if lockWaits > 0 {
+		status.AvgLockWait = time.Duration(lockWaitNanos / lockWaits)
+	}
+	if th.MinHitRatio > 0 && status.Requests >= th.MinRequests && status.Requests > 0 &&
+		status.HitRatio < th.MinHitRatio {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("hit ratio %.2f", status.HitRatio))
+	}
+	if th.MaxErrors > 0 && status.Errors > th.MaxErrors {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("%d errors", status.Errors))
+	}
+	if th.MaxPubSubGap > 0 && hasPubSub && status.PubSubGap > th.MaxPubSubGap {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("pubsub gap %s", status.PubSubGap))
+	}
+	if th.MaxLockWait > 0 && status.AvgLockWait > th.MaxLockWait {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("lock wait %s", status.AvgLockWait))
+	}
+	status.Degraded = len(status.Reasons) > 0
+	return status
+}
@@ -0,0 +1,64 @@
+package dcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// maxValueDigests caps the number of tracked digests, all of them are dropped when exceeded.
+const maxValueDigests = 100000
+
+// valueDigest is the digest of the value last Set by this pod.
+type valueDigest struct {
+	sum       uint64
+	expiredAt time.Time
+}
+
+// valueDigests tracks digests of values Set by this pod, so that Sets of the same bytes
+// can skip the Redis write and the invalidation broadcast.
+// Digests are dropped when keys are changed by any other writes, e.g., Invalidate,
+// read-through backfills and invalidations from peers.
+// Keys are store keys, the same as those of memory cache.
+type valueDigests struct {
+	mu      sync.Mutex
+	entries map[string]valueDigest
+}
+
+func newValueDigests() *valueDigests {
+	return &valueDigests{entries: make(map[string]valueDigest)}
+}
+
+// unchanged returns true if @p valueBytes are the same as the value last Set to @p key,
+// which will not expire within half of @p ttl.
+func (d *valueDigests) unchanged(key string, valueBytes []byte, ttl time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[key]
+	return ok && e.sum == xxhash.Sum64(valueBytes) && e.expiredAt.Sub(getNow()) >= ttl/2
+}
+
+// record the digest of @p valueBytes Set to @p key with @p ttl.
+func (d *valueDigests) record(key string, valueBytes []byte, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.entries) >= maxValueDigests {
+		d.entries = make(map[string]valueDigest)
+	}
+	d.entries[key] = valueDigest{sum: xxhash.Sum64(valueBytes), expiredAt: getNow().Add(ttl)}
+}
+
+// reset forgets digests of all keys.
+func (d *valueDigests) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = make(map[string]valueDigest)
+}
+
+// forget the digest of @p key.
+func (d *valueDigests) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, key)
+}
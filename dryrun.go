@@ -0,0 +1,137 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDryRunEntries bounds keys tracked by dry-run, keys beyond are not tracked until
+// others expire, so that estimates are lower bounds for huge key spaces.
+const maxDryRunEntries = 1 << 20
+
+// dryRunEntry is a value that would have been cached.
+type dryRunEntry struct {
+	size      int
+	expiredAt time.Time
+}
+
+// dryRun tracks what would have been cached in dry-run mode, see WithDryRun.
+type dryRun struct {
+	keyPrefix string
+
+	mu      sync.Mutex
+	entries map[string]dryRunEntry
+	bytes   int64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newDryRun(keyPrefix string) *dryRun {
+	return &dryRun{keyPrefix: keyPrefix, entries: make(map[string]dryRunEntry)}
+}
+
+// lookup returns true if @p key would have been a cache hit, and counts it.
+func (d *dryRun) lookup(key string) bool {
+	d.mu.Lock()
+	e, ok := d.entries[key]
+	if ok && !getNow().Before(e.expiredAt) {
+		d.removeLocked(key)
+		ok = false
+	}
+	d.mu.Unlock()
+	if ok {
+		d.hits.Add(1)
+	} else {
+		d.misses.Add(1)
+	}
+	return ok
+}
+
+// store tracks that @p size bytes of @p key would have been cached for @p ttl.
+func (d *dryRun) store(key string, size int, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(key)
+	if ttl <= 0 {
+		return
+	}
+	if len(d.entries) >= maxDryRunEntries {
+		now := getNow()
+		for k, e := range d.entries {
+			if !now.Before(e.expiredAt) {
+				d.removeLocked(k)
+			}
+		}
+		if len(d.entries) >= maxDryRunEntries {
+			return
+		}
+	}
+	// key is counted as it is stored in Redis along with the value.
+	size += len(storeKeyOf(d.keyPrefix, key))
+	d.entries[key] = dryRunEntry{size: size, expiredAt: getNow().Add(ttl)}
+	d.bytes += int64(size)
+}
+
+// remove tracks that @p key would have been invalidated.
+func (d *dryRun) remove(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(key)
+}
+
+func (d *dryRun) removeLocked(key string) {
+	if e, ok := d.entries[key]; ok {
+		d.bytes -= int64(e.size)
+		delete(d.entries, key)
+	}
+}
+
+// size returns the number and total bytes of keys that would be cached now.
+func (d *dryRun) size() (int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := getNow()
+	for k, e := range d.entries {
+		if !now.Before(e.expiredAt) {
+			d.removeLocked(k)
+		}
+	}
+	return int64(len(d.entries)), d.bytes
+}
+
+// dryRunGet is GetWithTtl in dry-run mode, @p read is always called and nothing is written.
+func (c *DCache) dryRunGet(ctx context.Context,
+	key string, target any, read ReadWithTtlFunc, noCache bool, noStore bool, co *callOptions) error {
+	if !noCache {
+		c.observeDryRun(key)
+	}
+	readStartedAt := getNow()
+	val, ttl, err := read()
+	if err != nil {
+		return err
+	}
+	c.makeHitRecorder(hitLabelDB, readStartedAt)()
+	if u, ok := val.(unstoredValue); ok {
+		val, noStore = u.value, true
+	}
+	valueBytes, err := c.marshal(ctx, key, val)
+	if err != nil {
+		return err
+	}
+	if !noStore {
+		c.dryRun.store(key, len(valueBytes), c.policyTTL(key, ttl))
+	}
+	co.setResult(&flightResult{valueBytes: valueBytes, from: hitDB})
+	return c.unmarshal(key, valueBytes, target)
+}
+
+// observeDryRun counts whether reading @p key would have been a cache hit.
+func (c *DCache) observeDryRun(key string) {
+	hit := c.dryRun.lookup(key)
+	if c.stats != nil {
+		c.stats.ObserveDryRun(hit)
+	}
+}
@@ -0,0 +1,78 @@
+package dcache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// keyIDLen is the length of key IDs prefixed to encrypted values, to find the key in rings.
+const keyIDLen = 4
+
+// ErrDecrypt is returned when reading a value that cannot be decrypted by any key of the ring.
+var ErrDecrypt = errors.New("dcache: failed to decrypt")
+
+// encryptor encrypts values by AES-GCM with the first key of a ring, and decrypts values
+// encrypted by any key of the ring. Encrypted values are key ID, nonce, then ciphertext, and
+// authenticate the store keys of values as additional data, so that values copied to other
+// keys are not decrypted.
+type encryptor struct {
+	aeads []cipher.AEAD
+	ids   [][]byte
+}
+
+func newEncryptor(keys [][]byte) (*encryptor, error) {
+	e := &encryptor{}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %w", i, err)
+		}
+		sum := sha256.Sum256(key)
+		e.aeads = append(e.aeads, aead)
+		e.ids = append(e.ids, sum[:keyIDLen])
+	}
+	return e, nil
+}
+
+// seal encrypts @p plain of the store key @p aad by the first key.
+func (e *encryptor) seal(plain []byte, aad []byte) ([]byte, error) {
+	aead := e.aeads[0]
+	b := make([]byte, keyIDLen+aead.NonceSize(), keyIDLen+aead.NonceSize()+len(plain)+aead.Overhead())
+	copy(b, e.ids[0])
+	if _, err := rand.Read(b[keyIDLen:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(b, b[keyIDLen:], plain, aad), nil
+}
+
+// open decrypts @p b of the store key @p aad by the key of its key ID.
+func (e *encryptor) open(b []byte, aad []byte) ([]byte, error) {
+	if len(b) < keyIDLen {
+		return nil, ErrDecrypt
+	}
+	for i, id := range e.ids {
+		if !bytes.Equal(b[:keyIDLen], id) {
+			continue
+		}
+		aead := e.aeads[i]
+		if len(b) < keyIDLen+aead.NonceSize() {
+			return nil, ErrDecrypt
+		}
+		nonce := b[keyIDLen : keyIDLen+aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, b[keyIDLen+aead.NonceSize():], aad)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return plain, nil
+	}
+	return nil, ErrDecrypt
+}
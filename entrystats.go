@@ -0,0 +1,241 @@
+package dcache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	entryStatsKeyPrefix = ":dcache_entry_stats:"
+	// maxEntryStatsKeys bounds keys tracked by entry stats, keys beyond are not tracked until
+	// the least recently accessed key is idle for entryStatsIdle.
+	maxEntryStatsKeys = 1 << 16
+	entryStatsIdle    = time.Hour
+	// entryStatsFlushInterval is the interval of adding entry stats of this client to Redis.
+	entryStatsFlushInterval = time.Second
+	// entryStatsTTL is the TTL of entry stats in Redis since the last access.
+	entryStatsTTL = 24 * time.Hour
+)
+
+// ErrNoEntryStats is returned by EntryStats if WithEntryStats is not enabled.
+var ErrNoEntryStats = errors.New("dcache: entry stats are not enabled")
+
+// EntryStats are approximate statistics of a key, see WithEntryStats.
+type EntryStats struct {
+	// Hits is the number of reads served from memory cache or Redis.
+	Hits int64
+	// Refreshes is the number of times the value was read from the data source.
+	Refreshes int64
+	// LastAccess is the time of the last hit or refresh, zero if never.
+	LastAccess time.Time
+}
+
+// entryCounter is the entry stats of a key in this client, with the part not yet flushed.
+type entryCounter struct {
+	EntryStats
+	key              string
+	pendingHits      int64
+	pendingRefreshes int64
+	dirty            bool
+}
+
+// entryStats tracks entry stats of keys in this client, in the order of their last access.
+type entryStats struct {
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newEntryStats() *entryStats {
+	return &entryStats{lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// observe counts a hit or a refresh of @p key.
+func (s *entryStats) observe(key string, refresh bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := getNow()
+	var e *entryCounter
+	if elem, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(elem)
+		e = elem.Value.(*entryCounter)
+	} else {
+		if s.lru.Len() >= maxEntryStatsKeys {
+			// others are accessed later than the least recently accessed key.
+			last := s.lru.Back()
+			if l := last.Value.(*entryCounter); l.dirty || now.Sub(l.LastAccess) <= entryStatsIdle {
+				return
+			}
+			s.lru.Remove(last)
+			delete(s.entries, last.Value.(*entryCounter).key)
+		}
+		e = &entryCounter{key: key}
+		s.entries[key] = s.lru.PushFront(e)
+	}
+	if refresh {
+		e.Refreshes++
+		e.pendingRefreshes++
+	} else {
+		e.Hits++
+		e.pendingHits++
+	}
+	e.LastAccess, e.dirty = now, true
+}
+
+// get returns the stats of @p key in this client, and the part not yet flushed.
+func (s *entryStats) get(key string) (EntryStats, EntryStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return EntryStats{}, EntryStats{}
+	}
+	e := elem.Value.(*entryCounter)
+	return e.EntryStats, EntryStats{Hits: e.pendingHits, Refreshes: e.pendingRefreshes, LastAccess: e.LastAccess}
+}
+
+// takePending returns stats of keys changed since the last call, and resets them.
+func (s *entryStats) takePending() map[string]EntryStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make(map[string]EntryStats)
+	for k, elem := range s.entries {
+		e := elem.Value.(*entryCounter)
+		if !e.dirty {
+			continue
+		}
+		pending[k] = EntryStats{Hits: e.pendingHits, Refreshes: e.pendingRefreshes, LastAccess: e.LastAccess}
+		e.pendingHits, e.pendingRefreshes, e.dirty = 0, 0, false
+	}
+	return pending
+}
+
+// restore adds back @p pending stats that failed to be flushed.
+func (s *entryStats) restore(pending map[string]EntryStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, p := range pending {
+		if elem, ok := s.entries[k]; ok {
+			e := elem.Value.(*entryCounter)
+			e.pendingHits += p.Hits
+			e.pendingRefreshes += p.Refreshes
+			e.dirty = true
+		}
+	}
+}
+
+// observeRead counts a read of @p key served from the cache.
+func (c *DCache) observeRead(key string) {
+	if c.writes != nil {
+		c.writes.read(key)
+	}
+	if c.writeReport != nil {
+		if prefix, first := c.writeReport.read(key); first && c.stats != nil {
+			c.stats.ObserveWriteOutcome(prefix, true, 1)
+		}
+	}
+	if c.entryStats != nil {
+		c.entryStats.observe(key, false)
+	}
+}
+
+// observeRefresh counts a read of @p key from the data source.
+func (c *DCache) observeRefresh(key string) {
+	if c.entryStats != nil {
+		c.entryStats.observe(key, true)
+	}
+}
+
+func (c *DCache) entryStatsKey(key string) string {
+	return entryStatsKeyPrefix + c.appName + ":" + key
+}
+
+// EntryStats returns approximate statistics of @p key, e.g., to tell whether anyone reads it.
+// Stats are of this client, or of all clients of the same app name if aggregated in Redis,
+// see WithEntryStats. ErrNoEntryStats is returned if entry stats are not enabled.
+func (c *DCache) EntryStats(ctx context.Context, key string) (stats EntryStats, err error) {
+	ctx = c.tagContext(ctx, "EntryStats")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "EntryStats", []string{fmt.Sprintf("key=%s", key)})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if c.entryStats == nil {
+		return stats, ErrNoEntryStats
+	}
+	if key, err = c.namespaced(ctx, key); err != nil {
+		return
+	}
+	local, pending := c.entryStats.get(key)
+	if !c.opts.entryStatsAggregate {
+		return local, nil
+	}
+	fields, err := c.conn.HGetAll(ctx, c.entryStatsKey(key)).Result()
+	if err != nil {
+		return stats, err
+	}
+	stats.Hits, _ = strconv.ParseInt(fields["hits"], 10, 64)
+	stats.Refreshes, _ = strconv.ParseInt(fields["refreshes"], 10, 64)
+	if ms, _ := strconv.ParseInt(fields["last_access"], 10, 64); ms > 0 {
+		stats.LastAccess = time.UnixMilli(ms)
+	}
+	// not yet flushed by this client.
+	stats.Hits += pending.Hits
+	stats.Refreshes += pending.Refreshes
+	if pending.LastAccess.After(stats.LastAccess) {
+		stats.LastAccess = pending.LastAccess
+	}
+	return stats, nil
+}
+
+// runEntryStats flushes entry stats to Redis periodically until the cache is closed.
+func (c *DCache) runEntryStats() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(entryStatsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flushEntryStats(c.ctx)
+		case <-c.ctx.Done():
+			// flush on a fresh context because c.ctx is done.
+			ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+			defer cancel()
+			c.flushEntryStats(ctx)
+			return
+		}
+	}
+}
+
+// flushEntryStats adds stats changed since the last flush to Redis. The last access is the
+// latest flushed, approximately.
+func (c *DCache) flushEntryStats(ctx context.Context) {
+	pending := c.entryStats.takePending()
+	if len(pending) == 0 {
+		return
+	}
+	_, err := c.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, p := range pending {
+			k := c.entryStatsKey(key)
+			if p.Hits > 0 {
+				pipe.HIncrBy(ctx, k, "hits", p.Hits)
+			}
+			if p.Refreshes > 0 {
+				pipe.HIncrBy(ctx, k, "refreshes", p.Refreshes)
+			}
+			pipe.HSet(ctx, k, "last_access", p.LastAccess.UnixMilli())
+			pipe.PExpire(ctx, k, entryStatsTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to flush entry stats of %d keys", len(pending))
+		c.entryStats.restore(pending)
+	}
+}
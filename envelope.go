@@ -0,0 +1,107 @@
+package dcache
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// EnvelopeVersion is the format of envelopes of values in Redis, see WithEnvelopeVersion.
+type EnvelopeVersion uint8
+
+const (
+	// EnvelopeCodec serializes envelopes by the codec, e.g., a msgpack map wrapping the
+	// msgpack value by default. It is the default.
+	EnvelopeCodec EnvelopeVersion = iota + 1
+	// EnvelopeFlat prefixes values with a header of the magic byte, the version and the
+	// expiration in big-endian UNIX milliseconds, so that values are not encoded twice.
+	EnvelopeFlat
+	// EnvelopeTagged prefixes envelopes serialized by the codec with the magic byte and the
+	// version, so that readers tell the format of any value without guessing, and later
+	// versions can change the schema of envelopes.
+	EnvelopeTagged
+)
+
+// latestEnvelopeVersion is the latest version understood by this client. Envelopes of later
+// versions, e.g., written by newer clients during rolling deploys, are read as misses.
+const latestEnvelopeVersion = EnvelopeTagged
+
+// envelopeMagic starts versioned envelopes. It is never the first byte of msgpack, nor of
+// JSON, so it does not collide with envelopes serialized by codecs.
+const envelopeMagic = 0xc1
+
+// versionHeaderLen is the length of the magic byte and the version.
+const versionHeaderLen = 2
+
+// flatHeaderLen is the length of headers of EnvelopeFlat.
+const flatHeaderLen = versionHeaderLen + 8
+
+// ErrBadEnvelope is returned when reading an envelope of an unknown version.
+var ErrBadEnvelope = errors.New("dcache: bad envelope")
+
+// encodeEnvelope serializes @p ve in the envelope version of the client.
+func (c *DCache) encodeEnvelope(ve *ValueBytesExpiredAt) ([]byte, error) {
+	switch c.opts.envelopeVersion {
+	case EnvelopeFlat:
+		return encodeFlatEnvelope(ve), nil
+	case EnvelopeTagged:
+		b, err := c.opts.codec.Marshal(ve)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{envelopeMagic, byte(EnvelopeTagged)}, b...), nil
+	default:
+		return c.opts.codec.Marshal(ve)
+	}
+}
+
+// decodeEnvelope deserializes an envelope from @p b of any version, so that clients of
+// different versions can share keys during migrations.
+func (c *DCache) decodeEnvelope(b []byte) (*ValueBytesExpiredAt, error) {
+	ve := &ValueBytesExpiredAt{}
+	switch envelopeVersionOf(b) {
+	case EnvelopeCodec:
+		if err := c.opts.codec.Unmarshal(b, ve); err != nil {
+			return nil, err
+		}
+	case EnvelopeFlat:
+		return decodeFlatEnvelope(b)
+	case EnvelopeTagged:
+		if err := c.opts.codec.Unmarshal(b[versionHeaderLen:], ve); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrBadEnvelope
+	}
+	return ve, nil
+}
+
+// encodeFlatEnvelope serializes @p ve in EnvelopeFlat, regardless of codecs.
+func encodeFlatEnvelope(ve *ValueBytesExpiredAt) []byte {
+	b := make([]byte, flatHeaderLen, flatHeaderLen+len(ve.ValueBytes))
+	b[0], b[1] = envelopeMagic, byte(EnvelopeFlat)
+	binary.BigEndian.PutUint64(b[versionHeaderLen:], uint64(ve.ExpiredAt))
+	return append(b, ve.ValueBytes...)
+}
+
+// decodeFlatEnvelope deserializes @p b of EnvelopeFlat, see encodeFlatEnvelope.
+func decodeFlatEnvelope(b []byte) (*ValueBytesExpiredAt, error) {
+	if envelopeVersionOf(b) != EnvelopeFlat || len(b) < flatHeaderLen {
+		return nil, ErrBadEnvelope
+	}
+	ve := &ValueBytesExpiredAt{ExpiredAt: int64(binary.BigEndian.Uint64(b[versionHeaderLen:]))}
+	if len(b) > flatHeaderLen {
+		ve.ValueBytes = b[flatHeaderLen:]
+	}
+	return ve, nil
+}
+
+// envelopeVersionOf returns the version of envelope @p b.
+func envelopeVersionOf(b []byte) EnvelopeVersion {
+	if len(b) == 0 || b[0] != envelopeMagic {
+		return EnvelopeCodec
+	}
+	if len(b) < versionHeaderLen {
+		return 0
+	}
+	return EnvelopeVersion(b[1])
+}
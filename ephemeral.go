@@ -0,0 +1,58 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ephemeralKeys are keys owned by this client, invalidated by Close, see MarkEphemeral.
+type ephemeralKeys struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// MarkEphemeral marks @p key owned by this client, e.g., presence or heartbeat entries of the
+// pod, so that Close deletes it from Redis and invalidates it on peers, instead of leaving a
+// ghost entry until it expires.
+func (c *DCache) MarkEphemeral(key string) {
+	c.ephemeral.mu.Lock()
+	defer c.ephemeral.mu.Unlock()
+	if c.ephemeral.keys == nil {
+		c.ephemeral.keys = make(map[string]struct{})
+	}
+	c.ephemeral.keys[key] = struct{}{}
+}
+
+// UnmarkEphemeral releases @p key marked by MarkEphemeral, it is then kept by Close.
+func (c *DCache) UnmarkEphemeral(key string) {
+	c.ephemeral.mu.Lock()
+	defer c.ephemeral.mu.Unlock()
+	delete(c.ephemeral.keys, key)
+}
+
+// SetEphemeral is Set that also marks @p key ephemeral, see MarkEphemeral.
+func (c *DCache) SetEphemeral(ctx context.Context, key string, val any, ttl time.Duration) error {
+	c.MarkEphemeral(key)
+	return c.Set(ctx, key, val, ttl)
+}
+
+// invalidateEphemeral invalidates keys marked ephemeral, on a fresh context as the caller of
+// Close may be cancelled already. Invalidations are published by Close with pending ones.
+func (c *DCache) invalidateEphemeral() {
+	c.ephemeral.mu.Lock()
+	keys := make([]string, 0, len(c.ephemeral.keys))
+	for key := range c.ephemeral.keys {
+		keys = append(keys, key)
+	}
+	c.ephemeral.keys = nil
+	c.ephemeral.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+	defer cancel()
+	if err := c.InvalidateMulti(ctx, keys...); err != nil {
+		c.logger(c.ctx).Err(err).Msgf("Failed to invalidate %d ephemeral keys on close", len(keys))
+	}
+}
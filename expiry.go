@@ -0,0 +1,178 @@
+package dcache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxTrackedWrites bounds keys written by this client tracked for expiry events, keys beyond
+// are not tracked until others expire.
+const maxTrackedWrites = 1 << 16
+
+// keyspaceOrigin is the origin of keys evicted by keyspace notifications in metrics.
+const keyspaceOrigin = "keyspace"
+
+// ExpiryEvent is a key of the cache expired in Redis, see WithExpiryEvents.
+type ExpiryEvent struct {
+	Key string
+	// Tracked is true if the key was last written by this client, and then Unread is true if
+	// this client has not read it since, i.e., the write was likely wasted.
+	Tracked bool
+	Unread  bool
+}
+
+// trackedWrite is a key written by this client.
+type trackedWrite struct {
+	expiredAt time.Time
+	read      bool
+}
+
+// writeTracker tracks keys written by this client, and whether they are read since.
+type writeTracker struct {
+	mu     sync.Mutex
+	writes map[string]*trackedWrite
+}
+
+func newWriteTracker() *writeTracker {
+	return &writeTracker{writes: make(map[string]*trackedWrite)}
+}
+
+// written tracks @p key written with @p ttl.
+func (t *writeTracker) written(key string, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := getNow()
+	if _, ok := t.writes[key]; !ok && len(t.writes) >= maxTrackedWrites {
+		// drop keys whose events were missed, e.g., during reconnections.
+		for k, w := range t.writes {
+			if now.Sub(w.expiredAt) > time.Minute {
+				delete(t.writes, k)
+			}
+		}
+		if len(t.writes) >= maxTrackedWrites {
+			return
+		}
+	}
+	t.writes[key] = &trackedWrite{expiredAt: now.Add(ttl)}
+}
+
+// read marks @p key read, if tracked.
+func (t *writeTracker) read(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w, ok := t.writes[key]; ok {
+		w.read = true
+	}
+}
+
+// forget stops tracking @p key, returns whether it was tracked and read.
+func (t *writeTracker) forget(key string) (tracked bool, read bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.writes[key]
+	if !ok {
+		return false, false
+	}
+	delete(t.writes, key)
+	return true, w.read
+}
+
+// expiryChannel returns the channel of keyspace notifications of expired keys of the DB of
+// the client.
+func (c *DCache) expiryChannel() string {
+	return c.keyeventChannel("expired")
+}
+
+// keyeventChannel returns the channel of keyspace notifications of @p event of the DB of the
+// client.
+func (c *DCache) keyeventChannel(event string) string {
+	db := 0
+	if client, ok := c.conn.(*redis.Client); ok {
+		db = client.Options().DB
+	}
+	return fmt.Sprintf("__keyevent@%d__:%s", db, event)
+}
+
+// listenExpiry delivers expiry events until the cache is closed.
+func (c *DCache) listenExpiry(pubsub *redis.PubSub) {
+	defer c.wg.Done()
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		var ok bool
+		select {
+		case msg, ok = <-ch:
+			if !ok {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+		key, ok := c.keyOf(msg.Payload)
+		if !ok {
+			continue
+		}
+		e := ExpiryEvent{Key: key}
+		var read bool
+		e.Tracked, read = c.writes.forget(e.Key)
+		e.Unread = e.Tracked && !read
+		c.counters.expired.Add(1)
+		if e.Unread {
+			c.counters.expiredUnread.Add(1)
+		}
+		if c.stats != nil {
+			c.stats.ObserveExpired(e.Tracked, e.Unread)
+		}
+		if c.opts.onExpiry != nil {
+			c.opts.onExpiry(e)
+		}
+	}
+}
+
+// startExpiryEvents subscribes to keyspace notifications of expired keys.
+func (c *DCache) startExpiryEvents() {
+	c.writes = newWriteTracker()
+	pubsub := c.conn.Subscribe(c.ctx, c.expiryChannel())
+	c.wg.Add(1)
+	go c.listenExpiry(pubsub)
+}
+
+// startKeyspaceEviction subscribes to keyspace notifications of deleted and expired keys, see
+// WithKeyspaceEviction.
+func (c *DCache) startKeyspaceEviction() {
+	pubsub := c.conn.Subscribe(c.ctx, c.keyeventChannel("del"), c.keyeventChannel("expired"))
+	c.wg.Add(1)
+	go c.listenKeyspaceEviction(pubsub)
+}
+
+// listenKeyspaceEviction evicts keys of the cache deleted or expired in Redis from memory
+// cache, until the cache is closed.
+func (c *DCache) listenKeyspaceEviction(pubsub *redis.PubSub) {
+	defer c.wg.Done()
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		var ok bool
+		select {
+		case msg, ok = <-ch:
+			if !ok {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+		if _, ok := c.keyOf(msg.Payload); !ok {
+			continue
+		}
+		if c.stats != nil {
+			c.stats.ObserveInvalidateReceived(keyspaceOrigin, 1)
+		}
+		// changes are not timestamped, and are applied even if written locally later.
+		c.applyInvalidation(msg.Payload, time.Time{}, valueStamp{}, "")
+	}
+}
@@ -0,0 +1,76 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Flush clears everything cached, e.g., to recover from cache poisoning: the memory cache of
+// this client, all keys of the cache in Redis, walked by SCAN in batches of
+// defaultMaintenanceBatch, and memory caches of peers, notified by a flush message.
+// NOTE: keys of all clients of the same key prefix sharing the Redis DB are deleted,
+// including other apps without key prefixes, see WithKeyPrefix.
+// ErrClusterUnsupported is returned on Redis Cluster, where SCAN walks only one node.
+func (c *DCache) Flush(ctx context.Context) (err error) {
+	ctx = c.tagContext(ctx, "Flush")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "Flush", nil)
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if _, ok := c.conn.(*redis.ClusterClient); ok {
+		return ErrClusterUnsupported
+	}
+	c.flushLocal()
+	match := c.storeKey("*")
+	var cursor uint64
+	for {
+		var keys []string
+		keys, cursor, err = c.conn.Scan(ctx, cursor, match, defaultMaintenanceBatch).Result()
+		if err != nil {
+			return
+		}
+		if len(keys) > 0 {
+			if err = c.conn.Unlink(ctx, keys...).Err(); err != nil {
+				return
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	// values backfilled from Redis during the walk.
+	c.flushLocal()
+	c.publishFlush(ctx)
+	return nil
+}
+
+// publishFlush publishes a flush message, clearing memory caches of peers.
+func (c *DCache) publishFlush(ctx context.Context) {
+	var buf bytes.Buffer
+	buf.WriteString(c.id)
+	appendMeta(&buf, metaSentAt, strconv.FormatInt(getNow().UnixMilli(), 10))
+	appendMeta(&buf, metaFlush, "1")
+	c.publish(ctx, []pubMsg{{topic: c.opts.invalidateTopic, payload: buf.Bytes()}})
+}
+
+// flushLocal clears the memory cache of this client, and states derived from it. It is
+// serialized with memory cache updates of all keys, and updates of reads started before it
+// are discarded, see updateMemoryCache.
+func (c *DCache) flushLocal() {
+	for i := range c.memLocks {
+		c.memLocks[i].Lock()
+		defer c.memLocks[i].Unlock()
+	}
+	c.versions.flushed()
+	c.stamps.reset()
+	if c.digests != nil {
+		c.digests.reset()
+	}
+	c.clearPins()
+	if mem := c.memCache(); mem != nil {
+		mem.Clear()
+	}
+}
@@ -0,0 +1,144 @@
+// Package gocache adapts dcache to the API of github.com/go-redis/cache, so that
+// users of that library can migrate to the two-tier cache with invalidation
+// by swapping the constructor.
+package gocache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/stumble/dcache"
+)
+
+// defaultTTL is the TTL used when Item.TTL is zero, same as go-redis/cache.
+const defaultTTL = time.Hour
+
+var (
+	// ErrCacheMiss is returned by Get when the key is not cached.
+	ErrCacheMiss = errors.New("cache: key is missing")
+	// ErrUnsupported is returned for Item options that dcache cannot honor.
+	ErrUnsupported = errors.New("cache: SetNX and SetXX are not supported")
+)
+
+// Item mirrors go-redis/cache Item.
+type Item struct {
+	Ctx context.Context
+
+	Key   string
+	Value interface{}
+
+	// TTL is the cache expiration time.
+	// Default TTL is 1 hour. Negative TTL does not cache the value.
+	TTL time.Duration
+
+	// Do returns value to be cached.
+	Do func(*Item) (interface{}, error)
+
+	// SetXX and SetNX are not supported, ErrUnsupported is returned if set.
+	SetXX bool
+	SetNX bool
+
+	// SkipLocalCache is ignored, memory tier of dcache is kept consistent
+	// by invalidation.
+	SkipLocalCache bool
+}
+
+// Context returns Ctx or context.Background() if nil.
+func (item *Item) Context() context.Context {
+	if item.Ctx == nil {
+		return context.Background()
+	}
+	return item.Ctx
+}
+
+// ttl returns the TTL of dcache, for items cached, see noStore.
+func (item *Item) ttl() time.Duration {
+	if item.TTL == 0 {
+		return defaultTTL
+	}
+	if item.TTL < time.Second {
+		return time.Second
+	}
+	return item.TTL
+}
+
+// noStore returns true if the value is not cached, by negative TTL.
+func (item *Item) noStore() bool {
+	return item.TTL < 0
+}
+
+func (item *Item) value() (interface{}, error) {
+	if item.Do != nil {
+		return item.Do(item)
+	}
+	return item.Value, nil
+}
+
+// Cache exposes dcache through the go-redis/cache Cache API.
+type Cache struct {
+	dc *dcache.DCache
+}
+
+// New creates a Cache on top of @p dc. @p dc is owned by caller and must be closed by caller.
+func New(dc *dcache.DCache) *Cache {
+	return &Cache{dc: dc}
+}
+
+// Set caches the item. Items of negative TTL are not cached, and delete the key instead, so
+// that previous values are not left.
+func (cd *Cache) Set(item *Item) error {
+	if item.SetNX || item.SetXX {
+		return ErrUnsupported
+	}
+	value, err := item.value()
+	if err != nil {
+		return err
+	}
+	if item.noStore() {
+		return cd.dc.Invalidate(item.Context(), item.Key)
+	}
+	return cd.dc.Set(item.Context(), item.Key, value, item.ttl())
+}
+
+// Exists reports whether value for the given key exists.
+func (cd *Cache) Exists(ctx context.Context, key string) bool {
+	var discard []byte
+	return cd.dc.Peek(ctx, key, &discard) == nil
+}
+
+// Get gets the value for the given key, ErrCacheMiss is returned on miss.
+func (cd *Cache) Get(ctx context.Context, key string, value interface{}) error {
+	err := cd.dc.Peek(ctx, key, value)
+	if errors.Is(err, dcache.ErrNotFound) {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+// Once gets the item.Value for the given item.Key from the cache or
+// executes, caches, and returns the results of the given item.Do,
+// making sure that only one execution is in-flight for a given item.Key
+// at a time, across all pods. Results of items of negative TTL are not cached.
+func (cd *Cache) Once(item *Item) error {
+	if item.SetNX || item.SetXX {
+		return ErrUnsupported
+	}
+	target := item.Value
+	if target == nil {
+		var discard []byte
+		target = &discard
+	}
+	var opts []dcache.CallOption
+	if item.noStore() {
+		opts = append(opts, dcache.NoStore())
+	}
+	return cd.dc.Get(item.Context(), item.Key, target, item.ttl(), func() (any, error) {
+		return item.Do(item)
+	}, false, false, opts...)
+}
+
+// Delete deletes the key from both tiers and invalidates peers.
+func (cd *Cache) Delete(ctx context.Context, key string) error {
+	return cd.dc.Invalidate(ctx, key)
+}
@@ -0,0 +1,113 @@
+package gocache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/stumble/dcache"
+)
+
+type object struct {
+	Str string
+	Num int
+}
+
+type gocacheTestSuite struct {
+	suite.Suite
+	redisConn  redis.UniversalClient
+	inMemCache *freecache.Cache
+	dc         *dcache.DCache
+	cache      *Cache
+}
+
+func TestGoCacheTestSuite(t *testing.T) {
+	suite.Run(t, &gocacheTestSuite{})
+}
+
+func (suite *gocacheTestSuite) SetupSuite() {
+	suite.redisConn = redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+		DB:   11,
+	})
+	suite.inMemCache = freecache.NewCache(1024 * 1024)
+	dc, err := dcache.NewDCache(
+		"gocache", suite.redisConn, suite.inMemCache, time.Second, false, false)
+	suite.Require().NoError(err)
+	suite.dc = dc
+	suite.cache = New(dc)
+}
+
+func (suite *gocacheTestSuite) TearDownSuite() {
+	suite.dc.Close()
+}
+
+func (suite *gocacheTestSuite) BeforeTest(_, _ string) {
+	suite.inMemCache.Clear()
+	suite.Require().NoError(suite.redisConn.FlushDB(context.Background()).Err())
+}
+
+func (suite *gocacheTestSuite) TestSetGetDelete() {
+	ctx := context.Background()
+	obj := &object{Str: "mystring", Num: 42}
+	var got object
+	suite.Equal(ErrCacheMiss, suite.cache.Get(ctx, "mykey", &got))
+	suite.False(suite.cache.Exists(ctx, "mykey"))
+
+	suite.Require().NoError(suite.cache.Set(&Item{Ctx: ctx, Key: "mykey", Value: obj, TTL: time.Hour}))
+	suite.True(suite.cache.Exists(ctx, "mykey"))
+	suite.Require().NoError(suite.cache.Get(ctx, "mykey", &got))
+	suite.Equal(*obj, got)
+
+	suite.Require().NoError(suite.cache.Delete(ctx, "mykey"))
+	suite.Equal(ErrCacheMiss, suite.cache.Get(ctx, "mykey", &got))
+	suite.Equal(ErrUnsupported, suite.cache.Set(&Item{Key: "mykey", Value: obj, SetNX: true}))
+
+	// negative TTL deletes the key instead of caching.
+	suite.Require().NoError(suite.cache.Set(&Item{Ctx: ctx, Key: "mykey", Value: obj}))
+	suite.Require().NoError(suite.cache.Set(&Item{Ctx: ctx, Key: "mykey", Value: obj, TTL: -1}))
+	suite.False(suite.cache.Exists(ctx, "mykey"))
+}
+
+func (suite *gocacheTestSuite) TestOnce() {
+	calls := 0
+	item := func(got *object) *Item {
+		return &Item{
+			Key:   "mykey",
+			Value: got,
+			Do: func(*Item) (interface{}, error) {
+				calls++
+				return &object{Str: "mystring", Num: 42}, nil
+			},
+		}
+	}
+	var got object
+	suite.Require().NoError(suite.cache.Once(item(&got)))
+	suite.Equal(object{Str: "mystring", Num: 42}, got)
+
+	var got2 object
+	suite.Require().NoError(suite.cache.Once(item(&got2)))
+	suite.Equal(got, got2)
+	suite.Equal(1, calls)
+
+	// nil value only populates the cache.
+	suite.Require().NoError(suite.cache.Delete(context.Background(), "mykey"))
+	populate := item(nil)
+	populate.Value = nil
+	suite.Require().NoError(suite.cache.Once(populate))
+	suite.Equal(2, calls)
+
+	// negative TTL does not cache the result.
+	suite.Require().NoError(suite.cache.Delete(context.Background(), "mykey"))
+	var got3 object
+	uncached := item(&got3)
+	uncached.TTL = -1
+	suite.Require().NoError(suite.cache.Once(uncached))
+	suite.Equal(got, got3)
+	suite.Equal(3, calls)
+	suite.False(suite.cache.Exists(context.Background(), "mykey"))
+}
@@ -0,0 +1,59 @@
+package dcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// getRedis reads the raw value of @p key from Redis, hedged to the replica if enabled.
+func (c *DCache) getRedis(ctx context.Context, key string) ([]byte, error) {
+	if c.opts.hedgeReplica == nil {
+		return c.conn.Get(ctx, c.storeKey(key)).Bytes()
+	}
+	return c.hedgedGet(ctx, c.storeKey(key))
+}
+
+// hedgedGet reads @p key from the primary, and also from the replica if the primary has not
+// answered within the hedge delay, returning whichever answers first. Only values found on
+// the replica are taken, as keys missing there may not be replicated yet. The primary's
+// answer is returned if both fail.
+func (c *DCache) hedgedGet(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type reply struct {
+		value  []byte
+		err    error
+		hedged bool
+	}
+	replies := make(chan reply, 2)
+	get := func(conn redis.Cmdable, hedged bool) {
+		value, err := conn.Get(ctx, key).Bytes()
+		replies <- reply{value: value, err: err, hedged: hedged}
+	}
+	go get(c.conn, false)
+	timer := time.NewTimer(c.opts.hedgeDelay)
+	defer timer.Stop()
+	select {
+	case r := <-replies:
+		return r.value, r.err
+	case <-timer.C:
+	}
+	c.counters.hedgedReads.Add(1)
+	go get(c.opts.hedgeReplica, true)
+	var primary reply
+	for i := 0; i < 2; i++ {
+		r := <-replies
+		if r.err == nil || (r.err == redis.Nil && !r.hedged) {
+			if r.hedged {
+				c.counters.hedgeWins.Add(1)
+			}
+			return r.value, r.err
+		}
+		if !r.hedged {
+			primary = r
+		}
+	}
+	return primary.value, primary.err
+}
@@ -0,0 +1,118 @@
+package dcache
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redisHookCtxKey is the context key of the tag of dcache-originated Redis commands.
+type redisHookCtxKey struct{}
+
+// opTag tags Redis commands issued by a DCache instance for an operation.
+type opTag struct {
+	cacheID string
+	op      string
+}
+
+// tagContext tags @p ctx so that Redis commands issued with it are attributed to
+// operation @p op of this cache by the installed redis hook. No-op if hook is not installed.
+func (c *DCache) tagContext(ctx context.Context, op string) context.Context {
+	if !c.opts.redisHook {
+		return ctx
+	}
+	return context.WithValue(ctx, redisHookCtxKey{}, &opTag{cacheID: c.id, op: op})
+}
+
+// redisHook instruments Redis commands originated from dcache. Hooks cannot be removed from
+// go-redis clients, so the cache is detached on Close, after which commands pass through.
+type redisHook struct {
+	cache atomic.Pointer[DCache]
+}
+
+var _ redis.Hook = (*redisHook)(nil)
+
+func newRedisHook(c *DCache) *redisHook {
+	h := &redisHook{}
+	h.cache.Store(c)
+	return h
+}
+
+// tag returns the cache and the tag of commands issued by it with @p ctx, nil if not.
+func (h *redisHook) tag(ctx context.Context) (*DCache, *opTag) {
+	c := h.cache.Load()
+	tag, ok := ctx.Value(redisHookCtxKey{}).(*opTag)
+	if c == nil || !ok || tag.cacheID != c.id {
+		return nil, nil
+	}
+	return c, tag
+}
+
+func (h *redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (h *redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c, tag := h.tag(ctx)
+		if tag == nil {
+			return next(ctx, cmd)
+		}
+		startedAt := getNow()
+		err := next(ctx, cmd)
+		c.observeRedis(ctx, tag, cmd.Name(), startedAt, func() string { return cmd.String() })
+		return err
+	}
+}
+
+func (h *redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c, tag := h.tag(ctx)
+		if tag == nil {
+			return next(ctx, cmds)
+		}
+		startedAt := getNow()
+		err := next(ctx, cmds)
+		c.observeRedis(ctx, tag, "pipeline", startedAt, func() string {
+			return redisPipelineString(cmds)
+		})
+		return err
+	}
+}
+
+// observeRedis records latency of a command to metrics, trace and slow-command log.
+func (c *DCache) observeRedis(
+	ctx context.Context, tag *opTag, cmdName string, startedAt time.Time, cmdString func() string) {
+	latency := getNow().Sub(startedAt)
+	if c.stats != nil {
+		c.stats.ObserveRedisLatency(cmdName, latency)
+	}
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.AddEvent("redis."+cmdName, trace.WithAttributes(
+			attribute.Key("dcache.op").String(tag.op),
+			attribute.Key("dcache.redis.latency_us").Int64(latency.Microseconds()),
+		))
+	}
+	if slow := c.opts.slowRedisCommand; slow > 0 && latency >= slow {
+		c.logger(ctx).Warn().Msgf("Slow Redis command for dcache %s took %s: %s",
+			tag.op, latency, cmdString())
+	}
+}
+
+func redisPipelineString(cmds []redis.Cmder) string {
+	s := ""
+	for i, cmd := range cmds {
+		if i > 0 {
+			s += "; "
+		}
+		s += cmd.Name()
+	}
+	return s
+}
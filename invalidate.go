@@ -0,0 +1,379 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Invalidation message, fields joined by delimiter:
+//
+//	<origin id> [@<meta>=<value> ...] <store key> ...
+//
+// Store keys start with the key prefix then ':', and the key prefix never starts
+// with '@', so metadata fields never collide with keys, and peers of older
+// versions, which do not know metadata, treat them as keys that do not exist.
+const (
+	metaPrefix   = "@"
+	metaSentAt   = "t" // UNIX timestamp in milliseconds.
+	metaFlush    = "f" // peers clear memory caches, see Flush.
+	metaStamps   = "v" // stamps of keys in order, see formatStamps.
+	storeKeyHead = ":"
+)
+
+// peerOrigin is the origin of invalidations sent by peers in metrics, whose IDs are not labels,
+// as they change with every restart of pods.
+const peerOrigin = "peer"
+
+// invalidateMessage is a parsed invalidation message.
+type invalidateMessage struct {
+	Origin string
+	SentAt time.Time // zero if not provided by origin.
+	Flush  bool
+	Keys   []string
+	// Stamps are stamps of values written of Keys in order, zero if unknown, nil if not
+	// provided by origin.
+	Stamps []valueStamp
+}
+
+// appendMeta appends a metadata field to the message being assembled in @p buf.
+func appendMeta(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(delimiter)
+	buf.WriteString(metaPrefix)
+	buf.WriteString(name)
+	buf.WriteString("=")
+	buf.WriteString(value)
+}
+
+// parseInvalidateMessage parses @p payload, unknown metadata are ignored.
+func parseInvalidateMessage(payload string) (*invalidateMessage, error) {
+	l := strings.Split(payload, delimiter)
+	if len(l) < 2 {
+		return nil, fmt.Errorf("invalid invalidate payload: %s", payload)
+	}
+	msg := &invalidateMessage{Origin: l[0]}
+	fields := l[1:]
+	stamps, stamped := "", false
+	for len(fields) > 0 && strings.HasPrefix(fields[0], metaPrefix) {
+		name, value, _ := strings.Cut(fields[0][len(metaPrefix):], "=")
+		switch name {
+		case metaSentAt:
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+				msg.SentAt = time.UnixMilli(ms)
+			}
+		case metaFlush:
+			msg.Flush = true
+		case metaStamps:
+			stamps, stamped = value, true
+		}
+		fields = fields[1:]
+	}
+	msg.Keys = fields
+	if stamped && !msg.SentAt.IsZero() {
+		// stamps are offsets to SentAt, and dropped if not aligned with keys.
+		if l := parseStamps(msg.SentAt.UnixMilli(), stamps); len(l) == len(msg.Keys) {
+			msg.Stamps = l
+		}
+	}
+	return msg, nil
+}
+
+// pubMsg is a message to be published to a pubsub topic.
+type pubMsg struct {
+	topic   string
+	payload []byte
+}
+
+// pendingKey is a store key pending to be published, with the stamp of the value written,
+// 0 if unknown or deleted.
+type pendingKey struct {
+	key   string
+	stamp valueStamp
+}
+
+// broadcastKeyInvalidate pushes key into a list and wait for broadcast. @p stamp is the stamp
+// of the value written, so that peers caching the value do not evict it, zero if unknown or
+// deleted. Stamps of later changes of the same key replace earlier ones.
+func (c *DCache) broadcastKeyInvalidate(key string, stamp valueStamp) {
+	c.invalidateMu.Lock()
+	c.invalidateKeys[c.storeKey(key)] = stamp
+	l := len(c.invalidateKeys)
+	c.invalidateMu.Unlock()
+	// handled by aggregateSend, as callers may hold memory cache locks.
+	overflowed := c.opts.invalidateBacklog > 0 && l > c.opts.invalidateBacklog
+	if overflowed {
+		c.invalidateOverflow.Store(true)
+	}
+	if overflowed || l >= c.opts.invalidateBatch {
+		select {
+		case c.invalidateCh <- struct{}{}:
+		default:
+			// aggregateSend is signalled already.
+		}
+	}
+}
+
+// aggregateSend waits for 1 seconds or list accumulating more than invalidateBatch
+// to send to redis pubsub. It is the only publisher, so buffers are reused across sends.
+func (c *DCache) aggregateSend() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	keys := make([]pendingKey, 0, c.opts.invalidateBatch)
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.invalidateCh:
+		case <-c.ctx.Done():
+			return
+		}
+		keys = c.takeInvalidateKeys(keys[:0])
+		// pending keys beyond the max backlog are handled by the overflow policy, see
+		// WithInvalidateBacklog.
+		if c.invalidateOverflow.Swap(false) && len(keys) > 0 {
+			c.counters.invalidateOverflows.Add(1)
+			if c.opts.backlogOverflow == OverflowFlushAll {
+				c.logger(c.ctx).Warn().Msgf(
+					"Invalidation backlog of %d keys overflowed, flushing memory caches of peers", len(keys))
+				c.publishFlush(c.ctx)
+				continue
+			}
+		}
+		if len(keys) == 0 && !c.keepalive() {
+			continue
+		}
+		c.sendInvalidateKeys(c.ctx, &buf, keys)
+	}
+}
+
+// invalidateBacklog returns the number of keys pending to be published.
+func (c *DCache) invalidateBacklog() int {
+	c.invalidateMu.Lock()
+	defer c.invalidateMu.Unlock()
+	return len(c.invalidateKeys)
+}
+
+// sendInvalidateKeys publishes @p keys, built in @p buf, in messages of at most invalidateBatch
+// keys and maxInvalidatePayload bytes each, unless a key alone exceeds it, see
+// WithMaxInvalidatePayload. Messages without keys are sent as keepalives.
+func (c *DCache) sendInvalidateKeys(ctx context.Context, buf *bytes.Buffer, keys []pendingKey) {
+	buf.Reset()
+	now := getNow().UnixMilli()
+	sentAt := strconv.FormatInt(now, 10)
+	// size of metadata, including metaStamps of no values.
+	header := len(c.id) + len(delimiter) + len(metaPrefix) + len(metaSentAt) + len("=") + len(sentAt) +
+		len(delimiter) + len(metaPrefix) + len(metaStamps) + len("=")
+	// ends of messages in buf.
+	ends := make([]int, 0, 1)
+	for first := 0; first == 0 || first < len(keys); {
+		last, size := first, header
+		for ; last < len(keys); last++ {
+			k := keys[last]
+			size += len(delimiter) + len(k.key) + len(",") + len(formatStamp(now, k.stamp))
+			if last > first && (last-first >= c.opts.invalidateBatch ||
+				(c.opts.maxInvalidatePayload > 0 && size > c.opts.maxInvalidatePayload)) {
+				break
+			}
+		}
+		buf.WriteString(c.id)
+		appendMeta(buf, metaSentAt, sentAt)
+		for _, k := range keys[first:last] {
+			if k.stamp.at > 0 {
+				appendMeta(buf, metaStamps, formatStamps(now, keys[first:last]))
+				break
+			}
+		}
+		for _, k := range keys[first:last] {
+			buf.WriteString(delimiter)
+			buf.WriteString(k.key)
+		}
+		ends = append(ends, buf.Len())
+		first = last
+	}
+	msgs := make([]pubMsg, len(ends))
+	start := 0
+	for i, end := range ends {
+		msgs[i] = pubMsg{topic: c.opts.invalidateTopic, payload: buf.Bytes()[start:end]}
+		start = end
+	}
+	c.publish(ctx, msgs)
+}
+
+// flushInvalidateKeys publishes pending keys synchronously, on a fresh context because c.ctx
+// is done, once aggregateSend and writers are stopped by Close, so that invalidations of the
+// last batch are not dropped.
+func (c *DCache) flushInvalidateKeys() {
+	keys := c.takeInvalidateKeys(nil)
+	if len(keys) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+	defer cancel()
+	var buf bytes.Buffer
+	c.sendInvalidateKeys(ctx, &buf, keys)
+}
+
+// keepalive returns true if messages must be sent even without keys, for
+// the degradation detector to discover pubsub gaps.
+func (c *DCache) keepalive() bool {
+	return c.degradation != nil && c.degradation.thresholds.MaxPubSubGap > 0
+}
+
+// takeInvalidateKeys appends all pending keys to @p keys and clears the pending set.
+// The two sets are swapped, so that no map is allocated per send, unless the spare set is
+// being drained by another caller, see flushInvalidateKeys.
+func (c *DCache) takeInvalidateKeys(keys []pendingKey) []pendingKey {
+	c.invalidateMu.Lock()
+	toSend := c.invalidateKeys
+	c.invalidateKeys = c.invalidateSpare
+	if c.invalidateKeys == nil {
+		c.invalidateKeys = make(map[string]valueStamp)
+	}
+	c.invalidateSpare = nil
+	c.invalidateMu.Unlock()
+	for key, stamp := range toSend {
+		keys = append(keys, pendingKey{key: key, stamp: stamp})
+		delete(toSend, key)
+	}
+	c.invalidateMu.Lock()
+	c.invalidateSpare = toSend
+	c.invalidateMu.Unlock()
+	return keys
+}
+
+// publish sends @p msgs, through one pipeline if there are more than one, appended to the
+// stream instead if invalidations are sent by stream, see WithStreamInvalidation.
+// Payloads can be reused after return.
+func (c *DCache) publish(ctx context.Context, msgs []pubMsg) {
+	if c.stream != nil {
+		c.appendStream(ctx, msgs)
+		return
+	}
+	if len(msgs) == 1 {
+		err := c.lockConn.Publish(ctx, msgs[0].topic, msgs[0].payload).Err()
+		if err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to publish invalidation to %s", msgs[0].topic)
+			c.recordError(errLabelPublish, "", err)
+		}
+		return
+	}
+	cmds, err := c.lockConn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range msgs {
+			pipe.Publish(ctx, msg.topic, msg.payload)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, cmd := range cmds {
+			if cmd.Err() != nil {
+				c.logger(ctx).Err(cmd.Err()).Msgf("Failed to publish invalidation: %s", cmd.String())
+				c.recordError(errLabelPublish, "", cmd.Err())
+			}
+		}
+	}
+}
+
+// listenKeyInvalidate subscribe to invalidate key requests and invalidates memory cache.
+// Memory cache is resynced once the subscription is reconnected, see WithPubSubResync.
+func (c *DCache) listenKeyInvalidate() {
+	defer c.wg.Done()
+	ch := c.pubsub.ChannelWithSubscriptions()
+	subscribed := false
+	for {
+		v, ok := <-ch
+		if !ok {
+			return
+		}
+		msg, ok := v.(*redis.Message)
+		if !ok {
+			if sub, ok := v.(*redis.Subscription); ok && sub.Kind == "subscribe" {
+				if subscribed {
+					c.resubscribed()
+				}
+				subscribed = true
+			}
+			continue
+		}
+		c.signals.lastPubSubAt.Store(getNow().UnixNano())
+		payload := msg.Payload
+		c.wg.Add(1)
+		go func(payload string) {
+			defer c.wg.Done()
+			c.handleInvalidatePayload(payload)
+		}(payload)
+	}
+}
+
+// handleInvalidatePayload applies the invalidation message @p payload received from peers.
+func (c *DCache) handleInvalidatePayload(payload string) {
+	msg, err := parseInvalidateMessage(payload)
+	if err != nil {
+		// Invalid payload
+		c.logger(c.ctx).Err(err).Msgf("Received invalidate payload %s", payload)
+		c.recordError(errLabelInvalidate, "", err)
+		return
+	}
+	if msg.Origin == c.id {
+		// Receive message from self
+		return
+	}
+	if c.stats != nil {
+		c.stats.ObserveInvalidateReceived(peerOrigin, len(msg.Keys))
+	}
+	if !msg.SentAt.IsZero() {
+		c.logger(c.ctx).Debug().Msgf("Received %d invalidated keys from %s, sent %s ago",
+			len(msg.Keys), msg.Origin, getNow().Sub(msg.SentAt))
+	}
+	if msg.Flush {
+		c.flushLocal()
+	}
+	// Invalidate key
+	for i, key := range msg.Keys {
+		var stamp valueStamp
+		if msg.Stamps != nil {
+			stamp = msg.Stamps[i]
+		}
+		c.applyInvalidation(key, msg.SentAt, stamp, msg.Origin)
+	}
+}
+
+// applyInvalidation invalidates @p key, a store key, sent by peer @p origin at @p sentAt, of
+// the value written at @p stamp, see broadcastKeyInvalidate. Zero @p sentAt and @p stamp, and
+// empty @p origin are unknown.
+func (c *DCache) applyInvalidation(key string, sentAt time.Time, stamp valueStamp, origin string) {
+	if head := c.opts.keyPrefix + namespaceKeyPrefix; strings.HasPrefix(key, head) {
+		// epoch of a namespace bumped, see BumpNamespace.
+		if c.namespaces != nil {
+			c.namespaces.forget(key[len(head):])
+		}
+		return
+	}
+	if !sentAt.IsZero() && c.versions.writtenAfter(key, sentAt) {
+		// key was written locally after the invalidation was sent.
+		return
+	}
+	if c.digests != nil {
+		c.digests.forget(key)
+	}
+	// ordered with memory cache updates of the key, see updateMemoryCache.
+	lock := c.memLock(key)
+	lock.Lock()
+	// updates of reads started before are discarded regardless, as they may be older.
+	c.versions.invalidated(key)
+	if c.stamps.covers(key, stamp, writerOf(origin)) {
+		// the value cached is the value written, or newer.
+		lock.Unlock()
+		return
+	}
+	c.stamps.forget(key)
+	// pinned key is reloaded by refreshPins, not to block the subscriber on Redis.
+	c.clearPinned(key)
+	c.memCache().Del([]byte(key))
+	lock.Unlock()
+}
@@ -0,0 +1,154 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const leaderKeyPrefix = ":dcache_leader:"
+
+var (
+	// renewLeaderScript extends the leader key only if it is still owned by us.
+	renewLeaderScript = redis.NewScript(`-- dcache:compare_and_pexpire
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	// releaseLeaderScript deletes the leader key only if it is still owned by us.
+	releaseLeaderScript = redis.NewScript(`-- dcache:compare_and_del
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// leaderElection elects one leader among clients of the same app name, by a Redis
+// key that expires unless renewed by the leader, so that leadership fails over
+// to another client within the ttl when the leader dies.
+type leaderElection struct {
+	key      string
+	ttl      time.Duration
+	isLeader atomic.Bool
+	// renewedAt is when the last successful acquisition or renewal was sent, after which the
+	// key expires in ttl. Only accessed by campaign.
+	renewedAt time.Time
+
+	mu          sync.Mutex
+	tasks       []func(ctx context.Context)
+	leaderCtx   context.Context
+	cancelTasks context.CancelFunc
+}
+
+// IsLeader returns true if this client is currently the leader.
+// Always false if leader election is not enabled by WithLeaderElection.
+func (c *DCache) IsLeader() bool {
+	return c.leader != nil && c.leader.isLeader.Load()
+}
+
+// RunAsLeader registers @p task to run whenever this client becomes the leader.
+// The context passed to @p task is cancelled when leadership is lost or the client
+// is closed, and @p task must return by then. It panics if leader election is not
+// enabled by WithLeaderElection.
+func (c *DCache) RunAsLeader(task func(ctx context.Context)) {
+	if c.leader == nil {
+		panic("dcache: leader election is not enabled")
+	}
+	c.leader.mu.Lock()
+	defer c.leader.mu.Unlock()
+	c.leader.tasks = append(c.leader.tasks, task)
+	if c.leader.leaderCtx != nil {
+		c.startLeaderTask(c.leader.leaderCtx, task)
+	}
+}
+
+func (c *DCache) startLeaderTask(ctx context.Context, task func(ctx context.Context)) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		task(ctx)
+	}()
+}
+
+// campaign tries to acquire or renew leadership periodically until closed.
+func (c *DCache) campaign() {
+	defer c.wg.Done()
+	l := c.leader
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		c.tryLead()
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			if l.isLeader.Load() {
+				c.setLeader(false)
+				// release on a fresh context because c.ctx is done.
+				ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+				defer cancel()
+				err := releaseLeaderScript.Run(ctx, c.conn, []string{l.key}, c.id).Err()
+				if err != nil {
+					c.logger(c.ctx).Err(err).Msgf("Failed to release leadership of %s", l.key)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (c *DCache) tryLead() {
+	l := c.leader
+	sentAt := getNow()
+	if l.isLeader.Load() {
+		renewed, err := renewLeaderScript.Run(
+			c.ctx, c.conn, []string{l.key}, c.id, l.ttl.Milliseconds()).Int()
+		if err != nil {
+			c.logger(c.ctx).Err(err).Msgf("Failed to renew leadership of %s", l.key)
+			// keep leadership until it is known to be lost or expired, as others may take the
+			// key once expired.
+			if getNow().Sub(l.renewedAt) >= l.ttl {
+				c.logger(c.ctx).Warn().Msgf("Leadership of %s expired", l.key)
+				c.setLeader(false)
+			}
+			return
+		}
+		if renewed == 0 {
+			c.logger(c.ctx).Warn().Msgf("Lost leadership of %s", l.key)
+			c.setLeader(false)
+			return
+		}
+		l.renewedAt = sentAt
+		return
+	}
+	acquired, err := c.conn.SetNX(c.ctx, l.key, c.id, l.ttl).Result()
+	if err != nil {
+		c.logger(c.ctx).Err(err).Msgf("Failed to campaign for leadership of %s", l.key)
+		return
+	}
+	if acquired {
+		c.logger(c.ctx).Info().Msgf("Became leader of %s", l.key)
+		l.renewedAt = sentAt
+		c.setLeader(true)
+	}
+}
+
+func (c *DCache) setLeader(isLeader bool) {
+	l := c.leader
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.isLeader.Store(isLeader)
+	if isLeader {
+		l.leaderCtx, l.cancelTasks = context.WithCancel(c.ctx)
+		for _, task := range l.tasks {
+			c.startLeaderTask(l.leaderCtx, task)
+		}
+		return
+	}
+	if l.cancelTasks != nil {
+		l.cancelTasks()
+	}
+	l.leaderCtx, l.cancelTasks = nil, nil
+}
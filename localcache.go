@@ -0,0 +1,106 @@
+package dcache
+
+import (
+	"time"
+
+	"github.com/coocood/freecache"
+)
+
+// LocalCache is the memory tier of the cache, see WithLocalCache. Keys are store keys.
+// Implementations must be safe for concurrent use, and values set must be read by Get once
+// Set returns, e.g., asynchronous sets must be waited for.
+// freecache is used by WithInMemCache, adapters of ristretto and otter are provided by
+// modules ristrettocache and ottercache, e.g., for admission policies of skewed workloads.
+type LocalCache interface {
+	// Get returns the value of @p key, ErrNotFound if absent or expired.
+	Get(key []byte) ([]byte, error)
+	// Set sets @p value of @p key, expiring in @p expireSeconds, never if 0. Values rejected
+	// return errors, ErrEntryTooLarge if larger than the cache accepts.
+	Set(key, value []byte, expireSeconds int) error
+	// Del deletes @p key, returns true if it was present.
+	Del(key []byte) bool
+	// Clear deletes all entries.
+	Clear()
+	// Stats returns the counters of the cache.
+	Stats() LocalCacheStats
+}
+
+// LocalCacheStats are counters of LocalCache.
+type LocalCacheStats struct {
+	// Entries is the number of entries, approximate for some implementations.
+	Entries int64
+	// Evictions is the number of entries evicted for lack of space since creation, which
+	// lowers admissions of WithPriority under pressure.
+	Evictions int64
+}
+
+// LocalCacheRanger is implemented by local caches iterating their entries, required by
+// Snapshot.Range, and ResyncReconcile of WithPubSubResync, which clears memory cache instead
+// otherwise.
+type LocalCacheRanger interface {
+	// Range calls @p f for entries in no particular order, until @p f returns false.
+	// Entries may be changed by @p f.
+	Range(f func(key, value []byte) bool)
+}
+
+// LocalCacheExpiry is implemented by local caches reporting remaining TTLs of entries,
+// required by WithReadRepair.
+type LocalCacheExpiry interface {
+	// TTL returns the remaining TTL of @p key, 0 if it never expires, ErrNotFound if absent.
+	TTL(key []byte) (time.Duration, error)
+}
+
+// freecacheLocal adapts freecache to LocalCache.
+type freecacheLocal struct {
+	mem *freecache.Cache
+}
+
+// FreecacheLocal returns the LocalCache of @p mem, the memory cache of WithInMemCache.
+func FreecacheLocal(mem *freecache.Cache) LocalCache {
+	return freecacheLocal{mem: mem}
+}
+
+func (f freecacheLocal) Get(key []byte) ([]byte, error) {
+	value, err := f.mem.Get(key)
+	if err == freecache.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (f freecacheLocal) Set(key, value []byte, expireSeconds int) error {
+	err := f.mem.Set(key, value, expireSeconds)
+	if err == freecache.ErrLargeEntry {
+		return ErrEntryTooLarge
+	}
+	return err
+}
+
+func (f freecacheLocal) Del(key []byte) bool {
+	return f.mem.Del(key)
+}
+
+func (f freecacheLocal) Clear() {
+	f.mem.Clear()
+}
+
+func (f freecacheLocal) Stats() LocalCacheStats {
+	return LocalCacheStats{Entries: f.mem.EntryCount(), Evictions: f.mem.EvacuateCount()}
+}
+
+func (f freecacheLocal) Range(fn func(key, value []byte) bool) {
+	it := f.mem.NewIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		if !fn(e.Key, e.Value) {
+			return
+		}
+	}
+}
+
+func (f freecacheLocal) TTL(key []byte) (time.Duration, error) {
+	ttl, err := f.mem.TTL(key)
+	if err == freecache.ErrNotFound {
+		return 0, ErrNotFound
+	}
+	return time.Duration(ttl) * time.Second, err
+}
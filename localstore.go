@@ -0,0 +1,67 @@
+package dcache
+
+import (
+	"errors"
+
+	"github.com/coocood/freecache"
+)
+
+var (
+	// ErrRemoteOnly memory cache is given to a cache in remote-only mode.
+	ErrRemoteOnly = errors.New("memory cache is given in remote-only mode")
+	// ErrLocalStoreAttached memory cache has been attached.
+	ErrLocalStoreAttached = errors.New("memory cache has been attached")
+)
+
+// memCache returns the memory cache, nil in remote-only mode. Once attached, it never
+// changes, so a non-nil result can be used without reloading.
+func (c *DCache) memCache() LocalCache {
+	if mem := c.inMemCache.Load(); mem != nil {
+		return *mem
+	}
+	return nil
+}
+
+// RemoteOnly returns true if the cache has no memory cache, i.e., only Redis is used.
+func (c *DCache) RemoteOnly() bool {
+	return c.memCache() == nil
+}
+
+// AttachLocalStore enables memory cache @p mem for a cache running in remote-only mode,
+// e.g., for services enabling the memory tier without restarting.
+// ErrLocalStoreAttached is returned if memory cache has been attached or given at creation.
+// It must not be called concurrently with Close.
+func (c *DCache) AttachLocalStore(mem *freecache.Cache) error {
+	return c.AttachLocalCache(FreecacheLocal(mem))
+}
+
+// AttachLocalCache is AttachLocalStore of any LocalCache @p mem.
+func (c *DCache) AttachLocalCache(mem LocalCache) error {
+	c.attachMu.Lock()
+	defer c.attachMu.Unlock()
+	if c.memCache() != nil {
+		return ErrLocalStoreAttached
+	}
+	c.startLocalStore(mem)
+	if c.stats != nil {
+		c.stats.UpdateMode(false)
+	}
+	return nil
+}
+
+// startLocalStore subscribes invalidations of peers, by pubsub, stream or Redis, then enables memory cache @p mem,
+// so that no invalidation is missed once it is used.
+func (c *DCache) startLocalStore(mem LocalCache) {
+	if c.opts.serverTracking {
+		c.startTracking()
+	} else if c.opts.streamRetention != nil {
+		c.startStream()
+	} else {
+		c.pubsub = c.lockConn.Subscribe(c.ctx, c.opts.invalidateTopic)
+		c.wg.Add(1)
+		go c.listenKeyInvalidate()
+	}
+	c.wg.Add(1)
+	go c.aggregateSend()
+	c.inMemCache.Store(&mem)
+}
@@ -0,0 +1,234 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultMaintenanceBatch is the default number of keys scanned per SCAN.
+const defaultMaintenanceBatch = 100
+
+// ErrClusterUnsupported is returned by operations that do not support Redis Cluster.
+var ErrClusterUnsupported = errors.New("dcache: Redis Cluster is not supported")
+
+// compareAndSetScript sets a key to ARGV[2] with ttl ARGV[3] in ms, 0 for no TTL, only if it
+// still holds ARGV[1]. Returns 1 if set.
+var compareAndSetScript = redis.NewScript(`-- dcache:compare_and_set
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if ARGV[3] == "0" then
+	redis.call("SET", KEYS[1], ARGV[2])
+else
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+end
+return 1`)
+
+// MaintenanceSpec specifies a maintenance job over cached keys in Redis, see Maintain.
+type MaintenanceSpec struct {
+	// Prefix of keys to walk, all keys if empty.
+	Prefix string
+	// Cursor to resume from, returned by a previous interrupted run, 0 to start over.
+	Cursor uint64
+	// Batch is the number of keys scanned per SCAN, defaultMaintenanceBatch if 0.
+	Batch int64
+	// Rate limits the number of keys scanned per second, unlimited if 0.
+	Rate int
+	// Rejitter adds a random duration up to the Jitter of the policy of each key to its
+	// remaining TTL, e.g., to spread expirations of keys warmed up at once.
+	Rejitter bool
+	// Reenvelope rewrites envelopes of other versions in the version of the client,
+	// see WithEnvelopeVersion.
+	Reenvelope bool
+	// Reencode re-encodes values with the current encoding, e.g., the compression of
+	// policies, if it returns a new target for the key, see Get for targets. Values
+	// are decoded into the target and encoded again. Keys are skipped if it returns nil.
+	Reencode func(key string) any
+}
+
+// MaintenanceResult is the progress of a maintenance job.
+type MaintenanceResult struct {
+	// Cursor to resume the job from, 0 if the job is done.
+	Cursor uint64
+	// Scanned is the number of keys walked, and Updated of them were rewritten.
+	Scanned int64
+	Updated int64
+}
+
+// Maintain walks keys in Redis by SCAN and rewrites them as @p spec asks, e.g., for online
+// migrations of the encoding. Keys are rewritten only if unchanged since read, keeping
+// their remaining TTLs, so that concurrent writes and invalidations win. Values in memory
+// caches are not changed. The job stops at the first error or when @p ctx is done, and the
+// result carries the cursor to resume it from.
+// ErrClusterUnsupported is returned on Redis Cluster, where SCAN walks only one node.
+func (c *DCache) Maintain(ctx context.Context, spec MaintenanceSpec) (rst MaintenanceResult, err error) {
+	ctx = c.tagContext(ctx, "Maintain")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "Maintain", []string{"prefix=" + spec.Prefix})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if _, ok := c.conn.(*redis.ClusterClient); ok {
+		return rst, ErrClusterUnsupported
+	}
+	if spec.Batch <= 0 {
+		spec.Batch = defaultMaintenanceBatch
+	}
+	match := c.storeKey(escapeGlob(spec.Prefix) + "*")
+	rst.Cursor = spec.Cursor
+	startedAt := getNow()
+	for {
+		var keys []string
+		var next uint64
+		keys, next, err = c.conn.Scan(ctx, rst.Cursor, match, spec.Batch).Result()
+		if err != nil {
+			return
+		}
+		for _, storedKey := range keys {
+			var updated bool
+			updated, err = c.maintainKey(ctx, storedKey, spec)
+			if err != nil {
+				return
+			}
+			if updated {
+				rst.Updated++
+			}
+		}
+		rst.Scanned += int64(len(keys))
+		rst.Cursor = next
+		if next == 0 {
+			return
+		}
+		if spec.Rate > 0 {
+			wait := startedAt.Add(time.Duration(rst.Scanned) * time.Second / time.Duration(spec.Rate)).Sub(getNow())
+			if err = sleepCtx(ctx, wait); err != nil {
+				return
+			}
+		} else if err = ctx.Err(); err != nil {
+			return
+		}
+	}
+}
+
+// maintainKey rewrites @p storedKey as @p spec asks, returns true if rewritten.
+func (c *DCache) maintainKey(ctx context.Context, storedKey string, spec MaintenanceSpec) (bool, error) {
+	key, _ := c.keyOf(storedKey)
+	veBytes, err := c.conn.Get(ctx, storedKey).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if isTombstone(veBytes) {
+		return false, nil
+	}
+	ve, err := c.decodeEnvelope(veBytes)
+	if err != nil {
+		return false, nil
+	}
+	changed := spec.Reenvelope && envelopeVersionOf(veBytes) != c.opts.envelopeVersion
+	if spec.Reencode != nil {
+		if target := spec.Reencode(key); target != nil {
+			if err := c.unmarshal(key, ve.ValueBytes, target); err != nil {
+				c.logger(ctx).Err(err).Msgf("Failed to decode %s for maintenance, skipped", key)
+				return false, nil
+			}
+			valueBytes, err := c.marshal(ctx, key, reflect.ValueOf(target).Elem().Interface())
+			if err != nil {
+				return false, err
+			}
+			ve.ValueBytes, changed = valueBytes, true
+		}
+	}
+	if p := c.policy(key); spec.Rejitter && ve.ExpiredAt > 0 && p != nil && p.Jitter > 0 {
+		ve.ExpiredAt += time.Duration(rand.Int63n(int64(p.Jitter))).Milliseconds()
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	var ttl int64
+	if ve.ExpiredAt > 0 {
+		if ttl = ve.ExpiredAt - getNow().UnixMilli(); ttl <= 0 {
+			return false, nil
+		}
+	}
+	newBytes, err := c.encodeEnvelope(ve)
+	if err != nil {
+		return false, err
+	}
+	n, err := compareAndSetScript.Run(ctx, c.conn, []string{storedKey}, veBytes, newBytes, ttl).Int()
+	return n == 1, err
+}
+
+// InvalidateByPrefix explicitly invalidates all keys starting with @p prefix in Redis, e.g.,
+// after bulk imports, walking them by SCAN in batches of defaultMaintenanceBatch, each
+// invalidated by InvalidateMulti. Keys only in memory caches, e.g., of Policy.SkipRemote,
+// are not invalidated. It stops at the first error or when @p ctx is done.
+// ErrClusterUnsupported is returned on Redis Cluster, where SCAN walks only one node.
+func (c *DCache) InvalidateByPrefix(ctx context.Context, prefix string) (err error) {
+	ctx = c.tagContext(ctx, "InvalidateByPrefix")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "InvalidateByPrefix", []string{"prefix=" + prefix})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if _, ok := c.conn.(*redis.ClusterClient); ok {
+		return ErrClusterUnsupported
+	}
+	match := c.storeKey(escapeGlob(prefix) + "*")
+	var cursor uint64
+	for {
+		var storedKeys []string
+		storedKeys, cursor, err = c.conn.Scan(ctx, cursor, match, defaultMaintenanceBatch).Result()
+		if err != nil {
+			return
+		}
+		keys := make([]string, len(storedKeys))
+		for i, storedKey := range storedKeys {
+			keys[i], _ = c.keyOf(storedKey)
+		}
+		if err = c.InvalidateMulti(resolvedContext(ctx), keys...); err != nil {
+			return
+		}
+		if cursor == 0 {
+			return
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+	}
+}
+
+// escapeGlob escapes special characters of glob-style patterns of Redis in @p s.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\', '^':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sleepCtx sleeps for @p d, returns the error of @p ctx if it is done before.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
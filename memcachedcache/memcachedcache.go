@@ -0,0 +1,121 @@
+// Package memcachedcache adapts Memcached, e.g., ElastiCache Memcached, to dcache.RemoteCache,
+// the distributed tier of dcache.TieredCache, e.g.,
+//
+//	mc := memcache.New("cache-1:11211", "cache-2:11211")
+//	tc, _ := dcache.NewTieredCache(memcachedcache.New(mc), nil, dcache.WithKeyPrefix("app"))
+//
+// Memcached has no pubsub, so memory caches of peers are invalidated by another
+// dcache.InvalidationBus, or expire by dcache.TieredCache.SetMemCacheMaxTTLSeconds if nil.
+// It is a module of its own, so that dcache does not depend on gomemcache.
+package memcachedcache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/stumble/dcache"
+)
+
+const (
+	// maxKeyLength is the longest key accepted by Memcached.
+	maxKeyLength = 250
+	// maxRelativeExpiration is the longest expiration in seconds read by Memcached as relative,
+	// longer ones are unix times.
+	maxRelativeExpiration = 30 * 24 * 60 * 60
+)
+
+// Remote is the dcache.RemoteCache of a Memcached client. Contexts are not supported by the
+// client, whose timeouts apply instead.
+type Remote struct {
+	client *memcache.Client
+}
+
+var _ dcache.RemoteCache = (*Remote)(nil)
+
+// New returns the dcache.RemoteCache of @p client.
+func New(client *memcache.Client) *Remote {
+	return &Remote{client: client}
+}
+
+// Get returns the value of @p key, dcache.ErrNotFound if absent.
+func (r *Remote) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := r.client.Get(itemKey(key))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, dcache.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// GetMulti returns values of @p keys found, absent keys are omitted.
+func (r *Remote) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	// keys of items may be hashed, see itemKey.
+	byItemKey := make(map[string]string, len(keys))
+	itemKeys := make([]string, len(keys))
+	for i, key := range keys {
+		itemKeys[i] = itemKey(key)
+		byItemKey[itemKeys[i]] = key
+	}
+	items, err := r.client.GetMulti(itemKeys)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string][]byte, len(items))
+	for k, item := range items {
+		rv[byItemKey[k]] = item.Value
+	}
+	return rv, nil
+}
+
+// Set sets @p value of @p key, expiring in @p ttl, never if 0.
+func (r *Remote) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(&memcache.Item{Key: itemKey(key), Value: value, Expiration: expiration(ttl)})
+}
+
+// Add sets @p value of @p key only if absent, returns false if present.
+func (r *Remote) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	err := r.client.Add(&memcache.Item{Key: itemKey(key), Value: value, Expiration: expiration(ttl)})
+	if errors.Is(err, memcache.ErrNotStored) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// itemKey returns the Memcached key of @p key, hashed if it is too long or has characters
+// rejected by Memcached, i.e., spaces and control characters.
+func itemKey(key string) string {
+	if len(key) <= maxKeyLength && validKey(key) {
+		return key
+	}
+	sum := sha1.Sum([]byte(key))
+	return "dcache:sha1:" + hex.EncodeToString(sum[:])
+}
+
+func validKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expiration returns the Memcached expiration of @p ttl, rounded up to seconds, as unix times
+// beyond maxRelativeExpiration.
+func expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds > maxRelativeExpiration {
+		return int32(time.Now().Unix() + seconds)
+	}
+	return int32(seconds)
+}
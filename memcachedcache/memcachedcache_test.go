@@ -0,0 +1,47 @@
+package memcachedcache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type memcachedTestSuite struct {
+	suite.Suite
+}
+
+func TestMemcachedTestSuite(t *testing.T) {
+	suite.Run(t, &memcachedTestSuite{})
+}
+
+func (suite *memcachedTestSuite) TestItemKey() {
+	suite.Equal("app:{key}", itemKey("app:{key}"))
+	long := strings.Repeat("k", maxKeyLength)
+	suite.Equal(long, itemKey(long))
+
+	// keys rejected by Memcached are hashed, the same for the same key.
+	for _, key := range []string{long + "k", "app:{a key}", "app:{key\n}", "app:{\x7f}"} {
+		hashed := itemKey(key)
+		suite.NotEqual(key, hashed)
+		suite.Equal(hashed, itemKey(key))
+		suite.LessOrEqual(len(hashed), maxKeyLength)
+		suite.True(validKey(hashed))
+	}
+	suite.NotEqual(itemKey("app:{a key}"), itemKey("app:{b key}"))
+}
+
+func (suite *memcachedTestSuite) TestExpiration() {
+	suite.EqualValues(0, expiration(0))
+	suite.EqualValues(0, expiration(-time.Second))
+	// rounded up to seconds, as 0 never expires.
+	suite.EqualValues(1, expiration(time.Millisecond))
+	suite.EqualValues(2, expiration(1500*time.Millisecond))
+	suite.EqualValues(maxRelativeExpiration, expiration(maxRelativeExpiration*time.Second))
+
+	// unix times beyond 30 days.
+	ttl := (maxRelativeExpiration + 60) * time.Second
+	at := int64(expiration(ttl))
+	suite.InDelta(time.Now().Add(ttl).Unix(), at, 1)
+}
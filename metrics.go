@@ -2,18 +2,40 @@ package dcache
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
 type metricSet struct {
-	AppName   string
-	Hit       *prometheus.CounterVec
-	Latency   *prometheus.HistogramVec
-	Error     *prometheus.CounterVec
-	RedisPool *prometheus.GaugeVec
+	AppName      string
+	LatencyUnit  LatencyUnit
+	Hit          *prometheus.CounterVec
+	Latency      *prometheus.HistogramVec
+	Error        *prometheus.CounterVec
+	RedisPool    *prometheus.GaugeVec
+	RedisPoolGet *poolCollector
+	Quarantine   *prometheus.CounterVec
+	RedisCmd     *prometheus.HistogramVec
+	WriteQueue   *prometheus.GaugeVec
+	Invalidated  *prometheus.CounterVec
+	Degraded     *prometheus.GaugeVec
+	Mode         *prometheus.GaugeVec
+	DryRun       *prometheus.CounterVec
+	DryRunSize   *prometheus.GaugeVec
+	CodecCanary  *prometheus.CounterVec
+	QuotaUsage   *prometheus.GaugeVec
+	QuotaRefuse  *prometheus.CounterVec
+	Expired      *prometheus.CounterVec
+	Writes       *prometheus.CounterVec
+	StreamLag    *prometheus.GaugeVec
+	RefreshQueue *prometheus.GaugeVec
+	Refresh      *prometheus.CounterVec
+	Backlog      *prometheus.GaugeVec
+	Reconnects   *prometheus.CounterVec
 }
 
 type metricHitLabel string
@@ -25,24 +47,74 @@ var (
 	hitLabelMemory metricHitLabel = "mem"
 	hitLabelRedis  metricHitLabel = "redis"
 	hitLabelDB     metricHitLabel = "db"
-	// The unit is ms.
-	latencyBucket = []float64{
+	// The unit is ms, scaled when latency is recorded in another unit.
+	defaultLatencyBuckets = []float64{
 		1, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096}
 
 	errLabels = []string{"app", "when"}
 	// metrics error labels
-	errLabelSetRedis              metricErrLabel = "set_redis"
-	errLabelSetMemCache           metricErrLabel = "set_mem_cache"
-	errLabelInvalidate            metricErrLabel = "invalidate_error"
-	errLabelMemoryUnmarshalFailed metricErrLabel = "mem_unmarshal_failed"
-	errLabelRedisUnmarshalFailed  metricErrLabel = "redis_unmarshal_failed"
+	errLabelSetRedis              metricErrLabel = ErrorOpSetRedis
+	errLabelSetMemCache           metricErrLabel = ErrorOpSetMemCache
+	errLabelInvalidate            metricErrLabel = ErrorOpInvalidate
+	errLabelPublish               metricErrLabel = ErrorOpPublish
+	errLabelMemoryUnmarshalFailed metricErrLabel = ErrorOpMemoryUnmarshal
+	errLabelRedisUnmarshalFailed  metricErrLabel = ErrorOpRedisUnmarshal
+	errLabelWriteDropped          metricErrLabel = ErrorOpWriteDropped
 
 	redisLabels = []string{"app", "name"}
+
+	quarantineLabels = []string{"app"}
+
+	redisCmdLabels = []string{"app", "cmd"}
+
+	writeQueueLabels = []string{"app"}
+
+	invalidatedLabels = []string{"app", "origin"}
+
+	degradedLabels = []string{"app"}
+
+	modeLabels = []string{"app", "mode"}
+	// metrics mode labels
+	modeLabelRemoteOnly = "remote_only"
+	modeLabelTwoTier    = "two_tier"
+
+	dryRunLabels     = []string{"app", "result"}
+	dryRunSizeLabels = []string{"app", "unit"}
+
+	codecCanaryLabels = []string{"app", "result"}
+
+	quotaLabels = []string{"app", "prefix"}
+
+	expiredLabels = []string{"app", "read"}
+	// metrics expired labels
+	expiredLabelRead      = "read"
+	expiredLabelUnread    = "unread"
+	expiredLabelUntracked = "untracked"
+
+	writesLabels = []string{"app", "prefix", "read"}
+
+	streamLagLabels = []string{"app"}
+
+	refreshQueueLabels = []string{"app"}
+	refreshLabels      = []string{"app", "result"}
+
+	backlogLabels = []string{"app"}
+
+	reconnectLabels = []string{"app"}
 )
 
-func newMetricSet(appName string) *metricSet {
+func newMetricSet(appName string, opts *options) *metricSet {
+	buckets := opts.latencyBuckets
+	if buckets == nil {
+		scale := float64(time.Millisecond) / float64(opts.latencyUnit.Duration())
+		buckets = make([]float64, len(defaultLatencyBuckets))
+		for i, b := range defaultLatencyBuckets {
+			buckets[i] = b * scale
+		}
+	}
 	return &metricSet{
-		AppName: appName,
+		AppName:     appName,
+		LatencyUnit: opts.latencyUnit,
 		Hit: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: fmt.Sprintf("dcache_hit_total"),
@@ -50,9 +122,11 @@ func newMetricSet(appName string) *metricSet {
 			}, hitLabels),
 		Latency: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Name:    fmt.Sprintf("dcache_latency_milliseconds"),
-				Help:    "Cache read latency in milliseconds",
-				Buckets: latencyBucket,
+				Name:    fmt.Sprintf("dcache_latency_%s", opts.latencyUnit),
+				Help:    fmt.Sprintf("Cache read latency in %s", opts.latencyUnit),
+				Buckets: buckets,
+
+				NativeHistogramBucketFactor: opts.nativeHistogramBucketFactor,
 			}, hitLabels),
 		Error: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -62,8 +136,106 @@ func newMetricSet(appName string) *metricSet {
 		RedisPool: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: fmt.Sprintf("dcache_redis_pool"),
-				Help: "redis pool status",
+				Help: "redis pool status: total, idle and stale conns",
 			}, redisLabels),
+		RedisPoolGet: &poolCollector{
+			appName: appName,
+			desc: prometheus.NewDesc("dcache_redis_pool_get_total",
+				"hits, misses and timeouts of getting conns from redis pools", redisLabels, nil),
+		},
+		Quarantine: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_quarantine_total"),
+				Help: "how many times keys were quarantined for repeated unmarshal failures",
+			}, quarantineLabels),
+		RedisCmd: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    fmt.Sprintf("dcache_redis_cmd_latency_%s", opts.latencyUnit),
+				Help:    fmt.Sprintf("Latency of Redis commands issued by dcache in %s", opts.latencyUnit),
+				Buckets: buckets,
+
+				NativeHistogramBucketFactor: opts.nativeHistogramBucketFactor,
+			}, redisCmdLabels),
+		WriteQueue: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_write_queue_depth"),
+				Help: "number of cache population writes waiting in the queue",
+			}, writeQueueLabels),
+		Invalidated: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_invalidate_received_keys_total"),
+				Help: "how many invalidated keys were received from each origin: {peer, redis, keyspace}",
+			}, invalidatedLabels),
+		Degraded: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_degraded"),
+				Help: "1 if the cache is evaluated as degraded, otherwise 0",
+			}, degradedLabels),
+		Mode: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_mode"),
+				Help: "1 for the current mode: {remote_only, two_tier}, otherwise 0",
+			}, modeLabels),
+		DryRun: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_dry_run_total"),
+				Help: "how many reads in dry-run mode would have been: {hit, miss}",
+			}, dryRunLabels),
+		DryRunSize: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_dry_run_size"),
+				Help: "size of values that would be cached in dry-run mode: {keys, bytes}",
+			}, dryRunSizeLabels),
+		CodecCanary: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_codec_canary_total"),
+				Help: "how many writes compared with the candidate codec: {match, mismatch, error}",
+			}, codecCanaryLabels),
+		QuotaUsage: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_quota_bytes"),
+				Help: "bytes written to Redis by all clients in the current window of quotas",
+			}, quotaLabels),
+		Expired: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_expired_total"),
+				Help: "how many keys expired in Redis: {read, unread} since written by this client, or untracked",
+			}, expiredLabels),
+		Writes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_writes_total"),
+				Help: "how many writes by this client of prefixes of the write report were {read, unread} by it",
+			}, writesLabels),
+		RefreshQueue: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_refresh_queue_depth"),
+				Help: "number of background refreshes of stale values waiting in the queue",
+			}, refreshQueueLabels),
+		Refresh: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_refresh_total"),
+				Help: "how many background refreshes of stale values succeeded, failed or were dropped",
+			}, refreshLabels),
+		Backlog: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_invalidate_backlog"),
+				Help: "number of invalidated keys pending to be published",
+			}, backlogLabels),
+		Reconnects: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_pubsub_reconnects_total"),
+				Help: "how many times the pubsub subscription of invalidations was reconnected",
+			}, reconnectLabels),
+		StreamLag: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("dcache_stream_lag_seconds"),
+				Help: "delay of the last invalidation read from the stream since appended",
+			}, streamLagLabels),
+		QuotaRefuse: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("dcache_quota_refused_total"),
+				Help: "how many writes were refused by quotas",
+			}, quotaLabels),
 	}
 }
 
@@ -84,6 +256,82 @@ func (m *metricSet) Register() {
 	if err != nil {
 		log.Err(err).Msgf("failed to register prometheus RedisPool gauge")
 	}
+	err = prometheus.Register(m.RedisPoolGet)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus RedisPoolGet counter")
+	}
+	err = prometheus.Register(m.Quarantine)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Quarantine counter")
+	}
+	err = prometheus.Register(m.RedisCmd)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus RedisCmd histogram")
+	}
+	err = prometheus.Register(m.WriteQueue)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus WriteQueue gauge")
+	}
+	err = prometheus.Register(m.Invalidated)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Invalidated counter")
+	}
+	err = prometheus.Register(m.Degraded)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Degraded gauge")
+	}
+	err = prometheus.Register(m.Mode)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Mode gauge")
+	}
+	err = prometheus.Register(m.DryRun)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus DryRun counter")
+	}
+	err = prometheus.Register(m.DryRunSize)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus DryRunSize gauge")
+	}
+	err = prometheus.Register(m.CodecCanary)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus CodecCanary counter")
+	}
+	err = prometheus.Register(m.QuotaUsage)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus QuotaUsage gauge")
+	}
+	err = prometheus.Register(m.QuotaRefuse)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus QuotaRefuse counter")
+	}
+	err = prometheus.Register(m.Expired)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Expired counter")
+	}
+	err = prometheus.Register(m.Writes)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Writes counter")
+	}
+	err = prometheus.Register(m.StreamLag)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus StreamLag gauge")
+	}
+	err = prometheus.Register(m.RefreshQueue)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus RefreshQueue gauge")
+	}
+	err = prometheus.Register(m.Refresh)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Refresh counter")
+	}
+	err = prometheus.Register(m.Backlog)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Backlog gauge")
+	}
+	err = prometheus.Register(m.Reconnects)
+	if err != nil {
+		log.Err(err).Msgf("failed to register prometheus Reconnects counter")
+	}
 }
 
 func (m *metricSet) Unregister() {
@@ -91,6 +339,25 @@ func (m *metricSet) Unregister() {
 	prometheus.Unregister(m.Error)
 	prometheus.Unregister(m.Latency)
 	prometheus.Unregister(m.RedisPool)
+	prometheus.Unregister(m.RedisPoolGet)
+	prometheus.Unregister(m.Quarantine)
+	prometheus.Unregister(m.RedisCmd)
+	prometheus.Unregister(m.WriteQueue)
+	prometheus.Unregister(m.Invalidated)
+	prometheus.Unregister(m.Degraded)
+	prometheus.Unregister(m.Mode)
+	prometheus.Unregister(m.DryRun)
+	prometheus.Unregister(m.DryRunSize)
+	prometheus.Unregister(m.CodecCanary)
+	prometheus.Unregister(m.QuotaUsage)
+	prometheus.Unregister(m.QuotaRefuse)
+	prometheus.Unregister(m.Expired)
+	prometheus.Unregister(m.Writes)
+	prometheus.Unregister(m.StreamLag)
+	prometheus.Unregister(m.RefreshQueue)
+	prometheus.Unregister(m.Refresh)
+	prometheus.Unregister(m.Backlog)
+	prometheus.Unregister(m.Reconnects)
 }
 
 // MakeHitObserver returns a function that can be used to observe hit by defer.
@@ -101,8 +368,9 @@ func (m *metricSet) MakeHitObserver(label metricHitLabel, startedAt time.Time) f
 			m.Hit.WithLabelValues(m.AppName, string(label)).Inc()
 		}
 		if m.Latency != nil {
+			// keep sub-millisecond precision, otherwise fast hits all fall into the first bucket.
 			m.Latency.WithLabelValues(m.AppName, string(label)).Observe(
-				float64(getNow().UnixMilli() - startedAt.UnixMilli()))
+				float64(getNow().Sub(startedAt)) / float64(m.LatencyUnit.Duration()))
 		}
 	}
 }
@@ -114,10 +382,214 @@ func (m *metricSet) ObserveError(label metricErrLabel) {
 	}
 }
 
-// UpdateConnPoolStatus updates the redis pool status.
-func (m *metricSet) UpdateConnPoolStatus(totalConns, idelConns uint32) {
-	if m.RedisPool != nil {
-		m.RedisPool.WithLabelValues(m.AppName, "total_conns").Set(float64(totalConns))
-		m.RedisPool.WithLabelValues(m.AppName, "idle_conns").Set(float64(idelConns))
+// UpdateConnPoolStatus updates the redis pool status, names are prefixed by @p prefix,
+// e.g., "lock_" for the client of locks.
+func (m *metricSet) UpdateConnPoolStatus(prefix string, stats *redis.PoolStats) {
+	if m.RedisPool != nil && stats != nil {
+		m.RedisPool.WithLabelValues(m.AppName, prefix+"total_conns").Set(float64(stats.TotalConns))
+		m.RedisPool.WithLabelValues(m.AppName, prefix+"idle_conns").Set(float64(stats.IdleConns))
+		m.RedisPool.WithLabelValues(m.AppName, prefix+"stale_conns").Set(float64(stats.StaleConns))
+	}
+}
+
+// AddConnPool adds the redis pool of @p stats to counters of getting conns, names are
+// prefixed by @p prefix, see UpdateConnPoolStatus.
+func (m *metricSet) AddConnPool(prefix string, stats func() *redis.PoolStats) {
+	if m.RedisPoolGet != nil {
+		m.RedisPoolGet.add(prefix, stats)
+	}
+}
+
+// poolCollector collects counters of getting conns from redis pools, read from pools when
+// collected, as they are cumulative.
+type poolCollector struct {
+	appName string
+	desc    *prometheus.Desc
+	mu      sync.Mutex
+	pools   []pooledStats
+}
+
+func (p *poolCollector) counter(name string, v uint32) prometheus.Metric {
+	return prometheus.MustNewConstMetric(p.desc, prometheus.CounterValue, float64(v), p.appName, name)
+}
+
+type pooledStats struct {
+	prefix string
+	stats  func() *redis.PoolStats
+}
+
+func (p *poolCollector) add(prefix string, stats func() *redis.PoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pools = append(p.pools, pooledStats{prefix: prefix, stats: stats})
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pool := range p.pools {
+		stats := pool.stats()
+		if stats == nil {
+			continue
+		}
+		ch <- p.counter(pool.prefix+"hits", stats.Hits)
+		ch <- p.counter(pool.prefix+"misses", stats.Misses)
+		ch <- p.counter(pool.prefix+"timeouts", stats.Timeouts)
+	}
+}
+
+// ObserveQuarantine increases the counter of quarantined keys.
+func (m *metricSet) ObserveQuarantine() {
+	if m.Quarantine != nil {
+		m.Quarantine.WithLabelValues(m.AppName).Inc()
+	}
+}
+
+// ObserveRedisLatency records the latency of a Redis command issued by dcache.
+func (m *metricSet) ObserveRedisLatency(cmd string, latency time.Duration) {
+	if m.RedisCmd != nil {
+		m.RedisCmd.WithLabelValues(m.AppName, cmd).Observe(
+			float64(latency) / float64(m.LatencyUnit.Duration()))
+	}
+}
+
+// UpdateWriteQueueDepth updates the depth of the write queue.
+func (m *metricSet) UpdateWriteQueueDepth(depth int) {
+	if m.WriteQueue != nil {
+		m.WriteQueue.WithLabelValues(m.AppName).Set(float64(depth))
+	}
+}
+
+// ObserveInvalidateReceived increases the number of invalidated keys received from @p origin,
+// one of a few kinds of origins, e.g., peerOrigin.
+func (m *metricSet) ObserveInvalidateReceived(origin string, keys int) {
+	if m.Invalidated != nil {
+		m.Invalidated.WithLabelValues(m.AppName, origin).Add(float64(keys))
+	}
+}
+
+// UpdateDegraded updates the degraded gauge.
+func (m *metricSet) UpdateDegraded(degraded bool) {
+	if m.Degraded != nil {
+		v := 0.0
+		if degraded {
+			v = 1
+		}
+		m.Degraded.WithLabelValues(m.AppName).Set(v)
+	}
+}
+
+// UpdateMode updates the mode gauge.
+func (m *metricSet) UpdateMode(remoteOnly bool) {
+	if m.Mode != nil {
+		v := 0.0
+		if remoteOnly {
+			v = 1
+		}
+		m.Mode.WithLabelValues(m.AppName, modeLabelRemoteOnly).Set(v)
+		m.Mode.WithLabelValues(m.AppName, modeLabelTwoTier).Set(1 - v)
+	}
+}
+
+// ObserveDryRun increases the counter of reads in dry-run mode that would have been a @p hit.
+func (m *metricSet) ObserveDryRun(hit bool) {
+	if m.DryRun != nil {
+		result := "miss"
+		if hit {
+			result = "hit"
+		}
+		m.DryRun.WithLabelValues(m.AppName, result).Inc()
+	}
+}
+
+// UpdateDryRunSize updates the number of @p keys and @p bytes that would be cached.
+func (m *metricSet) UpdateDryRunSize(keys, bytes int64) {
+	if m.DryRunSize != nil {
+		m.DryRunSize.WithLabelValues(m.AppName, "keys").Set(float64(keys))
+		m.DryRunSize.WithLabelValues(m.AppName, "bytes").Set(float64(bytes))
+	}
+}
+
+// ObserveCodecCanary increases the counter of writes compared with the candidate codec.
+func (m *metricSet) ObserveCodecCanary(result string) {
+	if m.CodecCanary != nil {
+		m.CodecCanary.WithLabelValues(m.AppName, result).Inc()
+	}
+}
+
+// UpdateQuotaUsage updates the bytes written by keys of quota @p prefix in the current window.
+func (m *metricSet) UpdateQuotaUsage(prefix string, bytes int64) {
+	if m.QuotaUsage != nil {
+		m.QuotaUsage.WithLabelValues(m.AppName, prefix).Set(float64(bytes))
+	}
+}
+
+// ObserveQuotaRefused increases the counter of writes refused by quota @p prefix.
+func (m *metricSet) ObserveQuotaRefused(prefix string) {
+	if m.QuotaRefuse != nil {
+		m.QuotaRefuse.WithLabelValues(m.AppName, prefix).Inc()
+	}
+}
+
+// ObserveExpired increases the counter of expired keys.
+func (m *metricSet) ObserveExpired(tracked, unread bool) {
+	if m.Expired != nil {
+		label := expiredLabelUntracked
+		if unread {
+			label = expiredLabelUnread
+		} else if tracked {
+			label = expiredLabelRead
+		}
+		m.Expired.WithLabelValues(m.AppName, label).Inc()
+	}
+}
+
+// ObserveWriteOutcome increases the counter of @p n writes of @p prefix read or not.
+func (m *metricSet) ObserveWriteOutcome(prefix string, read bool, n int) {
+	if m.Writes != nil {
+		label := expiredLabelUnread
+		if read {
+			label = expiredLabelRead
+		}
+		m.Writes.WithLabelValues(m.AppName, prefix, label).Add(float64(n))
+	}
+}
+
+// UpdateStreamLag updates the delay of the last invalidation read from the stream.
+func (m *metricSet) UpdateStreamLag(lag time.Duration) {
+	if m.StreamLag != nil {
+		m.StreamLag.WithLabelValues(m.AppName).Set(lag.Seconds())
+	}
+}
+
+// UpdateRefreshQueueDepth updates the depth of the queue of background refreshes.
+func (m *metricSet) UpdateRefreshQueueDepth(depth int) {
+	if m.RefreshQueue != nil {
+		m.RefreshQueue.WithLabelValues(m.AppName).Set(float64(depth))
+	}
+}
+
+// ObserveRefresh increases the number of background refreshes of @p result.
+func (m *metricSet) ObserveRefresh(result string) {
+	if m.Refresh != nil {
+		m.Refresh.WithLabelValues(m.AppName, result).Inc()
+	}
+}
+
+// UpdateInvalidateBacklog updates the number of invalidated keys pending to be published.
+func (m *metricSet) UpdateInvalidateBacklog(backlog int) {
+	if m.Backlog != nil {
+		m.Backlog.WithLabelValues(m.AppName).Set(float64(backlog))
+	}
+}
+
+// ObservePubSubReconnect increases the number of reconnects of the pubsub subscription.
+func (m *metricSet) ObservePubSubReconnect() {
+	if m.Reconnects != nil {
+		m.Reconnects.WithLabelValues(m.AppName).Inc()
 	}
 }
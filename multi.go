@@ -0,0 +1,418 @@
+package dcache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ReadMultiFunc reads values of @p keys from the data source, by key.
+// Keys not in the returned map are not found, and not cached.
+type ReadMultiFunc = func(keys []string) (map[string]any, error)
+
+// GetMulti reads values of @p keys into @p targets of the same indexes, see Get.
+// Keys are looked up in memory cache first, then the rest in Redis by a single MGET, or by
+// per-node pipelines on Redis Cluster.
+// Values still missing are read by a single call of @p readMulti, and cached with @p ttl.
+// Errors are reported per key, in the returned slice aligned with @p keys, so that one bad
+// key does not fail the whole batch: ErrNotFound for keys not returned by @p readMulti, and
+// the error of @p readMulti for keys it was called for, unless TolerateLoadErrors is given.
+// The returned slice is nil if values of all keys are read.
+// NOTE: distributed lock is not used for reading the data source.
+func (c *DCache) GetMulti(
+	ctx context.Context, keys []string, targets []any, ttl time.Duration, readMulti ReadMultiFunc,
+	opts ...CallOption) (errs []error) {
+	startedAt := getNow()
+	co := newCallOptions(opts)
+	ctx = c.tagContext(ctx, "GetMulti")
+	if co.priority != nil {
+		ctx = context.WithValue(ctx, priorityCtxKey{}, *co.priority)
+	}
+	if len(co.tags) > 0 {
+		ctx = context.WithValue(ctx, tagsCtxKey{}, co.tags)
+	}
+	if co.codec != nil {
+		ctx = context.WithValue(ctx, codecCtxKey{}, co.codec)
+	}
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "GetMulti", []string{fmt.Sprintf("keys=%d", len(keys))})
+		defer func() {
+			var err error
+			for _, e := range errs {
+				if e != nil {
+					err = e
+					break
+				}
+			}
+			c.tracer.TraceEnd(ctx, err)
+		}()
+	}
+	errs = make([]error, len(keys))
+	failed := false
+	fail := func(i int, err error) {
+		errs[i] = err
+		failed = true
+	}
+	if len(targets) != len(keys) {
+		for i := range keys {
+			fail(i, ErrTargetsMismatch)
+		}
+		return errs
+	}
+	stored, err := c.namespacedKeys(ctx, keys)
+	if err != nil {
+		for i := range keys {
+			fail(i, err)
+		}
+		return errs
+	}
+	if c.namespaces != nil {
+		// @p readMulti is called with keys of the caller.
+		readMulti = namespacedReadMulti(keys, stored, readMulti)
+		keys = stored
+	}
+
+	// local versions of keys before reading, see GetWithTtl.
+	seqs := make([]uint64, len(keys))
+	// keys not found in memory cache, to be read from Redis by one MGET.
+	var missing, remote []int
+	for i, key := range keys {
+		seqs[i] = c.versions.current(c.storeKey(key))
+		if c.dryRun != nil {
+			if !co.noCache {
+				c.observeDryRun(key)
+			}
+			missing = append(missing, i)
+			continue
+		}
+		if co.noCache || (c.quarantine != nil && c.quarantine.IsQuarantined(key)) {
+			missing = append(missing, i)
+			continue
+		}
+		if c.memCacheFor(key) {
+			if targetBytes, e := c.getMemoryCache(key); e == nil && c.unmarshal(key, targetBytes, targets[i]) == nil {
+				c.makeHitRecorder(hitLabelMemory, startedAt)()
+				c.traceHit(ctx, hitMem)
+				c.readRepair(ctx, key, targetBytes)
+				c.observeRead(key)
+				continue
+			}
+		}
+		if co.memoryOnly {
+			fail(i, ErrNotFound)
+			continue
+		}
+		if c.skipRemoteFor(key) {
+			missing = append(missing, i)
+			continue
+		}
+		remote = append(remote, i)
+	}
+	remoteKeys := make([]string, len(remote))
+	for j, i := range remote {
+		remoteKeys[j] = keys[i]
+	}
+	ves := c.readMultiFromRedis(ctx, remoteKeys)
+	for j, i := range remote {
+		key := keys[i]
+		if ves[j] == nil {
+			missing = append(missing, i)
+			continue
+		}
+		if err := c.unmarshal(key, ves[j].ValueBytes, targets[i]); err != nil {
+			// one undecodable entry only affects its own key.
+			c.logger(ctx).Err(err).Msgf("Failed to unmarshal from Redis for %s", key)
+			c.recordError(errLabelRedisUnmarshalFailed, key, err)
+			c.reportDecodeFailure(ctx, key)
+			if c.opts.decodeFailurePolicy == DecodeFailureError {
+				fail(i, err)
+			} else {
+				missing = append(missing, i)
+			}
+			continue
+		}
+		c.makeHitRecorder(hitLabelRedis, startedAt)()
+		c.traceHit(ctx, hitRedis)
+		c.observeRead(key)
+		if !co.noStore {
+			c.updateMemoryCache(ctx, key, ves[j], false, seqs[i])
+		}
+	}
+	if len(missing) == 0 {
+		if !failed {
+			return nil
+		}
+		return errs
+	}
+
+	missingKeys := make([]string, len(missing))
+	for j, i := range missing {
+		missingKeys[j] = keys[i]
+	}
+	c.traceHit(ctx, hitDB)
+	readStartedAt := getNow()
+	values, err := readMulti(missingKeys)
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to read %d keys", len(missingKeys))
+	}
+	for _, i := range missing {
+		key := keys[i]
+		if err != nil {
+			if co.tolerateLoadErrors {
+				fail(i, ErrNotFound)
+			} else {
+				fail(i, err)
+			}
+			continue
+		}
+		v, ok := values[key]
+		if !ok {
+			fail(i, ErrNotFound)
+			continue
+		}
+		c.makeHitRecorder(hitLabelDB, readStartedAt)()
+		c.observeRefresh(key)
+		valueBytes, e := c.marshal(ctx, key, v)
+		if e == nil {
+			e = c.unmarshal(key, valueBytes, targets[i])
+		}
+		if e != nil {
+			fail(i, e)
+			continue
+		}
+		if co.noStore || (c.quarantine != nil && c.quarantine.IsQuarantined(key)) {
+			continue
+		}
+		if co.shouldStore != nil && !co.shouldStore(v) {
+			continue
+		}
+		if c.dryRun != nil {
+			c.dryRun.store(key, len(valueBytes), c.policyTTL(key, ttl))
+			continue
+		}
+		if c.skipRemoteFor(key) {
+			ve := &ValueBytesExpiredAt{
+				ValueBytes: valueBytes,
+				ExpiredAt:  getNow().Add(c.policyTTL(key, ttl)).UnixMilli(),
+			}
+			c.updateMemoryCache(ctx, key, ve, false, seqs[i])
+			continue
+		}
+		if e := c.setKey(ctx, key, valueBytes, c.policyTTL(key, ttl), false, seqs[i]); e != nil {
+			c.logger(ctx).Err(e).Msgf("Failed to set Redis cache for %s", key)
+			c.recordError(errLabelSetRedis, key, e)
+		}
+	}
+	if !failed {
+		return nil
+	}
+	return errs
+}
+
+// readMultiFromRedis reads values of @p keys from Redis by one MGET, aligned with @p keys,
+// or by one MGET per slot on Redis Cluster.
+// Values not found or undecodable are nil. Errors of reading Redis are logged and treated
+// as not found.
+func (c *DCache) readMultiFromRedis(ctx context.Context, keys []string) []*ValueBytesExpiredAt {
+	ves := make([]*ValueBytesExpiredAt, len(keys))
+	if len(keys) == 0 {
+		return ves
+	}
+	storeKeys := make([]string, len(keys))
+	for i, key := range keys {
+		storeKeys[i] = c.storeKey(key)
+	}
+	values, err := c.mget(ctx, storeKeys)
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to read Redis for %d keys", len(keys))
+		return ves
+	}
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok || isTombstone([]byte(s)) {
+			continue
+		}
+		ve, err := c.decodeEnvelope([]byte(s))
+		if err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to decode Redis value of %s", keys[i])
+			continue
+		}
+		ves[i] = ve
+	}
+	if c.opts.serverTimeExpiry {
+		c.rebaseMultiExpiry(ctx, keys, ves)
+	}
+	return ves
+}
+
+// SetMulti explicitly sets keys to values in @p values with @p ttl, see Set.
+// All values are marshalled first, and nothing is written if any fails. Then values are
+// written to Redis in one pipeline, and memory cache is updated in one pass for keys
+// written successfully. The first error of writing is returned. Tags of @p ctx, see
+// SetMultiWithTags, are attached to all keys before they are written.
+// NOTE: values are neither skipped by WithNoopSetSkip nor coalesced by WithSetCoalescing.
+func (c *DCache) SetMulti(ctx context.Context, values map[string]any, ttl time.Duration) (err error) {
+	ctx = c.tagContext(ctx, "SetMulti")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "SetMulti",
+			[]string{
+				fmt.Sprintf("keys=%d", len(values)),
+				fmt.Sprintf("ttl=%s", ttl),
+			})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if c.namespaces != nil {
+		stored, err := c.namespacedKeys(ctx, keys)
+		if err != nil {
+			return err
+		}
+		storedValues := make(map[string]any, len(values))
+		for i, key := range keys {
+			storedValues[stored[i]] = values[key]
+		}
+		keys, values = stored, storedValues
+	}
+	ves := make([]*ValueBytesExpiredAt, len(keys))
+	veBytes := make([][]byte, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for i, key := range keys {
+		valueBytes, err := c.marshal(ctx, key, values[key])
+		if err != nil {
+			return fmt.Errorf("marshal %s: %w", key, err)
+		}
+		ttls[i] = c.policyTTL(key, ttl)
+		now := getNow()
+		stamp := c.stamps.next(now)
+		ves[i] = &ValueBytesExpiredAt{
+			ValueBytes: valueBytes,
+			ExpiredAt:  now.Add(ttls[i]).UnixMilli(),
+			CreatedAt:  stamp.at,
+			Seq:        stamp.seq,
+			Writer:     writerOf(c.id),
+		}
+		if veBytes[i], err = c.encodeEnvelope(ves[i]); err != nil {
+			return err
+		}
+		if c.recorder != nil {
+			c.recorder.record(RecordSet, key, len(valueBytes), "")
+		}
+	}
+	if c.dryRun != nil {
+		for i, key := range keys {
+			c.dryRun.store(key, len(ves[i].ValueBytes), ttls[i])
+		}
+		return nil
+	}
+
+	// same as writeSet, memory cache is updated only if keys are not changed during the write.
+	seqs := make([]uint64, len(keys))
+	for i, key := range keys {
+		c.versions.bump(c.storeKey(key))
+		defer c.versions.bump(c.storeKey(key))
+		seqs[i] = c.versions.current(c.storeKey(key))
+	}
+	wctx, cancel := c.writeContext(ctx)
+	defer cancel()
+	if tags := tagsOf(ctx); len(tags) > 0 {
+		// indexed before written, see setKey.
+		if err := c.addTagsMulti(wctx, keys, tags, ttls); err != nil {
+			return err
+		}
+	}
+	pipe := c.conn.Pipeline()
+	cmds := make([]*redis.StatusCmd, len(keys))
+	var refused []string
+	for i, key := range keys {
+		if !c.admitWrite(key, len(veBytes[i])) {
+			refused = append(refused, key)
+			continue
+		}
+		cmds[i] = pipe.Set(wctx, c.storeKey(key), veBytes[i], ttls[i])
+	}
+	if pipe.Len() > 0 {
+		_, err = pipe.Exec(wctx)
+	}
+	for i, key := range keys {
+		if cmds[i] == nil || cmds[i].Err() != nil {
+			continue
+		}
+		if c.digests != nil {
+			c.digests.record(c.storeKey(key), ves[i].ValueBytes, ttls[i])
+		}
+		c.observeWrite(key, ttls[i])
+		c.updateMemoryCache(ctx, key, ves[i], true, seqs[i])
+	}
+	if len(refused) > 0 {
+		// the previous values must not be left, see setKey.
+		if e := c.InvalidateMulti(resolvedContext(ctx), refused...); e != nil && err == nil {
+			err = e
+		}
+		if err == nil {
+			err = ErrQuotaExceeded
+		}
+	}
+	return err
+}
+
+// InvalidateMulti explicitly invalidates @p keys, see Invalidate. Keys are deleted from Redis
+// in one pipeline, and their invalidations are aggregated into messages to peers, the same as
+// those of Invalidate.
+// The first error of deleting is returned.
+func (c *DCache) InvalidateMulti(ctx context.Context, keys ...string) (err error) {
+	ctx = c.tagContext(ctx, "InvalidateMulti")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "InvalidateMulti", []string{fmt.Sprintf("keys=%d", len(keys))})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if keys, err = c.namespacedKeys(ctx, keys); err != nil {
+		return
+	}
+	for _, key := range keys {
+		c.versions.bump(c.storeKey(key))
+		defer c.versions.bump(c.storeKey(key))
+		if c.recorder != nil {
+			c.recorder.record(RecordInvalidate, key, 0, "")
+		}
+		if c.digests != nil {
+			c.digests.forget(c.storeKey(key))
+		}
+		c.observeDelete(key)
+		if c.dryRun != nil {
+			c.dryRun.remove(key)
+		}
+	}
+	if c.dryRun != nil {
+		return nil
+	}
+	pipe := c.conn.Pipeline()
+	existed := make([]func() (bool, error), len(keys))
+	pending := make([]bool, len(keys))
+	for i, key := range keys {
+		pending[i] = c.cancelPendingSet(key)
+		existed[i] = c.deleteCmd(ctx, pipe, key)
+	}
+	_, err = pipe.Exec(ctx)
+	for i, key := range keys {
+		// keys skipping Redis may be cached by peers regardless.
+		if ok, e := existed[i](); e == nil && (ok || pending[i] || c.skipRemoteFor(key)) && c.memCache() != nil {
+			c.deleteMemoryCache(key)
+			c.broadcastKeyInvalidate(key, valueStamp{})
+		}
+		c.forgetInFlight(key)
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// namespaceKeyPrefix is the prefix of keys of epochs of namespaces.
+	namespaceKeyPrefix = ":dcache_ns:"
+	// namespaceEpochRefresh is the interval of reloading epochs cached by clients, i.e., the
+	// maximum delay of clients to see bumps whose invalidation messages they missed.
+	namespaceEpochRefresh = time.Second
+)
+
+// resolvedCtxKey is the context key marking keys of calls already mapped to their
+// namespaces, e.g., keys read back from Redis, see WithNamespaces.
+type resolvedCtxKey struct{}
+
+// cachedEpoch is the epoch of a namespace cached by this client.
+type cachedEpoch struct {
+	epoch    int64
+	loadedAt time.Time
+}
+
+// namespaceEpochs caches epochs of namespaces, see WithNamespaces.
+type namespaceEpochs struct {
+	namespaces []string
+	mu         sync.Mutex
+	epochs     map[string]cachedEpoch
+}
+
+func newNamespaceEpochs(namespaces []string) *namespaceEpochs {
+	return &namespaceEpochs{namespaces: namespaces, epochs: make(map[string]cachedEpoch)}
+}
+
+// namespaceKey returns the key of the epoch of @p ns.
+func (c *DCache) namespaceKey(ns string) string {
+	return c.opts.keyPrefix + namespaceKeyPrefix + ns
+}
+
+// namespace returns the longest namespace of @p key, false if none.
+func (n *namespaceEpochs) namespace(key string) (string, bool) {
+	matched := -1
+	for i, ns := range n.namespaces {
+		if strings.HasPrefix(key, ns+":") && (matched < 0 || len(ns) > len(n.namespaces[matched])) {
+			matched = i
+		}
+	}
+	if matched < 0 {
+		return "", false
+	}
+	return n.namespaces[matched], true
+}
+
+// cached returns the epoch of @p ns cached, false if absent or too old.
+func (n *namespaceEpochs) cached(ns string) (int64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.epochs[ns]
+	if !ok || getNow().Sub(e.loadedAt) >= namespaceEpochRefresh {
+		return 0, false
+	}
+	return e.epoch, true
+}
+
+// store caches @p epoch of @p ns, unless a newer one is cached.
+func (n *namespaceEpochs) store(ns string, epoch int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e, ok := n.epochs[ns]; ok && e.epoch > epoch {
+		epoch = e.epoch
+	}
+	n.epochs[ns] = cachedEpoch{epoch: epoch, loadedAt: getNow()}
+}
+
+// forget drops the epoch of @p ns cached, e.g., on bumps by peers.
+func (n *namespaceEpochs) forget(ns string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.epochs, ns)
+}
+
+// epoch returns the current epoch of @p ns, loaded from Redis unless cached.
+func (c *DCache) epoch(ctx context.Context, ns string) (int64, error) {
+	if epoch, ok := c.namespaces.cached(ns); ok {
+		return epoch, nil
+	}
+	epoch, err := c.conn.Get(ctx, c.namespaceKey(ns)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	c.namespaces.store(ns, epoch)
+	return epoch, nil
+}
+
+// namespaced returns the key @p key is stored by, in the current epoch of its namespace.
+func (c *DCache) namespaced(ctx context.Context, key string) (string, error) {
+	if c.namespaces == nil || ctx.Value(resolvedCtxKey{}) != nil {
+		return key, nil
+	}
+	ns, ok := c.namespaces.namespace(key)
+	if !ok {
+		return key, nil
+	}
+	epoch, err := c.epoch(ctx, ns)
+	if err != nil {
+		return "", fmt.Errorf("load epoch of namespace %s: %w", ns, err)
+	}
+	return ns + ":" + strconv.FormatInt(epoch, 10) + key[len(ns):], nil
+}
+
+// namespacedKeys is namespaced of each of @p keys.
+func (c *DCache) namespacedKeys(ctx context.Context, keys []string) ([]string, error) {
+	if c.namespaces == nil || ctx.Value(resolvedCtxKey{}) != nil {
+		return keys, nil
+	}
+	rv := make([]string, len(keys))
+	for i, key := range keys {
+		var err error
+		if rv[i], err = c.namespaced(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// namespacedReadMulti returns @p read called with keys of the caller, @p keys, given the
+// keys they are stored by, @p stored, returning values by stored keys.
+func namespacedReadMulti(keys []string, stored []string, read ReadMultiFunc) ReadMultiFunc {
+	toKey := make(map[string]string, len(keys))
+	for i, key := range keys {
+		toKey[stored[i]] = key
+	}
+	return func(storedKeys []string) (map[string]any, error) {
+		callerKeys := make([]string, len(storedKeys))
+		for i, s := range storedKeys {
+			callerKeys[i] = toKey[s]
+		}
+		values, err := read(callerKeys)
+		if err != nil {
+			return nil, err
+		}
+		rv := make(map[string]any, len(values))
+		for i, s := range storedKeys {
+			if v, ok := values[callerKeys[i]]; ok {
+				rv[s] = v
+			}
+		}
+		return rv, nil
+	}
+}
+
+// resolvedContext marks keys of calls with the returned ctx already mapped to namespaces.
+func resolvedContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resolvedCtxKey{}, true)
+}
+
+// BumpNamespace invalidates all keys of namespace @p ns at once in O(1), by moving it to a
+// new epoch, see WithNamespaces. Keys of older epochs are not deleted, and expire by their
+// TTLs. Peers are notified at once to drop epochs they cached.
+func (c *DCache) BumpNamespace(ctx context.Context, ns string) (err error) {
+	ctx = c.tagContext(ctx, "BumpNamespace")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "BumpNamespace", []string{fmt.Sprintf("ns=%s", ns)})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	epoch, err := c.conn.Incr(ctx, c.namespaceKey(ns)).Result()
+	if err != nil {
+		return err
+	}
+	if c.namespaces != nil {
+		c.namespaces.store(ns, epoch)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(c.id)
+	appendMeta(&buf, metaSentAt, strconv.FormatInt(getNow().UnixMilli(), 10))
+	buf.WriteString(delimiter)
+	buf.WriteString(c.namespaceKey(ns))
+	c.publish(ctx, []pubMsg{{topic: c.opts.invalidateTopic, payload: buf.Bytes()}})
+	return nil
+}
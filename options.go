@@ -0,0 +1,903 @@
+package dcache
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/redis/go-redis/v9"
+)
+
+// Option configures optional behaviors of DCache at construction time.
+type Option func(*options)
+
+// options holds all optional configurations of DCache.
+type options struct {
+	// configurations of NewCache, given positionally to NewDCache.
+	localCache   LocalCache
+	readInterval time.Duration
+	enableStats  bool
+	enableTracer bool
+
+	lockSleep       time.Duration
+	invalidateTopic string
+	invalidateBatch int
+
+	// latencyBuckets of the latency histogram, in latencyUnit.
+	// nil means default buckets scaled to latencyUnit.
+	latencyBuckets []float64
+	latencyUnit    LatencyUnit
+
+	onError OnErrorFunc
+
+	quarantineThreshold int
+	quarantineCooldown  time.Duration
+
+	decodeFailurePolicy DecodeFailurePolicy
+
+	maxLockWaitAttempts int
+	maxLockWait         time.Duration
+	lockWaitFallback    bool
+
+	redisHook        bool
+	slowRedisCommand time.Duration
+
+	detachedWrites       bool
+	detachedWriteTimeout time.Duration
+
+	writeWorkers   int
+	writeQueueSize int
+
+	instanceID func() string
+
+	peerHeartbeat time.Duration
+
+	leaderTTL time.Duration
+
+	degradation *degradationDetector
+
+	noLockPrefixes []string
+	lockScope      LockScope
+
+	skipNoopSets bool
+
+	coalescePolicies []coalescePolicy
+
+	policies []Policy
+
+	loaderDigestPrefixes []string
+
+	remoteOnly bool
+
+	recordTo io.Writer
+
+	readRepairInterval time.Duration
+
+	tombstoneTTL time.Duration
+
+	dryRun bool
+
+	codec           Codec
+	noCompression   bool
+	envelopeVersion EnvelopeVersion
+
+	quotas []Quota
+
+	encryptionKeys [][]byte
+
+	expiryEvents bool
+	onExpiry     func(ExpiryEvent)
+
+	writeReportPrefixes []string
+
+	namespaces []string
+
+	prefetchRelated     func(key string) []string
+	prefetchConcurrency int
+
+	capacityTarget     float64
+	capacitySampleRate float64
+
+	keyPrefix string
+
+	logFields func(ctx context.Context) map[string]any
+
+	warmRate    int
+	warmLoaders []WarmLoader
+
+	xfetchBeta float64
+
+	entryStats          bool
+	entryStatsAggregate bool
+
+	lockClient redis.UniversalClient
+
+	canaryCodec    Codec
+	canaryFraction float64
+
+	hedgeReplica redis.UniversalClient
+	hedgeDelay   time.Duration
+
+	startupValidation time.Duration
+
+	serverTimeExpiry bool
+
+	streamRetention *StreamRetention
+
+	serverTracking bool
+
+	knownCodecs []Codec
+
+	backgroundRefresh BackgroundRefresh
+
+	keyspaceEviction bool
+
+	maxInvalidatePayload int
+
+	resyncPolicy ResyncPolicy
+
+	invalidateBacklog int
+	backlogOverflow   OverflowPolicy
+	// nativeHistogramBucketFactor enables Prometheus native histograms when > 1.
+	nativeHistogramBucketFactor float64
+	// setKeyHook is called by setKey between the Redis write and the memory cache update,
+	// for testing the ordering of them.
+	setKeyHook func(key string)
+}
+
+func defaultOptions() *options {
+	return &options{
+		readInterval:         defaultReadInterval,
+		lockSleep:            lockSleep,
+		invalidateBatch:      maxInvalidate,
+		maxInvalidatePayload: defaultMaxInvalidatePayload,
+		latencyUnit:          LatencyMilliseconds,
+		codec:                MsgpackCodec{},
+		envelopeVersion:      EnvelopeCodec,
+	}
+}
+
+// WithInMemCache enables memory cache @p mem, see NewCache.
+func WithInMemCache(mem *freecache.Cache) Option {
+	return func(o *options) {
+		o.localCache = nil
+		if mem != nil {
+			o.localCache = FreecacheLocal(mem)
+		}
+	}
+}
+
+// WithReadInterval sets the minimum duration between reads of the data source per key,
+// enforced by the distributed lock, 1 second by default.
+func WithReadInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.readInterval = interval
+	}
+}
+
+// WithStats registers Prometheus metrics of the cache to the default registerer.
+func WithStats(enabled bool) Option {
+	return func(o *options) {
+		o.enableStats = enabled
+	}
+}
+
+// WithTracer enables OpenTelemetry tracing of cache operations.
+func WithTracer(enabled bool) Option {
+	return func(o *options) {
+		o.enableTracer = enabled
+	}
+}
+
+// WithLockSleep sets the interval of retrying the distributed lock held by others,
+// 50 milliseconds by default.
+func WithLockSleep(d time.Duration) Option {
+	return func(o *options) {
+		o.lockSleep = d
+	}
+}
+
+// WithInvalidateTopic sets the Redis pubsub topic of invalidations, which must be the same
+// among clients of the same app name, "CacheInvalidatePubSub:<app name>" by default, so that
+// apps sharing a Redis do not receive invalidations of each other. Set it to
+// "CacheInvalidatePubSub" to keep exchanging invalidations with clients of older versions.
+func WithInvalidateTopic(topic string) Option {
+	return func(o *options) {
+		o.invalidateTopic = topic
+	}
+}
+
+// WithInvalidateBatch sets the maximum number of keys per invalidation message, 100 by
+// default. Pending invalidations are published once a batch is full, or every second.
+func WithInvalidateBatch(n int) Option {
+	return func(o *options) {
+		o.invalidateBatch = n
+	}
+}
+
+// LatencyUnit is the unit used to record latency metrics.
+type LatencyUnit int
+
+const (
+	// LatencyMilliseconds records latency in milliseconds, the default.
+	LatencyMilliseconds LatencyUnit = iota
+	// LatencySeconds records latency in seconds, the Prometheus convention.
+	LatencySeconds
+)
+
+// Duration returns the time.Duration of one unit.
+func (u LatencyUnit) Duration() time.Duration {
+	if u == LatencySeconds {
+		return time.Second
+	}
+	return time.Millisecond
+}
+
+// String returns the unit name used as the metric name suffix.
+func (u LatencyUnit) String() string {
+	if u == LatencySeconds {
+		return "seconds"
+	}
+	return "milliseconds"
+}
+
+// WithLatencyBuckets overrides the buckets of the latency histogram, in the latency unit,
+// milliseconds by default. Sub-millisecond buckets are allowed,
+// e.g., []float64{0.1, 0.25, 0.5, 1, 2, 5}.
+func WithLatencyBuckets(buckets []float64) Option {
+	return func(o *options) {
+		o.latencyBuckets = buckets
+	}
+}
+
+// WithNativeHistogram opts into Prometheus native (sparse) histograms for latency,
+// with @p bucketFactor as the maximum growth factor between two adjacent buckets,
+// e.g., 1.1. Classic buckets are still exposed for scrapers that do not support
+// native histograms.
+func WithNativeHistogram(bucketFactor float64) Option {
+	return func(o *options) {
+		o.nativeHistogramBucketFactor = bucketFactor
+	}
+}
+
+// WithLatencyUnit sets the unit of the latency histogram. The metric name suffix
+// follows the unit, i.e., dcache_latency_milliseconds or dcache_latency_seconds.
+// Default buckets are scaled accordingly, unless overridden by WithLatencyBuckets.
+func WithLatencyUnit(unit LatencyUnit) Option {
+	return func(o *options) {
+		o.latencyUnit = unit
+	}
+}
+
+// Operations reported to OnErrorFunc, also used as the "when" label of the error metric.
+const (
+	ErrorOpSetRedis        = "set_redis"
+	ErrorOpSetMemCache     = "set_mem_cache"
+	ErrorOpInvalidate      = "invalidate_error"
+	ErrorOpPublish         = "publish_invalidate"
+	ErrorOpMemoryUnmarshal = "mem_unmarshal_failed"
+	ErrorOpRedisUnmarshal  = "redis_unmarshal_failed"
+	ErrorOpWriteDropped    = "write_dropped"
+)
+
+// OnErrorFunc is called on failures that are handled internally and otherwise only logged,
+// e.g., failing to store a value into Redis after it was read from the data source.
+// @p op is one of the ErrorOp* constants, @p key is the cache key if applicable.
+// It is called synchronously, so it must not block.
+type OnErrorFunc func(op string, key string, err error)
+
+// WithOnError registers a callback for internally handled failures, so applications can
+// page or fall back when the cache is persistently failing.
+func WithOnError(f OnErrorFunc) Option {
+	return func(o *options) {
+		o.onError = f
+	}
+}
+
+// WithQuarantine quarantines keys whose cached bytes fail to unmarshal @p threshold
+// times in a row, i.e., each failure within @p cooldown of the previous one.
+// A quarantined key is deleted from the cache and caching is bypassed for it
+// for @p cooldown, so one corrupt entry does not keep failing requests.
+func WithQuarantine(threshold int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.quarantineThreshold = threshold
+		o.quarantineCooldown = cooldown
+	}
+}
+
+// DecodeFailurePolicy decides what to do when cached bytes fail to unmarshal into
+// the target, most commonly after a deploy that changed the struct shape.
+type DecodeFailurePolicy int
+
+const (
+	// DecodeFailureFallThrough ignores the undecodable entry and reads the next tier,
+	// the default. The entry is left in place until it is overwritten or expires.
+	DecodeFailureFallThrough DecodeFailurePolicy = iota
+	// DecodeFailureReload deletes the undecodable entry from the cache and falls
+	// through to the read function.
+	DecodeFailureReload
+	// DecodeFailureError returns the decode error to the caller.
+	DecodeFailureError
+)
+
+// WithDecodeFailurePolicy sets the policy of handling cached bytes that fail to unmarshal.
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) Option {
+	return func(o *options) {
+		o.decodeFailurePolicy = policy
+	}
+}
+
+// WithMaxLockWait caps the wait for another caller, holding the distributed lock of a key,
+// to populate the key: at most @p maxAttempts polling attempts and @p maxWait in total,
+// zero means no cap. Once reached, ErrLockWaitExceeded is returned, or when @p fallback
+// is true, the read function is called directly instead.
+// Without caps, callers wait until their context is done.
+func WithMaxLockWait(maxAttempts int, maxWait time.Duration, fallback bool) Option {
+	return func(o *options) {
+		o.maxLockWaitAttempts = maxAttempts
+		o.maxLockWait = maxWait
+		o.lockWaitFallback = fallback
+	}
+}
+
+// WithRedisHook installs a go-redis hook on the client that instruments Redis commands
+// issued by this cache: per-command latency is recorded into dcache metrics and traced as
+// span events, and commands slower than @p slowThreshold are logged, zero disables logging.
+// Commands issued by other users of the same client are not affected.
+// NOTE: go-redis cannot remove hooks, so the hook is left on the client after Close, passing
+// commands through, i.e., clients shared by many short-lived caches accumulate hooks.
+func WithRedisHook(slowThreshold time.Duration) Option {
+	return func(o *options) {
+		o.redisHook = true
+		o.slowRedisCommand = slowThreshold
+	}
+}
+
+// WithDetachedWrites writes values to Redis on a context detached from the caller's,
+// with its own @p timeout, one second if not positive. A caller whose context is
+// cancelled right after the data source was read still gets the value cached for
+// the next request.
+func WithDetachedWrites(timeout time.Duration) Option {
+	return func(o *options) {
+		o.detachedWrites = true
+		o.detachedWriteTimeout = timeout
+	}
+}
+
+// WithAsyncWrites offloads cache population writes, after reading the data source,
+// to @p workers background workers through a queue of @p queueSize, so the caller's
+// latency excludes the Redis write. Writes are dropped when the queue is full.
+// Writes use the timeout of WithDetachedWrites, one second by default.
+// Explicit Set is not affected.
+func WithAsyncWrites(workers int, queueSize int) Option {
+	return func(o *options) {
+		o.writeWorkers = workers
+		o.writeQueueSize = queueSize
+	}
+}
+
+// WithInstanceID sets the provider of the instance ID of the client, e.g., the pod name,
+// instead of a random UUID, so that invalidation origins correspond to actual pods.
+// A random UUID is used if @p provider returns empty string.
+// Instance IDs must be unique among clients sharing a Redis, because invalidations
+// from a client of the same ID are ignored as they were sent by itself.
+func WithInstanceID(provider func() string) Option {
+	return func(o *options) {
+		o.instanceID = provider
+	}
+}
+
+// HostnameInstanceID is an instance ID provider that returns the hostname,
+// which is the pod name on Kubernetes.
+func HostnameInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// WithPeerRegistry registers the client, with its ID, hostname and start time, in a Redis
+// hash shared by clients of the same app name, refreshed every @p heartbeat.
+// Registered clients are listed by Peers.
+func WithPeerRegistry(heartbeat time.Duration) Option {
+	return func(o *options) {
+		o.peerHeartbeat = heartbeat
+	}
+}
+
+// WithLeaderElection elects exactly one leader among clients of the same app name to run
+// cluster-wide background tasks registered by RunAsLeader. Leadership is held by a Redis
+// key of @p ttl renewed by the leader, so it fails over within @p ttl when the leader dies.
+func WithLeaderElection(ttl time.Duration) Option {
+	return func(o *options) {
+		o.leaderTTL = ttl
+	}
+}
+
+// WithDegradationDetector evaluates internal signals, i.e., hit ratio, errors, pubsub gaps
+// and lock waits, every @p interval against @p thresholds. The cache is degraded when any
+// threshold is exceeded, reported by Degraded, the dcache_degraded gauge, and @p onChange,
+// if not nil, which is called when the cache becomes degraded or recovers.
+func WithDegradationDetector(
+	interval time.Duration, thresholds DegradationThresholds, onChange func(DegradationStatus)) Option {
+	return func(o *options) {
+		o.degradation = &degradationDetector{
+			interval:   interval,
+			thresholds: thresholds,
+			onChange:   onChange,
+		}
+	}
+}
+
+// LockScope is the scope of locks that let only one caller read the data source per key.
+type LockScope int
+
+const (
+	// LockScopeAll uses both the in-process single flight and the distributed lock, the default.
+	LockScopeAll LockScope = iota
+	// LockScopeLocal uses only the in-process single flight, e.g., for single-pod deployments
+	// or cheap loaders, saving the Redis round trips of the distributed lock.
+	LockScopeLocal
+	// LockScopeDistributed uses only the distributed lock, so that callers in the same process
+	// do not share values with each other, e.g., for loaders that depend on callers.
+	LockScopeDistributed
+)
+
+// WithDefaultLockScope sets the scope of locks for all calls, see WithLockScope.
+func WithDefaultLockScope(scope LockScope) Option {
+	return func(o *options) {
+		o.lockScope = scope
+	}
+}
+
+// WithNoLockPrefixes skips the distributed lock for keys of any of @p prefixes, for key
+// families whose loaders are trivially cheap, e.g., local computations, where the extra
+// Redis round trips of the lock cost more than occasional duplicate reads.
+// Reads are still deduplicated within the process.
+func WithNoLockPrefixes(prefixes ...string) Option {
+	return func(o *options) {
+		o.noLockPrefixes = prefixes
+	}
+}
+
+// WithNoopSetSkip makes Set skip both the Redis write and the invalidation broadcast when
+// the value is the same bytes as the one last Set by this pod and not changed since.
+// The TTL of the existing value is not extended by skipped Sets, unless less than half of
+// the TTL of the Set remains. It requires memory cache to learn changes from peers.
+func WithNoopSetSkip() Option {
+	return func(o *options) {
+		o.skipNoopSets = true
+	}
+}
+
+// WithSetCoalescing coalesces Sets of keys of @p prefix within @p window, e.g., high-churn
+// counters or status keys, so that only the last value is written to Redis and broadcast.
+// Set returns without waiting for the write, which is reported by WithOnError if it fails.
+// Memory cache of this pod reflects the Set immediately. Pending values are written on Close.
+// It can be given multiple times for different key families, the first matched one applies.
+func WithSetCoalescing(prefix string, window time.Duration) Option {
+	return func(o *options) {
+		o.coalescePolicies = append(o.coalescePolicies, coalescePolicy{prefix: prefix, window: window})
+	}
+}
+
+// WithPolicies sets the policy table of key prefixes, so that cache policies, i.e., default
+// TTL, jitter, memory cache participation, compression and eviction priority, are configured
+// in one place. Policies are evaluated per call, by the longest prefix matching the key.
+func WithPolicies(policies ...Policy) Option {
+	return func(o *options) {
+		o.policies = policies
+	}
+}
+
+// WithLoaderLatencyDigests maintains t-digest sketches of latencies of reading data sources
+// for keys of each of @p prefixes, reported by Stats, for capacity planning of loaders
+// without tracing. Keys are counted into the longest prefix matched.
+func WithLoaderLatencyDigests(prefixes ...string) Option {
+	return func(o *options) {
+		o.loaderDigestPrefixes = prefixes
+	}
+}
+
+// WithRemoteOnly explicitly runs the cache in remote-only mode, i.e., without memory cache,
+// reported by the dcache_mode gauge. Memory cache can be attached later by AttachLocalStore.
+// NewDCache returns ErrRemoteOnly if memory cache is also given.
+func WithRemoteOnly() Option {
+	return func(o *options) {
+		o.remoteOnly = true
+	}
+}
+
+// WithRecorder records Gets, Sets and Invalidates into @p w in a compact binary format,
+// with keys, sizes of values and tiers serving Gets, to be replayed offline against other
+// configurations, see dcachebench.Replay. Events are buffered and flushed by Close, @p w is
+// not closed. Recording stops at the first write error.
+func WithRecorder(w io.Writer) Option {
+	return func(o *options) {
+		o.recordTo = w
+	}
+}
+
+// WithReadRepair writes values served from memory cache back to Redis, with the remaining
+// TTL of the memory copy, if Redis has lost them, e.g., after failover or eviction, so that
+// peers read them from Redis instead of the data source. Each key is checked in background
+// at most once per @p interval, by a SETNX. Repairs are undone if the key is invalidated
+// right after, as the memory copy might be older than an invalidation not yet received.
+func WithReadRepair(interval time.Duration) Option {
+	return func(o *options) {
+		o.readRepairInterval = interval
+	}
+}
+
+// WithTombstones makes Invalidate write a tombstone of @p ttl instead of deleting the key, so
+// that values read from the data source before the invalidation, and written to Redis after it
+// by any client, cannot resurrect the deleted value. Values read from the data source are not
+// cached in Redis while the key is tombstoned, so @p ttl should be just longer than loaders
+// take, e.g., a few seconds. Explicit Sets overwrite tombstones. All clients of the same app
+// name must enable it, as clients without it write values regardless of tombstones.
+func WithTombstones(ttl time.Duration) Option {
+	return func(o *options) {
+		o.tombstoneTTL = ttl
+	}
+}
+
+// WithCodec serializes values and their envelopes in Redis by @p codec instead of
+// MsgpackCodec, e.g., for data structures already serialized by other formats.
+// All clients of the same keys must use the same codec.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithJSONCodec serializes values by JSONCodec, uncompressed, so that values in Redis are
+// readable by redis-cli and by consumers in other languages.
+func WithJSONCodec() Option {
+	return func(o *options) {
+		o.codec = JSONCodec{}
+		o.noCompression = true
+	}
+}
+
+// WithExpiryEvents subscribes to keyspace notifications of keys of the cache expired in Redis,
+// calling @p onExpiry, if not nil, for each of them, e.g., to measure cached data expired
+// unread, i.e., wasted writes, see ExpiryEvent and Stats. Notifications of expired keys must
+// be enabled in Redis, e.g., notify-keyspace-events "Ex". Every client receives events of all
+// keys, but only the client that wrote a key tells whether it was read since.
+// @p onExpiry is called sequentially, and must not block.
+// NOTE: notifications are not delivered across nodes of Redis Cluster.
+func WithExpiryEvents(onExpiry func(ExpiryEvent)) Option {
+	return func(o *options) {
+		o.expiryEvents = true
+		o.onExpiry = onExpiry
+	}
+}
+
+// WithWriteReport tracks whether values of keys of each of @p prefixes written by this client
+// are read by it before they expire, or are overwritten or invalidated, reported by Stats and
+// the dcache_writes_total counter, to find caching of data written often but rarely read.
+// Keys are counted into the longest prefix matched. Reads by other clients are not seen, so
+// values written by one client and read by others are reported unread.
+func WithWriteReport(prefixes ...string) Option {
+	return func(o *options) {
+		o.writeReportPrefixes = prefixes
+	}
+}
+
+// WithNamespaces makes keys of each of @p namespaces, i.e., keys starting with "{ns}:", stored
+// as "{ns}:{epoch}:{rest}", where the epoch of the namespace lives in Redis, so that all keys
+// of a namespace are invalidated at once by BumpNamespace, without deleting them. Epochs are
+// cached by clients, and reloaded every namespaceEpochRefresh in case bumps are missed.
+// Keys are mapped to their namespaces by Get, GetWithTtl, GetMulti, Peek, WaitForValue, Set,
+// SetMulti, Invalidate, InvalidateMulti and EntryStats, and policies are matched against keys
+// as stored. Other operations, e.g., Pin, Maintain and InvalidateByPrefix, take keys as stored.
+func WithNamespaces(namespaces ...string) Option {
+	return func(o *options) {
+		o.namespaces = namespaces
+	}
+}
+
+// WithPrefetch makes hits of a key by Get/GetWithTtl prefetch keys returned by @p related for
+// it in the background, matching known access patterns, e.g., reads of profiles followed by
+// reads of settings. Related keys absent in memory cache are loaded from Redis, or warmed by
+// their warm loaders if absent in Redis, see WithWarmQueue. At most @p concurrency keys,
+// defaultPrefetchConcurrency if 0, are prefetched at once, and others are dropped.
+// @p related is called on every hit, and must be cheap. Keys are those of callers, not as
+// stored, see WithNamespaces.
+func WithPrefetch(related func(key string) []string, concurrency int) Option {
+	return func(o *options) {
+		o.prefetchRelated = related
+		o.prefetchConcurrency = concurrency
+	}
+}
+
+// WithCapacityAdvisor estimates the size of memory cache needed to reach @p targetHitRatio,
+// from reuse distances of reads by Get/GetWithTtl, and sizes and memory TTLs of values, as if
+// memory cache were an LRU of any size, reported by Stats and logged periodically. Keys are
+// sampled at @p sampleRate, all keys if 0, e.g., 0.01 for hot paths, with costs of reads of
+// sampled keys growing with the number of sampled keys, up to maxSampledKeys.
+// Keys of policies without memory cache are also counted.
+func WithCapacityAdvisor(targetHitRatio float64, sampleRate float64) Option {
+	return func(o *options) {
+		o.capacityTarget = targetHitRatio
+		o.capacitySampleRate = sampleRate
+	}
+}
+
+// WithKeyPrefix stores keys as "{prefix}:{key}" instead of ":{key}", including lock keys and
+// keys in invalidation messages, so that apps sharing Redis do not collide. Clients of the
+// same app must use the same prefix. @p prefix must not start with "@", nor contain the
+// delimiter of invalidation messages, otherwise NewCache returns ErrInvalidKeyPrefix.
+// NOTE: keys of the previous prefix are left in Redis to expire when the prefix is changed.
+func WithKeyPrefix(prefix string) Option {
+	return func(o *options) {
+		o.keyPrefix = prefix
+	}
+}
+
+// WithLogFields adds fields returned by @p f to logs of operations, e.g., the trace ID or
+// the user ID of the request carried by ctx, so that logs can be correlated with requests
+// that triggered them. @p f is called only when logging, including logs of async writes.
+func WithLogFields(f func(ctx context.Context) map[string]any) Option {
+	return func(o *options) {
+		o.logFields = f
+	}
+}
+
+// WithWarmQueue consumes warm requests from the Redis list shared by clients of the same app
+// name, e.g., pushed by CDC pipelines after data changes, see RequestWarm. Each key is reloaded
+// by the loader of the longest matching prefix of @p loaders and set, at most @p rate keys per
+// second per client, unlimited if 0, so that upstream systems re-warm keys without calling
+// every pod. Keys without loaders are dropped, and keys failed to load are pushed back to be
+// retried. Each consumer blocks a connection of the pool of the client while the queue is
+// empty.
+func WithWarmQueue(rate int, loaders ...WarmLoader) Option {
+	return func(o *options) {
+		o.warmRate = rate
+		o.warmLoaders = loaders
+	}
+}
+
+// WithXFetch recomputes values before they expire by XFetch, probabilistic early expiration:
+// the time taken to read values from the data source is stored along with them, and each read
+// from Redis recomputes the value early with probability growing as it approaches expiration,
+// scaled by its compute time and @p beta, e.g., 1, larger to recompute earlier. So that
+// expensive keys are recomputed by a single early reader instead of a stampede at expiration.
+// Errors of recomputing early are logged, and the value read is returned.
+// NOTE: values in memory cache are served until they expire, see SetMemCacheMaxTTLSeconds.
+func WithXFetch(beta float64) Option {
+	return func(o *options) {
+		o.xfetchBeta = beta
+	}
+}
+
+// WithEntryStats tracks approximate statistics of keys read by this client, i.e., hits,
+// refreshes and the last access, see EntryStats, e.g., to find keys nobody reads during
+// cleanups. If @p aggregate, stats are also added to Redis every second, so that EntryStats
+// returns stats of all clients of the same app name. Stats in Redis expire a day after the
+// last access.
+func WithEntryStats(aggregate bool) Option {
+	return func(o *options) {
+		o.entryStats = true
+		o.entryStatsAggregate = aggregate
+	}
+}
+
+// WithLockClient issues lock keys of reads and pub/sub of invalidations through @p client, e.g.,
+// a lighter or closer Redis, instead of the client of values, so that lock churn and
+// invalidation traffic do not compete with large values for the same connection pool.
+// All clients of the same app name must use the same Redis for locks and invalidations.
+func WithLockClient(client redis.UniversalClient) Option {
+	return func(o *options) {
+		o.lockClient = client
+	}
+}
+
+// WithEncryption encrypts values by AES-GCM, both in Redis and in memory cache, e.g., for PII
+// in shared Redis. @p keys is the key ring, each of 16, 24 or 32 bytes for AES-128, AES-192 or
+// AES-256: values are encrypted by the first key, and decrypted by the key they were encrypted
+// by. To rotate keys, prepend the new key to the ring, and remove the old one after values of
+// it expire, or are re-encrypted by Maintain with Reencode. Values are bound to their keys, so
+// values copied to other keys are not decrypted.
+// NOTE: encrypted values of the same value differ, so WithNoopSetSkip never skips Sets.
+func WithEncryption(keys ...[]byte) Option {
+	return func(o *options) {
+		o.encryptionKeys = keys
+	}
+}
+
+// WithQuotas sets budgets of bytes written to Redis by keys of prefixes, so that a runaway
+// feature cannot consume the shared Redis. Usage is counted in Redis across clients of the
+// same app name, approximately, as each client adds its usage every second. Quotas are
+// matched by the longest prefix. Values read from the data source past enforced budgets
+// are returned but not cached, and explicit Sets fail by ErrQuotaExceeded, with the previous
+// value invalidated, see Quota.
+func WithQuotas(quotas ...Quota) Option {
+	return func(o *options) {
+		o.quotas = quotas
+	}
+}
+
+// WithCodecCanary compares @p candidate with the codec of the client for @p fraction of
+// writes, e.g., 0.01, to de-risk codec migrations: values are encoded and decoded by both,
+// and results are compared, see Stats and the dcache_codec_canary_total metric.
+// Values are still written by the codec of the client. Strings and []byte are not compared.
+func WithCodecCanary(candidate Codec, fraction float64) Option {
+	return func(o *options) {
+		o.canaryCodec = candidate
+		o.canaryFraction = fraction
+	}
+}
+
+// WithEnvelopeVersion writes envelopes of values in Redis in version @p v. Envelopes of all
+// versions are read regardless, so formats can be changed across a fleet without flushing
+// the cache: roll out clients understanding the new version first, then switch versions.
+func WithEnvelopeVersion(v EnvelopeVersion) Option {
+	return func(o *options) {
+		o.envelopeVersion = v
+	}
+}
+
+// WithHedgedReads reads keys also from @p replica if Redis has not answered within @p delay,
+// e.g., the p95 latency of reads, taking whichever answers first, to cut tail latency of
+// occasionally slow Redis nodes. Values found on @p replica are taken, while keys not found
+// there are waited for on Redis, as they may not be replicated yet. Values on @p replica can
+// lag behind invalidations by the replication delay.
+// NOTE: it applies to reads of single keys, not to GetMulti.
+func WithHedgedReads(replica redis.UniversalClient, delay time.Duration) Option {
+	return func(o *options) {
+		o.hedgeReplica = replica
+		o.hedgeDelay = delay
+	}
+}
+
+// WithDryRun evaluates caching without caching, e.g., to estimate the hit ratio and Redis
+// size of a new endpoint before turning caching on. Reads always call loaders, and Sets and
+// Invalidates write nothing, neither to Redis nor to memory cache. Instead, values that would
+// have been cached are tracked by this client, and reads are counted as would-be hits or
+// misses, see Stats and the dcache_dry_run_total and dcache_dry_run_size metrics.
+// Estimates are per client, so hits served by peers through Redis are not counted.
+func WithDryRun() Option {
+	return func(o *options) {
+		o.dryRun = true
+	}
+}
+
+// WithStartupValidation makes NewCache run Validate within @p timeout, and fail with
+// ErrValidationFailed if any check fails, so that services fail fast on misconfiguration,
+// e.g., unreachable Redis or a pubsub topic without permissions. Warnings are logged.
+func WithStartupValidation(timeout time.Duration) Option {
+	return func(o *options) {
+		o.startupValidation = timeout
+	}
+}
+
+// WithServerTimeExpiry derives expirations of values read from Redis, and so their TTLs in
+// memory cache, from PTTLs of keys read along with them, instead of ExpiredAt written by
+// the clocks of writers, so that writers of skewed clocks do not write values expired at
+// once, or never expiring, for other clients. It costs a PTTL per key read, pipelined with
+// GET, or one more round trip for GetMulti, and reads are not hedged, see WithHedgedReads.
+func WithServerTimeExpiry() Option {
+	return func(o *options) {
+		o.serverTimeExpiry = true
+	}
+}
+
+// WithStreamInvalidation sends invalidations by a Redis stream shared by clients of the same
+// invalidation topic, instead of pubsub, read by a consumer group per client, so that clients
+// disconnected briefly catch up on messages sent meanwhile, instead of holding stale values.
+// Messages are kept by @p retention, and clients that missed messages trimmed clear their
+// memory caches. Consumer groups are removed by Close, or by peers once they missed messages
+// trimmed. All clients of the same app must use the same transport. Requires Redis 7.
+func WithStreamInvalidation(retention StreamRetention) Option {
+	return func(o *options) {
+		o.streamRetention = &retention
+	}
+}
+
+// WithServerTracking invalidates memory cache by Redis client tracking, instead of
+// invalidations of peers, so that values changed by anyone, including tools and services not
+// using dcache, are invalidated by Redis itself. A dedicated connection of the primary client,
+// which stores values, enables tracking in broadcasting mode on prefixes of store keys, with
+// invalidations redirected to it by RESP2 pubsub. Writes of this client also invalidate its
+// memory cache, and invalidations are still published for peers not using tracking. NewCache
+// returns ErrClusterUnsupported unless the primary client is a *redis.Client. Requires Redis 6.
+func WithServerTracking() Option {
+	return func(o *options) {
+		o.serverTracking = true
+	}
+}
+
+// WithKnownCodecs makes values encoded by @p codecs readable, e.g., values written by peers
+// with WithValueCodec. Values of codecs not known are read as errors. The codec of the
+// client, codecs of policies and the builtin codecs are always known, see Policy.Codec.
+func WithKnownCodecs(codecs ...Codec) Option {
+	return func(o *options) {
+		o.knownCodecs = append(o.knownCodecs, codecs...)
+	}
+}
+
+// WithBackgroundRefresh bounds background refreshes of stale values by @p cfg: each refresh
+// has its own deadline, independent of the read that triggered it, a bounded number of them
+// run at once, and refreshes beyond the queue are dropped, see SoftTTL. Queue depth and
+// failures are exported by Stats and the dcache_refresh_queue_depth and dcache_refresh_total
+// metrics. Defaults apply without it.
+func WithBackgroundRefresh(cfg BackgroundRefresh) Option {
+	return func(o *options) {
+		o.backgroundRefresh = cfg
+	}
+}
+
+// WithKeyspaceEviction subscribes to keyspace notifications of keys of the cache deleted or
+// expired in Redis, evicting them from memory cache, so that values deleted by tools not
+// using dcache, or expired in Redis earlier than in memory cache, are not served from memory.
+// Notifications must be enabled in Redis, e.g., notify-keyspace-events "Egx". It is ignored
+// without memory cache.
+// NOTE: notifications are not delivered across nodes of Redis Cluster.
+func WithKeyspaceEviction() Option {
+	return func(o *options) {
+		o.keyspaceEviction = true
+	}
+}
+
+// OverflowPolicy is how invalidations beyond the max backlog are handled, see
+// WithInvalidateBacklog.
+type OverflowPolicy int
+
+const (
+	// OverflowFlush publishes pending invalidations immediately, without waiting for the
+	// next batch.
+	OverflowFlush OverflowPolicy = iota
+	// OverflowFlushAll drops pending invalidations, and broadcasts a flush message instead,
+	// clearing memory caches of peers, e.g., when invalidations are too many to be published.
+	OverflowFlushAll
+)
+
+// WithInvalidateBacklog bounds invalidations pending to be published to @p max keys, unbounded
+// by default, in case the publisher falls behind, e.g., on slow Redis. Once it overflows,
+// pending invalidations are handled by @p policy. Backlog and overflows are exported by Stats
+// and the dcache_invalidate_backlog metric.
+func WithInvalidateBacklog(max int, policy OverflowPolicy) Option {
+	return func(o *options) {
+		o.invalidateBacklog = max
+		o.backlogOverflow = policy
+	}
+}
+
+// WithMaxInvalidatePayload splits invalidations into messages of at most @p size bytes,
+// 32KB by default, as pubsub proxies may reject large messages, e.g.,
+// batches of long keys. Keys longer than it are sent in messages of their own. It is
+// unbounded if @p size is not positive, then messages are split by WithInvalidateBatch only.
+func WithMaxInvalidatePayload(size int) Option {
+	return func(o *options) {
+		o.maxInvalidatePayload = size
+	}
+}
+
+// WithPubSubResync resyncs memory cache by @p policy once the pubsub subscription of
+// invalidations is reconnected, ResyncFlush by default, as invalidations published during
+// the gap are lost. Reconnects are exported by Stats and the dcache_pubsub_reconnects_total
+// metric. See WithStreamInvalidation for transports that do not lose invalidations.
+func WithPubSubResync(policy ResyncPolicy) Option {
+	return func(o *options) {
+		o.resyncPolicy = policy
+	}
+}
+
+// WithLocalCache enables memory cache @p local, e.g., adapters of caches of admission
+// policies, see LocalCache. It overrides WithInMemCache.
+func WithLocalCache(local LocalCache) Option {
+	return func(o *options) {
+		o.localCache = local
+	}
+}
+
+// withSetKeyHook sets the setKeyHook of tests.
+func withSetKeyHook(f func(key string)) Option {
+	return func(o *options) {
+		o.setKeyHook = f
+	}
+}
@@ -0,0 +1,117 @@
+// Package ottercache adapts otter to dcache.LocalCache, whose S3-FIFO eviction keeps hot keys
+// of skewed workloads resident, e.g.,
+//
+//	cache, _ := otter.MustBuilder[string, []byte](64 << 20).
+//		CollectStats().Cost(ottercache.Cost).WithVariableTTL().Build()
+//	dc, _ := dcache.NewCache("app", rdb, dcache.WithLocalCache(ottercache.New(cache)))
+//
+// It is a module of its own, so that dcache does not depend on otter.
+package ottercache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/maypok86/otter"
+
+	"github.com/stumble/dcache"
+)
+
+// noExpiry is the TTL of entries set without expirations, as otter requires positive TTLs.
+const noExpiry = 100 * 365 * 24 * time.Hour
+
+// ErrRejected is returned by Set if the value is refused by otter, so that the previous value
+// is not left. Values costing more than the capacity return dcache.ErrEntryTooLarge instead.
+var ErrRejected = errors.New("ottercache: value rejected")
+
+// Cost is the cost function of caches adapted by New, the size of entries in bytes, so that
+// the capacity is in bytes.
+func Cost(key string, value []byte) uint32 {
+	return uint32(len(key) + len(value))
+}
+
+// Cache is the dcache.LocalCache of an otter cache.
+type Cache struct {
+	cache otter.CacheWithVariableTTL[string, []byte]
+}
+
+var (
+	_ dcache.LocalCache       = (*Cache)(nil)
+	_ dcache.LocalCacheRanger = (*Cache)(nil)
+	_ dcache.LocalCacheExpiry = (*Cache)(nil)
+)
+
+// New returns the dcache.LocalCache of @p cache, built with Cost, variable TTLs, and
+// CollectStats for Stats.
+func New(cache otter.CacheWithVariableTTL[string, []byte]) *Cache {
+	return &Cache{cache: cache}
+}
+
+// Get returns the value of @p key, dcache.ErrNotFound if absent or expired.
+func (c *Cache) Get(key []byte) ([]byte, error) {
+	v, ok := c.cache.Get(string(key))
+	if !ok {
+		return nil, dcache.ErrNotFound
+	}
+	return v, nil
+}
+
+// Set sets @p value of @p key, expiring in @p expireSeconds, never if 0.
+func (c *Cache) Set(key, value []byte, expireSeconds int) error {
+	k := string(key)
+	ttl := time.Duration(expireSeconds) * time.Second
+	if expireSeconds <= 0 {
+		ttl = noExpiry
+	}
+	if int(Cost(k, value)) > c.cache.Capacity() {
+		c.cache.Delete(k)
+		return dcache.ErrEntryTooLarge
+	}
+	// values are retained, while callers may reuse their buffers.
+	if !c.cache.Set(k, append([]byte(nil), value...), ttl) {
+		c.cache.Delete(k)
+		return ErrRejected
+	}
+	return nil
+}
+
+// Del deletes @p key, returns true if it was present.
+func (c *Cache) Del(key []byte) bool {
+	k := string(key)
+	ok := c.cache.Has(k)
+	c.cache.Delete(k)
+	return ok
+}
+
+// Clear deletes all entries.
+func (c *Cache) Clear() {
+	c.cache.Clear()
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache) Stats() dcache.LocalCacheStats {
+	return dcache.LocalCacheStats{
+		Entries:   int64(c.cache.Size()),
+		Evictions: c.cache.Stats().EvictedCount(),
+	}
+}
+
+// Range calls @p f for entries in no particular order, until @p f returns false.
+func (c *Cache) Range(f func(key, value []byte) bool) {
+	c.cache.Range(func(key string, value []byte) bool {
+		return f([]byte(key), value)
+	})
+}
+
+// TTL returns the remaining TTL of @p key, 0 if it never expires.
+func (c *Cache) TTL(key []byte) (time.Duration, error) {
+	e, ok := c.cache.Extension().GetEntry(string(key))
+	if !ok {
+		return 0, dcache.ErrNotFound
+	}
+	ttl := e.TTL()
+	if ttl > noExpiry/2 {
+		return 0, nil
+	}
+	return ttl, nil
+}
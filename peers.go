@@ -0,0 +1,102 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	peersKeyPrefix = ":dcache_peers:"
+	// peers whose heartbeats are older than this number of intervals are considered gone.
+	peerExpireIntervals = 3
+)
+
+// ErrNoPeerRegistry is returned by Peers if the peer registry is not enabled by WithPeerRegistry.
+var ErrNoPeerRegistry = errors.New("dcache: peer registry is not enabled")
+
+// PeerInfo describes a cache client registered in the peer registry.
+type PeerInfo struct {
+	ID          string    `msgpack:"id"`
+	Hostname    string    `msgpack:"h"`
+	StartedAt   time.Time `msgpack:"s"`
+	HeartbeatAt time.Time `msgpack:"hb"`
+}
+
+func (c *DCache) peersKey() string {
+	return peersKeyPrefix + c.appName
+}
+
+// heartbeat registers this client in the peer registry periodically until closed.
+func (c *DCache) heartbeat() {
+	defer c.wg.Done()
+	hostname, _ := os.Hostname()
+	info := &PeerInfo{
+		ID:        c.id,
+		Hostname:  hostname,
+		StartedAt: getNow(),
+	}
+	ticker := time.NewTicker(c.opts.peerHeartbeat)
+	defer ticker.Stop()
+	for {
+		info.HeartbeatAt = getNow()
+		if err := c.registerPeer(info); err != nil {
+			c.logger(c.ctx).Err(err).Msgf("Failed to register peer %s", c.id)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			// unregister on a fresh context because c.ctx is done.
+			ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+			defer cancel()
+			if err := c.conn.HDel(ctx, c.peersKey(), c.id).Err(); err != nil {
+				c.logger(c.ctx).Err(err).Msgf("Failed to unregister peer %s", c.id)
+			}
+			return
+		}
+	}
+}
+
+func (c *DCache) registerPeer(info *PeerInfo) error {
+	b, err := msgpack.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return c.conn.HSet(c.ctx, c.peersKey(), c.id, b).Err()
+}
+
+// Peers returns alive clients sharing the app name of this client, including itself,
+// sorted by ID. It requires the peer registry to be enabled by WithPeerRegistry on
+// the clients, ErrNoPeerRegistry is returned if not enabled on this client, whose heartbeat
+// interval expires peers. Peers that stopped heartbeating are removed from the registry.
+func (c *DCache) Peers(ctx context.Context) ([]PeerInfo, error) {
+	if c.opts.peerHeartbeat <= 0 {
+		return nil, ErrNoPeerRegistry
+	}
+	all, err := c.conn.HGetAll(ctx, c.peersKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	expireBefore := getNow().Add(-peerExpireIntervals * c.opts.peerHeartbeat)
+	peers := make([]PeerInfo, 0, len(all))
+	gone := make([]string, 0)
+	for id, v := range all {
+		var info PeerInfo
+		if err := msgpack.Unmarshal([]byte(v), &info); err != nil || info.HeartbeatAt.Before(expireBefore) {
+			gone = append(gone, id)
+			continue
+		}
+		peers = append(peers, info)
+	}
+	if len(gone) > 0 {
+		if err := c.conn.HDel(ctx, c.peersKey(), gone...).Err(); err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to remove %d gone peers", len(gone))
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers, nil
+}
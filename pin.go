@@ -0,0 +1,175 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pinRefreshInterval is the interval to check pinned keys for refreshing.
+const pinRefreshInterval = time.Second
+
+// ErrNoMemCache is returned by operations that require memory cache when it is not enabled.
+var ErrNoMemCache = errors.New("memory cache is not enabled")
+
+// pinnedEntry is the value of a pinned key, kept outside of memory cache so that it is
+// never evicted.
+type pinnedEntry struct {
+	key        string
+	valueBytes []byte
+	expiredAt  time.Time
+	loadedAt   time.Time
+	// loaded is false when the value is absent or invalidated, until refreshed.
+	loaded bool
+}
+
+// pins holds pinned entries by store key.
+type pins struct {
+	mu      sync.RWMutex
+	entries map[string]*pinnedEntry
+	once    sync.Once
+	// reload wakes refreshPins to reload invalidated pins without waiting for the ticker.
+	reload chan struct{}
+}
+
+// wake signals refreshPins to reload invalidated pins, it never blocks.
+func (p *pins) wake() {
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Pin keeps @p key resident in memory cache regardless of eviction pressure, refreshed from
+// Redis before it expires, for a handful of keys read on literally every request.
+// Pinned values are still invalidated as usual, and reloaded from Redis in background right after.
+// ErrNoMemCache is returned if memory cache is not enabled.
+func (c *DCache) Pin(ctx context.Context, key string) error {
+	if c.memCache() == nil {
+		return ErrNoMemCache
+	}
+	c.pins.once.Do(func() {
+		c.wg.Add(1)
+		go c.refreshPins()
+	})
+	c.pins.mu.Lock()
+	if _, ok := c.pins.entries[c.storeKey(key)]; !ok {
+		c.pins.entries[c.storeKey(key)] = &pinnedEntry{key: key}
+	}
+	c.pins.mu.Unlock()
+	return c.refreshPin(ctx, key)
+}
+
+// Unpin releases @p key pinned by Pin, it is then cached in memory cache as usual.
+func (c *DCache) Unpin(key string) {
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+	delete(c.pins.entries, c.storeKey(key))
+}
+
+// getPinned returns the value of pinned @p key, false if it is not pinned or not loaded.
+func (c *DCache) getPinned(key string) ([]byte, bool) {
+	c.pins.mu.RLock()
+	defer c.pins.mu.RUnlock()
+	e, ok := c.pins.entries[c.storeKey(key)]
+	if !ok || !e.loaded || !getNow().Before(e.expiredAt) {
+		return nil, false
+	}
+	return e.valueBytes, true
+}
+
+// updatePinned updates the value of @p key to @p ve, if pinned.
+func (c *DCache) updatePinned(key string, ve *ValueBytesExpiredAt) {
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+	if e, ok := c.pins.entries[c.storeKey(key)]; ok {
+		e.valueBytes, e.expiredAt, e.loadedAt, e.loaded = ve.ValueBytes, time.UnixMilli(ve.ExpiredAt), getNow(), true
+	}
+}
+
+// clearPinned marks the value of pinned @p skey, a store key, invalidated, to be reloaded by
+// refreshPins. It returns the key and true if the key is pinned.
+func (c *DCache) clearPinned(skey string) (string, bool) {
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+	e, ok := c.pins.entries[skey]
+	if !ok {
+		return "", false
+	}
+	e.valueBytes, e.loaded = nil, false
+	c.pins.wake()
+	return e.key, true
+}
+
+// clearPins marks values of all pinned keys invalidated, reloaded by refreshPins.
+func (c *DCache) clearPins() {
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+	for _, e := range c.pins.entries {
+		e.valueBytes, e.loaded = nil, false
+	}
+	c.pins.wake()
+}
+
+// refreshPin reloads the value of pinned @p key from Redis. The value is discarded if key
+// has been changed locally since the read started, see updateMemoryCache, as it may be
+// older than the value loaded by the refresh after the change.
+func (c *DCache) refreshPin(ctx context.Context, key string) error {
+	seq := c.versions.current(c.storeKey(key))
+	ve, err := c.tryReadFromRedis(ctx, key)
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lock := c.memLock(c.storeKey(key))
+	lock.Lock()
+	defer lock.Unlock()
+	if c.versions.changed(c.storeKey(key), seq) {
+		return nil
+	}
+	c.updatePinned(key, ve)
+	return nil
+}
+
+// refreshPins refreshes pinned keys due, see refreshDuePins, every pinRefreshInterval and
+// right after invalidations, until cache is closed.
+func (c *DCache) refreshPins() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(pinRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.pins.reload:
+			c.refreshDuePins()
+		case <-ticker.C:
+			c.refreshDuePins()
+		}
+	}
+}
+
+// refreshDuePins refreshes pinned keys that are invalidated, about to expire, or older than
+// the max TTL of memory cache.
+func (c *DCache) refreshDuePins() {
+	now := getNow()
+	maxAge := time.Duration(c.memCacheMaxTTLSeconds.Load()) * time.Second
+	var keys []string
+	c.pins.mu.RLock()
+	for _, e := range c.pins.entries {
+		if !e.loaded || now.Sub(e.loadedAt) >= maxAge || e.expiredAt.Sub(now) < 2*pinRefreshInterval {
+			keys = append(keys, e.key)
+		}
+	}
+	c.pins.mu.RUnlock()
+	for _, key := range keys {
+		if err := c.refreshPin(c.ctx, key); err != nil {
+			c.logger(c.ctx).Err(err).Msgf("Failed to refresh pinned key %s", key)
+		}
+	}
+}
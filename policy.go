@@ -0,0 +1,110 @@
+package dcache
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Policy is the cache policy of keys of a prefix, see WithPolicies.
+type Policy struct {
+	// Prefix of keys the policy applies to.
+	Prefix string
+	// TTL is the default TTL, used when the TTL given to Set or returned by read is 0.
+	TTL time.Duration
+	// Jitter is the upper bound of a random duration added to TTLs, to spread expirations.
+	Jitter time.Duration
+	// NoMemCache keeps keys out of memory cache.
+	NoMemCache bool
+	// NoCompression stores values uncompressed.
+	NoCompression bool
+	// Priority is the eviction priority hint of entries in memory cache.
+	Priority Priority
+	// SkipRemote keeps values read by Get/GetWithTtl in memory cache only, never in Redis,
+	// e.g., results of local computations cheaper than Redis round trips, see Compute.
+	// Values are still dropped on all clients by Invalidate, and expire by the max TTL of
+	// memory cache. Values are not cached without memory cache.
+	SkipRemote bool
+	// Codec serializes values of keys of the prefix instead of the codec of the client, but not
+	// their envelopes, see WithValueCodec.
+	Codec Codec
+}
+
+// policy returns the policy of the longest prefix matching @p key, nil if none.
+func (c *DCache) policy(key string) *Policy {
+	var matched *Policy
+	for i := range c.opts.policies {
+		p := &c.opts.policies[i]
+		if strings.HasPrefix(key, p.Prefix) && (matched == nil || len(p.Prefix) > len(matched.Prefix)) {
+			matched = p
+		}
+	}
+	return matched
+}
+
+// policyTTL returns the TTL of @p key given @p ttl, with the default TTL and jitter applied.
+func (c *DCache) policyTTL(key string, ttl time.Duration) time.Duration {
+	p := c.policy(key)
+	if p == nil {
+		return ttl
+	}
+	if ttl == 0 {
+		ttl = p.TTL
+	}
+	if p.Jitter > 0 {
+		ttl += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return ttl
+}
+
+// capTTL returns @p read with the TTL capped at @p maxTTL, including the default TTL of
+// policies of @p key.
+func (c *DCache) capTTL(key string, read ReadWithTtlFunc, maxTTL time.Duration) ReadWithTtlFunc {
+	return func() (any, time.Duration, error) {
+		v, ttl, err := read()
+		if p := c.policy(key); ttl == 0 && p != nil {
+			ttl = p.TTL
+		}
+		if ttl <= 0 || ttl > maxTTL {
+			// no TTL is never expired.
+			ttl = maxTTL
+		}
+		return v, ttl, err
+	}
+}
+
+// memCacheFor returns true if @p key can be cached in memory cache.
+func (c *DCache) memCacheFor(key string) bool {
+	if c.memCache() == nil {
+		return false
+	}
+	p := c.policy(key)
+	return p == nil || !p.NoMemCache
+}
+
+// skipRemoteFor returns true if values of @p key skip Redis, see Policy.SkipRemote.
+func (c *DCache) skipRemoteFor(key string) bool {
+	p := c.policy(key)
+	return p != nil && p.SkipRemote
+}
+
+// marshal @p value of @p key written with @p ctx by its codec, see codecFor, compressed unless
+// disabled by options or policy, then encrypted if enabled.
+func (c *DCache) marshal(ctx context.Context, key string, value any) ([]byte, error) {
+	p := c.policy(key)
+	codec := c.codecFor(ctx, key)
+	b, err := encode(codec, value, !c.opts.noCompression && (p == nil || !p.NoCompression))
+	if err != nil {
+		return nil, err
+	}
+	if name := codecName(codec); name != codecName(c.opts.codec) {
+		b = c.tagCodec(b, value, codec, name)
+	} else {
+		c.checkCodec(key, value, b)
+	}
+	if c.encryptor != nil {
+		return c.encryptor.seal(b, []byte(c.storeKey(key)))
+	}
+	return b, nil
+}
@@ -0,0 +1,107 @@
+package dcache
+
+import (
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultPrefetchConcurrency is the default number of related keys prefetched at once.
+const defaultPrefetchConcurrency = 4
+
+// prefetcher prefetches keys related to keys hit in the background, see WithPrefetch.
+type prefetcher struct {
+	related func(key string) []string
+	sem     chan struct{}
+
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+func newPrefetcher(related func(key string) []string, concurrency int) *prefetcher {
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	return &prefetcher{
+		related:  related,
+		sem:      make(chan struct{}, concurrency),
+		inFlight: make(map[string]struct{}),
+	}
+}
+
+// begin returns false if @p key is being prefetched already.
+func (p *prefetcher) begin(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.inFlight[key]; ok {
+		return false
+	}
+	p.inFlight[key] = struct{}{}
+	return true
+}
+
+func (p *prefetcher) end(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inFlight, key)
+}
+
+// prefetchRelated prefetches keys related to @p key hit, a key of the caller, dropping those
+// beyond the concurrency of the prefetcher.
+func (c *DCache) prefetchRelated(key string) {
+	if c.prefetcher == nil {
+		return
+	}
+	for _, related := range c.prefetcher.related(key) {
+		if related == key || !c.prefetcher.begin(related) {
+			continue
+		}
+		select {
+		case c.prefetcher.sem <- struct{}{}:
+		default:
+			// prefetches are opportunistic, dropped under load.
+			c.prefetcher.end(related)
+			continue
+		}
+		c.wg.Add(1)
+		go func(related string) {
+			defer c.wg.Done()
+			defer func() { <-c.prefetcher.sem }()
+			defer c.prefetcher.end(related)
+			c.prefetch(related)
+		}(related)
+	}
+}
+
+// prefetch loads @p key, a key of the caller, from Redis into memory cache if absent there,
+// or warms it by its warm loader if absent in Redis, see WithWarmQueue.
+func (c *DCache) prefetch(key string) {
+	stored, err := c.namespaced(c.ctx, key)
+	if err != nil {
+		c.logger(c.ctx).Err(err).Msgf("Failed to prefetch %s", key)
+		return
+	}
+	if c.memCacheFor(stored) {
+		if _, err := c.getMemoryCache(stored); err == nil {
+			return
+		}
+	}
+	seq := c.versions.current(c.storeKey(stored))
+	ve, err := c.tryReadFromRedis(c.ctx, stored)
+	switch {
+	case err == nil:
+		if c.memCacheFor(stored) {
+			c.updateMemoryCache(c.ctx, stored, ve, false, seq)
+			c.counters.prefetches.Add(1)
+		}
+	case err == redis.Nil:
+		// warmed by the key of the caller, namespaced by Set.
+		if c.warmLoader(key) != nil && c.warm(c.ctx, key) {
+			c.counters.prefetches.Add(1)
+		}
+	default:
+		if c.ctx.Err() == nil {
+			c.logger(c.ctx).Err(err).Msgf("Failed to prefetch %s", key)
+		}
+	}
+}
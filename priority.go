@@ -0,0 +1,92 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority is the eviction priority hint of entries in memory cache. When memory cache is
+// under pressure, low priority entries are skipped from admission first, then normal ones,
+// so that high priority entries, e.g., auth and config, stay resident.
+type Priority int
+
+const (
+	// PriorityNormal entries are skipped when memory cache is under severe pressure.
+	PriorityNormal Priority = iota
+	// PriorityLow entries are skipped when memory cache is under any pressure.
+	PriorityLow
+	// PriorityHigh entries are always admitted.
+	PriorityHigh
+)
+
+// memPressureInterval is the interval to re-evaluate the pressure of memory cache.
+const memPressureInterval = time.Second
+
+// memory cache pressure levels.
+const (
+	memPressureNone int32 = iota
+	// entries were evicted in the last interval.
+	memPressureHigh
+	// more than 1/memPressureSevereRatio of entries were evicted in the last interval.
+	memPressureSevere
+)
+
+const memPressureSevereRatio = 10
+
+// priorityCtxKey is the context key of the priority given by WithPriority.
+type priorityCtxKey struct{}
+
+// memPressure evaluates the pressure of memory cache by evictions due to lack of space.
+type memPressure struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	evacuated int64
+	level     atomic.Int32
+}
+
+// get returns the pressure level of @p mem, re-evaluated at most once per interval.
+func (p *memPressure) get(mem LocalCache) int32 {
+	if p.mu.TryLock() {
+		now := getNow()
+		if now.Sub(p.checkedAt) >= memPressureInterval {
+			stats := mem.Stats()
+			evacuated := stats.Evictions
+			level := memPressureNone
+			if n := evacuated - p.evacuated; n > 0 && !p.checkedAt.IsZero() {
+				level = memPressureHigh
+				if n*memPressureSevereRatio > stats.Entries {
+					level = memPressureSevere
+				}
+			}
+			p.level.Store(level)
+			p.checkedAt, p.evacuated = now, evacuated
+		}
+		p.mu.Unlock()
+	}
+	return p.level.Load()
+}
+
+// priority returns the priority of @p key, given by WithPriority in @p ctx, or policies.
+func (c *DCache) priority(ctx context.Context, key string) Priority {
+	if p, ok := ctx.Value(priorityCtxKey{}).(Priority); ok {
+		return p
+	}
+	if p := c.policy(key); p != nil {
+		return p.Priority
+	}
+	return PriorityNormal
+}
+
+// admit returns true if entry of @p key can be added to memory cache under current pressure.
+func (c *DCache) admit(ctx context.Context, key string) bool {
+	switch c.priority(ctx, key) {
+	case PriorityHigh:
+		return true
+	case PriorityLow:
+		return c.memPressure.get(c.memCache()) == memPressureNone
+	default:
+		return c.memPressure.get(c.memCache()) != memPressureSevere
+	}
+}
@@ -0,0 +1,90 @@
+package dcache
+
+import (
+	"sync"
+	"time"
+)
+
+// maxPoisonKeys is the soft limit of keys tracked by quarantine, beyond which
+// stale states are purged.
+const maxPoisonKeys = 10000
+
+// poisonState is the decode failure state of a key.
+type poisonState struct {
+	failures     int
+	lastFailedAt time.Time
+	// quarantined until, zero if not quarantined.
+	until time.Time
+}
+
+// quarantine tracks keys whose stored bytes repeatedly fail to unmarshal.
+// Once a key fails @p threshold times, with less than @p cooldown between
+// failures, it is quarantined: caching is bypassed for the key for @p cooldown.
+type quarantine struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	keys      map[string]*poisonState
+}
+
+func newQuarantine(threshold int, cooldown time.Duration) *quarantine {
+	return &quarantine{
+		threshold: threshold,
+		cooldown:  cooldown,
+		keys:      make(map[string]*poisonState),
+	}
+}
+
+// IsQuarantined returns true if caching of @p key should be bypassed.
+func (q *quarantine) IsQuarantined(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st, ok := q.keys[key]
+	if !ok || st.until.IsZero() {
+		return false
+	}
+	if getNow().After(st.until) {
+		delete(q.keys, key)
+		return false
+	}
+	return true
+}
+
+// ReportFailure records a decode failure of @p key, returns true if the key
+// becomes quarantined by this failure.
+func (q *quarantine) ReportFailure(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := getNow()
+	st, ok := q.keys[key]
+	if !ok {
+		if len(q.keys) >= maxPoisonKeys {
+			q.purge(now)
+		}
+		st = &poisonState{}
+		q.keys[key] = st
+	}
+	if !st.until.IsZero() {
+		// already quarantined.
+		return false
+	}
+	if now.Sub(st.lastFailedAt) > q.cooldown {
+		st.failures = 0
+	}
+	st.failures++
+	st.lastFailedAt = now
+	if st.failures < q.threshold {
+		return false
+	}
+	st.until = now.Add(q.cooldown)
+	return true
+}
+
+// purge removes states that no longer matter, must be called with mu held.
+func (q *quarantine) purge(now time.Time) {
+	for key, st := range q.keys {
+		if now.After(st.until) && now.Sub(st.lastFailedAt) > q.cooldown {
+			delete(q.keys, key)
+		}
+	}
+}
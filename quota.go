@@ -0,0 +1,133 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	quotaKeyPrefix = ":dcache_quota:"
+	// quotaFlushInterval is the interval of adding bytes written by this client to the
+	// counters in Redis, and reading the totals of all clients back.
+	quotaFlushInterval = time.Second
+	// defaultQuotaWindow is the window of quotas not given one.
+	defaultQuotaWindow = time.Hour
+)
+
+// ErrQuotaExceeded is returned by explicit writes refused by an enforced Quota.
+var ErrQuotaExceeded = errors.New("dcache: quota exceeded")
+
+// incrWithTTLScript increments KEYS[1] by ARGV[1], with TTL ARGV[2] in ms if it is new.
+// Returns the new value.
+var incrWithTTLScript = redis.NewScript(`-- dcache:incr_with_ttl
+local n = redis.call("INCRBY", KEYS[1], ARGV[1])
+if n == tonumber(ARGV[1]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return n`)
+
+// Quota is the budget of bytes written to Redis by keys of a prefix, see WithQuotas.
+type Quota struct {
+	// Prefix of keys the quota applies to.
+	Prefix string
+	// Budget is the number of bytes, including keys, that can be written per Window.
+	Budget int64
+	// Window is the period of the budget, defaultQuotaWindow if 0. Bytes written are
+	// counted since the start of the window, which approximates the memory used in Redis
+	// if Window is about the TTL of keys.
+	Window time.Duration
+	// Enforce refuses writes past the budget, otherwise they are only counted.
+	Enforce bool
+}
+
+// quotaState is the usage of a Quota.
+type quotaState struct {
+	Quota
+	key string
+	// pending bytes written by this client, not yet added to the counter in Redis.
+	pending atomic.Int64
+	// total bytes written by all clients, as of the last flush.
+	total atomic.Int64
+}
+
+func newQuotaStates(appName string, quotas []Quota) []*quotaState {
+	states := make([]*quotaState, len(quotas))
+	for i, q := range quotas {
+		if q.Window <= 0 {
+			q.Window = defaultQuotaWindow
+		}
+		states[i] = &quotaState{Quota: q, key: quotaKeyPrefix + appName + ":" + q.Prefix}
+	}
+	return states
+}
+
+// quota returns the state of the quota of the longest prefix matching @p key, nil if none.
+func (c *DCache) quota(key string) *quotaState {
+	var matched *quotaState
+	for _, q := range c.quotas {
+		if strings.HasPrefix(key, q.Prefix) && (matched == nil || len(q.Prefix) > len(matched.Prefix)) {
+			matched = q
+		}
+	}
+	return matched
+}
+
+// admitWrite returns false if writing @p size bytes of value to @p key is refused by its quota,
+// otherwise the bytes are counted.
+func (c *DCache) admitWrite(key string, size int) bool {
+	q := c.quota(key)
+	if q == nil {
+		return true
+	}
+	size += len(c.storeKey(key))
+	if q.Enforce && q.total.Load()+q.pending.Load()+int64(size) > q.Budget {
+		c.counters.quotaRefused.Add(1)
+		if c.stats != nil {
+			c.stats.ObserveQuotaRefused(q.Prefix)
+		}
+		return false
+	}
+	q.pending.Add(int64(size))
+	return true
+}
+
+// runQuotas flushes usage of quotas periodically until the cache is closed.
+func (c *DCache) runQuotas() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flushQuotas(c.ctx)
+		case <-c.ctx.Done():
+			// flush on a fresh context because c.ctx is done.
+			ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+			defer cancel()
+			c.flushQuotas(ctx)
+			return
+		}
+	}
+}
+
+// flushQuotas adds pending bytes to counters in Redis, and reads totals of all clients back.
+func (c *DCache) flushQuotas(ctx context.Context) {
+	for _, q := range c.quotas {
+		n := q.pending.Swap(0)
+		total, err := incrWithTTLScript.Run(ctx, c.conn, []string{q.key}, n, q.Window.Milliseconds()).Int64()
+		if err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to update usage of quota %s", q.Prefix)
+			q.pending.Add(n)
+			continue
+		}
+		q.total.Store(total)
+		if c.stats != nil {
+			c.stats.UpdateQuotaUsage(q.Prefix, total)
+		}
+	}
+}
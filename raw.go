@@ -0,0 +1,30 @@
+package dcache
+
+import (
+	"context"
+	"time"
+)
+
+// ReadBytesFunc is the actual call to underlying data source that returns
+// already serialized bytes.
+type ReadBytesFunc = func() ([]byte, error)
+
+// GetBytes is Get for callers who already have serialized payloads, e.g., pre-rendered JSON.
+// Bytes are cached as-is, skipping marshal and unmarshal entirely, and no target is needed.
+// See Get for the meaning of @p key, @p ttl and @p read.
+func (c *DCache) GetBytes(
+	ctx context.Context, key string, ttl time.Duration, read ReadBytesFunc, opts ...CallOption) ([]byte, error) {
+	var b []byte
+	err := c.Get(ctx, key, &b, ttl, func() (any, error) {
+		return read()
+	}, false, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetBytes explicitly sets a cache key to the serialized @p val, cached as-is.
+func (c *DCache) SetBytes(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	return c.Set(ctx, key, val, ttl)
+}
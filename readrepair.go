@@ -0,0 +1,109 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// readRepairGrace is how long a repaired key is watched for invalidations that were sent
+// before the repair but not yet received, after which the repair is kept.
+const readRepairGrace = time.Second
+
+// readRepairer tracks when keys were last checked for read-repair, so that each key is
+// checked at most once per interval.
+type readRepairer struct {
+	interval time.Duration
+
+	mu        sync.Mutex
+	checkedAt map[string]time.Time
+	prunedAt  time.Time
+}
+
+func newReadRepairer(interval time.Duration) *readRepairer {
+	return &readRepairer{
+		interval:  interval,
+		checkedAt: make(map[string]time.Time),
+		prunedAt:  getNow(),
+	}
+}
+
+// due returns true if @p key should be checked now, and marks it checked.
+func (r *readRepairer) due(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := getNow()
+	if now.Sub(r.prunedAt) > r.interval {
+		for k, t := range r.checkedAt {
+			if now.Sub(t) > r.interval {
+				delete(r.checkedAt, k)
+			}
+		}
+		r.prunedAt = now
+	}
+	if t, ok := r.checkedAt[key]; ok && now.Sub(t) <= r.interval {
+		return false
+	}
+	r.checkedAt[key] = now
+	return true
+}
+
+// readRepair writes @p valueBytes of @p key, served from memory cache, back to Redis in
+// background if Redis has lost the key, with the remaining TTL of the memory copy.
+// The repair is undone if the key is invalidated within readRepairGrace, in case the
+// memory copy was already stale when Redis lost the key.
+func (c *DCache) readRepair(ctx context.Context, key string, valueBytes []byte) {
+	if c.repairer == nil || c.ctx.Err() != nil || !c.repairer.due(c.storeKey(key)) {
+		return
+	}
+	mem, ok := c.memCache().(LocalCacheExpiry)
+	if !ok {
+		return
+	}
+	ttl, err := mem.TTL([]byte(c.storeKey(key)))
+	if err != nil || ttl < time.Second {
+		return
+	}
+	seq := c.versions.current(c.storeKey(key))
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.repair(detachedContext{parent: ctx}, key, valueBytes, ttl, seq)
+	}()
+}
+
+func (c *DCache) repair(ctx context.Context, key string, valueBytes []byte, ttl time.Duration, seq uint64) {
+	ve := &ValueBytesExpiredAt{
+		ValueBytes: valueBytes,
+		ExpiredAt:  getNow().Add(ttl).UnixMilli(),
+	}
+	bs, err := c.encodeEnvelope(ve)
+	if err != nil {
+		return
+	}
+	repaired, err := c.conn.SetNX(ctx, c.storeKey(key), bs, ttl).Result()
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to read-repair %s", key)
+		c.recordError(errLabelSetRedis, key, err)
+		return
+	}
+	if !repaired {
+		return
+	}
+	c.counters.readRepairs.Add(1)
+	c.logger(ctx).Debug().Msgf("Read-repaired %s in Redis from memory cache", key)
+	timer := time.NewTimer(readRepairGrace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.ctx.Done():
+	}
+	if !c.versions.changed(c.storeKey(key), seq) {
+		return
+	}
+	// same as releaseLeaderScript, deletes the key only if it still holds the repair.
+	if err := releaseLeaderScript.Run(ctx, c.conn, []string{c.storeKey(key)}, bs).Err(); err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to undo read-repair of %s", key)
+		c.recordError(errLabelSetRedis, key, err)
+	}
+}
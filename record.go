@@ -0,0 +1,179 @@
+package dcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// recordMagic is the header of recordings, followed by events.
+const recordMagic = "DCREC\x01"
+
+// ErrBadRecording is returned when reading a recording in an unknown format.
+var ErrBadRecording = errors.New("dcache: bad recording")
+
+// RecordOp is the operation of a recorded event.
+type RecordOp uint8
+
+const (
+	RecordGet RecordOp = iota + 1
+	RecordSet
+	RecordInvalidate
+)
+
+func (op RecordOp) String() string {
+	switch op {
+	case RecordGet:
+		return "get"
+	case RecordSet:
+		return "set"
+	case RecordInvalidate:
+		return "invalidate"
+	}
+	return fmt.Sprintf("op(%d)", uint8(op))
+}
+
+// tiers of recorded events, indexes are the encoding.
+var recordTiers = []hitFrom{"", hitMem, hitRedis, hitDB}
+
+// RecordEvent is an operation on the cache, recorded by WithRecorder.
+type RecordEvent struct {
+	At  time.Time
+	Op  RecordOp
+	Key string
+	// Size is the size of the encoded value in bytes, 0 for invalidations.
+	Size int
+	// Tier is where the value of Gets was found: "mem", "redis" or "db", same as
+	// GetResult.Source. It is empty for other operations.
+	Tier string
+}
+
+// recorder writes events into a recording. Each event is encoded as
+// op(1) tier(1) uvarint(µs since previous event) uvarint(len(key)) key uvarint(size).
+type recorder struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	last time.Time
+	buf  []byte
+	err  error
+}
+
+func newRecorder(w io.Writer) *recorder {
+	r := &recorder{w: bufio.NewWriter(w)}
+	_, r.err = r.w.WriteString(recordMagic)
+	return r
+}
+
+// record writes an event, recording stops at the first write error.
+func (r *recorder) record(op RecordOp, key string, size int, tier hitFrom) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	now := getNow()
+	var delta int64
+	if !r.last.IsZero() && now.After(r.last) {
+		delta = now.Sub(r.last).Microseconds()
+	}
+	r.last = now
+	b := append(r.buf[:0], byte(op), tierCode(tier))
+	b = binary.AppendUvarint(b, uint64(delta))
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	b = binary.AppendUvarint(b, uint64(size))
+	r.buf = b
+	if _, r.err = r.w.Write(b); r.err != nil {
+		log.Err(r.err).Msg("failed to record cache event, recording stopped")
+	}
+}
+
+// flush writes buffered events.
+func (r *recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.err = r.w.Flush(); r.err != nil {
+		log.Err(r.err).Msg("failed to flush recording")
+	}
+}
+
+func tierCode(tier hitFrom) byte {
+	for i, t := range recordTiers {
+		if t == tier {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+// RecordReader reads events of a recording written by WithRecorder.
+type RecordReader struct {
+	r      *bufio.Reader
+	last   time.Time
+	header bool
+}
+
+// NewRecordReader returns a reader of the recording in @p r.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event, or io.EOF at the end of the recording. Times of events are
+// relative to the zero time, only intervals between them are recorded.
+func (rr *RecordReader) Next() (RecordEvent, error) {
+	if !rr.header {
+		magic := make([]byte, len(recordMagic))
+		if _, err := io.ReadFull(rr.r, magic); err != nil || string(magic) != recordMagic {
+			return RecordEvent{}, ErrBadRecording
+		}
+		rr.header = true
+	}
+	op, err := rr.r.ReadByte()
+	if err != nil {
+		// io.EOF only at the boundary of events.
+		return RecordEvent{}, err
+	}
+	e := RecordEvent{Op: RecordOp(op)}
+	tier, err := rr.r.ReadByte()
+	if err != nil || int(tier) >= len(recordTiers) || e.Op < RecordGet || e.Op > RecordInvalidate {
+		return RecordEvent{}, ErrBadRecording
+	}
+	e.Tier = string(recordTiers[tier])
+	delta, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return RecordEvent{}, ErrBadRecording
+	}
+	rr.last = rr.last.Add(time.Duration(delta) * time.Microsecond)
+	e.At = rr.last
+	keyLen, err := binary.ReadUvarint(rr.r)
+	if err != nil || keyLen > maxRecordKeyLen {
+		return RecordEvent{}, ErrBadRecording
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(rr.r, key); err != nil {
+		return RecordEvent{}, ErrBadRecording
+	}
+	e.Key = string(key)
+	size, err := binary.ReadUvarint(rr.r)
+	if err != nil || size > maxRecordValueSize {
+		return RecordEvent{}, ErrBadRecording
+	}
+	e.Size = int(size)
+	return e, nil
+}
+
+// maxRecordKeyLen bounds keys read from recordings, against corrupted lengths.
+const maxRecordKeyLen = 1 << 20
+
+// maxRecordValueSize bounds sizes of values read from recordings, against corrupted sizes, as
+// values of the sizes are allocated by replays. It is the max size of Redis strings.
+const maxRecordValueSize = 512 << 20
@@ -0,0 +1,149 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// RemoteCache is the distributed tier of TieredCache, e.g., Memcached by the memcachedcache
+// module, or Redis by RedisRemote. Values are opaque bytes, enveloped with their expirations,
+// or tombstones of invalidations.
+type RemoteCache interface {
+	// Get returns the value of @p key, ErrNotFound if absent.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// GetMulti returns values of @p keys found, absent keys are omitted.
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	// Set sets @p value of @p key, expiring in @p ttl, never if 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Add sets @p value of @p key only if absent, see Set, returns false if present.
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// InvalidationBus carries keys changed by TieredCaches sharing a RemoteCache, so that peers
+// evict them from their memory caches.
+type InvalidationBus interface {
+	// Publish sends @p keys changed by the client of ID @p origin to peers.
+	Publish(ctx context.Context, origin string, keys []string) error
+	// Subscribe calls @p f with keys published by any client, including the subscriber,
+	// until the bus is closed.
+	Subscribe(f func(origin string, keys []string)) error
+	// Close stops the subscription.
+	Close() error
+}
+
+// NopInvalidationBus drops invalidations, for remote tiers without buses, so that memory
+// caches of peers are stale until their entries expire, see
+// TieredCache.SetMemCacheMaxTTLSeconds.
+type NopInvalidationBus struct{}
+
+// Publish drops @p keys.
+func (NopInvalidationBus) Publish(ctx context.Context, origin string, keys []string) error {
+	return nil
+}
+
+// Subscribe never calls @p f.
+func (NopInvalidationBus) Subscribe(f func(origin string, keys []string)) error {
+	return nil
+}
+
+// Close does nothing.
+func (NopInvalidationBus) Close() error {
+	return nil
+}
+
+// redisRemote is the RemoteCache of a Redis client.
+type redisRemote struct {
+	conn redis.UniversalClient
+}
+
+// RedisRemote returns the RemoteCache of @p conn, e.g., for TieredCache in tests.
+// Prefer DCache on Redis, which adds distributed locks and batched invalidations.
+func RedisRemote(conn redis.UniversalClient) RemoteCache {
+	return redisRemote{conn: conn}
+}
+
+func (r redisRemote) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.conn.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (r redisRemote) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	vals, err := r.conn.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string][]byte, len(keys))
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			rv[keys[i]] = []byte(s)
+		}
+	}
+	return rv, nil
+}
+
+func (r redisRemote) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.conn.Set(ctx, key, value, ttl).Err()
+}
+
+func (r redisRemote) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return r.conn.SetNX(ctx, key, value, ttl).Result()
+}
+
+// redisBus is the InvalidationBus of a Redis pubsub topic.
+type redisBus struct {
+	conn   redis.UniversalClient
+	topic  string
+	pubsub *redis.PubSub
+}
+
+// RedisInvalidationBus returns the InvalidationBus of pubsub @p topic of @p conn, in the
+// invalidation message format of DCache.
+func RedisInvalidationBus(conn redis.UniversalClient, topic string) InvalidationBus {
+	return &redisBus{conn: conn, topic: topic}
+}
+
+func (b *redisBus) Publish(ctx context.Context, origin string, keys []string) error {
+	var buf bytes.Buffer
+	buf.WriteString(origin)
+	appendMeta(&buf, metaSentAt, strconv.FormatInt(getNow().UnixMilli(), 10))
+	for _, key := range keys {
+		buf.WriteString(delimiter)
+		buf.WriteString(key)
+	}
+	return b.conn.Publish(ctx, b.topic, buf.Bytes()).Err()
+}
+
+func (b *redisBus) Subscribe(f func(origin string, keys []string)) error {
+	b.pubsub = b.conn.Subscribe(context.Background(), b.topic)
+	if _, err := b.pubsub.Receive(context.Background()); err != nil {
+		b.pubsub.Close()
+		return err
+	}
+	ch := b.pubsub.Channel()
+	go func() {
+		for msg := range ch {
+			m, err := parseInvalidateMessage(msg.Payload)
+			if err != nil {
+				log.Err(err).Msgf("Received invalidate payload %s", msg.Payload)
+				continue
+			}
+			f(m.Origin, m.Keys)
+		}
+	}()
+	return nil
+}
+
+func (b *redisBus) Close() error {
+	if b.pubsub == nil {
+		return nil
+	}
+	return b.pubsub.Close()
+}
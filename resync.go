@@ -0,0 +1,127 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ResyncPolicy is how memory cache is resynced once the pubsub subscription of invalidations
+// is reconnected, as invalidations published during the gap are lost, see WithPubSubResync.
+type ResyncPolicy int
+
+const (
+	// ResyncFlush clears memory cache.
+	ResyncFlush ResyncPolicy = iota
+	// ResyncReconcile compares entries of memory cache with Redis in the background, evicting
+	// those changed, keeping memory cache warm at the cost of reading all of its keys.
+	ResyncReconcile
+)
+
+// resyncer is the state of resyncs of memory cache after pubsub reconnects.
+type resyncer struct {
+	reconnects atomic.Int64
+	// reconciling is true while a reconciliation runs, so that reconnects during it do not
+	// start others.
+	reconciling atomic.Bool
+}
+
+// resubscribed resyncs memory cache once the pubsub subscription is reconnected.
+func (c *DCache) resubscribed() {
+	c.resync.reconnects.Add(1)
+	if c.stats != nil {
+		c.stats.ObservePubSubReconnect()
+	}
+	// memory caches not iterating their entries are cleared, see LocalCacheRanger.
+	if _, ok := c.memCache().(LocalCacheRanger); c.opts.resyncPolicy != ResyncReconcile || !ok {
+		c.logger(c.ctx).Warn().Msgf("Resubscribed to %s, clearing memory cache", c.opts.invalidateTopic)
+		c.flushLocal()
+		return
+	}
+	if !c.resync.reconciling.CompareAndSwap(false, true) {
+		return
+	}
+	c.logger(c.ctx).Warn().Msgf("Resubscribed to %s, reconciling memory cache", c.opts.invalidateTopic)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.resync.reconciling.Store(false)
+		startedAt := time.Now()
+		evicted, err := c.reconcile(c.ctx)
+		if err != nil {
+			// entries not compared may be stale.
+			c.logger(c.ctx).Err(err).Msgf("Failed to reconcile memory cache, clearing it")
+			c.flushLocal()
+			return
+		}
+		c.logger(c.ctx).Info().Msgf("Reconciled memory cache in %s, %d entries evicted",
+			time.Since(startedAt), evicted)
+	}()
+}
+
+// reconcile evicts entries of memory cache whose values differ from those in Redis, or absent
+// there, comparing defaultMaintenanceBatch keys per pipeline. It returns the number of entries
+// evicted. Memory cache is cleared instead if it does not iterate its entries.
+func (c *DCache) reconcile(ctx context.Context) (int, error) {
+	mem, ok := c.memCache().(LocalCacheRanger)
+	if !ok {
+		c.flushLocal()
+		return 0, nil
+	}
+	// pinned values are reloaded from Redis.
+	c.clearPins()
+	evicted := 0
+	var err error
+	batch := make([]localEntry, 0, defaultMaintenanceBatch)
+	mem.Range(func(key, value []byte) bool {
+		batch = append(batch, localEntry{key: key, value: value})
+		if len(batch) < defaultMaintenanceBatch {
+			return true
+		}
+		var n int
+		n, err = c.reconcileBatch(ctx, batch)
+		evicted += n
+		batch = batch[:0]
+		return err == nil
+	})
+	if err != nil || len(batch) == 0 {
+		return evicted, err
+	}
+	n, err := c.reconcileBatch(ctx, batch)
+	return evicted + n, err
+}
+
+// localEntry is an entry of memory cache.
+type localEntry struct {
+	key   []byte
+	value []byte
+}
+
+// reconcileBatch evicts entries of @p batch changed in Redis, returns the number of them.
+func (c *DCache) reconcileBatch(ctx context.Context, batch []localEntry) (int, error) {
+	cmds := make([]*redis.StringCmd, len(batch))
+	_, err := c.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, e := range batch {
+			cmds[i] = pipe.Get(ctx, string(e.key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	evicted := 0
+	for i, e := range batch {
+		if veBytes, err := cmds[i].Bytes(); err == nil && !isTombstone(veBytes) {
+			if ve, err := c.decodeEnvelope(veBytes); err == nil && bytes.Equal(ve.ValueBytes, e.value) {
+				continue
+			}
+		}
+		// changes are not timestamped, and are applied even if written locally later.
+		c.applyInvalidation(string(e.key), time.Time{}, valueStamp{}, "")
+		evicted++
+	}
+	return evicted, nil
+}
@@ -0,0 +1,98 @@
+// Package ristrettocache adapts ristretto to dcache.LocalCache, whose TinyLFU admission
+// keeps hot keys of skewed workloads resident, e.g.,
+//
+//	cache, _ := ristretto.NewCache(&ristretto.Config{
+//		NumCounters: 1e6, MaxCost: 64 << 20, BufferItems: 64, Metrics: true})
+//	dc, _ := dcache.NewCache("app", rdb, dcache.WithLocalCache(ristrettocache.New(cache)))
+//
+// It is a module of its own, so that dcache does not depend on ristretto.
+package ristrettocache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+
+	"github.com/stumble/dcache"
+)
+
+// ErrRejected is returned by Set if the value is dropped by ristretto, e.g., its buffers are
+// full, so that the previous value is not left. Values costing more than MaxCost return
+// dcache.ErrEntryTooLarge instead.
+var ErrRejected = errors.New("ristrettocache: value rejected")
+
+// Cache is the dcache.LocalCache of a ristretto cache.
+type Cache struct {
+	cache *ristretto.Cache
+}
+
+var (
+	_ dcache.LocalCache       = (*Cache)(nil)
+	_ dcache.LocalCacheExpiry = (*Cache)(nil)
+)
+
+// New returns the dcache.LocalCache of @p cache. Entries cost their sizes in bytes, i.e.,
+// MaxCost of its config is in bytes, and Metrics of the config must be enabled for Stats.
+func New(cache *ristretto.Cache) *Cache {
+	return &Cache{cache: cache}
+}
+
+// Get returns the value of @p key, dcache.ErrNotFound if absent or expired.
+func (c *Cache) Get(key []byte) ([]byte, error) {
+	v, ok := c.cache.Get(string(key))
+	if !ok {
+		return nil, dcache.ErrNotFound
+	}
+	return v.([]byte), nil
+}
+
+// Set sets @p value of @p key, waiting for the buffered write, so that it is read once
+// returned. The value may still be refused by the admission policy, i.e., read as absent.
+func (c *Cache) Set(key, value []byte, expireSeconds int) error {
+	k := string(key)
+	cost := int64(len(k) + len(value))
+	// values are retained, while callers may reuse their buffers.
+	value = append([]byte(nil), value...)
+	if cost > c.cache.MaxCost() {
+		c.cache.Del(k)
+		return dcache.ErrEntryTooLarge
+	}
+	if !c.cache.SetWithTTL(k, value, cost, time.Duration(expireSeconds)*time.Second) {
+		c.cache.Del(k)
+		return ErrRejected
+	}
+	c.cache.Wait()
+	return nil
+}
+
+// Del deletes @p key, returns true if it was present.
+func (c *Cache) Del(key []byte) bool {
+	k := string(key)
+	_, ok := c.cache.Get(k)
+	c.cache.Del(k)
+	return ok
+}
+
+// Clear deletes all entries.
+func (c *Cache) Clear() {
+	c.cache.Clear()
+}
+
+// Stats returns the counters of the cache, entries are approximated by keys added and evicted.
+func (c *Cache) Stats() dcache.LocalCacheStats {
+	m := c.cache.Metrics
+	return dcache.LocalCacheStats{
+		Entries:   int64(m.KeysAdded()) - int64(m.KeysEvicted()),
+		Evictions: int64(m.KeysEvicted()),
+	}
+}
+
+// TTL returns the remaining TTL of @p key, 0 if it never expires.
+func (c *Cache) TTL(key []byte) (time.Duration, error) {
+	ttl, ok := c.cache.GetTTL(string(key))
+	if !ok {
+		return 0, dcache.ErrNotFound
+	}
+	return ttl, nil
+}
@@ -0,0 +1,120 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	scheduledKeyPrefix = ":dcache_scheduled:"
+	// scheduledInvalidationPoll is the max interval of the leader checking due invalidations,
+	// which bounds the delay of invalidations scheduled by other clients.
+	scheduledInvalidationPoll = 100 * time.Millisecond
+	// scheduledInvalidationBatch is the max number of due invalidations run per check.
+	scheduledInvalidationBatch = 100
+)
+
+// ErrNoLeaderElection is returned by operations that require WithLeaderElection.
+var ErrNoLeaderElection = errors.New("dcache: leader election is not enabled")
+
+// completeScheduledScript removes a scheduled invalidation only if it is not rescheduled.
+var completeScheduledScript = redis.NewScript(`-- dcache:compare_and_zrem
+if tonumber(redis.call("ZSCORE", KEYS[1], ARGV[1])) == tonumber(ARGV[2]) then
+	return redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0`)
+
+// InvalidateAt schedules an invalidation of @p key at @p t, e.g., for content embargoes.
+// Schedules are kept in Redis and run by the leader of clients of the same app name, so
+// they survive restarts and run once. A schedule replaces the previous one of the same key.
+// @p key is invalidated immediately if @p t is not in the future.
+// ErrNoLeaderElection is returned if WithLeaderElection is not enabled.
+func (c *DCache) InvalidateAt(ctx context.Context, key string, t time.Time) (err error) {
+	ctx = c.tagContext(ctx, "InvalidateAt")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "InvalidateAt",
+			[]string{
+				fmt.Sprintf("key=%s", key),
+				fmt.Sprintf("at=%s", t),
+			})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if c.leader == nil {
+		return ErrNoLeaderElection
+	}
+	if !t.After(getNow()) {
+		return c.Invalidate(ctx, key)
+	}
+	return c.conn.ZAdd(ctx, c.scheduledKey(), redis.Z{
+		Score:  float64(t.UnixMilli()),
+		Member: key,
+	}).Err()
+}
+
+func (c *DCache) scheduledKey() string {
+	return scheduledKeyPrefix + c.appName
+}
+
+// runScheduledInvalidations runs due invalidations, as a leader task, until @p ctx is done.
+func (c *DCache) runScheduledInvalidations(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		timer.Reset(c.invalidateDue(ctx))
+	}
+}
+
+// invalidateDue runs invalidations that are due, returns the duration until the next check.
+func (c *DCache) invalidateDue(ctx context.Context) time.Duration {
+	now := getNow()
+	due, err := c.conn.ZRangeByScoreWithScores(ctx, c.scheduledKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: scheduledInvalidationBatch,
+	}).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logger(ctx).Err(err).Msgf("Failed to read scheduled invalidations of %s", c.appName)
+		}
+		return scheduledInvalidationPoll
+	}
+	for _, z := range due {
+		key := z.Member.(string)
+		// invalidate before completing the schedule, so that it is retried by the next
+		// leader if this one dies in between.
+		if err := c.Invalidate(ctx, key); err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to run scheduled invalidation of %s", key)
+			c.recordError(errLabelInvalidate, key, err)
+			continue
+		}
+		err := completeScheduledScript.Run(ctx, c.conn, []string{c.scheduledKey()}, key, z.Score).Err()
+		if err != nil {
+			c.logger(ctx).Err(err).Msgf("Failed to complete scheduled invalidation of %s", key)
+		}
+	}
+	if len(due) == scheduledInvalidationBatch {
+		return 0
+	}
+	next, err := c.conn.ZRangeWithScores(ctx, c.scheduledKey(), 0, 0).Result()
+	if err != nil || len(next) == 0 {
+		return scheduledInvalidationPoll
+	}
+	wait := time.UnixMilli(int64(next[0].Score)).Sub(getNow())
+	if wait > scheduledInvalidationPoll {
+		return scheduledInvalidationPoll
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
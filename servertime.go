@@ -0,0 +1,74 @@
+package dcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readRedisRebased reads @p key from Redis along with its PTTL in one pipeline, and rebases
+// expirations of the value on the clock of this client, see WithServerTimeExpiry.
+func (c *DCache) readRedisRebased(ctx context.Context, key string) (*ValueBytesExpiredAt, error) {
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+	_, err := c.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, c.storeKey(key))
+		pttl = pipe.PTTL(ctx, c.storeKey(key))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	veBytes, err := get.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if isTombstone(veBytes) {
+		return nil, redis.Nil
+	}
+	ve, err := c.decodeEnvelope(veBytes)
+	if err != nil {
+		return nil, err
+	}
+	rebaseExpiry(ve, pttl.Val())
+	return ve, nil
+}
+
+// rebaseMultiExpiry rebases expirations of values @p ves of @p keys read by one MGET, by
+// PTTLs of keys found read in one pipeline. Values are left as written if it fails.
+func (c *DCache) rebaseMultiExpiry(ctx context.Context, keys []string, ves []*ValueBytesExpiredAt) {
+	pttls := make([]*redis.DurationCmd, len(keys))
+	_, err := c.conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if ves[i] != nil {
+				pttls[i] = pipe.PTTL(ctx, c.storeKey(key))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to read PTTLs of %d keys", len(keys))
+		return
+	}
+	for i, pttl := range pttls {
+		if pttl != nil {
+			rebaseExpiry(ves[i], pttl.Val())
+		}
+	}
+}
+
+// rebaseExpiry sets the expiration of @p ve to @p pttl from now, the remaining TTL of it in
+// Redis, shifting its soft expiration by the same amount, so that expirations written by
+// writers of skewed clocks are read by the clock of this client. Keys without TTLs, of
+// negative PTTLs, are left as written.
+func rebaseExpiry(ve *ValueBytesExpiredAt, pttl time.Duration) {
+	if pttl <= 0 {
+		return
+	}
+	expiredAt := getNow().Add(pttl).UnixMilli()
+	if ve.SoftExpiredAt > 0 {
+		ve.SoftExpiredAt += expiredAt - ve.ExpiredAt
+	}
+	ve.ExpiredAt = expiredAt
+}
@@ -0,0 +1,69 @@
+package dcache
+
+import "strings"
+
+// Snapshot is a read-only view over the memory cache, for background jobs, e.g., analytics
+// over currently cached data. It never reads Redis or data sources, and it is safe to use
+// while the cache keeps serving. It is not a point-in-time copy: entries changed during
+// iteration may or may not be observed.
+type Snapshot struct {
+	mem       LocalCache
+	keyPrefix string
+	unmarshal func(key string, b []byte, value any) error
+}
+
+// SnapshotEntry is an entry of memory cache iterated by Snapshot.Range.
+type SnapshotEntry struct {
+	Key        string
+	valueBytes []byte
+	unmarshal  func(key string, b []byte, value any) error
+}
+
+// Decode unmarshals the value of the entry into @p target, see Get.
+func (e SnapshotEntry) Decode(target any) error {
+	return e.unmarshal(e.Key, e.valueBytes, target)
+}
+
+// Snapshot returns a read-only view over the memory cache.
+// The view is empty if memory cache is not enabled.
+func (c *DCache) Snapshot() *Snapshot {
+	return &Snapshot{mem: c.memCache(), keyPrefix: c.opts.keyPrefix, unmarshal: c.unmarshal}
+}
+
+// Get reads the value of @p key in memory cache into @p target.
+// ErrNotFound is returned if the key is not in memory cache.
+func (s *Snapshot) Get(key string, target any) error {
+	if s.mem == nil {
+		return ErrNotFound
+	}
+	valueBytes, err := s.mem.Get([]byte(storeKeyOf(s.keyPrefix, key)))
+	if err != nil {
+		return ErrNotFound
+	}
+	return s.unmarshal(key, valueBytes, target)
+}
+
+// Len returns the number of entries in memory cache.
+func (s *Snapshot) Len() int64 {
+	if s.mem == nil {
+		return 0
+	}
+	return s.mem.Stats().Entries
+}
+
+// Range calls @p f for entries in memory cache, in no particular order, until @p f returns false.
+// Nothing is iterated if memory cache does not implement LocalCacheRanger.
+func (s *Snapshot) Range(f func(entry SnapshotEntry) bool) {
+	mem, ok := s.mem.(LocalCacheRanger)
+	if !ok {
+		return
+	}
+	head := s.keyPrefix + ":{"
+	mem.Range(func(k, value []byte) bool {
+		key := string(k)
+		if !strings.HasPrefix(key, head) || !strings.HasSuffix(key, "}") {
+			return true
+		}
+		return f(SnapshotEntry{Key: key[len(head) : len(key)-1], valueBytes: value, unmarshal: s.unmarshal})
+	})
+}
@@ -0,0 +1,170 @@
+package dcache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// maxEntryStamps caps the number of tracked stamps, all of them are dropped when exceeded.
+const maxEntryStamps = 100000
+
+// entryStamps tracks stamps of values in memory cache, i.e., CreatedAt, Seq and Writer of their
+// envelopes, so that invalidations stamped with values of the same or older writes do not
+// evict them, see applyInvalidation. Values without stamps are always evicted, e.g., values Set by
+// peers of older versions, and values dropped when the cap is exceeded.
+// Keys are store keys, the same as those of memory cache.
+type entryStamps struct {
+	mu      sync.Mutex
+	entries map[string]entryStamp
+	// last is the latest stamp of values written by this client, see next.
+	lastMu sync.Mutex
+	last   valueStamp
+}
+
+func newEntryStamps() *entryStamps {
+	return &entryStamps{entries: make(map[string]entryStamp)}
+}
+
+// valueStamp is the stamp of a value written, i.e., CreatedAt and Seq of its envelope, 0 if
+// unknown, unique per writer only.
+type valueStamp struct {
+	at  int64
+	seq uint32
+}
+
+// stampOf returns the stamp of @p ve.
+func stampOf(ve *ValueBytesExpiredAt) valueStamp {
+	return valueStamp{at: ve.CreatedAt, seq: ve.Seq}
+}
+
+// entryStamp is the stamp of a value written by the client of writer, see writerOf.
+type entryStamp struct {
+	stamp  valueStamp
+	writer uint32
+}
+
+// writerOf returns the Writer of envelopes of values written by the client of ID @p id,
+// 0, i.e., unknown, only if @p id is empty.
+func writerOf(id string) uint32 {
+	if id == "" {
+		return 0
+	}
+	if w := uint32(xxhash.Sum64String(id)); w != 0 {
+		return w
+	}
+	return 1
+}
+
+// next returns the stamp of a value written at @p now, i.e., its CreatedAt in wall clock
+// milliseconds, and Seq increased beyond stamps returned before until the clock passes the
+// latest one, so that values written by this client in the same millisecond are told apart
+// by peers.
+func (s *entryStamps) next(now time.Time) valueStamp {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	at := now.UnixMilli()
+	if at > s.last.at {
+		s.last = valueStamp{at: at}
+	} else {
+		s.last.seq++
+	}
+	return valueStamp{at: at, seq: s.last.seq}
+}
+
+// record @p stamp of the value of @p key written by @p writer cached in memory, forgotten
+// if unknown.
+func (s *entryStamps) record(key string, stamp valueStamp, writer uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stamp.at <= 0 {
+		delete(s.entries, key)
+		return
+	}
+	if len(s.entries) >= maxEntryStamps {
+		s.entries = make(map[string]entryStamp)
+	}
+	s.entries[key] = entryStamp{stamp: stamp, writer: writer}
+}
+
+// covers returns true if the value of @p key cached in memory is the value written at
+// @p stamp by @p writer, or written later by the same writer in the same millisecond, or
+// written later beyond the tolerance of clock skew. Stamps are unique per writer only, so
+// values of unknown writers are never the same.
+func (s *entryStamps) covers(key string, stamp valueStamp, writer uint32) bool {
+	if stamp.at <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	if cached.stamp.at == stamp.at {
+		return writer != 0 && cached.writer == writer && cached.stamp.seq >= stamp.seq
+	}
+	return cached.stamp.at-stamp.at > invalidateSkewTolerance.Milliseconds()
+}
+
+// forget the stamp of @p key.
+func (s *entryStamps) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// reset forgets stamps of all keys.
+func (s *entryStamps) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[string]entryStamp)
+}
+
+// formatStamp formats @p stamp of a message sent at @p sentAt: the offset to @p sentAt in
+// milliseconds, followed by '.' and Seq if not 0, empty if unknown.
+func formatStamp(sentAt int64, stamp valueStamp) string {
+	if stamp.at <= 0 {
+		return ""
+	}
+	s := strconv.FormatInt(sentAt-stamp.at, 10)
+	if stamp.seq > 0 {
+		s += "." + strconv.FormatUint(uint64(stamp.seq), 10)
+	}
+	return s
+}
+
+// formatStamps formats stamps of keys of a message sent at @p sentAt, as the value of
+// metaStamps: stamps of formatStamp joined by ','.
+func formatStamps(sentAt int64, keys []pendingKey) string {
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(formatStamp(sentAt, k.stamp))
+	}
+	return b.String()
+}
+
+// parseStamps parses @p value of metaStamps of a message sent at @p sentAt, zero for unknown
+// stamps.
+func parseStamps(sentAt int64, value string) []valueStamp {
+	l := strings.Split(value, ",")
+	stamps := make([]valueStamp, len(l))
+	for i, s := range l {
+		s, seq, _ := strings.Cut(s, ".")
+		offset, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		stamps[i].at = sentAt - offset
+		if n, err := strconv.ParseUint(seq, 10, 32); err == nil {
+			stamps[i].seq = uint32(n)
+		}
+	}
+	return stamps
+}
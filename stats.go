@@ -0,0 +1,218 @@
+package dcache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LatencyStats summarizes latencies of reading data sources.
+type LatencyStats struct {
+	Count int64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Stats are in-client statistics of the cache, see Stats.
+type Stats struct {
+	// LoaderLatency of prefixes registered by WithLoaderLatencyDigests.
+	LoaderLatency map[string]LatencyStats
+	// LockWaits is the number of reads that waited for the distributed lock held by others.
+	LockWaits int64
+	// LockWaitTime is the total time of LockWaits.
+	LockWaitTime time.Duration
+	// ReadRepairs is the number of keys written back to Redis from memory cache,
+	// see WithReadRepair.
+	ReadRepairs int64
+	// DryRunHits and DryRunMisses are the numbers of reads that would have been cache hits
+	// and misses, see WithDryRun.
+	DryRunHits   int64
+	DryRunMisses int64
+	// DryRunKeys and DryRunBytes are the number and size of values, including keys, that
+	// would be cached now, see WithDryRun.
+	DryRunKeys  int64
+	DryRunBytes int64
+	// HedgedReads is the number of reads sent also to the replica, of which HedgeWins were
+	// answered by the replica first, see WithHedgedReads.
+	HedgedReads int64
+	HedgeWins   int64
+	// CodecCanaryMatches, CodecCanaryMismatches and CodecCanaryErrors are the results of
+	// writes compared with the candidate codec, see WithCodecCanary.
+	CodecCanaryMatches    int64
+	CodecCanaryMismatches int64
+	CodecCanaryErrors     int64
+	// QuotaRefused is the number of writes refused by quotas, see WithQuotas.
+	QuotaRefused int64
+	// Expired is the number of keys expired in Redis, of which ExpiredUnread were written by
+	// this client but not read since, see WithExpiryEvents.
+	Expired       int64
+	ExpiredUnread int64
+	// StaleHits is the number of stale values returned, and Revalidations is the number of
+	// refreshes of them run by this client, see SoftTTL. RevalidationsFailed and
+	// RevalidationsDropped are the numbers of refreshes failed, and dropped as the queue was
+	// full, and RevalidationQueue is the number of refreshes queued, see WithBackgroundRefresh.
+	StaleHits            int64
+	Revalidations        int64
+	RevalidationsFailed  int64
+	RevalidationsDropped int64
+	RevalidationQueue    int
+	// Warmed is the number of keys warmed from the warm queue by this client, and WarmFailed
+	// is the number of them failed, see WithWarmQueue.
+	Warmed     int64
+	WarmFailed int64
+	// EarlyExpiries is the number of values recomputed before they expire, see WithXFetch.
+	EarlyExpiries int64
+	// Prefetches is the number of related keys prefetched, see WithPrefetch.
+	Prefetches int64
+	// RedisPool is the connection pool of the Redis client of values, and LockPool is the
+	// one of the client of locks and pub/sub if distinct, nil otherwise, see WithLockClient.
+	RedisPool *redis.PoolStats
+	LockPool  *redis.PoolStats
+	// Writes of prefixes registered by WithWriteReport.
+	Writes map[string]WriteStats
+	// CapacityAdvice is set if WithCapacityAdvisor is given.
+	CapacityAdvice *CapacityAdvice
+	// StreamLag is the delay of the last invalidation read from the stream since appended,
+	// and StreamGaps is the number of times invalidations were lost, clearing memory cache,
+	// see WithStreamInvalidation.
+	StreamLag  time.Duration
+	StreamGaps int64
+	// InvalidateBacklog is the number of invalidated keys pending to be published, and
+	// InvalidateOverflows is the number of times it overflowed, see WithInvalidateBacklog.
+	InvalidateBacklog   int
+	InvalidateOverflows int64
+	// PubSubReconnects is the number of times the pubsub subscription of invalidations was
+	// reconnected, resyncing memory cache, see WithPubSubResync.
+	PubSubReconnects int64
+}
+
+// statCounters are cumulative counters of Stats.
+type statCounters struct {
+	lockWaits     atomic.Int64
+	lockWaitNanos atomic.Int64
+	readRepairs   atomic.Int64
+	hedgedReads   atomic.Int64
+	hedgeWins     atomic.Int64
+	quotaRefused  atomic.Int64
+	expired       atomic.Int64
+	expiredUnread atomic.Int64
+	staleHits     atomic.Int64
+	revalidations atomic.Int64
+	warmed        atomic.Int64
+	warmFailed    atomic.Int64
+	earlyExpiries atomic.Int64
+	prefetches    atomic.Int64
+
+	invalidateOverflows atomic.Int64
+}
+
+func (s *statCounters) observeLockWait(d time.Duration) {
+	s.lockWaits.Add(1)
+	s.lockWaitNanos.Add(int64(d))
+}
+
+// loaderDigests tracks t-digest sketches of loader latencies by prefix.
+type loaderDigests struct {
+	mu       sync.Mutex
+	prefixes []string
+	digests  map[string]*tdigest
+}
+
+func newLoaderDigests(prefixes []string) *loaderDigests {
+	d := &loaderDigests{prefixes: prefixes, digests: make(map[string]*tdigest)}
+	for _, prefix := range prefixes {
+		d.digests[prefix] = newTDigest(defaultDigestCompression)
+	}
+	return d
+}
+
+// observe latency @p d of reading @p key, into the digest of the longest prefix matched.
+func (l *loaderDigests) observe(key string, d time.Duration) {
+	matched := -1
+	for i, prefix := range l.prefixes {
+		if strings.HasPrefix(key, prefix) && (matched < 0 || len(prefix) > len(l.prefixes[matched])) {
+			matched = i
+		}
+	}
+	if matched < 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.digests[l.prefixes[matched]].Add(float64(d))
+}
+
+func (l *loaderDigests) stats() map[string]LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rv := make(map[string]LatencyStats, len(l.digests))
+	for prefix, t := range l.digests {
+		s := LatencyStats{Count: t.Count()}
+		if s.Count > 0 {
+			s.P50 = time.Duration(t.Quantile(0.5))
+			s.P90 = time.Duration(t.Quantile(0.9))
+			s.P99 = time.Duration(t.Quantile(0.99))
+			s.Max = time.Duration(t.Quantile(1))
+		}
+		rv[prefix] = s
+	}
+	return rv
+}
+
+// Stats returns in-client statistics since the cache was created.
+func (c *DCache) Stats() Stats {
+	s := Stats{
+		LoaderLatency: map[string]LatencyStats{},
+		LockWaits:     c.counters.lockWaits.Load(),
+		LockWaitTime:  time.Duration(c.counters.lockWaitNanos.Load()),
+		ReadRepairs:   c.counters.readRepairs.Load(),
+		HedgedReads:   c.counters.hedgedReads.Load(),
+		HedgeWins:     c.counters.hedgeWins.Load(),
+		QuotaRefused:  c.counters.quotaRefused.Load(),
+		Expired:       c.counters.expired.Load(),
+		ExpiredUnread: c.counters.expiredUnread.Load(),
+		StaleHits:     c.counters.staleHits.Load(),
+		Revalidations: c.counters.revalidations.Load(),
+		Warmed:        c.counters.warmed.Load(),
+		WarmFailed:    c.counters.warmFailed.Load(),
+		EarlyExpiries: c.counters.earlyExpiries.Load(),
+		Prefetches:    c.counters.prefetches.Load(),
+		RedisPool:     c.conn.PoolStats(),
+	}
+	s.RevalidationsFailed, s.RevalidationsDropped = c.revalidator.failed.Load(), c.revalidator.dropped.Load()
+	s.RevalidationQueue = len(c.revalidator.tasks)
+	s.InvalidateBacklog, s.InvalidateOverflows = c.invalidateBacklog(), c.counters.invalidateOverflows.Load()
+	s.PubSubReconnects = c.resync.reconnects.Load()
+	if c.lockConn != c.conn {
+		s.LockPool = c.lockConn.PoolStats()
+	}
+	if c.loaderDigests != nil {
+		s.LoaderLatency = c.loaderDigests.stats()
+	}
+	if c.writeReport != nil {
+		s.Writes = c.writeReport.report()
+	}
+	if c.advisor != nil {
+		advice := c.advisor.advice()
+		s.CapacityAdvice = &advice
+	}
+	if c.stream != nil {
+		s.StreamLag = time.Duration(c.stream.lagNanos.Load())
+		s.StreamGaps = c.stream.gaps.Load()
+	}
+	if c.canary != nil {
+		s.CodecCanaryMatches = c.canary.matches.Load()
+		s.CodecCanaryMismatches = c.canary.mismatches.Load()
+		s.CodecCanaryErrors = c.canary.errors.Load()
+	}
+	if c.dryRun != nil {
+		s.DryRunHits, s.DryRunMisses = c.dryRun.hits.Load(), c.dryRun.misses.Load()
+		s.DryRunKeys, s.DryRunBytes = c.dryRun.size()
+	}
+	return s
+}
@@ -0,0 +1,310 @@
+package dcache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	streamKeyPrefix = ":dcache_stream:"
+	// streamField is the field of invalidation messages in entries of the stream.
+	streamField = "m"
+	// defaultStreamMaxLen is the default approximate number of messages kept in the stream.
+	defaultStreamMaxLen = 10000
+	// streamBlock bounds blocking reads of the stream, and so the delay of Close.
+	streamBlock     = time.Second
+	streamReadCount = 100
+	// streamRetryInterval is the interval of retrying reads of the stream after errors.
+	streamRetryInterval = time.Second
+	// streamMaintainInterval is the interval of trimming the stream by age, and removing
+	// consumer groups of gone clients.
+	streamMaintainInterval = time.Minute
+)
+
+// StreamRetention is the retention of messages of invalidation streams, see
+// WithStreamInvalidation. Clients disconnected longer than the retention lose messages, and
+// clear their memory caches once reconnected.
+type StreamRetention struct {
+	// MaxLen is the approximate maximum number of messages kept, defaultStreamMaxLen if 0.
+	MaxLen int64
+	// MaxAge trims messages older than it every streamMaintainInterval, unbounded if 0.
+	MaxAge time.Duration
+}
+
+// invalidateStream is the state of the stream transport of invalidations of this client.
+type invalidateStream struct {
+	key       string
+	retention StreamRetention
+	// lastID is the ID of the last message read, to detect messages trimmed before read.
+	lastID   string
+	lagNanos atomic.Int64
+	gaps     atomic.Int64
+}
+
+// streamKey returns the key of the invalidation stream, by the invalidation topic.
+func (c *DCache) streamKey() string {
+	return c.opts.keyPrefix + streamKeyPrefix + c.opts.invalidateTopic
+}
+
+// startStream creates the consumer group of this client at the end of the stream, so that
+// no message sent once memory cache is used is missed, then reads it in the background.
+func (c *DCache) startStream() {
+	retention := *c.opts.streamRetention
+	if retention.MaxLen <= 0 {
+		retention.MaxLen = defaultStreamMaxLen
+	}
+	c.stream = &invalidateStream{key: c.streamKey(), retention: retention}
+	if err := c.createStreamGroup(c.ctx); err != nil {
+		// retried by the listener.
+		c.logger(c.ctx).Err(err).Msgf("Failed to create consumer group of %s", c.stream.key)
+	}
+	c.wg.Add(2)
+	go c.listenStream()
+	go c.maintainStream()
+}
+
+// createStreamGroup creates the consumer group of this client, named by its ID, at the last
+// message of the stream, creating the stream if absent.
+func (c *DCache) createStreamGroup(ctx context.Context) error {
+	last, err := c.lockConn.XRevRangeN(ctx, c.stream.key, "+", "-", 1).Result()
+	if err != nil {
+		return err
+	}
+	lastID := "0-0"
+	if len(last) > 0 {
+		lastID = last[0].ID
+	}
+	err = c.lockConn.XGroupCreateMkStream(ctx, c.stream.key, c.id, lastID).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	c.stream.lastID = lastID
+	return nil
+}
+
+// appendStream appends @p msgs to the stream, through one pipeline if there are more than one.
+func (c *DCache) appendStream(ctx context.Context, msgs []pubMsg) {
+	cmds, err := c.lockConn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range msgs {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: c.stream.key,
+				MaxLen: c.stream.retention.MaxLen,
+				Approx: true,
+				Values: []any{streamField, msg.payload},
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		for _, cmd := range cmds {
+			if cmd.Err() != nil {
+				c.logger(ctx).Err(cmd.Err()).Msgf("Failed to append invalidation to %s", c.stream.key)
+				c.recordError(errLabelPublish, "", cmd.Err())
+			}
+		}
+	}
+}
+
+// listenStream reads messages of the stream by the consumer group of this client until the
+// cache is closed, then removes the group. After errors, messages delivered but not acked
+// are read again, and memory cache is cleared if messages were trimmed before read.
+func (c *DCache) listenStream() {
+	defer c.wg.Done()
+	defer c.destroyStreamGroup()
+	// recovering is true until messages pending are read again after errors, checked for
+	// losses first.
+	recovering, checked := false, false
+	for c.ctx.Err() == nil {
+		if recovering && !checked {
+			if err := c.recoverStream(); err != nil {
+				c.streamFailed(err)
+				continue
+			}
+			checked = true
+		}
+		id := ">"
+		if recovering {
+			id = "0"
+		}
+		streams, err := c.lockConn.XReadGroup(c.ctx, &redis.XReadGroupArgs{
+			Group:    c.id,
+			Consumer: c.id,
+			Streams:  []string{c.stream.key, id},
+			Count:    streamReadCount,
+			Block:    streamBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.streamFailed(err)
+			recovering, checked = true, false
+			continue
+		}
+		if n := c.handleStreamMessages(streams); recovering && n == 0 {
+			// all messages pending are read again.
+			recovering = false
+		}
+	}
+}
+
+// streamFailed records the read error @p err, and waits before retrying.
+func (c *DCache) streamFailed(err error) {
+	c.logger(c.ctx).Err(err).Msgf("Failed to read invalidation stream %s", c.stream.key)
+	c.recordError(errLabelInvalidate, "", err)
+	select {
+	case <-time.After(streamRetryInterval):
+	case <-c.ctx.Done():
+	}
+}
+
+// recoverStream clears memory cache if messages not read yet were trimmed, or the consumer
+// group of this client is lost, e.g., removed as gone, recreating it.
+func (c *DCache) recoverStream() error {
+	info, err := c.lockConn.XInfoStream(c.ctx, c.stream.key).Result()
+	if err != nil && !isNoSuchKey(err) {
+		return err
+	}
+	lost := err == nil && streamIDLess(c.stream.lastID, info.MaxDeletedEntryID)
+	groups, err := c.lockConn.XInfoGroups(c.ctx, c.stream.key).Result()
+	if err != nil && !isNoSuchKey(err) {
+		return err
+	}
+	found := false
+	for _, g := range groups {
+		found = found || g.Name == c.id
+	}
+	lost = lost || !found
+	if !found {
+		if err := c.createStreamGroup(c.ctx); err != nil {
+			return err
+		}
+	}
+	if lost {
+		c.logger(c.ctx).Warn().Msgf("Invalidations of %s may be lost, clearing memory cache", c.stream.key)
+		c.stream.gaps.Add(1)
+		c.flushLocal()
+	}
+	return nil
+}
+
+// handleStreamMessages applies and acks messages of @p streams, returns the number of them.
+func (c *DCache) handleStreamMessages(streams []redis.XStream) int {
+	n := 0
+	for _, s := range streams {
+		if len(s.Messages) == 0 {
+			continue
+		}
+		ids := make([]string, 0, len(s.Messages))
+		for _, m := range s.Messages {
+			c.signals.lastPubSubAt.Store(getNow().UnixNano())
+			if ms, ok := streamIDTime(m.ID); ok {
+				lag := getNow().Sub(ms)
+				c.stream.lagNanos.Store(int64(lag))
+				if c.stats != nil {
+					c.stats.UpdateStreamLag(lag)
+				}
+			}
+			if payload, ok := m.Values[streamField].(string); ok {
+				c.handleInvalidatePayload(payload)
+			}
+			ids = append(ids, m.ID)
+		}
+		if err := c.lockConn.XAck(c.ctx, c.stream.key, c.id, ids...).Err(); err != nil {
+			c.logger(c.ctx).Err(err).Msgf("Failed to ack %d invalidations of %s", len(ids), c.stream.key)
+		}
+		c.stream.lastID = ids[len(ids)-1]
+		n += len(ids)
+	}
+	return n
+}
+
+// destroyStreamGroup removes the consumer group of this client, on a fresh context because
+// c.ctx is done.
+func (c *DCache) destroyStreamGroup() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDetachedWriteTimeout)
+	defer cancel()
+	if err := c.lockConn.XGroupDestroy(ctx, c.stream.key, c.id).Err(); err != nil {
+		c.logger(c.ctx).Err(err).Msgf("Failed to remove consumer group %s of %s", c.id, c.stream.key)
+	}
+}
+
+// maintainStream trims messages older than the retention, and removes consumer groups of
+// clients gone without removing them, i.e., groups that missed messages trimmed, until the
+// cache is closed. Clients of removed groups recreate them, see recoverStream.
+func (c *DCache) maintainStream() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(streamMaintainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		if err := c.trimStream(c.ctx); err != nil && c.ctx.Err() == nil {
+			c.logger(c.ctx).Err(err).Msgf("Failed to trim invalidation stream %s", c.stream.key)
+		}
+	}
+}
+
+func (c *DCache) trimStream(ctx context.Context) error {
+	if maxAge := c.stream.retention.MaxAge; maxAge > 0 {
+		minID := strconv.FormatInt(getNow().Add(-maxAge).UnixMilli(), 10)
+		if err := c.lockConn.XTrimMinIDApprox(ctx, c.stream.key, minID, 0).Err(); err != nil {
+			return err
+		}
+	}
+	info, err := c.lockConn.XInfoStream(ctx, c.stream.key).Result()
+	if err != nil {
+		return err
+	}
+	groups, err := c.lockConn.XInfoGroups(ctx, c.stream.key).Result()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Name != c.id && streamIDLess(g.LastDeliveredID, info.MaxDeletedEntryID) {
+			if err := c.lockConn.XGroupDestroy(ctx, c.stream.key, g.Name).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isNoSuchKey returns true if @p err is returned by XINFO for streams that do not exist.
+func isNoSuchKey(err error) bool {
+	return strings.HasPrefix(err.Error(), "ERR no such key")
+}
+
+// streamIDLess returns true if stream entry ID @p a is less than @p b.
+func streamIDLess(a, b string) bool {
+	parse := func(id string) (uint64, uint64) {
+		ms, seq, _ := strings.Cut(id, "-")
+		m, _ := strconv.ParseUint(ms, 10, 64)
+		s, _ := strconv.ParseUint(seq, 10, 64)
+		return m, s
+	}
+	am, as := parse(a)
+	bm, bs := parse(b)
+	return am < bm || (am == bm && as < bs)
+}
+
+// streamIDTime returns the time stream entry ID @p id was generated, by the Redis clock.
+func streamIDTime(id string) (time.Time, bool) {
+	ms, _, _ := strings.Cut(id, "-")
+	v, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(v), true
+}
@@ -0,0 +1,188 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// softTTLCtxKey is the context key of the soft TTL given by SoftTTL, carried to writes of
+// values read from the data source, including async writes.
+type softTTLCtxKey struct{}
+
+// softExpiredAt returns the soft expiration of values of @p ttl written with @p ctx, 0 if none.
+func softExpiredAt(ctx context.Context, now time.Time, ttl time.Duration) int64 {
+	soft, ok := ctx.Value(softTTLCtxKey{}).(time.Duration)
+	if !ok || soft <= 0 || soft >= ttl {
+		return 0
+	}
+	return now.Add(soft).UnixMilli()
+}
+
+// isStale returns true if @p ve is past its soft expiration, see SoftTTL.
+func isStale(ve *ValueBytesExpiredAt) bool {
+	return ve.SoftExpiredAt > 0 && getNow().UnixMilli() >= ve.SoftExpiredAt
+}
+
+const (
+	defaultRefreshTimeout     = 10 * time.Second
+	defaultRefreshConcurrency = 16
+	defaultRefreshQueueSize   = 256
+)
+
+// Results of background refreshes in metrics.
+const (
+	refreshLabelOK      = "ok"
+	refreshLabelFailed  = "failed"
+	refreshLabelDropped = "dropped"
+)
+
+// BackgroundRefresh bounds background refreshes of stale values, see WithBackgroundRefresh,
+// so that they do not pile up when the data source slows down.
+type BackgroundRefresh struct {
+	// Timeout is the deadline of each refresh, including taking the lock and writing the
+	// value, defaultRefreshTimeout if 0. Loaders take no contexts and are not interrupted,
+	// but values they return past the deadline are not written.
+	Timeout time.Duration
+	// Concurrency is the number of refreshes run at once, defaultRefreshConcurrency if 0.
+	Concurrency int
+	// QueueSize is the number of refreshes waiting to run, defaultRefreshQueueSize if 0.
+	// Refreshes beyond are dropped, and left to later reads of the stale values.
+	QueueSize int
+}
+
+// refreshTask is a background refresh of a stale key.
+type refreshTask struct {
+	ctx  context.Context
+	key  string
+	read ReadWithTtlFunc
+}
+
+// revalidator runs at most one background refresh of a key at a time per client, by a
+// bounded pool of workers started on the first refresh.
+type revalidator struct {
+	mu      sync.Mutex
+	keys    map[string]struct{}
+	timeout time.Duration
+	workers int
+	tasks   chan *refreshTask
+	start   sync.Once
+	failed  atomic.Int64
+	dropped atomic.Int64
+}
+
+func newRevalidator(cfg BackgroundRefresh) *revalidator {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultRefreshTimeout
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultRefreshConcurrency
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultRefreshQueueSize
+	}
+	return &revalidator{
+		keys:    make(map[string]struct{}),
+		timeout: cfg.Timeout,
+		workers: cfg.Concurrency,
+		tasks:   make(chan *refreshTask, cfg.QueueSize),
+	}
+}
+
+// begin returns false if @p key is being refreshed already.
+func (r *revalidator) begin(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[key]; ok {
+		return false
+	}
+	r.keys[key] = struct{}{}
+	return true
+}
+
+func (r *revalidator) end(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.keys, key)
+}
+
+// revalidate queues a background refresh of stale @p key from @p read, dropped if the queue
+// is full, see BackgroundRefresh.
+func (c *DCache) revalidate(ctx context.Context, key string, read ReadWithTtlFunc) {
+	r := c.revalidator
+	if !r.begin(key) {
+		return
+	}
+	r.start.Do(func() {
+		c.wg.Add(r.workers)
+		for i := 0; i < r.workers; i++ {
+			go c.revalidateWorker()
+		}
+	})
+	// values of ctx, e.g., the soft TTL, are carried, but not its cancellation.
+	select {
+	case r.tasks <- &refreshTask{ctx: detachedContext{parent: ctx}, key: key, read: read}:
+	default:
+		r.end(key)
+		r.dropped.Add(1)
+		if c.stats != nil {
+			c.stats.ObserveRefresh(refreshLabelDropped)
+		}
+	}
+}
+
+// revalidateWorker runs queued refreshes until cache is closed, refreshes still queued are
+// dropped.
+func (c *DCache) revalidateWorker() {
+	defer c.wg.Done()
+	for {
+		select {
+		case task := <-c.revalidator.tasks:
+			c.refresh(task)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh refreshes the stale key of @p task under the distributed lock, so that only one
+// client of the fleet reads the data source, while others keep serving the stale value.
+func (c *DCache) refresh(task *refreshTask) {
+	key := task.key
+	defer c.revalidator.end(key)
+	ctx, cancel := context.WithTimeout(task.ctx, c.revalidator.timeout)
+	defer cancel()
+	seq := c.versions.current(c.storeKey(key))
+	locked, err := c.lockConn.SetNX(ctx, c.lockKey(key), "", c.readInterval).Result()
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to get lock by SetNX for %s", key)
+		c.recordError(errLabelSetRedis, key, err)
+		c.refreshFailed()
+		return
+	}
+	if !locked {
+		// another client is reading the data source.
+		return
+	}
+	c.counters.revalidations.Add(1)
+	rst, err := c.readValue(ctx, key, task.read, false, seq)
+	if err == nil {
+		err = rst.storeErr
+	}
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to refresh stale %s", key)
+		c.refreshFailed()
+		return
+	}
+	if c.stats != nil {
+		c.stats.ObserveRefresh(refreshLabelOK)
+	}
+}
+
+func (c *DCache) refreshFailed() {
+	c.revalidator.failed.Add(1)
+	if c.stats != nil {
+		c.stats.ObserveRefresh(refreshLabelFailed)
+	}
+}
@@ -0,0 +1,104 @@
+package dcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tagKeyPrefix is the prefix of the Redis sets of keys of tags.
+const tagKeyPrefix = ":dcache_tag:"
+
+// tagAddScript adds ARGV[2] to the set KEYS[1], and extends its TTL to ARGV[1] in ms if
+// shorter, so that the set lives as long as its longest-lived member.
+var tagAddScript = redis.NewScript(`-- dcache:tag_add
+redis.call("SADD", KEYS[1], ARGV[2])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return 1`)
+
+// tagsCtxKey is the context key of tags given by WithTags or SetWithTags, carried to writes
+// of values, including async writes.
+type tagsCtxKey struct{}
+
+// tagKey returns the key of the set of keys of @p tag.
+func (c *DCache) tagKey(tag string) string {
+	return c.opts.keyPrefix + tagKeyPrefix + tag
+}
+
+// tagsOf returns tags of values written with @p ctx.
+func tagsOf(ctx context.Context) []string {
+	tags, _ := ctx.Value(tagsCtxKey{}).([]string)
+	return tags
+}
+
+// addTags adds @p key written with @p ttl to the sets of @p tags.
+func (c *DCache) addTags(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	for _, tag := range tags {
+		if err := tagAddScript.Run(ctx, c.conn, []string{c.tagKey(tag)}, ttl.Milliseconds(), key).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTagsMulti adds each of @p keys written with ttls of @p ttls to the sets of @p tags, in
+// one pipeline.
+func (c *DCache) addTagsMulti(ctx context.Context, keys []string, tags []string, ttls []time.Duration) error {
+	pipe := c.conn.Pipeline()
+	for i, key := range keys {
+		for _, tag := range tags {
+			// not EVALSHA, whose NOSCRIPT errors are not retried in pipelines.
+			tagAddScript.Eval(ctx, pipe, []string{c.tagKey(tag)}, ttls[i].Milliseconds(), key)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// SetWithTags is Set that also attaches @p tags to @p key, see InvalidateTag.
+func (c *DCache) SetWithTags(ctx context.Context, key string, val any, ttl time.Duration, tags ...string) error {
+	if len(tags) > 0 {
+		ctx = context.WithValue(ctx, tagsCtxKey{}, tags)
+	}
+	return c.Set(ctx, key, val, ttl)
+}
+
+// SetMultiWithTags is SetMulti that also attaches @p tags to all keys of @p values, see
+// InvalidateTag.
+func (c *DCache) SetMultiWithTags(ctx context.Context, values map[string]any, ttl time.Duration, tags ...string) error {
+	if len(tags) > 0 {
+		ctx = context.WithValue(ctx, tagsCtxKey{}, tags)
+	}
+	return c.SetMulti(ctx, values, ttl)
+}
+
+// InvalidateTag explicitly invalidates all keys tagged with @p tag, see InvalidateMulti.
+// Tags are kept in Redis sets of keys, which live as long as their longest-lived keys. Keys
+// are not removed from the sets when invalidated or expired, so invalidating a tag may
+// invalidate keys written again without it since.
+func (c *DCache) InvalidateTag(ctx context.Context, tag string) (err error) {
+	ctx = c.tagContext(ctx, "InvalidateTag")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "InvalidateTag", []string{fmt.Sprintf("tag=%s", tag)})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	keys, err := c.conn.SMembers(ctx, c.tagKey(tag)).Result()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	// keys are as stored, see WithNamespaces.
+	if err = c.InvalidateMulti(resolvedContext(ctx), keys...); err != nil {
+		// kept for retries.
+		return err
+	}
+	// keys tagged meanwhile are kept.
+	members := make([]any, len(keys))
+	for i, key := range keys {
+		members[i] = key
+	}
+	return c.conn.SRem(ctx, c.tagKey(tag), members...).Err()
+}
@@ -0,0 +1,117 @@
+package dcache
+
+import (
+	"math"
+	"sort"
+)
+
+// defaultDigestCompression trades accuracy for size, about 100 centroids are kept.
+const defaultDigestCompression = 100
+
+// centroid is a cluster of samples in tdigest.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tdigest is a merging t-digest, a compact sketch for estimating quantiles of a stream,
+// accurate at tails. It is not safe for concurrent use.
+// See https://arxiv.org/abs/1902.04023.
+type tdigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	count       float64
+	min         float64
+	max         float64
+}
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{
+		compression: compression,
+		buffer:      make([]centroid, 0, 5*int(compression)),
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add a sample @p x.
+func (t *tdigest) Add(x float64) {
+	t.buffer = append(t.buffer, centroid{mean: x, weight: 1})
+	t.count++
+	t.min = math.Min(t.min, x)
+	t.max = math.Max(t.max, x)
+	if len(t.buffer) == cap(t.buffer) {
+		t.merge()
+	}
+}
+
+// Count returns the number of samples.
+func (t *tdigest) Count() int64 {
+	return int64(t.count)
+}
+
+// merge buffered samples into centroids, with sizes bounded by the k1 scale function.
+func (t *tdigest) merge() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	cur := all[0]
+	var before float64
+	kLeft := t.scale(0)
+	for _, c := range all[1:] {
+		if t.scale((before+cur.weight+c.weight)/t.count)-kLeft <= 1 {
+			cur.mean += (c.mean - cur.mean) * c.weight / (cur.weight + c.weight)
+			cur.weight += c.weight
+			continue
+		}
+		merged = append(merged, cur)
+		before += cur.weight
+		kLeft = t.scale(before / t.count)
+		cur = c
+	}
+	t.centroids = append(merged, cur)
+	t.buffer = t.buffer[:0]
+}
+
+// scale is the k1 scale function. A centroid spans at most 1 in it, so that centroids
+// are smaller near the tails.
+func (t *tdigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// Quantile returns the estimated value at quantile @p q in [0, 1], NaN if no samples.
+func (t *tdigest) Quantile(q float64) float64 {
+	t.merge()
+	if len(t.centroids) == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+	target := q * t.count
+	// interpolate between centers of adjacent centroids, and the min/max at both ends.
+	prevX, prevW := t.min, 0.0
+	var cum float64
+	for _, c := range t.centroids {
+		center := cum + c.weight/2
+		if target < center {
+			if center == prevW {
+				return c.mean
+			}
+			return prevX + (c.mean-prevX)*(target-prevW)/(center-prevW)
+		}
+		prevX, prevW = c.mean, center
+		cum += c.weight
+	}
+	if t.count == prevW {
+		return t.max
+	}
+	return prevX + (t.max-prevX)*(target-prevW)/(t.count-prevW)
+}
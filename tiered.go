@@ -0,0 +1,616 @@
+package dcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/coocood/freecache"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultMemoryOnlySize is the size of the freecache of NewMemoryCache and NewTieredCache
+	// if memory cache is not given.
+	defaultMemoryOnlySize = 64 << 20
+	// defaultTieredTombstoneTTL is the TTL of tombstones of TieredCache, see WithTombstones.
+	defaultTieredTombstoneTTL = 3 * time.Second
+)
+
+// TieredCache implements Cache by memory cache in front of any RemoteCache, e.g., Memcached,
+// or by memory cache only, see NewMemoryCache. Unlike DCache, reads of the data source are
+// deduplicated per key in process only, without distributed locks, and keys changed are
+// published to peers by the InvalidationBus per write, without batching.
+// Same as DCache, values read before local writes or invalidations of their keys are not
+// cached, and TTLs shorter than a second are not cached in memory. Invalidations write
+// tombstones to the remote tier, so that values read from the data source before them are
+// not cached by anyone, see WithTombstones.
+type TieredCache struct {
+	id     string
+	mem    LocalCache
+	remote RemoteCache // nil if memory cache only.
+	bus    InvalidationBus
+	codec  Codec
+	prefix string
+	// tombstoneTTL is the TTL of tombstones written by invalidations.
+	tombstoneTTL time.Duration
+	group        singleflight.Group
+	versions     *localVersions
+	// locks serialize updates of the same key with reads in flight, see store.
+	locks [memLockStripes]sync.Mutex
+	// memMaxTTL caps TTLs of memory cache in seconds, unbounded if 0.
+	memMaxTTL atomic.Int64
+}
+
+// MemoryCache is a TieredCache of memory cache only, see NewMemoryCache.
+type MemoryCache = TieredCache
+
+var _ Cache = (*TieredCache)(nil)
+
+// NewMemoryCache creates a cache of memory cache only, without Redis, e.g., for tests,
+// single-instance deployments and local development. Nothing is shared with other processes.
+// @p opts are the same as NewTieredCache. TTLs are not capped, values of TTL 0 never expire,
+// and sub-second TTLs are rounded up to a second.
+func NewMemoryCache(opts ...Option) *MemoryCache {
+	return newTieredCache(opts)
+}
+
+// NewTieredCache creates a cache of memory cache in front of @p remote, whose memory caches
+// of peers are invalidated by @p bus, NopInvalidationBus if nil. TTLs of memory cache are
+// capped by 5 seconds by default, see SetMemCacheMaxTTLSeconds.
+// Of @p opts, WithInMemCache, WithLocalCache, WithCodec, WithKeyPrefix, WithInstanceID and
+// WithTombstones, 3 seconds by default, are used, others are ignored. A freecache of
+// defaultMemoryOnlySize bytes is used if memory cache is not given. Call options other than
+// WithResult, NoCache, NoStore, MemoryOnly, WithMaxTTL, WithShouldStore and
+// TolerateLoadErrors are ignored.
+// Cache MUST be explicitly closed by calling Close().
+func NewTieredCache(remote RemoteCache, bus InvalidationBus, opts ...Option) (*TieredCache, error) {
+	t := newTieredCache(opts)
+	t.remote, t.bus = remote, bus
+	if t.bus == nil {
+		t.bus = NopInvalidationBus{}
+	}
+	t.memMaxTTL.Store(defaultMemCacheMaxTTLSeconds)
+	if err := t.bus.Subscribe(t.invalidated); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newTieredCache(opts []Option) *TieredCache {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	t := &TieredCache{
+		id:       instanceID(o.instanceID),
+		mem:      o.localCache,
+		codec:    o.codec,
+		prefix:   o.keyPrefix,
+		versions: newLocalVersions(),
+	}
+	t.tombstoneTTL = o.tombstoneTTL
+	if t.tombstoneTTL <= 0 {
+		t.tombstoneTTL = defaultTieredTombstoneTTL
+	}
+	if t.mem == nil {
+		t.mem = FreecacheLocal(freecache.NewCache(defaultMemoryOnlySize))
+	}
+	if t.codec == nil {
+		t.codec = MsgpackCodec{}
+	}
+	return t
+}
+
+// ID returns the instance ID of the cache client, which identifies the origin of
+// invalidations.
+func (t *TieredCache) ID() string {
+	return t.id
+}
+
+// SetMemCacheMaxTTLSeconds caps TTLs of memory cache at @p ttl, see DCache.
+func (t *TieredCache) SetMemCacheMaxTTLSeconds(ttl int64) error {
+	if (ttl <= 0) || (ttl > memCacheMaxTTLHardCapSeconds) {
+		return fmt.Errorf(
+			"invalid ttl: %d, should be in range (0, %d]", ttl, memCacheMaxTTLHardCapSeconds)
+	}
+	t.memMaxTTL.Store(ttl)
+	return nil
+}
+
+// Get reads @p key into @p target, or by @p read, cached with @p expire, see DCache.Get.
+func (t *TieredCache) Get(ctx context.Context, key string, target any, expire time.Duration, read ReadFunc,
+	noCache bool, noStore bool, opts ...CallOption) error {
+	readWithTtl := func() (any, time.Duration, error) {
+		v, err := read()
+		return v, expire, err
+	}
+	return t.GetWithTtl(ctx, key, target, readWithTtl, noCache, noStore, opts...)
+}
+
+// GetWithTtl reads @p key into @p target, from memory cache, the remote tier, or by @p read,
+// cached with the TTL returned by it, see DCache.GetWithTtl.
+func (t *TieredCache) GetWithTtl(ctx context.Context, key string, target any, read ReadWithTtlFunc,
+	noCache bool, noStore bool, opts ...CallOption) error {
+	co := newCallOptions(opts)
+	noCache, noStore = noCache || co.noCache, noStore || co.noStore
+	if err := checkTarget(target); err != nil {
+		return err
+	}
+	if maxTTL := co.maxTTL; maxTTL > 0 {
+		f := read
+		read = func() (any, time.Duration, error) {
+			v, ttl, err := f()
+			if ttl > maxTTL {
+				ttl = maxTTL
+			}
+			return v, ttl, err
+		}
+	}
+	if co.shouldStore != nil {
+		read = checkShouldStore(read, co.shouldStore)
+	}
+	skey := t.storeKey(key)
+	if !noCache {
+		if valueBytes, err := t.mem.Get([]byte(skey)); err == nil {
+			co.setResult(&flightResult{valueBytes: valueBytes, from: hitMem})
+			return decode(t.codec, valueBytes, target)
+		}
+		if co.memoryOnly {
+			return ErrNotFound
+		}
+	}
+	rst, err := t.read(ctx, skey, read, noCache, noStore, t.versions.current(skey))
+	if err != nil {
+		return err
+	}
+	co.setResult(rst)
+	return decode(t.codec, rst.valueBytes, target)
+}
+
+// read reads @p skey from the remote tier unless @p noCache, or by @p f, once at a time per
+// key, and caches the value unless @p noStore, see store for @p seq.
+func (t *TieredCache) read(
+	ctx context.Context, skey string, f ReadWithTtlFunc, noCache, noStore bool, seq uint64) (*flightResult, error) {
+	type valueTtl struct {
+		Val any
+		Ttl time.Duration
+	}
+	rv, err, _ := t.group.Do(skey, func() (any, error) {
+		if t.remote != nil && !noCache {
+			ve, err := t.readRemote(ctx, skey)
+			if err == nil {
+				return ve, nil
+			}
+			if err != ErrNotFound {
+				log.Err(err).Msgf("Failed to read %s from remote cache", skey)
+			}
+		}
+		val, ttl, err := f()
+		return &valueTtl{Val: val, Ttl: ttl}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ve, ok := rv.(*ValueBytesExpiredAt); ok {
+		if !noStore {
+			_ = t.store(skey, ve.ValueBytes, remainingTTL(ve), seq)
+		}
+		return &flightResult{valueBytes: ve.ValueBytes, from: hitRemote}, nil
+	}
+	valTtl := rv.(*valueTtl)
+	val := valTtl.Val
+	if u, ok := val.(unstoredValue); ok {
+		val, noStore = u.value, true
+	}
+	valueBytes, err := encode(t.codec, val, false)
+	if err != nil {
+		return nil, err
+	}
+	rst := &flightResult{valueBytes: valueBytes, from: hitDB}
+	if !noStore {
+		rst.storeErr = t.fill(ctx, skey, valueBytes, valTtl.Ttl, seq)
+	}
+	return rst, nil
+}
+
+// readRemote reads @p skey from the remote tier, ErrNotFound if absent, tombstoned or expired.
+func (t *TieredCache) readRemote(ctx context.Context, skey string) (*ValueBytesExpiredAt, error) {
+	b, err := t.remote.Get(ctx, skey)
+	if err != nil {
+		return nil, err
+	}
+	if isTombstone(b) {
+		return nil, ErrNotFound
+	}
+	ve, err := decodeFlatEnvelope(b)
+	if err != nil {
+		return nil, err
+	}
+	if ve.ExpiredAt > 0 && ve.ExpiredAt <= getNow().UnixMilli() {
+		return nil, ErrNotFound
+	}
+	return ve, nil
+}
+
+// fill caches @p valueBytes of @p skey read from the data source with @p ttl, in the remote
+// tier only if absent, so that values written or tombstoned by peers meanwhile are not
+// overwritten, then in memory cache, see store for @p seq.
+func (t *TieredCache) fill(ctx context.Context, skey string, valueBytes []byte, ttl time.Duration, seq uint64) error {
+	if t.versions.changed(skey, seq) {
+		return nil
+	}
+	if t.remote != nil {
+		added, err := t.remote.Add(ctx, skey, t.envelope(valueBytes, ttl), ttl)
+		if err != nil {
+			return err
+		}
+		if !added {
+			// written by others meanwhile.
+			return nil
+		}
+	}
+	return t.store(skey, valueBytes, ttl, seq)
+}
+
+// store caches @p valueBytes of @p skey with @p ttl in memory cache, unless the key has been
+// changed locally since its version was @p seq, when the read started.
+func (t *TieredCache) store(skey string, valueBytes []byte, ttl time.Duration, seq uint64) error {
+	lock := t.lock(skey)
+	lock.Lock()
+	defer lock.Unlock()
+	if t.versions.changed(skey, seq) {
+		return nil
+	}
+	return t.setMem(skey, valueBytes, ttl)
+}
+
+// setMem caches @p valueBytes of @p skey in memory cache with @p ttl, never expiring if not
+// positive, capped by SetMemCacheMaxTTLSeconds if set. Memory cache expires in seconds, so
+// sub-second TTLs are not cached in front of the remote tier, and rounded up to a second
+// by memory-only caches. The previous value is deleted if it fails.
+// The caller must hold the lock of the key.
+func (t *TieredCache) setMem(skey string, valueBytes []byte, ttl time.Duration) error {
+	if max := time.Duration(t.memMaxTTL.Load()) * time.Second; max > 0 && (ttl <= 0 || ttl > max) {
+		ttl = max
+	}
+	switch {
+	case ttl <= 0:
+		ttl = 0
+	case ttl < time.Second && t.remote != nil:
+		t.mem.Del([]byte(skey))
+		return nil
+	case ttl < time.Second:
+		ttl = time.Second
+	}
+	if err := t.mem.Set([]byte(skey), valueBytes, int(ttl/time.Second)); err != nil {
+		t.mem.Del([]byte(skey))
+		return err
+	}
+	return nil
+}
+
+// envelope returns the envelope of @p valueBytes expiring in @p ttl in the remote tier.
+func (t *TieredCache) envelope(valueBytes []byte, ttl time.Duration) []byte {
+	ve := &ValueBytesExpiredAt{ValueBytes: valueBytes}
+	if ttl > 0 {
+		ve.ExpiredAt = getNow().Add(ttl).UnixMilli()
+	}
+	return encodeFlatEnvelope(ve)
+}
+
+// remainingTTL returns the remaining TTL of @p ve, 0 if it never expires.
+func remainingTTL(ve *ValueBytesExpiredAt) time.Duration {
+	if ve.ExpiredAt == 0 {
+		return 0
+	}
+	return time.UnixMilli(ve.ExpiredAt).Sub(getNow())
+}
+
+func (t *TieredCache) lock(skey string) *sync.Mutex {
+	return &t.locks[xxhash.Sum64String(skey)%memLockStripes]
+}
+
+func (t *TieredCache) storeKey(key string) string {
+	return storeKeyOf(t.prefix, key)
+}
+
+// GetMulti reads values of @p keys into @p targets of the same indexes, from memory cache,
+// the remote tier by one call, then values still missing by a single call of @p readMulti,
+// see DCache.GetMulti.
+func (t *TieredCache) GetMulti(ctx context.Context, keys []string, targets []any, ttl time.Duration,
+	readMulti ReadMultiFunc, opts ...CallOption) []error {
+	co := newCallOptions(opts)
+	errs := make([]error, len(keys))
+	failed := false
+	fail := func(i int, err error) {
+		errs[i] = err
+		failed = true
+	}
+	if len(targets) != len(keys) {
+		for i := range keys {
+			fail(i, ErrTargetsMismatch)
+		}
+		return errs
+	}
+	skeys := make([]string, len(keys))
+	seqs := make([]uint64, len(keys))
+	var missing []int
+	for i, key := range keys {
+		skeys[i] = t.storeKey(key)
+		seqs[i] = t.versions.current(skeys[i])
+		if !co.noCache {
+			if valueBytes, err := t.mem.Get([]byte(skeys[i])); err == nil {
+				if err := decode(t.codec, valueBytes, targets[i]); err != nil {
+					fail(i, err)
+				}
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) > 0 && co.memoryOnly && !co.noCache {
+		for _, i := range missing {
+			fail(i, ErrNotFound)
+		}
+		missing = nil
+	}
+	if len(missing) > 0 && t.remote != nil && !co.noCache {
+		missing = t.getRemoteMulti(ctx, skeys, seqs, targets, missing, co.noStore, fail)
+	}
+	if len(missing) > 0 {
+		missingKeys := make([]string, len(missing))
+		for j, i := range missing {
+			missingKeys[j] = keys[i]
+		}
+		values, err := readMulti(missingKeys)
+		for _, i := range missing {
+			if err != nil {
+				if co.tolerateLoadErrors {
+					fail(i, ErrNotFound)
+				} else {
+					fail(i, err)
+				}
+				continue
+			}
+			v, ok := values[keys[i]]
+			if !ok {
+				fail(i, ErrNotFound)
+				continue
+			}
+			valueBytes, err := encode(t.codec, v, false)
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			if !co.noStore {
+				// the value is still returned if it is not cached.
+				_ = t.fill(ctx, skeys[i], valueBytes, ttl, seqs[i])
+			}
+			if err := decode(t.codec, valueBytes, targets[i]); err != nil {
+				fail(i, err)
+			}
+		}
+	}
+	if !failed {
+		return nil
+	}
+	return errs
+}
+
+// getRemoteMulti reads keys of indexes @p missing from the remote tier into @p targets,
+// returns indexes still missing. Errors of the remote tier are logged, and all keys read from
+// the data source.
+func (t *TieredCache) getRemoteMulti(ctx context.Context, skeys []string, seqs []uint64, targets []any,
+	missing []int, noStore bool, fail func(int, error)) []int {
+	l := make([]string, len(missing))
+	for j, i := range missing {
+		l[j] = skeys[i]
+	}
+	found, err := t.remote.GetMulti(ctx, l)
+	if err != nil {
+		log.Err(err).Msgf("Failed to read %d keys from remote cache", len(l))
+		return missing
+	}
+	rest := missing[:0]
+	for _, i := range missing {
+		b, ok := found[skeys[i]]
+		if !ok || isTombstone(b) {
+			rest = append(rest, i)
+			continue
+		}
+		ve, err := decodeFlatEnvelope(b)
+		if err != nil || (ve.ExpiredAt > 0 && ve.ExpiredAt <= getNow().UnixMilli()) {
+			rest = append(rest, i)
+			continue
+		}
+		if !noStore {
+			_ = t.store(skeys[i], ve.ValueBytes, remainingTTL(ve), seqs[i])
+		}
+		if err := decode(t.codec, ve.ValueBytes, targets[i]); err != nil {
+			fail(i, err)
+		}
+	}
+	return rest
+}
+
+// Peek reads @p key into @p target from memory cache, or the remote tier, ErrNotFound if
+// absent. The value read from the remote tier is not cached in memory.
+func (t *TieredCache) Peek(ctx context.Context, key string, target any) error {
+	if err := checkTarget(target); err != nil {
+		return err
+	}
+	skey := t.storeKey(key)
+	if valueBytes, err := t.mem.Get([]byte(skey)); err == nil {
+		return decode(t.codec, valueBytes, target)
+	}
+	if t.remote == nil {
+		return ErrNotFound
+	}
+	ve, err := t.readRemote(ctx, skey)
+	if err != nil {
+		return err
+	}
+	return decode(t.codec, ve.ValueBytes, target)
+}
+
+// Set caches @p val of @p key with @p ttl, discarding reads of it in flight, then
+// invalidates memory caches of peers.
+func (t *TieredCache) Set(ctx context.Context, key string, val any, ttl time.Duration) error {
+	valueBytes, err := encode(t.codec, val, false)
+	if err != nil {
+		return err
+	}
+	skey := t.storeKey(key)
+	err = t.set(ctx, skey, valueBytes, ttl)
+	t.publish(ctx, skey)
+	return err
+}
+
+// SetMulti caches @p values with @p ttl, none of them if any fails to marshal, then
+// invalidates memory caches of peers by one message.
+func (t *TieredCache) SetMulti(ctx context.Context, values map[string]any, ttl time.Duration) error {
+	encoded := make(map[string][]byte, len(values))
+	for key, val := range values {
+		valueBytes, err := encode(t.codec, val, false)
+		if err != nil {
+			return fmt.Errorf("marshal %s: %w", key, err)
+		}
+		encoded[t.storeKey(key)] = valueBytes
+	}
+	skeys := make([]string, 0, len(encoded))
+	var err error
+	for skey, valueBytes := range encoded {
+		skeys = append(skeys, skey)
+		if err = t.set(ctx, skey, valueBytes, ttl); err != nil {
+			break
+		}
+	}
+	t.publish(ctx, skeys...)
+	return err
+}
+
+// set writes @p valueBytes of @p skey to the remote tier, then memory cache. Errors of memory
+// cache are returned only if it is the only tier.
+func (t *TieredCache) set(ctx context.Context, skey string, valueBytes []byte, ttl time.Duration) error {
+	if t.remote != nil {
+		// reads in flight must not overwrite the value.
+		t.versions.bump(skey)
+		if err := t.remote.Set(ctx, skey, t.envelope(valueBytes, ttl), ttl); err != nil {
+			// the previous value must not be left.
+			t.deleteMem(skey)
+			return err
+		}
+	}
+	lock := t.lock(skey)
+	lock.Lock()
+	defer lock.Unlock()
+	t.versions.bump(skey)
+	if err := t.setMem(skey, valueBytes, ttl); err != nil && t.remote == nil {
+		return err
+	}
+	return nil
+}
+
+// Invalidate deletes @p key, discarding reads of it in flight, then invalidates memory caches
+// of peers. The key is tombstoned in the remote tier, so that values read from the data
+// source before the invalidation are not cached by anyone until the tombstone expires.
+func (t *TieredCache) Invalidate(ctx context.Context, key string) error {
+	return t.InvalidateMulti(ctx, key)
+}
+
+// InvalidateMulti deletes @p keys, see Invalidate, all of them even if some fail. Memory
+// caches of peers are invalidated by one message.
+func (t *TieredCache) InvalidateMulti(ctx context.Context, keys ...string) error {
+	skeys := make([]string, len(keys))
+	var errs []error
+	for i, key := range keys {
+		skeys[i] = t.storeKey(key)
+		t.deleteMem(skeys[i])
+		if t.remote == nil {
+			continue
+		}
+		if err := t.remote.Set(ctx, skeys[i], []byte(tombstone), t.tombstoneTTL); err != nil {
+			errs = append(errs, fmt.Errorf("invalidate %s: %w", key, err))
+		}
+		// reads of the remote tier during the write must not be cached.
+		t.deleteMem(skeys[i])
+	}
+	t.publish(ctx, skeys...)
+	return joinErrors(errs)
+}
+
+// multiError is errors of a call on multiple keys.
+type multiError []error
+
+func (m multiError) Error() string {
+	l := make([]string, len(m))
+	for i, err := range m {
+		l[i] = err.Error()
+	}
+	return strings.Join(l, "; ")
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As.
+func (m multiError) Unwrap() []error {
+	return m
+}
+
+// joinErrors returns @p errs as one error, nil if empty.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return multiError(errs)
+}
+
+// deleteMem deletes @p skey from memory cache, discarding reads of it in flight.
+func (t *TieredCache) deleteMem(skey string) {
+	lock := t.lock(skey)
+	lock.Lock()
+	defer lock.Unlock()
+	t.versions.bump(skey)
+	t.mem.Del([]byte(skey))
+}
+
+// publish invalidates @p skeys in memory caches of peers.
+func (t *TieredCache) publish(ctx context.Context, skeys ...string) {
+	if t.remote == nil || len(skeys) == 0 {
+		return
+	}
+	if err := t.bus.Publish(ctx, t.id, skeys); err != nil {
+		log.Err(err).Msgf("Failed to publish invalidation of %d keys", len(skeys))
+	}
+}
+
+// invalidated evicts @p skeys changed by peer @p origin from memory cache.
+func (t *TieredCache) invalidated(origin string, skeys []string) {
+	if origin == t.id {
+		return
+	}
+	for _, skey := range skeys {
+		lock := t.lock(skey)
+		lock.Lock()
+		t.versions.invalidated(skey)
+		t.mem.Del([]byte(skey))
+		lock.Unlock()
+	}
+}
+
+// Close stops receiving invalidations. Values in memory cache are kept.
+func (t *TieredCache) Close() {
+	if t.bus == nil {
+		return
+	}
+	if err := t.bus.Close(); err != nil {
+		log.Err(err).Msgf("Failed to close invalidation bus")
+	}
+}
@@ -0,0 +1,66 @@
+package dcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tombstone is the value written by Invalidate when WithTombstones is enabled.
+// It is never a msgpack encoded ValueBytesExpiredAt.
+const tombstone = "\xc1dcache:tombstone"
+
+// setUnlessTombstoneScript writes a value filled from the data source, expiring in ARGV[2]
+// milliseconds, never if 0, unless the key is tombstoned. Returns 1 if written.
+var setUnlessTombstoneScript = redis.NewScript(`-- dcache:set_unless_tombstone
+if redis.call("GET", KEYS[1]) == ARGV[3] then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return 1`)
+
+// isTombstone returns true if @p b read from Redis is a tombstone.
+func isTombstone(b []byte) bool {
+	return string(b) == tombstone
+}
+
+// fillKey writes @p veBytes of @p key read from the data source with @p ttl. If tombstones are
+// enabled, nothing is written when the key is tombstoned, and false is returned.
+func (c *DCache) fillKey(ctx context.Context, key string, veBytes []byte, ttl time.Duration) (bool, error) {
+	if c.opts.tombstoneTTL <= 0 {
+		return true, c.conn.Set(ctx, c.storeKey(key), veBytes, ttl).Err()
+	}
+	ttlMs := int64(0)
+	if ttl > 0 {
+		// sub-millisecond TTLs are rounded up, as Redis rejects 0.
+		ttlMs = int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	}
+	written, err := setUnlessTombstoneScript.Run(
+		ctx, c.conn, []string{c.storeKey(key)}, veBytes, ttlMs, tombstone).Int()
+	return written == 1, err
+}
+
+// deleteCmd deletes @p key from Redis through @p cmdable, or tombstones it if enabled.
+// The returned function reports whether a value existed, after the command is executed.
+func (c *DCache) deleteCmd(ctx context.Context, cmdable redis.Cmdable, key string) func() (bool, error) {
+	if c.opts.tombstoneTTL <= 0 {
+		cmd := cmdable.Del(ctx, c.storeKey(key))
+		return func() (bool, error) {
+			n, err := cmd.Result()
+			return n > 0, err
+		}
+	}
+	cmd := cmdable.SetArgs(ctx, c.storeKey(key), tombstone, redis.SetArgs{TTL: c.opts.tombstoneTTL, Get: true})
+	return func() (bool, error) {
+		old, err := cmd.Result()
+		if err == redis.Nil {
+			return false, nil
+		}
+		return err == nil && !isTombstone([]byte(old)), err
+	}
+}
@@ -28,6 +28,8 @@ const (
 	hitDB    hitFrom = "db"
 	hitMem   hitFrom = "mem"
 	hitRedis hitFrom = "redis"
+	// hitRemote is the remote tier of TieredCache.
+	hitRemote hitFrom = "remote"
 )
 
 type tracer struct {
@@ -0,0 +1,70 @@
+package dcache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// trackingChannel is the channel of invalidations of client tracking redirected to
+// connections of RESP2.
+const trackingChannel = "__redis__:invalidate"
+
+// trackingOrigin is the origin of invalidations sent by Redis in metrics.
+const trackingOrigin = "redis"
+
+// startTracking subscribes invalidations sent by Redis for keys of the cache changed by
+// anyone, by a dedicated client of the options of the primary client, whose connection enables
+// client tracking in broadcasting mode on prefixes of store keys and namespace epochs,
+// redirected to itself. Memory cache is cleared on reconnects, as invalidations may be lost.
+func (c *DCache) startTracking() {
+	opt := *c.conn.(*redis.Client).Options()
+	opt.PoolSize = 1
+	// invalidations are pushed instead of published on connections of RESP3, which pubsub
+	// does not read.
+	opt.Protocol = 2
+	onConnect := opt.OnConnect
+	var connects atomic.Int64
+	opt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if onConnect != nil {
+			if err := onConnect(ctx, cn); err != nil {
+				return err
+			}
+		}
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		args := []any{"client", "tracking", "on", "redirect", id, "bcast",
+			"prefix", c.opts.keyPrefix + storeKeyHead + "{", "prefix", c.namespaceKey("")}
+		if err := cn.Process(ctx, redis.NewStatusCmd(ctx, args...)); err != nil {
+			return err
+		}
+		if connects.Add(1) > 1 {
+			c.logger(c.ctx).Warn().Msgf("Reconnected to client tracking, clearing memory cache")
+			c.flushLocal()
+		}
+		return nil
+	}
+	c.tracking = redis.NewClient(&opt)
+	c.pubsub = c.tracking.Subscribe(c.ctx, trackingChannel)
+	c.wg.Add(1)
+	go c.listenTracking()
+}
+
+// listenTracking invalidates memory cache by invalidations sent by Redis, until closed.
+func (c *DCache) listenTracking() {
+	defer c.wg.Done()
+	for msg := range c.pubsub.Channel() {
+		c.signals.lastPubSubAt.Store(getNow().UnixNano())
+		if c.stats != nil {
+			c.stats.ObserveInvalidateReceived(trackingOrigin, len(msg.PayloadSlice))
+		}
+		for _, key := range msg.PayloadSlice {
+			// changes are not timestamped, and are applied even if written locally later.
+			c.applyInvalidation(key, time.Time{}, valueStamp{}, "")
+		}
+	}
+}
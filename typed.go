@@ -0,0 +1,75 @@
+package dcache
+
+import (
+	"context"
+	"time"
+)
+
+// Get reads the value of @p key from @p c as T, or calls @p read and caches its value for
+// @p ttl on misses, see DCache.Get. Values are decoded into a T owned by Get, so that callers
+// do not pass targets; the zero T is returned on errors.
+func Get[T any](
+	ctx context.Context, c Cache, key string, ttl time.Duration, read func() (T, error),
+	opts ...CallOption) (T, error) {
+	var v T
+	err := c.Get(ctx, key, &v, ttl, func() (any, error) {
+		rv, err := read()
+		return rv, err
+	}, false, false, opts...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
+
+// Compute memoizes the result of @p compute, an expensive computation, e.g., template
+// rendering or permission evaluation, under @p key for @p ttl, see Get. Results are shared
+// through Redis by default, or kept in memory cache only by Policy.SkipRemote, for
+// computations cheaper than Redis round trips. Either way, Invalidate drops them on all clients.
+func Compute[T any](
+	ctx context.Context, c Cache, key string, ttl time.Duration, compute func(ctx context.Context) (T, error),
+	opts ...CallOption) (T, error) {
+	return Get(ctx, c, key, ttl, func() (T, error) {
+		return compute(ctx)
+	}, opts...)
+}
+
+// TypedCache caches values of type T under keys of a prefix with the same TTL, e.g., users
+// by ID, so that call sites do not repeat key formatting, TTLs and decoding.
+type TypedCache[T any] struct {
+	cache  Cache
+	prefix string
+	ttl    time.Duration
+	load   func(ctx context.Context, id string) (T, error)
+}
+
+// NewTypedCache returns a TypedCache of values in @p c, keyed by @p prefix followed by IDs,
+// and cached for @p ttl. @p load reads the value of an ID from the data source on misses.
+func NewTypedCache[T any](
+	c Cache, prefix string, ttl time.Duration, load func(ctx context.Context, id string) (T, error),
+) *TypedCache[T] {
+	return &TypedCache[T]{cache: c, prefix: prefix, ttl: ttl, load: load}
+}
+
+// Key returns the cache key of @p id.
+func (t *TypedCache[T]) Key(id string) string {
+	return t.prefix + id
+}
+
+// Get returns the value of @p id, see Get.
+func (t *TypedCache[T]) Get(ctx context.Context, id string, opts ...CallOption) (T, error) {
+	return Get(ctx, t.cache, t.Key(id), t.ttl, func() (T, error) {
+		return t.load(ctx, id)
+	}, opts...)
+}
+
+// Set explicitly sets the value of @p id to @p v, see DCache.Set.
+func (t *TypedCache[T]) Set(ctx context.Context, id string, v T) error {
+	return t.cache.Set(ctx, t.Key(id), v, t.ttl)
+}
+
+// Invalidate explicitly invalidates the value of @p id, see DCache.Invalidate.
+func (t *TypedCache[T]) Invalidate(ctx context.Context, id string) error {
+	return t.cache.Invalidate(ctx, t.Key(id))
+}
@@ -0,0 +1,193 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Checks of Validate.
+const (
+	CheckRedis     = "redis"
+	CheckLockRedis = "lock_redis"
+	CheckPubSub    = "pubsub"
+	CheckClockSkew = "clock_skew"
+	CheckMemCache  = "memory_cache"
+)
+
+const (
+	// maxClockSkew is the clock skew against Redis TIME beyond which Validate warns, as
+	// timestamps of entries and messages written by clients are compared by their peers.
+	maxClockSkew = 500 * time.Millisecond
+	// validatePubSubTimeout bounds the wait of the pubsub round trip of Validate.
+	validatePubSubTimeout = 3 * time.Second
+	// validateMemEntrySize is the size of the entry memory caches are expected to hold, e.g.,
+	// freecache smaller than 1024 times of it rejects common values.
+	validateMemEntrySize = 4 << 10
+	// metaProbe is the nonce of probes of Validate, ignored by peers.
+	metaProbe = "p"
+)
+
+// ErrValidationFailed is returned by Validate if any check fails.
+var ErrValidationFailed = errors.New("dcache: validation failed")
+
+// FindingLevel is the severity of a finding of Validate.
+type FindingLevel int
+
+const (
+	// FindingOK is a passed check.
+	FindingOK FindingLevel = iota
+	// FindingWarning is a check passed with degraded behaviors, e.g., a small memory cache.
+	FindingWarning
+	// FindingError is a failed check, the cache does not work as configured.
+	FindingError
+)
+
+func (l FindingLevel) String() string {
+	switch l {
+	case FindingOK:
+		return "ok"
+	case FindingWarning:
+		return "warning"
+	case FindingError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Finding is the result of a check of Validate.
+type Finding struct {
+	Check   string
+	Level   FindingLevel
+	Message string
+}
+
+// Validate checks the configuration of the cache against its environment: connectivity of
+// Redis and the lock client, a pubsub round trip of a probe published to the invalidation
+// topic, clock skew against Redis TIME, and whether memory cache holds values of common sizes.
+// All findings are returned, and ErrValidationFailed wrapping failed ones if any, e.g., to
+// fail fast at startup, see WithStartupValidation. The probe is ignored by peers.
+func (c *DCache) Validate(ctx context.Context) (findings []Finding, err error) {
+	ctx = c.tagContext(ctx, "Validate")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "Validate", nil)
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	findings = append(findings, pingFinding(CheckRedis, c.conn.Ping(ctx).Err()))
+	if c.lockConn != c.conn {
+		findings = append(findings, pingFinding(CheckLockRedis, c.lockConn.Ping(ctx).Err()))
+	}
+	findings = append(findings, c.validatePubSub(ctx), c.validateClockSkew(ctx), c.validateMemCache())
+	var failed []string
+	for _, f := range findings {
+		if f.Level == FindingError {
+			failed = append(failed, f.Check+": "+f.Message)
+		}
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("%w: %s", ErrValidationFailed, strings.Join(failed, "; "))
+	}
+	return findings, err
+}
+
+// validateOnStart runs Validate within @p timeout, logging warnings, see WithStartupValidation.
+func (c *DCache) validateOnStart(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	findings, err := c.Validate(ctx)
+	for _, f := range findings {
+		if f.Level == FindingWarning {
+			c.logger(ctx).Warn().Msgf("Validation of %s: %s: %s", c.appName, f.Check, f.Message)
+		}
+	}
+	return err
+}
+
+func pingFinding(check string, err error) Finding {
+	if err != nil {
+		return Finding{Check: check, Level: FindingError, Message: fmt.Sprintf("ping: %v", err)}
+	}
+	return Finding{Check: check, Level: FindingOK, Message: "reachable"}
+}
+
+// validatePubSub publishes a probe to the invalidation topic and waits for it on a new
+// subscription of the lock client, the client subscribing invalidations.
+func (c *DCache) validatePubSub(ctx context.Context) Finding {
+	if c.stream != nil {
+		return Finding{Check: CheckPubSub, Level: FindingOK, Message: "invalidations are sent by stream"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, validatePubSubTimeout)
+	defer cancel()
+	topic := c.opts.invalidateTopic
+	pubsub := c.lockConn.Subscribe(ctx, topic)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return Finding{Check: CheckPubSub, Level: FindingError, Message: fmt.Sprintf("subscribe %s: %v", topic, err)}
+	}
+	nonce := uuid.NewV4().String()
+	var buf bytes.Buffer
+	buf.WriteString(c.id)
+	appendMeta(&buf, metaSentAt, strconv.FormatInt(getNow().UnixMilli(), 10))
+	appendMeta(&buf, metaProbe, nonce)
+	start := time.Now()
+	if err := c.lockConn.Publish(ctx, topic, buf.Bytes()).Err(); err != nil {
+		return Finding{Check: CheckPubSub, Level: FindingError, Message: fmt.Sprintf("publish %s: %v", topic, err)}
+	}
+	for {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			return Finding{Check: CheckPubSub, Level: FindingError,
+				Message: fmt.Sprintf("probe not received on %s: %v", topic, err)}
+		}
+		if strings.Contains(msg.Payload, nonce) {
+			return Finding{Check: CheckPubSub, Level: FindingOK,
+				Message: fmt.Sprintf("round trip on %s in %s", topic, time.Since(start))}
+		}
+	}
+}
+
+// validateClockSkew compares the clock of this client with Redis TIME, corrected by half of
+// the round trip.
+func (c *DCache) validateClockSkew(ctx context.Context) Finding {
+	before := getNow()
+	redisNow, err := c.conn.Time(ctx).Result()
+	if err != nil {
+		return Finding{Check: CheckClockSkew, Level: FindingError, Message: fmt.Sprintf("time: %v", err)}
+	}
+	after := getNow()
+	skew := redisNow.Sub(before.Add(after.Sub(before) / 2))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		return Finding{Check: CheckClockSkew, Level: FindingWarning,
+			Message: fmt.Sprintf("clock skew %s against Redis exceeds %s", skew, maxClockSkew)}
+	}
+	return Finding{Check: CheckClockSkew, Level: FindingOK, Message: fmt.Sprintf("clock skew %s", skew)}
+}
+
+// validateMemCache writes and deletes a probe of validateMemEntrySize bytes in memory cache.
+// The probe key starts with "@", so that it never collides with store keys.
+func (c *DCache) validateMemCache() Finding {
+	mem := c.memCache()
+	if mem == nil {
+		return Finding{Check: CheckMemCache, Level: FindingOK, Message: "remote-only"}
+	}
+	key := []byte(metaPrefix + "dcache_validate:" + c.id)
+	err := mem.Set(key, make([]byte, validateMemEntrySize), 1)
+	mem.Del(key)
+	switch {
+	case errors.Is(err, ErrEntryTooLarge):
+		return Finding{Check: CheckMemCache, Level: FindingWarning, Message: fmt.Sprintf(
+			"values of %d bytes are not cached in memory, memory cache is too small", validateMemEntrySize)}
+	case err != nil:
+		return Finding{Check: CheckMemCache, Level: FindingError, Message: fmt.Sprintf("set: %v", err)}
+	}
+	return Finding{Check: CheckMemCache, Level: FindingOK, Message: fmt.Sprintf("%d entries", mem.Stats().Entries)}
+}
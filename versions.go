@@ -0,0 +1,127 @@
+package dcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// how long versions of locally written keys are tracked.
+	localVersionRetention = time.Minute
+	// invalidations sent earlier than a local write by more than this are ignored.
+	invalidateSkewTolerance = time.Second
+)
+
+// localVersion is the version of a key changed locally.
+type localVersion struct {
+	seq       uint64
+	writtenAt time.Time // zero if only invalidated by peers.
+	changedAt time.Time
+}
+
+// localVersions tracks versions of keys written locally by Set and Invalidate, or invalidated
+// by peers, so that memory cache updates and invalidations older than the changes can be
+// discarded, i.e., reads on the same pod always reflect its own writes.
+// Keys are store keys, the same as those of memory cache. Keys are striped by hash, as they
+// are looked up by every read and write, while versions are drawn from one sequence.
+type localVersions struct {
+	seq     atomic.Uint64
+	stripes [memLockStripes]versionStripe
+	// flushedSeq is the version of all keys at the last flush of memory cache, see flushed.
+	flushedSeq atomic.Uint64
+}
+
+// versionStripe holds versions of keys of the same stripe.
+type versionStripe struct {
+	mu       sync.Mutex
+	entries  map[string]localVersion
+	prunedAt time.Time
+}
+
+func newLocalVersions() *localVersions {
+	v := &localVersions{}
+	now := getNow()
+	for i := range v.stripes {
+		v.stripes[i].entries = make(map[string]localVersion)
+		v.stripes[i].prunedAt = now
+	}
+	return v
+}
+
+func (v *localVersions) stripe(key string) *versionStripe {
+	return &v.stripes[xxhash.Sum64String(key)%memLockStripes]
+}
+
+// current returns the version of @p key, 0 if it was neither changed locally recently nor
+// flushed.
+func (v *localVersions) current(key string) uint64 {
+	s := v.stripe(key)
+	s.mu.Lock()
+	seq := s.entries[key].seq
+	s.mu.Unlock()
+	if flushedSeq := v.flushedSeq.Load(); flushedSeq > seq {
+		return flushedSeq
+	}
+	return seq
+}
+
+// flushed increments versions of all keys, as memory cache is flushed, so that updates of
+// reads started before are discarded.
+func (v *localVersions) flushed() {
+	seq := v.seq.Add(1)
+	for {
+		flushedSeq := v.flushedSeq.Load()
+		if flushedSeq >= seq || v.flushedSeq.CompareAndSwap(flushedSeq, seq) {
+			return
+		}
+	}
+}
+
+// bump increments the version of @p key written locally.
+func (v *localVersions) bump(key string) {
+	v.change(key, true)
+}
+
+// invalidated increments the version of @p key invalidated by peers.
+func (v *localVersions) invalidated(key string) {
+	v.change(key, false)
+}
+
+func (v *localVersions) change(key string, written bool) {
+	s := v.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := getNow()
+	e := s.entries[key]
+	e.seq, e.changedAt = v.seq.Add(1), now
+	if written {
+		e.writtenAt = now
+	}
+	s.entries[key] = e
+	if now.Sub(s.prunedAt) > localVersionRetention {
+		for k, e := range s.entries {
+			if now.Sub(e.changedAt) > localVersionRetention {
+				delete(s.entries, k)
+			}
+		}
+		s.prunedAt = now
+	}
+}
+
+// changed returns true if @p key was changed locally after its version was @p seq.
+func (v *localVersions) changed(key string, seq uint64) bool {
+	return v.current(key) != seq
+}
+
+// writtenAfter returns true if @p key was written locally after @p t, beyond the
+// tolerance of clock skew.
+func (v *localVersions) writtenAfter(key string, t time.Time) bool {
+	s := v.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return ok && !e.writtenAt.IsZero() && e.writtenAt.Sub(t) > invalidateSkewTolerance
+}
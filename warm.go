@@ -0,0 +1,124 @@
+package dcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	warmKeyPrefix = ":dcache_warm:"
+	// warmPopTimeout is the timeout of blocking pops of the warm queue, which bounds the wait
+	// of Close. It is the least timeout of BLPOP supported by go-redis.
+	warmPopTimeout = time.Second
+	// warmRetryDelay is the delay of consuming after errors, e.g., of requests failed to load
+	// and pushed back, so that failing loaders are not retried in a busy loop.
+	warmRetryDelay = time.Second
+)
+
+// WarmLoader loads values of keys of a prefix for warm requests, see WithWarmQueue.
+type WarmLoader struct {
+	// Prefix of keys the loader applies to.
+	Prefix string
+	// Load reads the value of @p key from the data source, with its TTL.
+	Load func(ctx context.Context, key string) (any, time.Duration, error)
+}
+
+// RequestWarm asks consumers of the warm queue to reload @p keys from the data source into
+// the cache, e.g., after the data changed. Keys are warmed once, by one of the consumers.
+// Upstream systems can also push keys by RPUSH to the list WarmQueueKey(appName) directly.
+func (c *DCache) RequestWarm(ctx context.Context, keys ...string) (err error) {
+	ctx = c.tagContext(ctx, "RequestWarm")
+	if c.tracer != nil {
+		ctx = c.tracer.TraceStart(ctx, "RequestWarm", []string{fmt.Sprintf("keys=%d", len(keys))})
+		defer c.tracer.TraceEnd(ctx, err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	members := make([]any, len(keys))
+	for i, key := range keys {
+		members[i] = key
+	}
+	return c.conn.RPush(ctx, WarmQueueKey(c.appName), members...).Err()
+}
+
+// WarmQueueKey returns the key of the Redis list of warm requests of clients of @p appName.
+func WarmQueueKey(appName string) string {
+	return warmKeyPrefix + appName
+}
+
+// warmLoader returns the loader of the longest prefix matching @p key, nil if none.
+func (c *DCache) warmLoader(key string) *WarmLoader {
+	var matched *WarmLoader
+	for i := range c.opts.warmLoaders {
+		l := &c.opts.warmLoaders[i]
+		if strings.HasPrefix(key, l.Prefix) && (matched == nil || len(l.Prefix) > len(matched.Prefix)) {
+			matched = l
+		}
+	}
+	return matched
+}
+
+// consumeWarmQueue pops warm requests at the rate of options until the cache is closed.
+// Requests failed to load are pushed back to the queue, to be retried by any consumer.
+func (c *DCache) consumeWarmQueue() {
+	defer c.wg.Done()
+	var interval time.Duration
+	if c.opts.warmRate > 0 {
+		interval = time.Second / time.Duration(c.opts.warmRate)
+	}
+	queue := WarmQueueKey(c.appName)
+	for c.ctx.Err() == nil {
+		startedAt := getNow()
+		// blocks a connection of the pool for up to warmPopTimeout.
+		popped, err := c.conn.BLPop(c.ctx, warmPopTimeout, queue).Result()
+		var wait time.Duration
+		switch {
+		case err == redis.Nil:
+		case err != nil:
+			if c.ctx.Err() == nil {
+				c.logger(c.ctx).Err(err).Msgf("Failed to pop warm requests of %s", c.appName)
+			}
+			wait = warmRetryDelay
+		default:
+			// popped is the queue and the key.
+			key := popped[1]
+			wait = interval - getNow().Sub(startedAt)
+			if !c.warm(c.ctx, key) && c.warmLoader(key) != nil {
+				if err := c.conn.RPush(c.ctx, queue, key).Err(); err != nil {
+					c.logger(c.ctx).Err(err).Msgf("Failed to push back warm request of %s", key)
+				}
+				wait = warmRetryDelay
+			}
+		}
+		if sleepCtx(c.ctx, wait) != nil {
+			return
+		}
+	}
+}
+
+// warm reloads @p key by its loader and sets it, so that peers drop their copies.
+// Returns true if warmed.
+func (c *DCache) warm(ctx context.Context, key string) bool {
+	l := c.warmLoader(key)
+	if l == nil {
+		c.logger(ctx).Warn().Msgf("No warm loader of %s, skipped", key)
+		c.counters.warmFailed.Add(1)
+		return false
+	}
+	value, ttl, err := l.Load(ctx, key)
+	if err == nil {
+		err = c.Set(ctx, key, value, c.policyTTL(key, ttl))
+	}
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to warm %s", key)
+		c.counters.warmFailed.Add(1)
+		return false
+	}
+	c.counters.warmed.Add(1)
+	return true
+}
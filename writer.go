@@ -0,0 +1,77 @@
+package dcache
+
+import (
+	"context"
+	"time"
+)
+
+// writeTask is a cache population write offloaded to the write workers.
+type writeTask struct {
+	ctx        context.Context
+	key        string
+	valueBytes []byte
+	ttl        time.Duration
+	seq        uint64
+}
+
+// startWriteWorkers starts @p workers goroutines that perform queued writes.
+func (c *DCache) startWriteWorkers(workers int, queueSize int) {
+	c.writeCh = make(chan *writeTask, queueSize)
+	c.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.writeWorker()
+	}
+}
+
+// enqueueWrite queues a write of the value read from data source, without blocking.
+// ErrWriteQueueFull is returned if the queue is full and the write is dropped.
+func (c *DCache) enqueueWrite(
+	ctx context.Context, key string, valueBytes []byte, ttl time.Duration, seq uint64) error {
+	select {
+	case c.writeCh <- &writeTask{
+		// caller will not wait for the write.
+		ctx:        detachedContext{parent: ctx},
+		key:        key,
+		valueBytes: valueBytes,
+		ttl:        ttl,
+		seq:        seq,
+	}:
+		return nil
+	default:
+		return ErrWriteQueueFull
+	}
+}
+
+// writeWorker performs queued writes until cache is closed, then drains the queue.
+func (c *DCache) writeWorker() {
+	defer c.wg.Done()
+	for {
+		select {
+		case task := <-c.writeCh:
+			c.doWrite(task)
+		case <-c.ctx.Done():
+			for {
+				select {
+				case task := <-c.writeCh:
+					c.doWrite(task)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *DCache) doWrite(task *writeTask) {
+	timeout := c.opts.detachedWriteTimeout
+	if timeout <= 0 {
+		timeout = defaultDetachedWriteTimeout
+	}
+	ctx, cancel := context.WithTimeout(task.ctx, timeout)
+	defer cancel()
+	err := c.setKey(ctx, task.key, task.valueBytes, task.ttl, false, task.seq)
+	if err != nil {
+		c.logger(ctx).Err(err).Msgf("Failed to set Redis cache for %s", task.key)
+		c.recordError(errLabelSetRedis, task.key, err)
+	}
+}
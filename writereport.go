@@ -0,0 +1,193 @@
+package dcache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeReportSweepInterval is the interval of resolving writes expired unread.
+const writeReportSweepInterval = time.Second
+
+// WriteStats reports whether values of keys of a prefix written by this client are read,
+// see WithWriteReport.
+type WriteStats struct {
+	// Written is the number of values written.
+	Written int64
+	// Read is the number of values read by this client at least once, and Unread is the
+	// number of values expired, overwritten or invalidated before read by this client.
+	Read   int64
+	Unread int64
+}
+
+// UnreadRatio returns the ratio of writes never read to all writes of known outcomes,
+// i.e., the share of wasted writes, 0 if none is known yet.
+func (s WriteStats) UnreadRatio() float64 {
+	if s.Read+s.Unread == 0 {
+		return 0
+	}
+	return float64(s.Unread) / float64(s.Read+s.Unread)
+}
+
+// writeReport tracks values written by this client, by prefix, until they are read,
+// expire, or are overwritten or invalidated, see WithWriteReport.
+type writeReport struct {
+	mu       sync.Mutex
+	prefixes []string
+	stats    map[string]*WriteStats
+	writes   map[string]*trackedWrite
+}
+
+func newWriteReport(prefixes []string) *writeReport {
+	r := &writeReport{
+		prefixes: prefixes,
+		stats:    make(map[string]*WriteStats),
+		writes:   make(map[string]*trackedWrite),
+	}
+	for _, prefix := range prefixes {
+		r.stats[prefix] = &WriteStats{}
+	}
+	return r
+}
+
+// prefix returns the longest prefix matching @p key, false if none.
+func (r *writeReport) prefix(key string) (string, bool) {
+	matched := -1
+	for i, prefix := range r.prefixes {
+		if strings.HasPrefix(key, prefix) && (matched < 0 || len(prefix) > len(r.prefixes[matched])) {
+			matched = i
+		}
+	}
+	if matched < 0 {
+		return "", false
+	}
+	return r.prefixes[matched], true
+}
+
+// written tracks @p key written with @p ttl, returns its prefix, and true if the previous
+// write of it was not read.
+func (r *writeReport) written(key string, ttl time.Duration) (string, bool) {
+	prefix, ok := r.prefix(key)
+	if !ok {
+		return "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wasted := r.resolveLocked(key, prefix)
+	if len(r.writes) >= maxTrackedWrites {
+		// untracked writes are not counted, so that ratios are not skewed.
+		return prefix, wasted
+	}
+	r.writes[key] = &trackedWrite{expiredAt: getNow().Add(ttl)}
+	r.stats[prefix].Written++
+	return prefix, wasted
+}
+
+// read marks @p key read, returns its prefix, and true if it is the first read since written.
+func (r *writeReport) read(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.writes[key]
+	if !ok || w.read {
+		return "", false
+	}
+	w.read = true
+	prefix, _ := r.prefix(key)
+	r.stats[prefix].Read++
+	return prefix, true
+}
+
+// forget stops tracking @p key invalidated, returns its prefix, and true if it was not read.
+func (r *writeReport) forget(key string) (string, bool) {
+	prefix, ok := r.prefix(key)
+	if !ok {
+		return "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return prefix, r.resolveLocked(key, prefix)
+}
+
+// resolveLocked stops tracking @p key, returns true if it was not read.
+func (r *writeReport) resolveLocked(key string, prefix string) bool {
+	w, ok := r.writes[key]
+	if !ok {
+		return false
+	}
+	delete(r.writes, key)
+	if !w.read {
+		r.stats[prefix].Unread++
+	}
+	return !w.read
+}
+
+// sweep stops tracking expired keys, returns the number of them not read by prefix.
+func (r *writeReport) sweep() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := getNow()
+	unread := make(map[string]int)
+	for key, w := range r.writes {
+		if now.Before(w.expiredAt) {
+			continue
+		}
+		prefix, _ := r.prefix(key)
+		if r.resolveLocked(key, prefix) {
+			unread[prefix]++
+		}
+	}
+	return unread
+}
+
+func (r *writeReport) report() map[string]WriteStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rv := make(map[string]WriteStats, len(r.stats))
+	for prefix, s := range r.stats {
+		rv[prefix] = *s
+	}
+	return rv
+}
+
+// runWriteReport resolves writes expired unread periodically until the cache is closed.
+func (c *DCache) runWriteReport() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(writeReportSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		for prefix, n := range c.writeReport.sweep() {
+			if c.stats != nil {
+				c.stats.ObserveWriteOutcome(prefix, false, n)
+			}
+		}
+	}
+}
+
+// observeWrite tracks @p key written by this client with @p ttl.
+func (c *DCache) observeWrite(key string, ttl time.Duration) {
+	if c.writes != nil {
+		c.writes.written(key, ttl)
+	}
+	if c.writeReport != nil {
+		if prefix, wasted := c.writeReport.written(key, ttl); wasted && c.stats != nil {
+			c.stats.ObserveWriteOutcome(prefix, false, 1)
+		}
+	}
+}
+
+// observeDelete stops tracking @p key invalidated by this client.
+func (c *DCache) observeDelete(key string) {
+	if c.writes != nil {
+		c.writes.forget(key)
+	}
+	if c.writeReport != nil {
+		if prefix, wasted := c.writeReport.forget(key); wasted && c.stats != nil {
+			c.stats.ObserveWriteOutcome(prefix, false, 1)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package dcache
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// xfetchRand returns a random number in (0, 1], replaced in tests.
+var xfetchRand = func() float64 {
+	return 1 - rand.Float64()
+}
+
+// computeTimeCtxKey is the context key of the time taken to read the value being written
+// from the data source, stored in envelopes for XFetch, see WithXFetch.
+type computeTimeCtxKey struct{}
+
+// computeTimeOf returns the compute time carried by @p ctx in milliseconds, 0 if none.
+func computeTimeOf(ctx context.Context) int64 {
+	d, _ := ctx.Value(computeTimeCtxKey{}).(time.Duration)
+	return d.Milliseconds()
+}
+
+// expireEarly returns true if @p ve read from Redis should be recomputed before it expires,
+// by XFetch: with probability growing as it approaches expiration, scaled by its compute
+// time, so that one early reader recomputes it instead of a stampede at expiration.
+func (c *DCache) expireEarly(ve *ValueBytesExpiredAt) bool {
+	if c.opts.xfetchBeta <= 0 || ve.ComputeTime <= 0 || ve.ExpiredAt <= 0 {
+		return false
+	}
+	gap := float64(ve.ComputeTime) * c.opts.xfetchBeta * -math.Log(xfetchRand())
+	return float64(getNow().UnixMilli())+gap >= float64(ve.ExpiredAt)
+}